@@ -21,6 +21,8 @@
  * current status and returns two results:
  *
  * - When the task is not completed, <nil, nil> will be returned.
+ *   If the task reports its progress, <nil, nil, progress> will
+ *   be returned instead, whose form depends on the task.
  * - When the task has been completed with result, <result, nil>
  *   will be returned, subsequent call returns the same result.
  * - When the task encounters error and is interrupted, the
@@ -74,15 +76,201 @@ LUALIB_API int luatc_read(lua_State* L);
  */
 LUALIB_API int luatc_write(lua_State* L);
 
+/**
+ * @brief err = client.writelane(conn, lane, ...)
+ *
+ * luatc_writelane is the function that serves the client.writelane
+ * on the lua side, which is like client.write, but the arguments
+ * are sent in the lane of priority:
+ *
+ * - realtime: time-critical frames such as the game inputs, which
+ *   are sent before any other frames queued.
+ * - normal: the default lane of client.write.
+ * - bulk: large frames such as chat histories and replays, which
+ *   are sent after the frames of other lanes.
+ *
+ * When the connection does not support priorities, the error
+ * "connection not prioritizable" will be returned.
+ */
+LUALIB_API int luatc_writelane(lua_State* L);
+
+/**
+ * @brief state, err = client.inspect(conn)
+ *
+ * luatc_inspect is the function that serves the client.inspect
+ * on the lua side. Each call to this function will query for
+ * the current state of the connection, whose form depends on
+ * the kind of connection.
+ *
+ * - When the connection supports inspection, <state, nil> will
+ *   be returned, and the state is usually a table.
+ * - When the connection does not support inspection, <nil, err>
+ *   will be returned. The error must be a string.
+ */
+LUALIB_API int luatc_inspect(lua_State* L);
+
+/**
+ * @brief rpctask, err = client.rpc(conn, method, params, timeout)
+ *
+ * luatc_rpc is the function that serves the client.rpc on the
+ * lua side, which sends the request { type = method, id, ... }
+ * through the connection, where the fields of params table are
+ * merged into the request, and the id is generated on the go
+ * side as a string like "rpc:1". The connection must be created
+ * by client.wsraw with the json or msgpack codec.
+ *
+ * The response is the frame received with the same id, which is
+ * dispatched to the task instead of client.read, while the other
+ * frames such as server pushes still flow to client.read:
+ *
+ * response, err = client.poll(rpctask)
+ *
+ * - When the response arrives, <response, nil> is returned. If
+ *   the response is { type = "error", error }, <response, error>
+ *   is returned instead.
+ * - When the timeout in seconds (nullable) elapses first, <nil,
+ *   "rpc timeout"> is returned. The request is cancelled when
+ *   there's no reference to the task on lua side.
+ * - When the connection fails, <nil, err> is returned.
+ *
+ * The responses arriving after the request is cancelled or timed
+ * out are delivered to client.read like other frames.
+ */
+LUALIB_API int luatc_rpc(lua_State* L);
+
+/**
+ * @brief synctask, err = client.clocksync(conn, samples)
+ *
+ * luatc_clocksync creates a lua task synchronizing with the clock
+ * of the server, by exchanging samples (default 8) pings through
+ * the connection like client.rpc(conn, "ping"), whose pongs carry
+ * the server time in milliseconds. The pings are sent in the
+ * realtime lane, and the estimate is taken from the ping of the
+ * shortest round trip:
+ *
+ * {
+ *     "offset" = offset, -- Server time minus local time in ms
+ *     "bound" = bound,   -- Error bound of the offset in ms
+ *     "rtt" = rtt        -- Round trip time of the ping in ms
+ * }, err = client.poll(synctask)
+ *
+ * After synchronized, the connection keeps resynchronizing in the
+ * background every 10 seconds until it closes, and the estimate is
+ * only replaced by a better one.
+ */
+LUALIB_API int luatc_clocksync(lua_State* L);
+
+/**
+ * @brief time, bound, err = client.servertime(conn)
+ *
+ * luatc_servertime returns the current server time estimated in
+ * unix milliseconds, with its error bound in milliseconds which
+ * grows slowly since the last synchronization, so that the clients
+ * in the room could begin at the same server time, such as the time
+ * carried by the start message of the online server. The error
+ * "clock not synchronized" is returned before client.clocksync
+ * completes.
+ */
+LUALIB_API int luatc_servertime(lua_State* L);
+
+/**
+ * @brief stats, err = client.connstats(conn, interval)
+ *
+ * luatc_connstats returns the traffic statistics of the conn created
+ * by client.wsraw, client.wschannel, client.httpstream or client.sse,
+ * where the rates and delays are measured over the latest 10 seconds:
+ *
+ * {
+ *     "time" = time,             -- Local time of sample in unix ms
+ *     "uptime" = uptime,         -- Seconds since last connection
+ *     "reconnects" = reconnects, -- Number of reconnections
+ *     "in" = {
+ *         "frames" = frames,       -- Number of frames received
+ *         "bytes" = bytes,         -- Number of bytes received
+ *         "framerate" = framerate, -- Frames received per second
+ *         "byterate" = byterate,   -- Bytes received per second
+ *         "delay" = delay,         -- Average ms queued before read
+ *         "maxdelay" = maxdelay    -- Maximum ms queued before read
+ *     },
+ *     "out" = {
+ *         ...                      -- Like in, but for frames sent,
+ *                                  -- queued after written until sent
+ *     },
+ *     "lanes" = {
+ *         ...                      -- Frames queued in each lane of the
+ *                                  -- last wsconn like client.inspect
+ *     }
+ * }, err = client.connstats(conn)
+ *
+ * The frames are websocket messages, events of sse and chunks of
+ * httpstream, and the frames of a wschannel are also measured in
+ * its wsconn. The lanes are only sampled for the wsconn, so that
+ * the queue building up could be correlated with the delays. The
+ * reconnections of sse are counted automatically, while the wsconn
+ * reconnected by passing the previous wsconn as the stats field to
+ * client.wsraw carries over its statistics.
+ *
+ * When the interval in seconds is specified, the stream of samples
+ * taken every interval is returned, which obeys the conn interface
+ * and each read returns the samples taken since last read, so that
+ * they could be logged into the telemetry of match:
+ *
+ * { sample1, sample2, ... }, err = client.read(statstream)
+ *
+ * The samples are skipped while the conn is closed, and the error
+ * "connection closed" is returned after all samples are read. The
+ * conn is not kept alive by the stream, and at most 1024 samples are
+ * kept before read.
+ */
+LUALIB_API int luatc_connstats(lua_State* L);
+
 /**
  * reqtask, err = client.httpraw({
- *     "url" = url,       -- http or https url
- *     "method" = method, -- GET, POST, PUSH, etc. (default GET)
+ *     "url" = url,              -- http or https url
+ *     "method" = method,        -- GET, POST, PUSH, etc. (default GET)
+ *     "query" = {
+ *     },                        -- Query merged into the url (nullable)
  *     "header" = {
- *     },                 -- HTTP request header (nullable)
- *     "body" = body      -- Long string of request content (nullable)
+ *     },                        -- HTTP request header (nullable)
+ *     "body" = body,            -- Long string of request content (nullable)
+ *     "form" = {
+ *     },                        -- Form to upload as body (nullable)
+ *     "enctype" = enctype,      -- Content type of form (nullable)
+ *     "redirect" = redirect,    -- follow, none or same-host (default follow)
+ *     "maxredirects" = hops,    -- Maximum redirects followed (default 10)
+ *     "cache" = cache,          -- Whether to use http cache (default true)
+ *     "compress" = encoding,    -- gzip, deflate, br or zstd (nullable)
+ *     "decompress" = decompress -- Whether to decode response (default true)
  * })
  *
+ * The header maps each key to either a string, or an array of
+ * strings { v1, v2, ... } when the key is repeated. In the
+ * response, each key of header maps to the canonical single
+ * string form, where the values are joined by ", ", and each
+ * key of headers maps to the array of its values instead,
+ * which should be used for keys like Set-Cookie that could not
+ * be joined.
+ *
+ * The query maps names to string values, or arrays of strings
+ * for repeated keys. They are escaped and appended to the query
+ * of url, so that the url should not be escaped manually.
+ *
+ * The form maps field names to their values, and each value is
+ * either a string or a file part, or an array of them for
+ * repeated fields. The form is encoded by the enctype, which is
+ * either "application/x-www-form-urlencoded" or
+ * "multipart/form-data", and defaults to the latter. The
+ * urlencoded form could not carry file parts. The multipart body
+ * is streamed while uploading, and the method defaults to POST
+ * when the form is present. A file part is a table:
+ *
+ * {
+ *     "path" = path,         -- File to upload from disk
+ *     "content" = content,   -- In-memory content if no path
+ *     "filename" = filename, -- Reported file name (nullable)
+ *     "type" = type          -- Content type of the part (nullable)
+ * }
+ *
  * luatc_httpraw creates a lua task where lua side could poll
  * for the completion of this task using the poll interface.
  * The error could still be generated when the request is malformed,
@@ -95,9 +283,60 @@ LUALIB_API int luatc_write(lua_State* L);
  *     "status" = status, -- status string, like '200 OK', '404 Not Found'.
  *     "header" = {
  *     },                 -- HTTP response header
- *     "body" = body      -- Long string of received content
+ *     "headers" = {
+ *     },                 -- HTTP response header values in arrays
+ *     "body" = body,     -- Long string of received content
+ *     "url" = url,       -- Final url where the response came from
+ *     "redirects" = {
+ *     },                 -- Urls redirected to in order
+ *     "cached" = cached, -- Whether served from http cache
+ *     "stale" = stale,   -- Whether served from cache unvalidated
+ *     "compression" = {
+ *         "request" = size,  -- Size of request body (nil if no body)
+ *         "response" = size  -- Size of response body (nil if cached)
+ *     },
+ *     "protocol" = protocol, -- Protocol like 'HTTP/2.0' (nil if cached)
+ *     "reused" = reused,     -- Whether the connection has been reused
+ *     "cacheerror" = err     -- Error storing into http cache (nullable)
  * }, err = client.poll(reqtask)
  *
+ * When compress is specified, the request body is compressed
+ * with the encoding and the Content-Encoding is set. When the
+ * decompress is true, the Accept-Encoding is negotiated unless
+ * specified in the header, and the response body is decoded
+ * according to its Content-Encoding, which is then removed from
+ * the response header along with the Content-Length. The empty
+ * bodies of HEAD, 204 and 304 responses are never decoded. When
+ * the decompress is false, the identity encoding is requested
+ * unless specified in the header, and the body is returned as
+ * received. The sizes of the bodies are reported as:
+ *
+ * {
+ *     "encoding" = encoding,    -- Content encoding of the body
+ *     "size" = size,            -- Size of the uncompressed body
+ *     "compressed" = compressed -- Size of the body on the wire
+ * }
+ *
+ * When the http cache is configured by client.configure, GET
+ * requests without body are served through the cache unless
+ * the cache field is false. The fresh response is served from
+ * the cache directly, and the stale response is validated with
+ * If-None-Match and If-Modified-Since, and served from the cache
+ * when the server responds 304 Not Modified. The Cache-Control
+ * of both request and response is honored. If the server is
+ * unreachable, the stale response is served with stale = true,
+ * so that the game keeps working offline. The responses are
+ * cached separately by the request headers named in their Vary
+ * header, and the requests carrying Authorization or Cookie are
+ * only served by the responses marked as public. Failing to
+ * store the response does not fail the request, but is reported
+ * as cacheerror.
+ *
+ * When the redirect mode is none, or same-host while redirecting
+ * to another host, the redirect response itself is returned, and
+ * the Location could be read from its header. When the number of
+ * redirects exceeds maxredirects, the task fails with error.
+ *
  * XXX: this function is not intended for developing networking
  * in techmino, it is just used for demonstrating how the task
  * mechanism works, and intended for temporary http access.
@@ -110,6 +349,8 @@ LUALIB_API int luatc_httpraw(lua_State* L);
  *     "origin" = origin, -- origin url (nullable)
  *     "header" = {
  *     },                 -- HTTP request header (nullable)
+ *     "codec" = codec,   -- raw, json or msgpack (default raw)
+ *     "stats" = wsconn   -- previous wsconn reconnected (nullable)
  * })
  *
  * luatc_wsraw creates a lua task attempting to connect to
@@ -129,7 +370,47 @@ LUALIB_API int luatc_httpraw(lua_State* L);
  * { frame1, frame2, ... }, err = client.read(wsconn)
  * err = client.write(wsconn, frame1, frame2, ...)
  *
- * The wsconn closes when there's no reference on lua side.
+ * When the codec is json, the values written are encoded as
+ * json text frames like client.json.encode, and the frames
+ * received are decoded like client.json.decode, both of which
+ * are performed in the background. The frames failed to decode
+ * are returned as strings, whose errors are reported in the
+ * errors field of the result and the connection is kept:
+ *
+ * { value1, frame2, ..., errors = { [2] = err2 } }, err = client.read(wsconn)
+ *
+ * When the codec is msgpack, the values are packed and unpacked
+ * like client.msgpack as binary frames in the same way.
+ *
+ * The frames are sent in the lanes of priority written by
+ * client.writelane. With the json or msgpack codec, the bulk
+ * frames larger than 16KiB are split into the fragments of
+ * { type = "fragment", fragment, index, count, data }, so that
+ * the frames of higher lanes could be sent between them, and
+ * the fragments received are reassembled in the same way, up to
+ * 1MiB per value. The reference server fragments its large
+ * messages likewise, and the scheme is part of version 1 of its
+ * protocol, so the version is bumped when the scheme changes.
+ * The raw codec gets no bulk fragmentation, since its frames are
+ * opaque, and writing a bulk frame larger than 16KiB fails with
+ * "bulk frame too large for raw codec". The frames queued in each
+ * lane are queried by:
+ *
+ * {
+ *     "lanes" = {
+ *         "realtime" = realtime, -- Frames queued in realtime lane
+ *         "normal" = normal,     -- Frames queued in normal lane
+ *         "bulk" = bulk          -- Frames and fragments in bulk lane
+ *     }
+ * }, err = client.inspect(wsconn)
+ *
+ * When the stats is specified, the wsconn is regarded as the
+ * reconnection of it, and its statistics queried by client.connstats
+ * are carried over.
+ *
+ * The wsconn closes when there's no reference on lua side. The
+ * cookies in the jar shared with httpraw are sent along with
+ * the handshake request.
  *
  * XXX: this function is not intended for developing networking
  * in techmino, it is just used for benchmarking websocket
@@ -137,6 +418,590 @@ LUALIB_API int luatc_httpraw(lua_State* L);
  */
 LUALIB_API int luatc_wsraw(lua_State* L);
 
+/**
+ * chconn, err = client.wschannel(wsconn, name, maxbacklog)
+ *
+ * luatc_wschannel opens the logical channel of the name over the
+ * websocket connection, so that the streams like lobby, chat and
+ * match could share a single socket. The connection must be
+ * created by client.wsraw with the json or msgpack codec, and
+ * the frames of the channel are wrapped as:
+ *
+ * { channel = name, data = value }
+ *
+ * The chconn obeys the conn interface like wsconn, where the values
+ * written are wrapped and the data of the frames received is
+ * unwrapped. The frames of other channels are not seen by chconn,
+ * while the frames not wrapped or of channels never opened are
+ * still read from wsconn:
+ *
+ * { value1, value2, ... }, err = client.read(chconn)
+ * err = client.write(chconn, value1, value2, ...)
+ *
+ * Each channel holds at most maxbacklog frames received and not read
+ * yet (default 1024). When the backlog is full, the socket is not
+ * read until the channel is read or closed, so the peer writing
+ * faster than the channel is read is slowed down by the transport
+ * and no frame is lost. Since the socket is shared, the frames of
+ * other channels, wsconn and client.rpc also wait meanwhile, so
+ * every open channel must keep being read.
+ *
+ * The channel is closed when there is no reference on lua side.
+ * The frames of the channel arriving after then are counted and
+ * dropped instead of being read from wsconn, until the name is
+ * opened again.
+ *
+ * The peer must speak the same framing. The reference server in
+ * cmd/server unwraps the frames of any channel as its messages,
+ * and its replies carrying the id of the request are wrapped in
+ * the same channel, while the other messages like room and relay
+ * are sent unwrapped. The state of channel is queried by:
+ *
+ * {
+ *     "channel" = name,      -- Name of the channel
+ *     "queued" = queued,     -- Number of frames not read
+ *     "received" = received, -- Number of frames received
+ *     "dropped" = dropped,   -- Number of frames dropped after closed
+ *     "paused" = paused,     -- Whether the socket waits for backlog
+ *     "error" = err          -- Error of closed channel (nullable)
+ * }, err = client.inspect(chconn)
+ *
+ * The wsconn is kept alive while any of its channels is alive.
+ */
+LUALIB_API int luatc_wschannel(lua_State* L);
+
+/**
+ * streamtask, err = client.httpstream({
+ *     "url" = url,       -- http or https url
+ *     "method" = method, -- GET, POST, PUSH, etc. (default GET)
+ *     "header" = {
+ *     },                 -- HTTP request header (nullable)
+ *     "body" = body      -- Long string of request content (nullable)
+ * })
+ *
+ * luatc_httpstream accepts the same arguments as client.httpraw,
+ * but the task completes as soon as the response header arrives,
+ * instead of after the whole body has been received:
+ *
+ * stream, err = client.poll(streamtask)
+ *
+ * The stream obeys the conn interface, and the body is received
+ * in the background as chunks of string. The end of body is marked
+ * by the eof field, after which no more chunks will be returned:
+ *
+ * { chunk1, chunk2, ..., eof = true }, err = client.read(stream)
+ *
+ * The response and the download progress could be queried by:
+ *
+ * {
+ *     "code" = code,         -- status code, like 200, 404
+ *     "status" = status,     -- status string, like '200 OK'.
+ *     "header" = {
+ *     },                     -- HTTP response header
+ *     "headers" = {
+ *     },                     -- HTTP response header values in arrays
+ *     "received" = received, -- Number of body bytes received
+ *     "length" = length,     -- Content-Length (nil if unknown)
+ *     "protocol" = protocol, -- Protocol like 'HTTP/2.0'
+ *     "reused" = reused      -- Whether the connection has been reused
+ * }, err = client.inspect(stream)
+ *
+ * The stream could not be written, and the request is aborted
+ * when there's no reference on lua side.
+ */
+LUALIB_API int luatc_httpstream(lua_State* L);
+
+/**
+ * downloadtask, err = client.download({
+ *     "url" = url,       -- http or https url
+ *     "header" = {
+ *     },                 -- HTTP request header (nullable)
+ *     "path" = path,     -- Destination file path
+ *     "sha256" = sha256  -- Expected hex SHA-256 digest (nullable)
+ * })
+ *
+ * luatc_download creates a lua task which streams the response
+ * body into the file at path, without passing through the lua
+ * side. The content is written to "<path>.part" first, and the
+ * partial file is renamed to path after the digest is verified.
+ *
+ * When the partial file exists, the download resumes from its
+ * end using a Range request. The ETag or Last-Modified of the
+ * response is stored in "<path>.part.validator" and sent as
+ * If-Range, so that the file changed remotely is downloaded again
+ * from scratch instead of being appended. Without the validator,
+ * the download only resumes when sha256 is specified. When the
+ * task is canceled or fails to receive the content, the partial
+ * file is preserved for resuming. When the digest mismatches, the
+ * partial file is removed and the download must restart.
+ *
+ * The progress could be queried while the task is running:
+ *
+ * nil, nil, {
+ *     "received" = received, -- Number of bytes in the file
+ *     "length" = length      -- Size of the file (nil if unknown)
+ * } = client.poll(downloadtask)
+ *
+ * The result received from the task should be:
+ *
+ * {
+ *     "path" = path,       -- Destination file path
+ *     "size" = size,       -- Size of the file
+ *     "sha256" = sha256,   -- Hex SHA-256 digest of the file
+ *     "resumed" = resumed  -- Whether resumed from partial file
+ * }, err = client.poll(downloadtask)
+ */
+LUALIB_API int luatc_download(lua_State* L);
+
+/**
+ * err = client.cookiejar(path)
+ *
+ * luatc_cookiejar persists the cookie jar shared by httpraw and
+ * wsraw into the file at path. The cookies in the file will be
+ * loaded to replace those in the jar, and the file is updated
+ * whenever the cookies change. Session cookies are kept in
+ * memory only and never written into the file, and cookies
+ * rejected by the jar (e.g. set for a foreign domain or a
+ * public suffix) are neither recorded nor persisted.
+ */
+LUALIB_API int luatc_cookiejar(lua_State* L);
+
+/**
+ * { cookie1, cookie2, ... }, err = client.getcookies(domain)
+ *
+ * luatc_getcookies lists the cookies of the domain and its sub
+ * domains in the cookie jar, or all cookies if domain is nil.
+ * Each cookie is a table:
+ *
+ * {
+ *     "name" = name,         -- Name of the cookie
+ *     "value" = value,       -- Value of the cookie
+ *     "domain" = domain,     -- Domain of the cookie
+ *     "path" = path,         -- Path of the cookie
+ *     "hostonly" = hostonly, -- Whether only sent to the domain
+ *     "secure" = secure,     -- Whether only sent over https
+ *     "httponly" = httponly, -- Whether marked HttpOnly
+ *     "expires" = expires    -- Unix timestamp (nil for session)
+ * }
+ */
+LUALIB_API int luatc_getcookies(lua_State* L);
+
+/**
+ * err = client.setcookie(cookie)
+ *
+ * luatc_setcookie sets the cookie into the cookie jar, which
+ * is of the same form listed by client.getcookies, and only
+ * the name and domain fields are required. Setting a cookie
+ * that has expired removes it from the jar.
+ */
+LUALIB_API int luatc_setcookie(lua_State* L);
+
+/**
+ * err = client.clearcookies(domain)
+ *
+ * luatc_clearcookies removes the cookies of the domain and its
+ * sub domains in the cookie jar, or all cookies if domain is nil.
+ */
+LUALIB_API int luatc_clearcookies(lua_State* L);
+
+/**
+ * err = client.configure({
+ *     "cachedir" = cachedir,             -- Directory of http cache (nullable)
+ *     "maxidleperhost" = maxidleperhost, -- Idle connections per host (nullable)
+ *     "idletimeout" = idletimeout,       -- Idle timeout in seconds (nullable)
+ *     "maxdecodesize" = maxdecodesize,   -- Max decompressed body bytes (nullable)
+ *     "protocol" = protocol              -- 'auto', 'http2' or 'http1.1' (nullable)
+ * })
+ *
+ * luatc_configure updates the configuration of the client, the
+ * fields absent in the table are left unchanged.
+ *
+ * - cachedir: the directory to store the http cache of httpraw,
+ *   which will be created if it does not exist. The http cache
+ *   is disabled when cachedir is an empty string, which is the
+ *   default configuration.
+ * - maxidleperhost: the maximum idle connections kept alive for
+ *   reuse of each host, which is 2 by default.
+ * - idletimeout: how long an idle connection is kept before it
+ *   is closed, 0 means no limit, which is 90 by default.
+ * - maxdecodesize: the maximum size of the response body after
+ *   being decompressed by httpraw, the request fails when the
+ *   body exceeds it, which is 64 MiB by default.
+ * - protocol: 'auto' negotiates HTTP/2 on https and falls back
+ *   to HTTP/1.1, which is the default. 'http2' fails requests
+ *   unless the server speaks HTTP/2, and plain http urls are
+ *   accessed by HTTP/2 with prior knowledge. 'http1.1' always
+ *   speaks HTTP/1.1. The plain http urls accessed by HTTP/2
+ *   share a single connection of each host, which is kept until
+ *   closed by server or reconfigured, so that maxidleperhost and
+ *   idletimeout do not apply to them.
+ *
+ * Updating the transport options closes the idle connections,
+ * and the requests in flight are not affected.
+ */
+LUALIB_API int luatc_configure(lua_State* L);
+
+/**
+ * ssetask, err = client.sse({
+ *     "url" = url,       -- http or https url
+ *     "header" = {
+ *     },                 -- HTTP request header (nullable)
+ * })
+ *
+ * luatc_sse accepts the same arguments as client.httpraw except
+ * the request body, and connects to the Server-Sent Events
+ * stream. The task completes when the first stream is
+ * established, or fails when the server responds with a status
+ * other than 200 or a content type other than text/event-stream:
+ *
+ * events, err = client.poll(ssetask)
+ *
+ * The events obeys the conn interface, and each read returns
+ * the events dispatched since last read:
+ *
+ * {
+ *     {
+ *         "event" = event, -- Event type (default 'message')
+ *         "data" = data,   -- Event data
+ *         "id" = id        -- Last event id ('' if none)
+ *     }, ...
+ * }, err = client.read(events)
+ *
+ * When the stream is broken, it is reconnected after the delay
+ * specified by the retry field (default 3 seconds), carrying
+ * the Last-Event-ID header. Reconnection stops with error when
+ * the server rejects the stream. At most 1024 events are queued
+ * before read, and the stream is closed with an error when the
+ * queue overflows, while the events queued could still be read.
+ * The state is queried by:
+ *
+ * {
+ *     "connected" = connected,  -- Whether the stream is up
+ *     "lastid" = lastid,        -- Last event id received
+ *     "retry" = retry,          -- Reconnection delay in seconds
+ *     "reconnects" = reconnects -- Number of reconnections
+ * }, err = client.inspect(events)
+ *
+ * The events could not be written, and the stream is closed
+ * when there's no reference on lua side.
+ */
+LUALIB_API int luatc_sse(lua_State* L);
+
+/**
+ * text, err = client.json.encode(value, {
+ *     "maxdepth" = maxdepth,    -- Maximum nesting depth (default 128)
+ *     "emptyarray" = emptyarray -- Encode empty tables as [] (nullable)
+ * })
+ *
+ * luatc_jsonencode encodes the lua value as json text. The table
+ * whose keys are exactly 1 to n is encoded as an array, otherwise
+ * it is encoded as an object whose numeric keys are converted to
+ * strings. The empty table is encoded as {} unless emptyarray is
+ * true. The client.json.null sentinel is encoded as null.
+ *
+ * The error is returned when the nesting depth exceeds maxdepth
+ * (at most 1000), a table references itself directly or
+ * indirectly, or a value could not be represented in json, like
+ * functions, userdata, NaN and infinities.
+ */
+LUALIB_API int luatc_jsonencode(lua_State* L);
+
+/**
+ * value, err = client.json.decode(text, {
+ *     "maxdepth" = maxdepth     -- Maximum nesting depth (default 128)
+ * })
+ *
+ * luatc_jsondecode decodes the json text into lua value. Arrays
+ * and objects are decoded as tables, and null is decoded as the
+ * client.json.null sentinel so that the array length and the
+ * object keys are kept. Numbers are decoded as lua numbers.
+ */
+LUALIB_API int luatc_jsondecode(lua_State* L);
+
+/**
+ * texttask, err = client.json.encodeasync(value, options)
+ * valuetask, err = client.json.decodeasync(text, options)
+ *
+ * The async variants of client.json.encode and decode accept the
+ * same arguments, but return tasks which complete with the text
+ * or value respectively, so that huge documents are processed
+ * without blocking the lua thread. The value to encode is still
+ * converted on the lua thread, which reports the conversion
+ * errors immediately.
+ */
+LUALIB_API int luatc_jsonencodeasync(lua_State* L);
+LUALIB_API int luatc_jsondecodeasync(lua_State* L);
+
+/**
+ * data, err = client.msgpack.pack(value, {
+ *     "maxdepth" = maxdepth,    -- Maximum nesting depth (default 128)
+ *     "emptyarray" = emptyarray -- Pack empty tables as arrays (nullable)
+ * })
+ *
+ * luatc_msgpackpack packs the lua value as msgpack data. The
+ * tables are packed as arrays or maps like client.json.encode,
+ * except that the keys of maps could be numbers, strings and
+ * booleans, and they are sorted so that the data is reproducible.
+ * The integral numbers are packed as integers in the smallest
+ * form, while the others are packed as float64. The strings are
+ * packed as str if they are valid utf-8, or bin otherwise. The
+ * client.msgpack.null sentinel, which is the same as the
+ * client.json.null, is packed as nil.
+ */
+LUALIB_API int luatc_msgpackpack(lua_State* L);
+
+/**
+ * value, err = client.msgpack.unpack(data, {
+ *     "maxdepth" = maxdepth     -- Maximum nesting depth (default 128)
+ * })
+ *
+ * luatc_msgpackunpack unpacks the msgpack data into lua value.
+ * Both str and bin are unpacked as strings, integers and floats
+ * are unpacked as lua numbers, losing precision beyond 2^53, and
+ * nil is unpacked as the client.msgpack.null sentinel. The ext
+ * types are not supported, and the data must contain exactly
+ * one value.
+ */
+LUALIB_API int luatc_msgpackunpack(lua_State* L);
+
+/**
+ * game, err = client.game.new({
+ *     "seed" = seed,           -- Seed of the piece generator
+ *     "algorithm" = algorithm, -- bag, his or random (default bag)
+ *     "gravity" = gravity,     -- Frames to fall a row, 0 for 20G (default 60)
+ *     "lockdelay" = lockdelay, -- Frames to lock after landing (default 60)
+ *     "maxresets" = maxresets, -- Lock delay resets by moving (default 15)
+ *     "preview" = preview,     -- Number of next pieces (default 6)
+ *     "hold" = hold,           -- Whether hold is enabled (default true)
+ *     "allspin" = allspin      -- Whether all pieces spin (default true)
+ * })
+ * game, err = client.game.clone(game)
+ *
+ * luatc_gamenew creates the deterministic simulation of a game
+ * with the core rules of Techmino, which is also run by the server
+ * to verify the games. The pieces are generated like client.rng,
+ * and the games with the same seed and rules always evolve
+ * identically with the same inputs on every platform, so that the
+ * game could be cloned for prediction. The game only advances by
+ * the following functions called:
+ *
+ * - moved, lock = client.game.input(game, action) applies the
+ *   action, which is one of left, right, softdrop, harddrop, cw,
+ *   ccw, 180 and hold, and returns whether the action takes effect
+ *   with the lock result if the piece is locked by the action. The
+ *   <nil, err> is returned if the action is invalid.
+ * - { lock1, lock2, ... }, err = client.game.tick(game, frames)
+ *   advances the game by the frames (default 1), where the piece
+ *   falls by gravity and locks after the lock delay.
+ * - err = client.game.garbage(game, lines, hole) raises the board
+ *   by the garbage lines with the hole at the column.
+ *
+ * The result of lock is:
+ *
+ * {
+ *     "piece" = piece,       -- Name of the piece locked, like 'T'
+ *     "spin" = spin,         -- mini or full if it spins (nullable)
+ *     "lines" = lines,       -- Number of lines cleared
+ *     "combo" = combo,       -- Consecutive clears before, -1 if no clear
+ *     "b2b" = b2b,           -- Whether back-to-back bonus applies
+ *     "allclear" = allclear, -- Whether the board is emptied
+ *     "attack" = attack      -- Number of garbage lines sent
+ * }
+ *
+ * The state of game is queried by client.game.state(game), where
+ * the columns and rows are numbered from 1 at the bottom left:
+ *
+ * {
+ *     "board" = {
+ *     },                 -- Rows of cells from the bottom
+ *     "falling" = piece, -- Piece controlled (nil if over)
+ *     "ghost" = piece,   -- Where the piece would drop (nil if over)
+ *     "next" = {
+ *     },                 -- Names of the next pieces
+ *     "hold" = hold,     -- Name of the held piece (nullable)
+ *     "frame" = frame,   -- Number of frames elapsed
+ *     "combo" = combo,   -- Current combo, -1 if none
+ *     "b2b" = b2b,       -- Whether back-to-back is active
+ *     "over" = over,     -- Whether the game is over
+ *     "pieces" = pieces, -- Number of pieces locked
+ *     "lines" = lines,   -- Number of lines cleared
+ *     "attack" = attack  -- Number of garbage lines sent
+ * }, err = client.game.state(game)
+ *
+ * The cell is 0 if empty, 1 to 7 for the pieces Z, S, J, L, T, O
+ * and I in order, or 8 for garbage. The piece is represented as
+ * { piece, rotation, x, y, cells }, where the rotation is 0 to 3
+ * clockwise from spawn, x and y locate the bottom left of its
+ * bounding box in super rotation system, and the cells are the
+ * { x, y } occupied.
+ */
+LUALIB_API int luatc_gamenew(lua_State* L);
+LUALIB_API int luatc_gameclone(lua_State* L);
+LUALIB_API int luatc_gameinput(lua_State* L);
+LUALIB_API int luatc_gametick(lua_State* L);
+LUALIB_API int luatc_gamegarbage(lua_State* L);
+LUALIB_API int luatc_gamestate(lua_State* L);
+
+/**
+ * rng, err = client.rng.new(seed, algorithm)
+ * rng, err = client.rng.clone(rng)
+ *
+ * luatc_rngnew creates the seeded generator of pieces, so that
+ * the players of a match get the same sequence from the seed
+ * shared by the server. The seed must be an integer within 0 and
+ * 2^53, and the algorithm is one of:
+ *
+ * - bag: deals the shuffled permutations of all seven pieces.
+ * - his: rerolls the piece up to 6 times if it is in the last
+ *   four pieces.
+ * - random: picks each piece uniformly.
+ *
+ * The algorithm defaults to bag. The generators only compute
+ * with 64-bit integers, so that the sequences are identical on
+ * every platform and the same as the server. The pieces are
+ * generated by the functions below, which returns the names
+ * of pieces like 'T':
+ *
+ * - piece, err = client.rng.next(rng) generates the next piece.
+ * - { piece1, piece2, ... }, err = client.rng.peek(rng, n)
+ *   returns the next n pieces (default 1) without advancing.
+ *
+ * The generator could be cloned, and the clone generates the
+ * same sequence independently afterwards.
+ */
+LUALIB_API int luatc_rngnew(lua_State* L);
+LUALIB_API int luatc_rngclone(lua_State* L);
+LUALIB_API int luatc_rngnext(lua_State* L);
+LUALIB_API int luatc_rngpeek(lua_State* L);
+
+/**
+ * session, err = client.netcode.new(conn, {
+ *     "players" = players,       -- Number of players (default 2)
+ *     "player" = player,         -- Local player from 1 (default 1)
+ *     "inputdelay" = inputdelay, -- Frames to delay local inputs (default 2)
+ *     "window" = window,         -- Frames predicted at most (default 8)
+ *     "relay" = relay,           -- Wrap packets as relay (default true)
+ *     ...                        -- Seed and rules like client.game.new
+ * })
+ *
+ * luatc_netcodenew creates the lockstep session of a versus match,
+ * where only the inputs are exchanged through the connection, and
+ * the games of all players are simulated like client.game from the
+ * same seed and rules, which must be identical among the peers.
+ * The connection must be created by client.wsraw with the json or
+ * msgpack codec, and it could still be used by the lua side.
+ *
+ * The session keeps the games at the confirmed frame, where the
+ * inputs of all players have arrived, and the games at the current
+ * frame, which are predicted by assuming the inputs not arrived
+ * are empty. When the inputs arrive late and differ from the
+ * prediction, the game is rolled back to the confirmed frame and
+ * simulated again. The session is driven by:
+ *
+ * - err = client.netcode.input(session, action, ...) schedules
+ *   the local actions like client.game.input, which are applied
+ *   after the input delay.
+ * - err = client.netcode.garbage(session, lines, hole) schedules
+ *   the garbage received by the local player like client.game
+ *   .garbage, e.g. taken from client.garbage.take, which is also
+ *   applied after the input delay before the actions of the frame.
+ *   The garbage must be scheduled this way rather than applied to
+ *   a game state, otherwise the peers would simulate the local
+ *   game without it.
+ * - advanced, err = client.netcode.advance(session, frames)
+ *   advances the frames (default 1) unless the current frame is
+ *   window frames ahead of the confirmed frame, and returns the
+ *   frames advanced. The local inputs are then sent as packet
+ *   { player, frame, inputs, garbage }, where inputs are the arrays
+ *   of actions of each frame from the frame, and garbage is the
+ *   array of { frame, lines, hole } received within them, which is
+ *   absent if there's none. When relay is true,
+ *   the packet is sent as { type = "relay", data = packet }.
+ *   The packets are sent in the realtime lane of client.writelane.
+ * - err = client.netcode.receive(session, packet) accepts the
+ *   packet of the remote player, which must be received in order.
+ * - state, err = client.netcode.state(session, player, confirmed)
+ *   returns the state of the game of the player like client.game
+ *   .state, at the confirmed frame if confirmed is true, or the
+ *   current frame otherwise.
+ *
+ * The progress of the session is queried by:
+ *
+ * {
+ *     "frame" = frame,         -- Current frame
+ *     "confirmed" = confirmed, -- Confirmed frame
+ *     "stalled" = stalled,     -- Whether waiting for remote inputs
+ *     "rollbacks" = rollbacks, -- Times of rolling back
+ *     "received" = {
+ *     }                        -- Frames of inputs received by players
+ * }, err = client.netcode.info(session)
+ */
+LUALIB_API int luatc_netcodenew(lua_State* L);
+LUALIB_API int luatc_netcodeinput(lua_State* L);
+LUALIB_API int luatc_netcodegarbage(lua_State* L);
+LUALIB_API int luatc_netcodeadvance(lua_State* L);
+LUALIB_API int luatc_netcodereceive(lua_State* L);
+LUALIB_API int luatc_netcodestate(lua_State* L);
+LUALIB_API int luatc_netcodeinfo(lua_State* L);
+
+/**
+ * exchange, err = client.garbage.new(conn, {
+ *     "seed" = seed,   -- Seed of holes of garbage sent (default 0)
+ *     "relay" = relay, -- Wrap messages as relay (default true)
+ * })
+ *
+ * luatc_garbagenew creates the attack exchange with the peer of
+ * a versus match, where the attacks are sent through connection
+ * like client.netcode as the messages:
+ *
+ * - { type = "attack", seq, ack, lines, hole } is an attack of
+ *   the lines with the hole column from 1, where seq numbers the
+ *   attacks from 1, and ack is the seq of the last attack from
+ *   the peer received in order.
+ * - { type = "ack", ack } acknowledges the attacks received.
+ *
+ * The attacks received are accepted in order of seq exactly once,
+ * so that the duplicated ones are ignored and the early ones are
+ * held until their preceding ones arrive. The exchange is driven
+ * by:
+ *
+ * - sent, err = client.garbage.attack(exchange, lines) cancels
+ *   the pending garbage from the oldest with the lines, and sends
+ *   the rest of lines which are returned.
+ * - err = client.garbage.receive(exchange, message) accepts the
+ *   message from the peer and replies the ack.
+ * - err = client.garbage.resend(exchange) sends the attacks not
+ *   acknowledged again, e.g. after the connection recovers.
+ *
+ * The garbage received is queued until taken, where each item of
+ * the queue is { seq, lines, hole }:
+ *
+ * - { item1, item2, ... }, err = client.garbage.pending(exchange)
+ *   returns the queue of pending garbage.
+ * - { item1, item2, ... }, err = client.garbage.take(exchange,
+ *   lines) removes at most the lines from the queue, splitting
+ *   the last item if necessary, which could be applied to game
+ *   by client.game.garbage, or scheduled by client.netcode.garbage
+ *   in a lockstep session.
+ *
+ * The statistics of the exchange are queried by:
+ *
+ * {
+ *     "sent" = sent,           -- Lines of garbage sent
+ *     "received" = received,   -- Lines of garbage received
+ *     "cancelled" = cancelled, -- Lines of garbage cancelled
+ *     "pending" = pending,     -- Lines of garbage pending
+ *     "unacked" = unacked,     -- Attacks not acknowledged
+ * }, err = client.garbage.info(exchange)
+ */
+LUALIB_API int luatc_garbagenew(lua_State* L);
+LUALIB_API int luatc_garbageattack(lua_State* L);
+LUALIB_API int luatc_garbagereceive(lua_State* L);
+LUALIB_API int luatc_garbageresend(lua_State* L);
+LUALIB_API int luatc_garbagepending(lua_State* L);
+LUALIB_API int luatc_garbagetake(lua_State* L);
+LUALIB_API int luatc_garbageinfo(lua_State* L);
+
 // luaopen_client is the library entry point function that will
 // be called in 'require "client"' statement.
 LUALIB_API int luaopen_client(lua_State* L);
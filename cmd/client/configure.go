@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaConfigureOption is an option of client.configure, which
+// reads the value at the stack top and applies it.
+type luaConfigureOption func(L *C.lua_State) error
+
+// luaConfigureOptions are the options of client.configure.
+var luaConfigureOptions = map[string]luaConfigureOption{
+	"cachedir": func(L *C.lua_State) error {
+		if luaTypeOf(L, -1) != luaTypeString {
+			return errors.New("invalid cachedir argument")
+		}
+		return rawCache.configure(luaStringGet(L, -1))
+	},
+	"maxidleperhost": func(L *C.lua_State) error {
+		if luaTypeOf(L, -1) != luaTypeNumber {
+			return errors.New("invalid maxidleperhost argument")
+		}
+		maxIdlePerHost := int(luaNumberGet(L, -1))
+		if maxIdlePerHost < 0 {
+			return errors.New("invalid maxidleperhost argument")
+		}
+		rawTransport.configure(func(config *httpTransportConfig) {
+			config.maxIdlePerHost = maxIdlePerHost
+		})
+		return nil
+	},
+	"idletimeout": func(L *C.lua_State) error {
+		if luaTypeOf(L, -1) != luaTypeNumber {
+			return errors.New("invalid idletimeout argument")
+		}
+		seconds := luaNumberGet(L, -1)
+		if seconds < 0 {
+			return errors.New("invalid idletimeout argument")
+		}
+		rawTransport.configure(func(config *httpTransportConfig) {
+			config.idleTimeout = time.Duration(seconds * float64(time.Second))
+		})
+		return nil
+	},
+	"maxdecodesize": func(L *C.lua_State) error {
+		if luaTypeOf(L, -1) != luaTypeNumber {
+			return errors.New("invalid maxdecodesize argument")
+		}
+		maxDecodeSize := int64(luaNumberGet(L, -1))
+		if maxDecodeSize <= 0 {
+			return errors.New("invalid maxdecodesize argument")
+		}
+		atomic.StoreInt64(&httpDecodeLimitValue, maxDecodeSize)
+		return nil
+	},
+	"protocol": func(L *C.lua_State) error {
+		if luaTypeOf(L, -1) != luaTypeString {
+			return errors.New("invalid protocol argument")
+		}
+		protocol, err := parseHttpProtocol(luaStringGet(L, -1))
+		if err != nil {
+			return err
+		}
+		rawTransport.configure(func(config *httpTransportConfig) {
+			config.protocol = protocol
+		})
+		return nil
+	},
+}
+
+//export luatc_configure
+func luatc_configure(L *C.lua_State) C.int {
+	// Make sure that the fields are valid for returning first.
+	if luaTypeOf(L, 1) != luaTypeTable {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "missing table argument")
+		return C.int(1)
+	}
+
+	// Apply the options present in the table, and the
+	// absent options are left unchanged.
+	for key, option := range luaConfigureOptions {
+		luaStringPush(L, key)
+		luaTableRawGet(L, 1)
+		if luaTypeOf(L, -1) == luaTypeNil {
+			luaStackPop(L, 1)
+			continue
+		}
+		if err := option(L); err != nil {
+			luaStackTopSet(L, 0)
+			luaStringPush(L, err.Error())
+			return C.int(1)
+		}
+		luaStackPop(L, 1)
+	}
+
+	// return nil
+	luaStackTopSet(L, 0)
+	luaNilPush(L)
+	return C.int(1)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaConnStatsWindow is the number of seconds which the
+// rates and delays of connections are measured over.
+const luaConnStatsWindow = 10
+
+// luaConnStatsMaxSamples is the maximum number of samples
+// queued in the sample stream before read, the oldest ones
+// are dropped when it is exceeded.
+const luaConnStatsMaxSamples = 1024
+
+// errConnStatsClosed is returned by the sample stream after
+// the connection measured is closed and the samples are read.
+var errConnStatsClosed = errors.New("connection closed")
+
+// luaConnStatter is the optional interface implemented by
+// the connections whose traffic is measured for the
+// client.connstats function.
+type luaConnStatter interface {
+	// stats returns the statistics of the connection.
+	stats() *luaConnStats
+}
+
+// luaConnStatsBucket is the measurements in a second.
+type luaConnStatsBucket struct {
+	// second is the unix second of the bucket.
+	second int64
+
+	// count is the number of measurements.
+	count int64
+
+	// sum is the sum of measurements.
+	sum int64
+
+	// max is the maximum of measurements.
+	max int64
+}
+
+// luaConnStatsRolling is the rolling window of measurements
+// in the latest seconds.
+type luaConnStatsRolling [luaConnStatsWindow]luaConnStatsBucket
+
+// add records the measurement at the local time.
+func (r *luaConnStatsRolling) add(now time.Time, value int64) {
+	second := now.Unix()
+	bucket := &r[second%luaConnStatsWindow]
+	if bucket.second != second {
+		*bucket = luaConnStatsBucket{second: second}
+	}
+	bucket.count++
+	bucket.sum += value
+	if value > bucket.max {
+		bucket.max = value
+	}
+}
+
+// total sums up the measurements within the window.
+func (r *luaConnStatsRolling) total(now time.Time) luaConnStatsBucket {
+	second := now.Unix()
+	var result luaConnStatsBucket
+	for _, bucket := range r {
+		if bucket.second <= second-luaConnStatsWindow || bucket.second > second {
+			continue
+		}
+		result.count += bucket.count
+		result.sum += bucket.sum
+		if bucket.max > result.max {
+			result.max = bucket.max
+		}
+	}
+	return result
+}
+
+// luaConnStatsDirection is the statistics of the traffic in
+// one direction of the connection.
+type luaConnStatsDirection struct {
+	// frames is the number of frames transferred.
+	frames int64
+
+	// bytes is the number of bytes transferred.
+	bytes int64
+
+	// traffic is the sizes of frames transferred.
+	traffic luaConnStatsRolling
+
+	// delay is the nanoseconds the frames are queued.
+	delay luaConnStatsRolling
+}
+
+// luaConnStats is the statistics of the connection, which
+// could be shared by the reconnected connections.
+type luaConnStats struct {
+	// mtx is the mutex for the statistics.
+	mtx sync.Mutex
+
+	// created is the local time of the first connection.
+	created time.Time
+
+	// connected is the local time of the last connection.
+	connected time.Time
+
+	// reconnects is the number of reconnections.
+	reconnects int
+
+	// alive is the number of connections not closed yet,
+	// since the previous connection might be closed after
+	// the reconnection.
+	alive int
+
+	// in is the traffic received from the remote.
+	in luaConnStatsDirection
+
+	// out is the traffic sent to the remote.
+	out luaConnStatsDirection
+
+	// lanes returns the number of frames queued in each
+	// lane of the last connection, nil if the connection
+	// does not send in lanes.
+	lanes func() [luaConnLaneCount]int
+}
+
+// newLuaConnStats creates the statistics of connection
+// established now.
+func newLuaConnStats() *luaConnStats {
+	now := time.Now()
+	return &luaConnStats{created: now, connected: now, alive: 1}
+}
+
+// received records the frame of the size received.
+func (s *luaConnStats) received(now time.Time, size int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.in.frames++
+	s.in.bytes += int64(size)
+	s.in.traffic.add(now, int64(size))
+}
+
+// read records the frame read by the lua side after it has
+// been queued since received.
+func (s *luaConnStats) read(now, received time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.in.delay.add(now, int64(now.Sub(received)))
+}
+
+// sent records the frame of the size sent after it has
+// been queued since written by the lua side.
+func (s *luaConnStats) sent(now, queued time.Time, size int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.out.frames++
+	s.out.bytes += int64(size)
+	s.out.traffic.add(now, int64(size))
+	s.out.delay.add(now, int64(now.Sub(queued)))
+}
+
+// reconnect records the reconnection of the connection.
+func (s *luaConnStats) reconnect() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reconnects++
+	s.connected = time.Now()
+}
+
+// resume records the new connection which the statistics
+// are carried over to, as the reconnection of the previous.
+func (s *luaConnStats) resume() {
+	s.reconnect()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.alive++
+}
+
+// attachLanes records the lanes of the last connection,
+// whose depths are sampled along with the traffic.
+func (s *luaConnStats) attachLanes(lanes func() [luaConnLaneCount]int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lanes = lanes
+}
+
+// close records the connection has been closed.
+func (s *luaConnStats) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.alive--
+}
+
+// closed returns whether all connections have been closed.
+func (s *luaConnStats) closed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.alive <= 0
+}
+
+// luaConnStatsTraffic is the sampled traffic in one
+// direction of the connection.
+type luaConnStatsTraffic struct {
+	// frames is the number of frames transferred.
+	frames int64
+
+	// bytes is the number of bytes transferred.
+	bytes int64
+
+	// frameRate is the frames per second in the window.
+	frameRate float64
+
+	// byteRate is the bytes per second in the window.
+	byteRate float64
+
+	// delay is the average queue delay in the window.
+	delay time.Duration
+
+	// maxDelay is the maximum queue delay in the window.
+	maxDelay time.Duration
+}
+
+// luaConnStatsSample is the sample of the statistics.
+type luaConnStatsSample struct {
+	// at is the local time of the sample.
+	at time.Time
+
+	// uptime is the duration since the last connection.
+	uptime time.Duration
+
+	// reconnects is the number of reconnections.
+	reconnects int
+
+	// in is the traffic received from the remote.
+	in luaConnStatsTraffic
+
+	// out is the traffic sent to the remote.
+	out luaConnStatsTraffic
+
+	// lanes is the number of frames queued in each lane,
+	// nil if the connection does not send in lanes.
+	lanes *[luaConnLaneCount]int
+}
+
+// sample takes the sample of the statistics at local time.
+func (s *luaConnStats) sample(now time.Time) *luaConnStatsSample {
+	// The lanes are queried without the mutex, since the
+	// connection records its traffic with its queue locked.
+	s.mtx.Lock()
+	lanes := s.lanes
+	s.mtx.Unlock()
+	var depths *[luaConnLaneCount]int
+	if lanes != nil {
+		queued := lanes()
+		depths = &queued
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// The rates are averaged over the seconds elapsed in the
+	// window, which is shorter right after the connection.
+	start := time.Unix(now.Unix()-luaConnStatsWindow+1, 0)
+	if s.created.After(start) {
+		start = s.created
+	}
+	elapsed := math.Max(now.Sub(start).Seconds(), 1e-3)
+	traffic := func(d *luaConnStatsDirection) luaConnStatsTraffic {
+		size := d.traffic.total(now)
+		delay := d.delay.total(now)
+		result := luaConnStatsTraffic{
+			frames:    d.frames,
+			bytes:     d.bytes,
+			frameRate: float64(size.count) / elapsed,
+			byteRate:  float64(size.sum) / elapsed,
+			maxDelay:  time.Duration(delay.max),
+		}
+		if delay.count > 0 {
+			result.delay = time.Duration(delay.sum / delay.count)
+		}
+		return result
+	}
+	return &luaConnStatsSample{
+		at:         now,
+		uptime:     now.Sub(s.connected),
+		reconnects: s.reconnects,
+		in:         traffic(&s.in),
+		out:        traffic(&s.out),
+		lanes:      depths,
+	}
+}
+
+// marshal the traffic to the lua stack.
+func (t *luaConnStatsTraffic) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 6)
+	luaStringPush(L, "frames")
+	luaNumberPush(L, float64(t.frames))
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "bytes")
+	luaNumberPush(L, float64(t.bytes))
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "framerate")
+	luaNumberPush(L, t.frameRate)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "byterate")
+	luaNumberPush(L, t.byteRate)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "delay")
+	luaNumberPush(L, t.delay.Seconds()*1000)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "maxdelay")
+	luaNumberPush(L, t.maxDelay.Seconds()*1000)
+	luaTableRawSet(L, -3)
+}
+
+// marshal the sample to the lua stack.
+func (r *luaConnStatsSample) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 6)
+	luaStringPush(L, "time")
+	luaNumberPush(L, float64(r.at.UnixNano())/float64(time.Millisecond))
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "uptime")
+	luaNumberPush(L, r.uptime.Seconds())
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "reconnects")
+	luaIntegerPush(L, r.reconnects)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "in")
+	r.in.marshal(L)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "out")
+	r.out.marshal(L)
+	luaTableRawSet(L, -3)
+	if r.lanes != nil {
+		luaStringPush(L, "lanes")
+		luaTableNew(L, 0, int(luaConnLaneCount))
+		for lane, queued := range r.lanes {
+			luaStringPush(L, luaConnLaneNames[lane])
+			luaIntegerPush(L, queued)
+			luaTableRawSet(L, -3)
+		}
+		luaTableRawSet(L, -3)
+	}
+}
+
+// luaConnStatsStream is the connection which the samples
+// of statistics are read from periodically.
+type luaConnStatsStream struct {
+	// stats is the statistics sampled, the connection
+	// measured is not kept alive by the stream.
+	stats *luaConnStats
+
+	// mtx is the mutex for the samples.
+	mtx sync.Mutex
+
+	// samples are the samples taken since last read.
+	samples []*luaConnStatsSample
+
+	// closeOnce ensures the stream closes once.
+	closeOnce sync.Once
+
+	// closeCh is the channel that is unblocked when
+	// the stream should close.
+	closeCh chan struct{}
+}
+
+// runConnStatsSampler takes the samples periodically until
+// the stream closes, and the samples are skipped while the
+// connection measured is closed.
+func (s *luaConnStatsStream) runConnStatsSampler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case now := <-ticker.C:
+			if s.stats.closed() {
+				continue
+			}
+			sample := s.stats.sample(now)
+			s.mtx.Lock()
+			if len(s.samples) >= luaConnStatsMaxSamples {
+				s.samples = s.samples[1:]
+			}
+			s.samples = append(s.samples, sample)
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// luaConnStatsReadResult is the samples read using the
+// read interface of the sample stream.
+type luaConnStatsReadResult struct {
+	// samples are the samples taken since last read.
+	samples []*luaConnStatsSample
+}
+
+// marshal the samples to the lua stack.
+func (r *luaConnStatsReadResult) marshal(L *C.lua_State) {
+	luaTableNew(L, len(r.samples), 0)
+	for i, sample := range r.samples {
+		sample.marshal(L)
+		luaTableRawSeti(L, -2, i+1)
+	}
+}
+
+// read implements the luaConn.read for luaConnStatsStream.
+func (s *luaConnStatsStream) read() (luaReadResult, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	readResult := &luaConnStatsReadResult{}
+	readResult.samples, s.samples = s.samples, nil
+	if len(readResult.samples) == 0 && s.stats.closed() {
+		return readResult, errConnStatsClosed
+	}
+	return readResult, nil
+}
+
+// write implements the luaConn.write for luaConnStatsStream.
+func (s *luaConnStatsStream) write(L *C.lua_State) error {
+	return errNotWritable
+}
+
+// close implements the luaConn.close for luaConnStatsStream.
+func (s *luaConnStatsStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
+
+// luaConnStatsLookup attempts to fetch the statistics of
+// the connection at the specified index.
+func luaConnStatsLookup(L *C.lua_State, index int) (*luaConnStats, error) {
+	connHandle, ok := luaGcLookup(L, index).(*luaConnHandle)
+	if !ok {
+		return nil, errors.New("not main.luaConnHandle")
+	}
+	statter, ok := connHandle.conn.(luaConnStatter)
+	if !ok {
+		return nil, errors.New("connection not measured")
+	}
+	return statter.stats(), nil
+}
+
+//export luatc_connstats
+func luatc_connstats(L *C.lua_State) C.int {
+	stats, err := luaConnStatsLookup(L, 1)
+	var interval time.Duration
+	if typeOf := luaTypeOf(L, 2); err == nil && typeOf == luaTypeNumber {
+		seconds := luaNumberGet(L, 2)
+		if !(seconds >= 0.01) || seconds > math.MaxInt64/float64(time.Second) {
+			err = errors.New("invalid interval argument")
+		}
+		interval = time.Duration(seconds * float64(time.Second))
+	} else if err == nil && typeOf != luaTypeNil && typeOf != luaTypeNone {
+		err = errors.New("invalid interval argument")
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Push back the sample of now if there's no interval,
+	// or the stream of samples taken periodically.
+	if interval == 0 {
+		stats.sample(time.Now()).marshal(L)
+		luaNilPush(L)
+		return C.int(2)
+	}
+	stream := &luaConnStatsStream{
+		stats:   stats,
+		closeCh: make(chan struct{}),
+	}
+	go stream.runConnStatsSampler(interval)
+	newLuaConnHandle(stream).marshal(L)
+	luaNilPush(L)
+	return C.int(2)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// rawCookie is a cookie recorded by the rawCookieJar, it
+// is also the format of cookies persisted on disk.
+type rawCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	HostOnly bool      `json:"hostOnly"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"httpOnly"`
+	Expires  time.Time `json:"expires"`
+}
+
+// key returns the identity of the cookie in the jar.
+func (c *rawCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// expired returns whether the cookie has expired, and
+// the session cookies never expire in the jar.
+func (c *rawCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// replay sets the cookie into the underlying jar.
+func (c *rawCookie) replay(jar http.CookieJar) {
+	u := &url.URL{Scheme: "http", Host: c.Domain, Path: c.Path}
+	if c.Secure {
+		u.Scheme = "https"
+	}
+	cookie := &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		Expires:  c.Expires,
+	}
+	if !c.HostOnly {
+		cookie.Domain = c.Domain
+	}
+	jar.SetCookies(u, []*http.Cookie{cookie})
+}
+
+// rawCookieJar is the cookie jar shared by httpraw and
+// wsraw. The cookies are stored in the cookiejar.Jar for
+// matching, and recorded aside for listing, deleting and
+// persisting them, which the cookiejar.Jar cannot do.
+type rawCookieJar struct {
+	// mtx is the mutex for accessing the jar.
+	mtx sync.Mutex
+
+	// jar is the underlying jar for matching cookies.
+	jar *cookiejar.Jar
+
+	// cookies recorded in the jar indexed by their keys.
+	cookies map[string]*rawCookie
+
+	// path to persist the cookies, empty when the jar
+	// is not persisted.
+	path string
+}
+
+// rawCookies is the cookie jar shared among raw requests.
+var rawCookies = newRawCookieJar()
+
+// newCookieJar creates the underlying jar which refuses
+// cookies set for the public suffixes.
+func newCookieJar() *cookiejar.Jar {
+	jar, _ := cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	return jar
+}
+
+// newRawCookieJar creates an empty cookie jar.
+func newRawCookieJar() *rawCookieJar {
+	return &rawCookieJar{
+		jar:     newCookieJar(),
+		cookies: make(map[string]*rawCookie),
+	}
+}
+
+// cookieDomainAllowed returns whether the host is allowed
+// to set a cookie for the domain, following the rules of
+// the underlying jar. Cookies rejected by the jar must not
+// be recorded, otherwise they would be replayed as valid
+// cookies of the domain after loading.
+func cookieDomainAllowed(host, domain string) bool {
+	host = strings.ToLower(host)
+	if domain == host {
+		return true
+	}
+	if net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	return publicsuffix.List.PublicSuffix(domain) != domain
+}
+
+// defaultCookiePath returns the default path of cookies
+// set by the response of specified url.
+func defaultCookiePath(u *url.URL) string {
+	path := u.Path
+	if path == "" || path[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// record updates the record of cookie set by the url,
+// the caller must hold the mutex.
+func (j *rawCookieJar) record(u *url.URL, c *http.Cookie, now time.Time) {
+	cookie := &rawCookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   strings.ToLower(strings.TrimPrefix(c.Domain, ".")),
+		Path:     c.Path,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		Expires:  c.Expires,
+	}
+	if cookie.Domain == "" {
+		cookie.Domain = strings.ToLower(u.Hostname())
+		cookie.HostOnly = true
+	} else if !cookieDomainAllowed(u.Hostname(), cookie.Domain) {
+		return
+	}
+	if cookie.Path == "" || cookie.Path[0] != '/' {
+		cookie.Path = defaultCookiePath(u)
+	}
+	if c.MaxAge < 0 {
+		cookie.Expires = now
+	} else if c.MaxAge > 0 {
+		cookie.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	}
+	if cookie.expired(now) {
+		delete(j.cookies, cookie.key())
+	} else {
+		j.cookies[cookie.key()] = cookie
+	}
+}
+
+// save persists the cookies to the file if the jar is
+// persisted, the caller must hold the mutex. The session
+// cookies are kept in memory only and never persisted.
+func (j *rawCookieJar) save() error {
+	if j.path == "" {
+		return nil
+	}
+	now := time.Now()
+	var cookies []*rawCookie
+	for _, cookie := range j.cookies {
+		if !cookie.Expires.IsZero() && !cookie.expired(now) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	sort.Slice(cookies, func(i, k int) bool {
+		return cookies[i].key() < cookies[k].key()
+	})
+	data, err := json.MarshalIndent(cookies, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so that
+	// the file would not be corrupted by a crash.
+	tempPath := j.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, j.path)
+}
+
+// rebuild recreates the underlying jar from the records,
+// the caller must hold the mutex.
+func (j *rawCookieJar) rebuild() {
+	j.jar = newCookieJar()
+	now := time.Now()
+	for key, cookie := range j.cookies {
+		if cookie.expired(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		cookie.replay(j.jar)
+	}
+}
+
+// SetCookies implements http.CookieJar for rawCookieJar.
+func (j *rawCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.jar.SetCookies(u, cookies)
+	now := time.Now()
+	for _, cookie := range cookies {
+		j.record(u, cookie, now)
+	}
+	_ = j.save()
+}
+
+// Cookies implements http.CookieJar for rawCookieJar.
+func (j *rawCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.jar.Cookies(u)
+}
+
+// load replaces the cookies with those persisted in the
+// file, and the cookies will be persisted there later.
+func (j *rawCookieJar) load(path string) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var cookies []*rawCookie
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &cookies); err != nil {
+			return err
+		}
+	}
+	j.path = path
+	j.cookies = make(map[string]*rawCookie)
+	for _, cookie := range cookies {
+		j.cookies[cookie.key()] = cookie
+	}
+	j.rebuild()
+	return nil
+}
+
+// list returns the cookies of the domain and its sub
+// domains, or all cookies when domain is empty.
+func (j *rawCookieJar) list(domain string) []*rawCookie {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	now := time.Now()
+	var result []*rawCookie
+	for _, cookie := range j.cookies {
+		if cookie.expired(now) || !cookieDomainMatch(cookie, domain) {
+			continue
+		}
+		copied := *cookie
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, k int) bool {
+		return result[i].key() < result[k].key()
+	})
+	return result
+}
+
+// clear removes the cookies of the domain and its sub
+// domains, or all cookies when domain is empty.
+func (j *rawCookieJar) clear(domain string) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	for key, cookie := range j.cookies {
+		if cookieDomainMatch(cookie, domain) {
+			delete(j.cookies, key)
+		}
+	}
+	j.rebuild()
+	return j.save()
+}
+
+// set records the cookie into the jar directly.
+func (j *rawCookieJar) set(cookie *rawCookie) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	cookie.Domain = strings.ToLower(strings.TrimPrefix(cookie.Domain, "."))
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if cookie.expired(time.Now()) {
+		delete(j.cookies, cookie.key())
+		j.rebuild()
+	} else {
+		j.cookies[cookie.key()] = cookie
+		cookie.replay(j.jar)
+	}
+	return j.save()
+}
+
+// cookieDomainMatch returns whether the cookie belongs to
+// the domain or its sub domains, the empty domain matches
+// all cookies.
+func cookieDomainMatch(cookie *rawCookie, domain string) bool {
+	return domain == "" || cookie.Domain == domain ||
+		strings.HasSuffix(cookie.Domain, "."+domain)
+}
+
+// luaPushRawCookie pushes the cookie as a table onto stack.
+func luaPushRawCookie(L *C.lua_State, cookie *rawCookie) {
+	luaTableNew(L, 0, 8)
+
+	// Set the string fields of the cookie.
+	for _, kv := range [][2]string{
+		{"name", cookie.Name},
+		{"value", cookie.Value},
+		{"domain", cookie.Domain},
+		{"path", cookie.Path},
+	} {
+		luaStringPush(L, kv[0])
+		luaStringPush(L, kv[1])
+		luaTableRawSet(L, -3)
+	}
+
+	// Set the boolean fields of the cookie.
+	for _, kv := range []struct {
+		key   string
+		value bool
+	}{
+		{"hostonly", cookie.HostOnly},
+		{"secure", cookie.Secure},
+		{"httponly", cookie.HttpOnly},
+	} {
+		luaStringPush(L, kv.key)
+		luaBooleanPush(L, kv.value)
+		luaTableRawSet(L, -3)
+	}
+
+	// Set the expires field as unix timestamp, which is
+	// left nil for session cookies.
+	if !cookie.Expires.IsZero() {
+		luaStringPush(L, "expires")
+		luaNumberPush(L, float64(cookie.Expires.Unix()))
+		luaTableRawSet(L, -3)
+	}
+}
+
+// luaReadRawCookie attempts to read the cookie table at
+// the specified index.
+func luaReadRawCookie(L *C.lua_State, idx int) (*rawCookie, error) {
+	if luaTypeOf(L, idx) != luaTypeTable {
+		return nil, errors.New("missing table argument")
+	}
+
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if idx < 0 {
+		idx = stackTop + idx + 1
+	}
+	result := &rawCookie{}
+
+	// Attempt to fetch the string fields of the cookie.
+	for _, field := range []struct {
+		key      string
+		value    *string
+		required bool
+	}{
+		{"name", &result.Name, true},
+		{"value", &result.Value, false},
+		{"domain", &result.Domain, true},
+		{"path", &result.Path, false},
+	} {
+		luaStringPush(L, field.key)
+		luaTableRawGet(L, idx)
+		switch luaTypeOf(L, -1) {
+		case luaTypeString:
+			*field.value = luaStringGet(L, -1)
+		case luaTypeNil:
+			if field.required {
+				return nil, errors.New(
+					"missing " + field.key + " argument")
+			}
+		default:
+			return nil, errors.New(
+				"invalid " + field.key + " argument")
+		}
+		luaStackPop(L, 1)
+	}
+
+	// Attempt to fetch the boolean fields of the cookie.
+	for _, field := range []struct {
+		key   string
+		value *bool
+	}{
+		{"hostonly", &result.HostOnly},
+		{"secure", &result.Secure},
+		{"httponly", &result.HttpOnly},
+	} {
+		luaStringPush(L, field.key)
+		luaTableRawGet(L, idx)
+		*field.value = luaBooleanGet(L, -1)
+		luaStackPop(L, 1)
+	}
+
+	// Attempt to fetch the expires field as timestamp.
+	luaStringPush(L, "expires")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeNumber {
+		result.Expires = time.Unix(int64(luaNumberGet(L, -1)), 0)
+	} else if luaTypeOf(L, -1) != luaTypeNil {
+		return nil, errors.New("invalid expires argument")
+	}
+	luaStackPop(L, 1)
+	return result, nil
+}
+
+// luaOptionalStringGet returns the string at the index,
+// or empty string if the index is absent or nil.
+func luaOptionalStringGet(L *C.lua_State, idx int) (string, error) {
+	switch luaTypeOf(L, idx) {
+	case luaTypeString:
+		return luaStringGet(L, idx), nil
+	case luaTypeNone, luaTypeNil:
+		return "", nil
+	default:
+		return "", errors.New("invalid string argument")
+	}
+}
+
+//export luatc_cookiejar
+func luatc_cookiejar(L *C.lua_State) C.int {
+	path, err := luaOptionalStringGet(L, 1)
+	if err == nil && path == "" {
+		err = errors.New("missing path argument")
+	}
+	if err == nil {
+		err = rawCookies.load(path)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_getcookies
+func luatc_getcookies(L *C.lua_State) C.int {
+	domain, err := luaOptionalStringGet(L, 1)
+	if err != nil {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	cookies := rawCookies.list(domain)
+	luaStackTopSet(L, 0)
+	luaTableNew(L, len(cookies), 0)
+	for i, cookie := range cookies {
+		luaPushRawCookie(L, cookie)
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_setcookie
+func luatc_setcookie(L *C.lua_State) C.int {
+	cookie, err := luaReadRawCookie(L, 1)
+	if err == nil {
+		err = rawCookies.set(cookie)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_clearcookies
+func luatc_clearcookies(L *C.lua_State) C.int {
+	domain, err := luaOptionalStringGet(L, 1)
+	if err == nil {
+		err = rawCookies.clear(domain)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// downloadPartSuffix is appended to the destination path
+// for storing the partially downloaded file.
+const downloadPartSuffix = ".part"
+
+// downloadValidatorSuffix is appended to the destination
+// path for storing the validator of the partial file, which
+// is sent as If-Range when resuming.
+const downloadValidatorSuffix = ".part.validator"
+
+// downloadProgress is the progress reported by a download
+// task while it is running.
+type downloadProgress struct {
+	// received is the number of bytes in the file.
+	received int64
+
+	// length is the length of the whole file, and -1
+	// when it is unknown.
+	length int64
+}
+
+// marshal the download progress to the lua stack.
+func (p *downloadProgress) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 2)
+
+	// Set the progress.received field.
+	luaStringPush(L, "received")
+	luaNumberPush(L, float64(p.received))
+	luaTableRawSet(L, -3)
+
+	// Set the progress.length field, which is left nil
+	// when the length is unknown.
+	if p.length >= 0 {
+		luaStringPush(L, "length")
+		luaNumberPush(L, float64(p.length))
+		luaTableRawSet(L, -3)
+	}
+}
+
+// downloadResult is the task result of a completed download.
+type downloadResult struct {
+	// path of the downloaded file.
+	path string
+
+	// size of the downloaded file.
+	size int64
+
+	// sha256 is the hex digest of the downloaded file.
+	sha256 string
+
+	// resumed indicates whether the download has been
+	// resumed from a partial file.
+	resumed bool
+}
+
+// marshal the download result to the lua stack.
+func (r downloadResult) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 4)
+
+	// Set the result.path field.
+	luaStringPush(L, "path")
+	luaStringPush(L, r.path)
+	luaTableRawSet(L, -3)
+
+	// Set the result.size field.
+	luaStringPush(L, "size")
+	luaNumberPush(L, float64(r.size))
+	luaTableRawSet(L, -3)
+
+	// Set the result.sha256 field.
+	luaStringPush(L, "sha256")
+	luaStringPush(L, r.sha256)
+	luaTableRawSet(L, -3)
+
+	// Set the result.resumed field.
+	luaStringPush(L, "resumed")
+	luaBooleanPush(L, r.resumed)
+	luaTableRawSet(L, -3)
+}
+
+// downloadWriter counts the bytes written to the partial
+// file and reports the progress to the task.
+type downloadWriter struct {
+	// ctx of the task for reporting the progress.
+	ctx context.Context
+
+	// file is the partial file being written.
+	file *os.File
+
+	// received is the number of bytes in the file.
+	received int64
+
+	// length is the length of the whole file.
+	length int64
+}
+
+// Write implements io.Writer for downloadWriter.
+func (w *downloadWriter) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.received += int64(n)
+	luaTaskReport(w.ctx, &downloadProgress{
+		received: w.received,
+		length:   w.length,
+	})
+	return n, err
+}
+
+// downloadHashFile feeds the content of the partial file
+// into the digest, returning the size of the file.
+func downloadHashFile(file *os.File, digest hash.Hash) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(digest, file)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// downloadRangeStart parses the start offset of the
+// Content-Range header in a partial content response.
+func downloadRangeStart(contentRange string) (int64, error) {
+	// The header is of form "bytes start-end/size".
+	spec := strings.TrimPrefix(contentRange, "bytes ")
+	if spec == contentRange {
+		return 0, fmt.Errorf(
+			"invalid content range %q", contentRange)
+	}
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, fmt.Errorf(
+			"invalid content range %q", contentRange)
+	}
+	return strconv.ParseInt(spec[:dash], 10, 64)
+}
+
+// downloadValidator returns the validator of the response
+// for If-Range, which is the strong ETag or the Last-Modified
+// date, or empty if there's none.
+func downloadValidator(response *http.Response) string {
+	if etag := response.Header.Get("ETag"); etag != "" &&
+		!strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return response.Header.Get("Last-Modified")
+}
+
+// downloadSaveValidator stores the validator of the partial
+// file, or removes the stored one if it is empty.
+func downloadSaveValidator(validatorPath, validator string) error {
+	if validator == "" {
+		if err := os.Remove(validatorPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(validatorPath, []byte(validator), 0644)
+}
+
+// runDownload executes the download task, resuming from
+// the partial file if there's any.
+func runDownload(
+	ctx context.Context, parsedRequest *httpRawRequest,
+	path, expectedSum string,
+) (luaTaskResult, error) {
+	// Open the partial file for resuming the download, the
+	// partial file is preserved when download interrupts.
+	partPath := path + downloadPartSuffix
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+		}
+	}()
+	digest := sha256.New()
+	offset, err := downloadHashFile(file, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Request for the remaining part of the file. The range
+	// is conditioned on the validator of the partial file,
+	// so that the file changed remotely is sent in whole
+	// instead of being appended. Without validator, it is
+	// only resumed when the sha256 could verify the result.
+	validatorPath := path + downloadValidatorSuffix
+	validator, err := ioutil.ReadFile(validatorPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	request := parsedRequest.newRequest(ctx)
+	request.Header = make(http.Header)
+	for k, v := range parsedRequest.header {
+		request.Header[k] = v
+	}
+	if offset > 0 && (len(validator) > 0 || expectedSum != "") {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if len(validator) > 0 {
+			request.Header.Set("If-Range", string(validator))
+		}
+	}
+	response, err := rawClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	// Determine where to continue writing the file.
+	resumed := false
+	switch response.StatusCode {
+	case http.StatusOK:
+		// The server does not support range requests or
+		// the file has changed, so restart from scratch
+		// with the validator of the new content.
+		if err := file.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		digest.Reset()
+		offset = 0
+		if err := downloadSaveValidator(validatorPath,
+			downloadValidator(response)); err != nil {
+			return nil, err
+		}
+	case http.StatusPartialContent:
+		start, err := downloadRangeStart(
+			response.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		if start != offset {
+			return nil, fmt.Errorf(
+				"unexpected range start %d, want %d", start, offset)
+		}
+		resumed = true
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file has covered the whole content,
+		// so it just needs verification.
+		if offset == 0 {
+			return nil, errors.New(response.Status)
+		}
+		response.Body = http.NoBody
+		response.ContentLength = 0
+		resumed = true
+	default:
+		return nil, errors.New(response.Status)
+	}
+
+	// Receive the remaining content into the partial file.
+	length := int64(-1)
+	if response.ContentLength >= 0 {
+		length = offset + response.ContentLength
+	}
+	writer := &downloadWriter{
+		ctx:      ctx,
+		file:     file,
+		received: offset,
+		length:   length,
+	}
+	luaTaskReport(ctx, &downloadProgress{
+		received: offset,
+		length:   length,
+	})
+	if _, err := io.Copy(io.MultiWriter(writer, digest),
+		response.Body); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	err = file.Close()
+	file = nil
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the content of file before placing it.
+	sum := hex.EncodeToString(digest.Sum(nil))
+	if expectedSum != "" && !strings.EqualFold(sum, expectedSum) {
+		// The partial file is corrupted and should not be
+		// resumed from in the next attempt.
+		_ = os.Remove(partPath)
+		_ = os.Remove(validatorPath)
+		return nil, fmt.Errorf(
+			"sha256 mismatch, got %s, want %s", sum, expectedSum)
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(validatorPath)
+	return downloadResult{
+		path:    path,
+		size:    writer.received,
+		sha256:  sum,
+		resumed: resumed,
+	}, nil
+}
+
+//export luatc_download
+func luatc_download(L *C.lua_State) C.int {
+	// Attempt to parse the request from the argument.
+	parsedRequest, err := luaReadHttpRawRequest(L, 1)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Attempt to fetch the path field from the table.
+	luaStringPush(L, "path")
+	luaTableRawGet(L, 1)
+	if luaTypeOf(L, -1) != luaTypeString {
+		luaNilPush(L)
+		luaStringPush(L, "missing path argument")
+		return C.int(2)
+	}
+	argumentPath := luaStringGet(L, -1)
+	luaStackPop(L, 1)
+
+	// Attempt to fetch the sha256 field from the table.
+	var argumentSum string
+	luaStringPush(L, "sha256")
+	luaTableRawGet(L, 1)
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeString {
+		argumentSum = luaStringGet(L, -1)
+		if _, err := hex.DecodeString(argumentSum); err != nil ||
+			len(argumentSum) != 2*sha256.Size {
+			luaNilPush(L)
+			luaStringPush(L, "invalid sha256 argument")
+			return C.int(2)
+		}
+	} else if typeOf != luaTypeNil {
+		luaNilPush(L)
+		luaStringPush(L, "invalid sha256 argument")
+		return C.int(2)
+	}
+	luaStackPop(L, 1)
+
+	// Create the download task and return.
+	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
+		return runDownload(ctx, parsedRequest,
+			argumentPath, argumentSum)
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
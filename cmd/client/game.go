@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Techmino/TechminoOnline/game"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaGameMaxSeed is the maximum seed, which is the largest
+// integer represented exactly by lua numbers.
+const luaGameMaxSeed = 1 << 53
+
+// luaGameIntegerField reads the optional integer field of
+// the table at the specified index into the value.
+func luaGameIntegerField(
+	L *C.lua_State, index int, key string, value *int,
+) error {
+	luaStringPush(L, key)
+	luaTableRawGet(L, index)
+	defer luaStackPop(L, 1)
+	switch luaTypeOf(L, -1) {
+	case luaTypeNil:
+		return nil
+	case luaTypeNumber:
+		number := luaNumberGet(L, -1)
+		if number != math.Trunc(number) ||
+			math.Abs(number) > math.MaxInt32 {
+			return fmt.Errorf("invalid %s argument", key)
+		}
+		*value = int(number)
+		return nil
+	default:
+		return fmt.Errorf("invalid %s argument", key)
+	}
+}
+
+// luaGameBooleanField reads the optional boolean field of
+// the table at the specified index into the value.
+func luaGameBooleanField(
+	L *C.lua_State, index int, key string, value *bool,
+) error {
+	luaStringPush(L, key)
+	luaTableRawGet(L, index)
+	defer luaStackPop(L, 1)
+	switch luaTypeOf(L, -1) {
+	case luaTypeNil:
+		return nil
+	case luaTypeBoolean:
+		*value = luaBooleanGet(L, -1)
+		return nil
+	default:
+		return fmt.Errorf("invalid %s argument", key)
+	}
+}
+
+// luaGameSeedGet reads the seed at the specified index,
+// which must be a non-negative integer.
+func luaGameSeedGet(L *C.lua_State, index int) (uint64, error) {
+	if luaTypeOf(L, index) != luaTypeNumber {
+		return 0, errors.New("missing seed argument")
+	}
+	seed := luaNumberGet(L, index)
+	if seed != math.Trunc(seed) || seed < 0 || seed > luaGameMaxSeed {
+		return 0, errors.New("invalid seed argument")
+	}
+	return uint64(seed), nil
+}
+
+// luaGameAlgorithmGet reads the optional algorithm of the
+// generator at the specified index.
+func luaGameAlgorithmGet(L *C.lua_State, index int) (string, error) {
+	switch luaTypeOf(L, index) {
+	case luaTypeNil, luaTypeNone:
+		return game.DefaultAlgorithm, nil
+	case luaTypeString:
+		return luaStringGet(L, index), nil
+	default:
+		return "", errors.New("invalid algorithm argument")
+	}
+}
+
+// luaReadGameConfig reads the options table at the specified
+// index, and the fields absent are left as the defaults.
+func luaReadGameConfig(
+	L *C.lua_State, index int,
+) (config game.Config, algorithm string, seed uint64, err error) {
+	config = game.DefaultConfig()
+	if luaTypeOf(L, index) != luaTypeTable {
+		return config, "", 0, errors.New("missing table argument")
+	}
+
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if index < 0 {
+		index = stackTop + index + 1
+	}
+
+	// Attempt to fetch the generator of the game.
+	luaStringPush(L, "seed")
+	luaTableRawGet(L, index)
+	luaStringPush(L, "algorithm")
+	luaTableRawGet(L, index)
+	if seed, err = luaGameSeedGet(L, -2); err != nil {
+		return
+	}
+	if algorithm, err = luaGameAlgorithmGet(L, -1); err != nil {
+		return
+	}
+	luaStackPop(L, 2)
+
+	// Attempt to fetch the rules of the game.
+	for _, field := range []struct {
+		key   string
+		value *int
+	}{
+		{"gravity", &config.Gravity},
+		{"lockdelay", &config.LockDelay},
+		{"maxresets", &config.MaxLockResets},
+		{"preview", &config.Preview},
+	} {
+		if err = luaGameIntegerField(L, index, field.key, field.value); err != nil {
+			return
+		}
+	}
+	if err = luaGameBooleanField(L, index, "hold", &config.Hold); err != nil {
+		return
+	}
+	if err = luaGameBooleanField(L, index, "allspin", &config.AllSpin); err != nil {
+		return
+	}
+	return config, algorithm, seed, config.Validate()
+}
+
+// luaGameLookup attempts to dereference the game at the
+// specified index.
+func luaGameLookup(L *C.lua_State, index int) (*game.Game, bool) {
+	g, ok := luaGcLookup(L, index).(*game.Game)
+	return g, ok
+}
+
+// luaGamePush pushes the game as userdata onto the stack.
+func luaGamePush(L *C.lua_State, g *game.Game) {
+	luaGcAlloc(L, g, func() {})
+}
+
+// luaPiecePush pushes the name of the piece, or nil if it
+// is not a piece.
+func luaPiecePush(L *C.lua_State, piece game.Piece) {
+	if piece == game.PieceNone {
+		luaNilPush(L)
+	} else {
+		luaStringPush(L, piece.String())
+	}
+}
+
+// luaFallingPush pushes the falling piece as a table, whose
+// positions are numbered from 1 like the lua arrays.
+func luaFallingPush(L *C.lua_State, falling game.Falling) {
+	luaTableNew(L, 0, 5)
+	luaStringPush(L, "piece")
+	luaPiecePush(L, falling.Piece)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "rotation")
+	luaIntegerPush(L, int(falling.Rotation))
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "x")
+	luaIntegerPush(L, falling.X+1)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "y")
+	luaIntegerPush(L, falling.Y+1)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "cells")
+	luaTableNew(L, 4, 0)
+	for i, cell := range falling.Cells() {
+		luaTableNew(L, 2, 0)
+		luaIntegerPush(L, cell.X+1)
+		luaTableRawSeti(L, -2, 1)
+		luaIntegerPush(L, cell.Y+1)
+		luaTableRawSeti(L, -2, 2)
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaTableRawSet(L, -3)
+}
+
+// luaGameLock is the result of lock returned to lua.
+type luaGameLock game.Lock
+
+// marshal the result of lock to the lua stack.
+func (r *luaGameLock) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 7)
+	luaStringPush(L, "piece")
+	luaPiecePush(L, r.Piece)
+	luaTableRawSet(L, -3)
+	if r.Spin != game.SpinNone {
+		luaStringPush(L, "spin")
+		luaStringPush(L, r.Spin.String())
+		luaTableRawSet(L, -3)
+	}
+	luaStringPush(L, "lines")
+	luaIntegerPush(L, r.Lines)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "combo")
+	luaIntegerPush(L, r.Combo)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "b2b")
+	luaBooleanPush(L, r.B2B)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "allclear")
+	luaBooleanPush(L, r.AllClear)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "attack")
+	luaIntegerPush(L, r.Attack)
+	luaTableRawSet(L, -3)
+}
+
+// luaGameState is the state of the game returned to lua.
+type luaGameState struct {
+	// g is the game inspected.
+	g *game.Game
+}
+
+// marshal the state of the game to the lua stack.
+func (r *luaGameState) marshal(L *C.lua_State) {
+	g := r.g
+	luaTableNew(L, 0, 12)
+
+	// Push the board as rows from bottom to top.
+	board := g.Board()
+	luaStringPush(L, "board")
+	luaTableNew(L, game.BoardHeight, 0)
+	for y, row := range board {
+		luaTableNew(L, game.BoardWidth, 0)
+		for x, cell := range row {
+			luaIntegerPush(L, int(cell))
+			luaTableRawSeti(L, -2, x+1)
+		}
+		luaTableRawSeti(L, -2, y+1)
+	}
+	luaTableRawSet(L, -3)
+
+	// Push the falling piece and where it would drop.
+	if falling, ok := g.Falling(); ok {
+		luaStringPush(L, "falling")
+		luaFallingPush(L, falling)
+		luaTableRawSet(L, -3)
+		luaStringPush(L, "ghost")
+		luaFallingPush(L, g.Ghost())
+		luaTableRawSet(L, -3)
+	}
+
+	// Push the next pieces and the held piece.
+	next := g.Next()
+	luaStringPush(L, "next")
+	luaTableNew(L, len(next), 0)
+	for i, piece := range next {
+		luaPiecePush(L, piece)
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "hold")
+	luaPiecePush(L, g.Hold())
+	luaTableRawSet(L, -3)
+
+	// Push the progress and statistics.
+	stats := g.Stats()
+	for _, field := range []struct {
+		key   string
+		value int
+	}{
+		{"frame", g.Frame()},
+		{"combo", g.Combo()},
+		{"pieces", stats.Pieces},
+		{"lines", stats.Lines},
+		{"attack", stats.Attack},
+	} {
+		luaStringPush(L, field.key)
+		luaIntegerPush(L, field.value)
+		luaTableRawSet(L, -3)
+	}
+	luaStringPush(L, "b2b")
+	luaBooleanPush(L, g.B2B())
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "over")
+	luaBooleanPush(L, g.Over())
+	luaTableRawSet(L, -3)
+}
+
+//export luatc_gamenew
+func luatc_gamenew(L *C.lua_State) C.int {
+	config, algorithm, seed, err := luaReadGameConfig(L, 1)
+	var generator game.Generator
+	if err == nil {
+		generator, err = game.NewGenerator(algorithm, seed)
+	}
+	var g *game.Game
+	if err == nil {
+		g, err = game.NewWithGenerator(config, generator)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	luaGamePush(L, g)
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_gameclone
+func luatc_gameclone(L *C.lua_State) C.int {
+	g, ok := luaGameLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not game.Game")
+		return C.int(2)
+	}
+	luaGamePush(L, g.Clone())
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_gameinput
+func luatc_gameinput(L *C.lua_State) C.int {
+	g, ok := luaGameLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not game.Game")
+		return C.int(2)
+	}
+	var action game.Action
+	err := errors.New("missing action argument")
+	if luaTypeOf(L, 2) == luaTypeString {
+		action, err = game.ParseAction(luaStringGet(L, 2))
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// return moved, lock
+	moved, lock := g.Apply(action)
+	luaBooleanPush(L, moved)
+	if lock != nil {
+		(*luaGameLock)(lock).marshal(L)
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(2)
+}
+
+//export luatc_gametick
+func luatc_gametick(L *C.lua_State) C.int {
+	g, ok := luaGameLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not game.Game")
+		return C.int(2)
+	}
+	frames := 1
+	if typeOf := luaTypeOf(L, 2); typeOf == luaTypeNumber {
+		frames = int(luaNumberGet(L, 2))
+	} else if typeOf != luaTypeNil && typeOf != luaTypeNone {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "invalid frames argument")
+		return C.int(2)
+	}
+	luaStackTopSet(L, 0)
+
+	// return { lock1, lock2, ... }, nil
+	var locks []*game.Lock
+	for i := 0; i < frames; i++ {
+		if lock := g.Tick(); lock != nil {
+			locks = append(locks, lock)
+		}
+	}
+	luaTableNew(L, len(locks), 0)
+	for i, lock := range locks {
+		(*luaGameLock)(lock).marshal(L)
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_gamegarbage
+func luatc_gamegarbage(L *C.lua_State) C.int {
+	g, ok := luaGameLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "not game.Game")
+		return C.int(1)
+	}
+	if luaTypeOf(L, 2) != luaTypeNumber || luaTypeOf(L, 3) != luaTypeNumber {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "missing lines or hole argument")
+		return C.int(1)
+	}
+	lines := int(luaNumberGet(L, 2))
+	hole := int(luaNumberGet(L, 3)) - 1
+	luaStackTopSet(L, 0)
+	if err := g.Garbage(lines, hole); err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_gamestate
+func luatc_gamestate(L *C.lua_State) C.int {
+	g, ok := luaGameLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not game.Game")
+		return C.int(2)
+	}
+	(&luaGameState{g: g}).marshal(L)
+	luaNilPush(L)
+	return C.int(2)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Techmino/TechminoOnline/netcode"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaGarbageMessageOptions are the options to read messages,
+// which are tables of { type, seq, ack, lines, hole }.
+var luaGarbageMessageOptions = luaValueOptions{
+	maxDepth: 1,
+}
+
+// luaGarbageExchange is the attack exchange bound to the
+// connection which the messages are sent through.
+type luaGarbageExchange struct {
+	// exchange is the attack exchange.
+	exchange *netcode.Exchange
+
+	// conn is the handle of connection, which is kept so
+	// that the connection is alive with the exchange.
+	conn *luaConnHandle
+
+	// sender is the connection to send the messages.
+	sender luaConnSender
+
+	// relay indicates the messages are wrapped as relay
+	// messages of the online server.
+	relay bool
+}
+
+// luaGarbageLookup attempts to dereference the exchange at
+// the specified index.
+func luaGarbageLookup(L *C.lua_State, index int) (*luaGarbageExchange, bool) {
+	e, ok := luaGcLookup(L, index).(*luaGarbageExchange)
+	return e, ok
+}
+
+// send sends the messages through the connection, where the
+// holes are numbered from 1 like the lua side.
+func (e *luaGarbageExchange) send(messages ...*netcode.Message) error {
+	values := make([]interface{}, 0, len(messages))
+	for _, message := range messages {
+		if message == nil {
+			continue
+		}
+		var value interface{}
+		if message.Type == netcode.MessageAttack {
+			value = luaValueMap{
+				{"ack", int64(message.Ack)},
+				{"hole", int64(message.Hole + 1)},
+				{"lines", int64(message.Lines)},
+				{"seq", int64(message.Seq)},
+				{"type", message.Type},
+			}
+		} else {
+			value = luaValueMap{
+				{"ack", int64(message.Ack)},
+				{"type", message.Type},
+			}
+		}
+		if e.relay {
+			value = luaValueMap{
+				{"data", value},
+				{"type", "relay"},
+			}
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return e.sender.send(luaConnLaneRealtime, values...)
+}
+
+// luaReadGarbageMessage reads the message received at the
+// specified index.
+func luaReadGarbageMessage(L *C.lua_State, index int) (*netcode.Message, error) {
+	value, err := luaValueGet(L, index, &luaGarbageMessageOptions)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := value.(luaValueMap)
+	if !ok {
+		return nil, errors.New("invalid message")
+	}
+	result := &netcode.Message{}
+	for _, pair := range fields {
+		var field *int
+		switch pair.key {
+		case "type":
+			if result.Type, ok = pair.value.(string); !ok {
+				return nil, errors.New("invalid type of message")
+			}
+			continue
+		case "seq":
+			field = &result.Seq
+		case "ack":
+			field = &result.Ack
+		case "lines":
+			field = &result.Lines
+		case "hole":
+			field = &result.Hole
+		default:
+			continue
+		}
+		if *field, ok = luaNetcodeInteger(pair.value); !ok {
+			return nil, errors.New("invalid " + pair.key.(string) + " of message")
+		}
+	}
+	result.Hole--
+	return result, nil
+}
+
+// luaGarbagePush pushes the garbage lines as array of tables
+// { seq, lines, hole } onto the stack.
+func luaGarbagePush(L *C.lua_State, garbage []netcode.Garbage) {
+	luaTableNew(L, len(garbage), 0)
+	for i, item := range garbage {
+		luaTableNew(L, 0, 3)
+		luaStringPush(L, "seq")
+		luaIntegerPush(L, item.Seq)
+		luaTableRawSet(L, -3)
+		luaStringPush(L, "lines")
+		luaIntegerPush(L, item.Lines)
+		luaTableRawSet(L, -3)
+		luaStringPush(L, "hole")
+		luaIntegerPush(L, item.Hole+1)
+		luaTableRawSet(L, -3)
+		luaTableRawSeti(L, -2, i+1)
+	}
+}
+
+// luaGarbageLinesGet reads the lines at the specified index.
+func luaGarbageLinesGet(L *C.lua_State, index int) (int, error) {
+	if luaTypeOf(L, index) != luaTypeNumber {
+		return 0, errors.New("missing lines argument")
+	}
+	lines, ok := luaNetcodeInteger(luaNumberGet(L, index))
+	if !ok || lines < 0 {
+		return 0, errors.New("invalid lines argument")
+	}
+	return lines, nil
+}
+
+//export luatc_garbagenew
+func luatc_garbagenew(L *C.lua_State) C.int {
+	// First, attempt to cast the interface into a conn
+	// which the go side could send through.
+	connHandle, ok := luaGcLookup(L, 1).(*luaConnHandle)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaConnHandle")
+		return C.int(2)
+	}
+	sender, ok := connHandle.conn.(luaConnSender)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "connection not sendable")
+		return C.int(2)
+	}
+
+	// Second, read the options of the exchange.
+	var seed uint64
+	relay := true
+	var err error
+	switch luaTypeOf(L, 2) {
+	case luaTypeNil, luaTypeNone:
+	case luaTypeTable:
+		luaStringPush(L, "seed")
+		luaTableRawGet(L, 2)
+		if luaTypeOf(L, -1) != luaTypeNil {
+			seed, err = luaGameSeedGet(L, -1)
+		}
+		luaStackPop(L, 1)
+		if err == nil {
+			err = luaGameBooleanField(L, 2, "relay", &relay)
+		}
+	default:
+		err = errors.New("invalid table argument")
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Third, push back the exchange normally.
+	luaGcAlloc(L, &luaGarbageExchange{
+		exchange: netcode.NewExchange(seed),
+		conn:     connHandle,
+		sender:   sender,
+		relay:    relay,
+	}, func() {})
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_garbageattack
+func luatc_garbageattack(L *C.lua_State) C.int {
+	e, ok := luaGarbageLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaGarbageExchange")
+		return C.int(2)
+	}
+	lines, err := luaGarbageLinesGet(L, 2)
+	luaStackTopSet(L, 0)
+	var message *netcode.Message
+	if err == nil {
+		message, err = e.exchange.Attack(lines)
+	}
+	if err == nil {
+		err = e.send(message)
+	}
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// return sent, nil
+	sent := 0
+	if message != nil {
+		sent = message.Lines
+	}
+	luaIntegerPush(L, sent)
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_garbagereceive
+func luatc_garbagereceive(L *C.lua_State) C.int {
+	e, ok := luaGarbageLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "not main.luaGarbageExchange")
+		return C.int(1)
+	}
+	message, err := luaReadGarbageMessage(L, 2)
+	luaStackTopSet(L, 0)
+	var ack *netcode.Message
+	if err == nil {
+		ack, err = e.exchange.Receive(message)
+	}
+	if err == nil {
+		err = e.send(ack)
+	}
+	if err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_garbageresend
+func luatc_garbageresend(L *C.lua_State) C.int {
+	e, ok := luaGarbageLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaStringPush(L, "not main.luaGarbageExchange")
+		return C.int(1)
+	}
+	if err := e.send(e.exchange.Unacked()...); err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_garbagepending
+func luatc_garbagepending(L *C.lua_State) C.int {
+	e, ok := luaGarbageLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaGarbageExchange")
+		return C.int(2)
+	}
+	luaGarbagePush(L, e.exchange.Pending())
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_garbagetake
+func luatc_garbagetake(L *C.lua_State) C.int {
+	e, ok := luaGarbageLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaGarbageExchange")
+		return C.int(2)
+	}
+	lines, err := luaGarbageLinesGet(L, 2)
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	luaGarbagePush(L, e.exchange.Take(lines))
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_garbageinfo
+func luatc_garbageinfo(L *C.lua_State) C.int {
+	e, ok := luaGarbageLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaGarbageExchange")
+		return C.int(2)
+	}
+	sent, received, cancelled := e.exchange.Stats()
+	pending := 0
+	for _, item := range e.exchange.Pending() {
+		pending += item.Lines
+	}
+	luaTableNew(L, 0, 5)
+	for _, field := range []struct {
+		key   string
+		value int
+	}{
+		{"sent", sent},
+		{"received", received},
+		{"cancelled", cancelled},
+		{"pending", pending},
+		{"unacked", len(e.exchange.Unacked())},
+	} {
+		luaStringPush(L, field.key)
+		luaIntegerPush(L, field.value)
+		luaTableRawSet(L, -3)
+	}
+	luaNilPush(L)
+	return C.int(2)
+}
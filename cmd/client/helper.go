@@ -1,6 +1,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"unsafe"
 )
 
@@ -21,6 +25,17 @@ static void luatc_pop(lua_State* L, int n) {
 */
 import "C"
 
+// luaStateNew creates a standalone lua state, which is not
+// driven by the game and used for converting values alone.
+func luaStateNew() *C.lua_State {
+	return C.luaL_newstate()
+}
+
+// luaStateClose releases the state created by luaStateNew.
+func luaStateClose(L *C.lua_State) {
+	C.lua_close(L)
+}
+
 // luaBytesPush pushes the bytes slice as a lua lstring.
 func luaBytesPush(L *C.lua_State, b []byte) {
 	if len(b) > 0 {
@@ -63,6 +78,31 @@ func luaIntegerPush(L *C.lua_State, value int) {
 	C.lua_pushinteger(L, C.lua_Integer(value))
 }
 
+// luaNumberPush pushes a number to lua stack.
+func luaNumberPush(L *C.lua_State, value float64) {
+	C.lua_pushnumber(L, C.lua_Number(value))
+}
+
+// luaNumberGet returns the lua number back to the go side.
+func luaNumberGet(L *C.lua_State, index int) float64 {
+	return float64(C.lua_tonumber(L, C.int(index)))
+}
+
+// luaBooleanGet returns the lua boolean back to the go side,
+// only nil and false are considered false.
+func luaBooleanGet(L *C.lua_State, index int) bool {
+	return C.lua_toboolean(L, C.int(index)) != C.int(0)
+}
+
+// luaBooleanPush pushes a boolean to lua stack.
+func luaBooleanPush(L *C.lua_State, value bool) {
+	if value {
+		C.lua_pushboolean(L, C.int(1))
+	} else {
+		C.lua_pushboolean(L, C.int(0))
+	}
+}
+
 // luaStackTopGet returns the current lua stack top.
 func luaStackTopGet(L *C.lua_State) int {
 	top := C.lua_gettop(L)
@@ -79,6 +119,43 @@ func luaStackPop(L *C.lua_State, i int) {
 	C.luatc_pop(L, C.int(i))
 }
 
+// luaStackRemove removes the item at the index from the lua
+// stack, shifting down the items above it.
+func luaStackRemove(L *C.lua_State, index int) {
+	C.lua_remove(L, C.int(index))
+}
+
+// luaStackCopy pushes a copy of the item at the index onto
+// the lua stack, the tables are copied by reference.
+func luaStackCopy(L *C.lua_State, index int) {
+	C.lua_pushvalue(L, C.int(index))
+}
+
+// luaStackGrow ensures there're at least n free slots on
+// the lua stack, returning false if it could not grow.
+func luaStackGrow(L *C.lua_State, n int) bool {
+	return C.lua_checkstack(L, C.int(n)) != C.int(0)
+}
+
+// luaNullPush pushes the null sentinel onto the lua stack,
+// which is the light userdata of NULL pointer.
+func luaNullPush(L *C.lua_State) {
+	C.lua_pushlightuserdata(L, nil)
+}
+
+// luaNullIs returns whether the value at given index is
+// the null sentinel.
+func luaNullIs(L *C.lua_State, index int) bool {
+	return luaTypeOf(L, index) == luaTypeLightUserdata &&
+		C.lua_touserdata(L, C.int(index)) == nil
+}
+
+// luaPointerGet returns the identity of the lua object at
+// given index, which is only used for comparison.
+func luaPointerGet(L *C.lua_State, index int) uintptr {
+	return uintptr(C.lua_topointer(L, C.int(index)))
+}
+
 // luaType is the type of object returned by the luaTypeOf.
 type luaType int
 
@@ -130,3 +207,401 @@ func luaTableRawSeti(L *C.lua_State, index, n int) {
 func luaTableNext(L *C.lua_State, index int) bool {
 	return C.lua_next(L, C.int(index)) != C.int(0)
 }
+
+// luaValueDefaultDepth is the default maximum nesting depth
+// of tables converted by luaValueGet and luaValuePush.
+const luaValueDefaultDepth = 128
+
+// luaValueMaxDepth is the upper bound of the depth option,
+// so that the lua stack will not overflow while pushing.
+const luaValueMaxDepth = 1000
+
+// luaValueOptions is the options of converting between the
+// lua values and the go values.
+type luaValueOptions struct {
+	// maxDepth is the maximum nesting depth of tables.
+	maxDepth int
+
+	// emptyArray indicates the empty tables are converted
+	// into slices instead of maps.
+	emptyArray bool
+
+	// integers indicates the integral numbers are converted
+	// into int64 instead of float64.
+	integers bool
+
+	// null indicates the nil values are pushed as the null
+	// sentinel, so that the arrays will not have holes.
+	null bool
+}
+
+// luaValueOptionsGet attempts to read the options table
+// {maxdepth, emptyarray} at the specified index, which is
+// nullable, and the fields absent are left as defaults.
+func luaValueOptionsGet(
+	L *C.lua_State, index int, defaults luaValueOptions,
+) (*luaValueOptions, error) {
+	result := defaults
+	if typeOf := luaTypeOf(L, index); typeOf == luaTypeNil ||
+		typeOf == luaTypeNone {
+		return &result, nil
+	} else if typeOf != luaTypeTable {
+		return nil, errors.New("invalid options argument")
+	}
+
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if index < 0 {
+		index = stackTop + index + 1
+	}
+
+	// Attempt to fetch the maximum depth.
+	luaStringPush(L, "maxdepth")
+	luaTableRawGet(L, index)
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeNumber {
+		result.maxDepth = int(luaNumberGet(L, -1))
+		if result.maxDepth < 1 || result.maxDepth > luaValueMaxDepth {
+			return nil, fmt.Errorf(
+				"maxdepth must be within 1 and %d", luaValueMaxDepth)
+		}
+	} else if typeOf != luaTypeNil {
+		return nil, errors.New("invalid maxdepth argument")
+	}
+	luaStackPop(L, 1)
+
+	// Attempt to fetch how the empty tables are converted.
+	luaStringPush(L, "emptyarray")
+	luaTableRawGet(L, index)
+	if luaTypeOf(L, -1) == luaTypeBoolean {
+		result.emptyArray = luaBooleanGet(L, -1)
+	}
+	luaStackPop(L, 1)
+	return &result, nil
+}
+
+// luaValuePair is an entry of the luaValueMap.
+type luaValuePair struct {
+	key, value interface{}
+}
+
+// luaValueMap is the table converted by luaValueGet which
+// is not an array. The keys could be float64, int64 (or
+// uint64 when unpacked), string and bool like the lua
+// tables, and they are sorted by luaValueKeyLess.
+type luaValueMap []luaValuePair
+
+// luaValueKeyLess orders the keys of the map so that the
+// conversion is reproducible, the numbers are placed before
+// strings and booleans.
+func luaValueKeyLess(a, b interface{}) bool {
+	rank := func(key interface{}) int {
+		switch key.(type) {
+		case int64, uint64, float64:
+			return 0
+		case string:
+			return 1
+		default:
+			return 2
+		}
+	}
+	number := func(key interface{}) float64 {
+		switch key := key.(type) {
+		case int64:
+			return float64(key)
+		case uint64:
+			return float64(key)
+		default:
+			return key.(float64)
+		}
+	}
+	rankA, rankB := rank(a), rank(b)
+	if rankA != rankB {
+		return rankA < rankB
+	}
+	switch rankA {
+	case 0:
+		return number(a) < number(b)
+	case 1:
+		return a.(string) < b.(string)
+	default:
+		return !a.(bool) && b.(bool)
+	}
+}
+
+// luaValueReader is the state of luaValueGet.
+type luaValueReader struct {
+	// options of the conversion.
+	options *luaValueOptions
+
+	// visiting are the tables being converted, which are
+	// used for detecting cycles.
+	visiting map[uintptr]struct{}
+}
+
+// number converts the lua number by the options.
+func (r *luaValueReader) number(number float64) interface{} {
+	if r.options.integers && number == math.Trunc(number) &&
+		!(number == 0 && math.Signbit(number)) &&
+		number >= -(1<<63) && number < (1<<63) {
+		return int64(number)
+	}
+	return number
+}
+
+// read converts the lua value at the specified index, with
+// the depth of its enclosing tables.
+func (r *luaValueReader) read(
+	L *C.lua_State, index int, depth int,
+) (interface{}, error) {
+	switch luaTypeOf(L, index) {
+	case luaTypeNil, luaTypeNone:
+		return nil, nil
+	case luaTypeBoolean:
+		return luaBooleanGet(L, index), nil
+	case luaTypeNumber:
+		return r.number(luaNumberGet(L, index)), nil
+	case luaTypeString:
+		return luaStringGet(L, index), nil
+	case luaTypeLightUserdata:
+		if luaNullIs(L, index) {
+			return nil, nil
+		}
+	case luaTypeTable:
+		return r.readTable(L, index, depth+1)
+	}
+	return nil, fmt.Errorf("unsupported value of %s",
+		C.GoString(C.lua_typename(L, C.lua_type(L, C.int(index)))))
+}
+
+// readTable converts the lua table at the specified index
+// into either a slice or a luaValueMap.
+func (r *luaValueReader) readTable(
+	L *C.lua_State, index int, depth int,
+) (interface{}, error) {
+	if depth > r.options.maxDepth {
+		return nil, errors.New("maximum depth exceeded")
+	}
+
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if index < 0 {
+		index = stackTop + index + 1
+	}
+	if !luaStackGrow(L, 3) {
+		return nil, errors.New("stack overflow")
+	}
+
+	// Mark the table as visiting to detect cycles, the
+	// table referenced by its siblings is not a cycle.
+	pointer := luaPointerGet(L, index)
+	if _, ok := r.visiting[pointer]; ok {
+		return nil, errors.New("cycle detected")
+	}
+	r.visiting[pointer] = struct{}{}
+	defer delete(r.visiting, pointer)
+
+	// Collect the entries of the table, the table is an
+	// array if its keys are exactly 1 to n.
+	var entries luaValueMap
+	isArray := true
+	maxIndex := 0
+	luaNilPush(L)
+	for luaTableNext(L, index) {
+		var key interface{}
+		switch luaTypeOf(L, -2) {
+		case luaTypeNumber:
+			number := luaNumberGet(L, -2)
+			key = r.number(number)
+			if number >= 1 && number <= math.MaxInt32 &&
+				number == math.Trunc(number) {
+				if int(number) > maxIndex {
+					maxIndex = int(number)
+				}
+			} else {
+				isArray = false
+			}
+		case luaTypeString:
+			key = luaStringGet(L, -2)
+			isArray = false
+		case luaTypeBoolean:
+			key = luaBooleanGet(L, -2)
+			isArray = false
+		default:
+			return nil, errors.New("invalid table key")
+		}
+		value, err := r.read(L, -1, depth)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, luaValuePair{key: key, value: value})
+		luaStackPop(L, 1)
+	}
+	if len(entries) == 0 && r.options.emptyArray {
+		return []interface{}{}, nil
+	}
+
+	// Convert the entries into the slice or map.
+	if len(entries) > 0 && isArray && maxIndex == len(entries) {
+		result := make([]interface{}, len(entries))
+		for _, entry := range entries {
+			switch key := entry.key.(type) {
+			case int64:
+				result[key-1] = entry.value
+			case float64:
+				result[int(key)-1] = entry.value
+			}
+		}
+		return result, nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return luaValueKeyLess(entries[i].key, entries[j].key)
+	})
+	return entries, nil
+}
+
+// luaValueGet converts the lua value at the specified index
+// into the go value, which is one of nil, bool, float64,
+// int64 (with options.integers), string, []interface{} for
+// arrays and luaValueMap for other tables. The null sentinel
+// is converted into nil. Error is returned when the tables
+// are nested too deep, referenced cyclically, or the value
+// is not convertible, like functions and userdata.
+func luaValueGet(
+	L *C.lua_State, index int, options *luaValueOptions,
+) (interface{}, error) {
+	reader := &luaValueReader{
+		options:  options,
+		visiting: make(map[uintptr]struct{}),
+	}
+	return reader.read(L, index, 0)
+}
+
+// luaValueDepthCheck validates the nesting depth of the go
+// value, so that it could be pushed in another goroutine.
+func luaValueDepthCheck(value interface{}, maxDepth int) error {
+	switch value := value.(type) {
+	case []interface{}:
+		if maxDepth < 1 {
+			return errors.New("maximum depth exceeded")
+		}
+		for _, item := range value {
+			if err := luaValueDepthCheck(item, maxDepth-1); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if maxDepth < 1 {
+			return errors.New("maximum depth exceeded")
+		}
+		for _, item := range value {
+			if err := luaValueDepthCheck(item, maxDepth-1); err != nil {
+				return err
+			}
+		}
+	case luaValueMap:
+		if maxDepth < 1 {
+			return errors.New("maximum depth exceeded")
+		}
+		for _, pair := range value {
+			if err := luaValueDepthCheck(pair.value, maxDepth-1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// push pushes the go value with the depth of its enclosing
+// tables, leaving the stack unbalanced on error.
+func (options *luaValueOptions) push(
+	L *C.lua_State, value interface{}, depth int,
+) error {
+	if !luaStackGrow(L, 3) {
+		return errors.New("stack overflow")
+	}
+	switch value := value.(type) {
+	case nil:
+		if options.null {
+			luaNullPush(L)
+		} else {
+			luaNilPush(L)
+		}
+	case bool:
+		luaBooleanPush(L, value)
+	case int:
+		luaNumberPush(L, float64(value))
+	case int64:
+		luaNumberPush(L, float64(value))
+	case uint64:
+		luaNumberPush(L, float64(value))
+	case float64:
+		luaNumberPush(L, value)
+	case string:
+		luaStringPush(L, value)
+	case []byte:
+		luaBytesPush(L, value)
+	case []interface{}:
+		if depth+1 > options.maxDepth {
+			return errors.New("maximum depth exceeded")
+		}
+		luaTableNew(L, len(value), 0)
+		for i, item := range value {
+			if err := options.push(L, item, depth+1); err != nil {
+				return err
+			}
+			luaTableRawSeti(L, -2, i+1)
+		}
+	case map[string]interface{}:
+		if depth+1 > options.maxDepth {
+			return errors.New("maximum depth exceeded")
+		}
+		luaTableNew(L, 0, len(value))
+		for key, item := range value {
+			luaStringPush(L, key)
+			if err := options.push(L, item, depth+1); err != nil {
+				return err
+			}
+			luaTableRawSet(L, -3)
+		}
+	case luaValueMap:
+		if depth+1 > options.maxDepth {
+			return errors.New("maximum depth exceeded")
+		}
+		luaTableNew(L, 0, len(value))
+		for _, pair := range value {
+			if pair.key == nil {
+				return errors.New("invalid table key")
+			}
+			if key, ok := pair.key.(float64); ok && math.IsNaN(key) {
+				return errors.New("invalid table key")
+			}
+			if err := options.push(L, pair.key, depth+1); err != nil {
+				return err
+			}
+			if err := options.push(L, pair.value, depth+1); err != nil {
+				return err
+			}
+			luaTableRawSet(L, -3)
+		}
+	default:
+		return fmt.Errorf("unsupported value of %T", value)
+	}
+	return nil
+}
+
+// luaValuePush pushes the go value onto the lua stack, which
+// is one of the types returned by luaValueGet, or int, uint64,
+// []byte and map[string]interface{}. On error, the stack is
+// restored and nothing is pushed.
+func luaValuePush(
+	L *C.lua_State, value interface{}, options *luaValueOptions,
+) error {
+	stackTop := luaStackTopGet(L)
+	if err := options.push(L, value, 0); err != nil {
+		luaStackTopSet(L, stackTop)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestLuaValueRoundTrip pushes the go values and converts
+// them back, the tables are converted into slices and the
+// sorted luaValueMap.
+func TestLuaValueRoundTrip(t *testing.T) {
+	options := &luaValueOptions{maxDepth: luaValueDefaultDepth}
+	integers := &luaValueOptions{
+		maxDepth: luaValueDefaultDepth, integers: true}
+	for _, testCase := range []struct {
+		name    string
+		value   interface{}
+		options *luaValueOptions
+		expect  interface{}
+	}{
+		{"nil", nil, options, nil},
+		{"bool", true, options, true},
+		{"number", 1.5, options, 1.5},
+		{"int", 42, options, float64(42)},
+		{"integers", 42, integers, int64(42)},
+		{"negative zero", math.Copysign(0, -1), integers, math.Copysign(0, -1)},
+		{"string", "techmino", options, "techmino"},
+		{"bytes", []byte{0, 1, 2}, options, "\x00\x01\x02"},
+		{"array", []interface{}{"a", "b", "c"}, options,
+			[]interface{}{"a", "b", "c"}},
+		{"nested", map[string]interface{}{
+			"name":  "player",
+			"board": []interface{}{[]interface{}{1.0, 2.0}, []interface{}{}},
+			"stats": map[string]interface{}{"lines": 40.0},
+		}, options, luaValueMap{
+			{"board", []interface{}{
+				[]interface{}{1.0, 2.0},
+				luaValueMap(nil),
+			}},
+			{"name", "player"},
+			{"stats", luaValueMap{{"lines", 40.0}}},
+		}},
+		{"mixed keys", luaValueMap{
+			{true, "t"},
+			{"b", 2.0},
+			{2.5, "x"},
+			{"a", 1.0},
+			{-1.0, "y"},
+		}, options, luaValueMap{
+			{-1.0, "y"},
+			{2.5, "x"},
+			{"a", 1.0},
+			{"b", 2.0},
+			{true, "t"},
+		}},
+		{"sparse array", luaValueMap{
+			{1.0, "a"},
+			{3.0, "c"},
+		}, options, luaValueMap{
+			{1.0, "a"},
+			{3.0, "c"},
+		}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			L := luaStateNew()
+			defer luaStateClose(L)
+			if err := luaValuePush(L, testCase.value, testCase.options); err != nil {
+				t.Fatalf("push: %v", err)
+			}
+			if top := luaStackTopGet(L); top != 1 {
+				t.Fatalf("unexpected stack top %d", top)
+			}
+			value, err := luaValueGet(L, -1, testCase.options)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if !reflect.DeepEqual(value, testCase.expect) {
+				t.Fatalf("expect %#v, got %#v", testCase.expect, value)
+			}
+			if math.Signbit(toFloat(testCase.expect)) != math.Signbit(toFloat(value)) {
+				t.Fatalf("expect sign of %v, got %v", testCase.expect, value)
+			}
+			if top := luaStackTopGet(L); top != 1 {
+				t.Fatalf("unexpected stack top %d", top)
+			}
+		})
+	}
+}
+
+// toFloat returns the float64 value, or zero otherwise.
+func toFloat(value interface{}) float64 {
+	result, _ := value.(float64)
+	return result
+}
+
+// nestedArrays returns the arrays nested to the depth.
+func nestedArrays(depth int) interface{} {
+	var result interface{} = "leaf"
+	for i := 0; i < depth; i++ {
+		result = []interface{}{result}
+	}
+	return result
+}
+
+// TestLuaValueMaxDepth ensures the nesting depth of tables
+// is limited in both directions.
+func TestLuaValueMaxDepth(t *testing.T) {
+	L := luaStateNew()
+	defer luaStateClose(L)
+	shallow := &luaValueOptions{maxDepth: 3}
+	deep := &luaValueOptions{maxDepth: 4}
+
+	// The value within the limit is converted.
+	if err := luaValuePush(L, nestedArrays(3), shallow); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if _, err := luaValueGet(L, -1, shallow); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	luaStackTopSet(L, 0)
+
+	// The deeper value is rejected and nothing is pushed.
+	err := luaValuePush(L, nestedArrays(4), shallow)
+	if err == nil || !strings.Contains(err.Error(), "maximum depth") {
+		t.Fatalf("expect depth error, got %v", err)
+	}
+	if top := luaStackTopGet(L); top != 0 {
+		t.Fatalf("stack not restored, top %d", top)
+	}
+
+	// The deeper table is rejected while converting.
+	if err := luaValuePush(L, nestedArrays(4), deep); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	_, err = luaValueGet(L, -1, shallow)
+	if err == nil || !strings.Contains(err.Error(), "maximum depth") {
+		t.Fatalf("expect depth error, got %v", err)
+	}
+	if top := luaStackTopGet(L); top != 1 {
+		t.Fatalf("stack not restored, top %d", top)
+	}
+
+	// The depth is also checked for the values pushed in
+	// another goroutine.
+	if err := luaValueDepthCheck(nestedArrays(3), 3); err != nil {
+		t.Fatalf("depth check: %v", err)
+	}
+	if err := luaValueDepthCheck(nestedArrays(4), 3); err == nil {
+		t.Fatal("expect depth check error")
+	}
+}
+
+// TestLuaValueCycle ensures the cyclic tables are rejected,
+// while the tables shared by siblings are not cycles.
+func TestLuaValueCycle(t *testing.T) {
+	options := &luaValueOptions{maxDepth: luaValueDefaultDepth}
+	L := luaStateNew()
+	defer luaStateClose(L)
+
+	// Build t = { self = { parent = t } }.
+	luaTableNew(L, 0, 1)
+	luaStringPush(L, "self")
+	luaTableNew(L, 0, 1)
+	luaStringPush(L, "parent")
+	luaStackCopy(L, 1)
+	luaTableRawSet(L, -3)
+	luaTableRawSet(L, 1)
+	_, err := luaValueGet(L, 1, options)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expect cycle error, got %v", err)
+	}
+	if top := luaStackTopGet(L); top != 1 {
+		t.Fatalf("stack not restored, top %d", top)
+	}
+	luaStackTopSet(L, 0)
+
+	// Build s = { 1 }, t = { a = s, b = s }.
+	luaTableNew(L, 0, 2)
+	luaTableNew(L, 1, 0)
+	luaNumberPush(L, 1)
+	luaTableRawSeti(L, -2, 1)
+	luaStringPush(L, "a")
+	luaStackCopy(L, 2)
+	luaTableRawSet(L, 1)
+	luaStringPush(L, "b")
+	luaStackCopy(L, 2)
+	luaTableRawSet(L, 1)
+	value, err := luaValueGet(L, 1, options)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	expect := luaValueMap{
+		{"a", []interface{}{1.0}},
+		{"b", []interface{}{1.0}},
+	}
+	if !reflect.DeepEqual(value, expect) {
+		t.Fatalf("expect %#v, got %#v", expect, value)
+	}
+}
+
+// TestLuaValueSpecialKeys ensures the infinite keys are
+// converted, while the NaN keys are rejected.
+func TestLuaValueSpecialKeys(t *testing.T) {
+	options := &luaValueOptions{maxDepth: luaValueDefaultDepth}
+	L := luaStateNew()
+	defer luaStateClose(L)
+	if err := luaValuePush(L, luaValueMap{
+		{math.Inf(1), "max"},
+		{math.Inf(-1), "min"},
+		{0.0, "zero"},
+	}, options); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	value, err := luaValueGet(L, -1, options)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	expect := luaValueMap{
+		{math.Inf(-1), "min"},
+		{0.0, "zero"},
+		{math.Inf(1), "max"},
+	}
+	if !reflect.DeepEqual(value, expect) {
+		t.Fatalf("expect %#v, got %#v", expect, value)
+	}
+	luaStackTopSet(L, 0)
+
+	// The keys could not be NaN or nil in lua.
+	for _, key := range []interface{}{math.NaN(), nil} {
+		err := luaValuePush(L, luaValueMap{{key, "value"}}, options)
+		if err == nil || !strings.Contains(err.Error(), "invalid table key") {
+			t.Fatalf("expect key error for %v, got %v", key, err)
+		}
+		if top := luaStackTopGet(L); top != 0 {
+			t.Fatalf("stack not restored, top %d", top)
+		}
+	}
+}
+
+// TestLuaValueOptions ensures the emptyArray and null
+// options change the conversion of empty tables and nil.
+func TestLuaValueOptions(t *testing.T) {
+	L := luaStateNew()
+	defer luaStateClose(L)
+
+	// The empty table is a map unless emptyArray is set.
+	luaTableNew(L, 0, 0)
+	value, err := luaValueGet(L, -1, &luaValueOptions{maxDepth: 1})
+	if err != nil || !reflect.DeepEqual(value, luaValueMap(nil)) {
+		t.Fatalf("expect empty map, got %#v, %v", value, err)
+	}
+	value, err = luaValueGet(L, -1, &luaValueOptions{
+		maxDepth: 1, emptyArray: true})
+	if err != nil || !reflect.DeepEqual(value, []interface{}{}) {
+		t.Fatalf("expect empty array, got %#v, %v", value, err)
+	}
+	luaStackTopSet(L, 0)
+
+	// The nil inside arrays leaves a hole without null.
+	array := []interface{}{"a", nil, "c"}
+	if err := luaValuePush(L, array, &luaValueOptions{maxDepth: 1}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	value, err = luaValueGet(L, -1, &luaValueOptions{maxDepth: 1})
+	expect := luaValueMap{{1.0, "a"}, {3.0, "c"}}
+	if err != nil || !reflect.DeepEqual(value, expect) {
+		t.Fatalf("expect %#v, got %#v, %v", expect, value, err)
+	}
+	luaStackTopSet(L, 0)
+
+	// The nil is pushed as the null sentinel with null,
+	// which is converted back into nil.
+	null := &luaValueOptions{maxDepth: 1, null: true}
+	if err := luaValuePush(L, array, null); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	luaTableRawGeti(L, -1, 2)
+	if !luaNullIs(L, -1) {
+		t.Fatal("expect null sentinel in the array")
+	}
+	luaStackPop(L, 1)
+	value, err = luaValueGet(L, -1, null)
+	if err != nil || !reflect.DeepEqual(value, array) {
+		t.Fatalf("expect %#v, got %#v, %v", array, value, err)
+	}
+}
+
+// TestLuaValueUnsupported ensures the unsupported values
+// are rejected without leaving anything on the stack.
+func TestLuaValueUnsupported(t *testing.T) {
+	options := &luaValueOptions{maxDepth: luaValueDefaultDepth}
+	L := luaStateNew()
+	defer luaStateClose(L)
+	err := luaValuePush(L, []interface{}{1.0, struct{}{}}, options)
+	if err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("expect unsupported error, got %v", err)
+	}
+	if top := luaStackTopGet(L); top != 0 {
+		t.Fatalf("stack not restored, top %d", top)
+	}
+}
+
+// TestLuaValueKeyLess ensures the keys are ordered as the
+// numbers, strings and then booleans.
+func TestLuaValueKeyLess(t *testing.T) {
+	keys := []interface{}{
+		true, "b", uint64(3), false, "a", 2.5, int64(-1), math.Inf(1),
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return luaValueKeyLess(keys[i], keys[j])
+	})
+	expect := []interface{}{
+		int64(-1), 2.5, uint64(3), math.Inf(1), "a", "b", false, true,
+	}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("expect %#v, got %#v", expect, keys)
+	}
+}
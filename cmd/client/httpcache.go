@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpCacheHeuristicMax is the maximum freshness lifetime
+// estimated from the Last-Modified header.
+const httpCacheHeuristicMax = 24 * time.Hour
+
+// httpCacheEntry is the metadata of a cached response,
+// whose body is stored aside in another file.
+type httpCacheEntry struct {
+	// URL is the final url of the response.
+	URL string `json:"url"`
+
+	// StatusCode of the response.
+	StatusCode int `json:"statusCode"`
+
+	// Status string of the response.
+	Status string `json:"status"`
+
+	// Header of the response.
+	Header http.Header `json:"header"`
+
+	// Vary is the canonical names of request headers
+	// listed in the Vary header of the response.
+	Vary []string `json:"vary"`
+
+	// BodyDigest is the hex encoded sha256 digest of the
+	// body, so that a body replaced by another concurrent
+	// store of the same entry would not be served.
+	BodyDigest string `json:"bodyDigest"`
+
+	// StoredAt is when the response has been generated,
+	// corrected by the Age header of the response.
+	StoredAt time.Time `json:"storedAt"`
+}
+
+// httpCache is the on-disk cache of responses, which is
+// placed in front of the rawClient.
+type httpCache struct {
+	// mtx is the mutex for accessing the cache.
+	mtx sync.RWMutex
+
+	// dir is the directory of cache, and the cache is
+	// disabled when it is empty.
+	dir string
+}
+
+// rawCache is the http cache shared among raw requests.
+var rawCache httpCache
+
+// enabled returns whether the cache is configured.
+func (c *httpCache) enabled() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.dir != ""
+}
+
+// configure updates the directory of the cache, and the
+// cache will be disabled if the directory is empty.
+func (c *httpCache) configure(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.dir = dir
+	return nil
+}
+
+// path returns the path of files of the cache entry.
+func (c *httpCache) path(key string) string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return filepath.Join(c.dir, key)
+}
+
+// httpCacheRequestHeader returns the request header as
+// sent by the raw client, including the cookies from the
+// jar, which is used for matching the Vary header.
+func httpCacheRequestHeader(request *httpRawRequest) http.Header {
+	header := make(http.Header)
+	for k, v := range request.header {
+		header[k] = v
+	}
+	if header.Get("Accept-Encoding") == "" {
+		header.Set("Accept-Encoding", request.acceptEncoding())
+	}
+	for _, cookie := range rawCookies.Cookies(request.url) {
+		header.Add("Cookie", cookie.Name+"="+cookie.Value)
+	}
+	return header
+}
+
+// httpCacheVary returns the sorted canonical names of the
+// request headers listed in the Vary header.
+func httpCacheVary(header http.Header) []string {
+	var result []string
+	seen := make(map[string]struct{})
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if _, ok := seen[name]; ok || name == "" {
+				continue
+			}
+			seen[name] = struct{}{}
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// httpCacheKey returns the key of the request in cache.
+// The values of request headers named by vary are folded
+// into the key, so that the responses varying by them are
+// cached separately. The key with nil vary is the index of
+// the names varied by the request.
+func httpCacheKey(
+	request *httpRawRequest, header http.Header, vary []string,
+) string {
+	digest := sha256.New()
+	_, _ = digest.Write([]byte(request.method + " " +
+		request.url.String() + "\n" +
+		strconv.FormatBool(request.decompress) + "\n"))
+	for _, name := range vary {
+		value, _ := json.Marshal(header[name])
+		_, _ = digest.Write([]byte(name + ": "))
+		_, _ = digest.Write(value)
+		_, _ = digest.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// loadVary reads the names varied by the request from the
+// index, nil is returned when there's no index.
+func (c *httpCache) loadVary(index string) []string {
+	data, err := ioutil.ReadFile(c.path(index) + ".vary")
+	if err != nil {
+		return nil
+	}
+	var result []string
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// storeVary writes the names varied by the request into
+// the index.
+func (c *httpCache) storeVary(index string, vary []string) error {
+	data, err := json.Marshal(vary)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(index)+".vary", data)
+}
+
+// httpCacheDigest returns the hex encoded sha256 digest.
+func httpCacheDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return hex.EncodeToString(digest[:])
+}
+
+// load reads the cache entry and its body.
+func (c *httpCache) load(key string) (*httpCacheEntry, []byte, error) {
+	path := c.path(key)
+	data, err := ioutil.ReadFile(path + ".meta")
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := &httpCacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadFile(path + ".body")
+	if err != nil {
+		return nil, nil, err
+	}
+	if httpCacheDigest(body) != entry.BodyDigest {
+		return nil, nil, errors.New("mismatched cache body")
+	}
+	return entry, body, nil
+}
+
+// writeFileAtomic writes to a temporary file and rename it,
+// so that the file would not be corrupted by a crash. The
+// temporary file is unique so that the concurrent writes
+// of the same file would not interfere with each other.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := ioutil.TempFile(
+		filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return err
+}
+
+// storeEntry writes the metadata of the cache entry.
+func (c *httpCache) storeEntry(key string, entry *httpCacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(key)+".meta", data)
+}
+
+// store writes the cache entry and its body, the body is
+// written first so that the entry is always complete. The
+// entry records the digest of its body, so that the entry
+// mismatching its body is discarded while loading.
+func (c *httpCache) store(key string, entry *httpCacheEntry, body []byte) error {
+	entry.BodyDigest = httpCacheDigest(body)
+	if err := writeFileAtomic(c.path(key)+".body", body); err != nil {
+		return err
+	}
+	return c.storeEntry(key, entry)
+}
+
+// httpCacheControl parses the Cache-Control header into
+// directives with their lower-cased names.
+func httpCacheControl(header http.Header) map[string]string {
+	result := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name = directive[:i]
+				arg = strings.Trim(directive[i+1:], `"`)
+			}
+			result[strings.ToLower(name)] = arg
+		}
+	}
+	return result
+}
+
+// httpCachePrivate returns whether the request carries
+// credentials, whose responses are only shared when they
+// are explicitly marked as public.
+func httpCachePrivate(header http.Header) bool {
+	return header.Get("Authorization") != "" || header.Get("Cookie") != ""
+}
+
+// httpCachePublic returns whether the response is marked
+// as public by its Cache-Control header.
+func httpCachePublic(header http.Header) bool {
+	_, ok := httpCacheControl(header)["public"]
+	return ok
+}
+
+// httpCacheStorable returns whether the response to the
+// request could be stored in the cache.
+func httpCacheStorable(private bool, response *httpRawResponse) bool {
+	if response.statusCode != http.StatusOK {
+		return false
+	}
+	directives := httpCacheControl(response.header)
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["private"]; ok {
+		return false
+	}
+	if private && !httpCachePublic(response.header) {
+		return false
+	}
+	for _, name := range httpCacheVary(response.header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// freshness returns the freshness lifetime of the entry.
+func (e *httpCacheEntry) freshness() time.Duration {
+	directives := httpCacheControl(e.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	if arg, ok := directives["max-age"]; ok {
+		seconds, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	// Fallback to the Expires header relative to Date.
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.StoredAt
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return expiresAt.Sub(date)
+	}
+
+	// Estimate the lifetime from the Last-Modified header
+	// as 10% of the time since the last modification.
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil || !lastModified.Before(date) {
+		return 0
+	}
+	heuristic := date.Sub(lastModified) / 10
+	if heuristic > httpCacheHeuristicMax {
+		heuristic = httpCacheHeuristicMax
+	}
+	return heuristic
+}
+
+// fresh returns whether the entry could be served without
+// being validated by the server.
+func (e *httpCacheEntry) fresh(now time.Time) bool {
+	return now.Sub(e.StoredAt) < e.freshness()
+}
+
+// newHttpCacheEntry creates the cache entry of response.
+func newHttpCacheEntry(response *httpRawResponse, now time.Time) *httpCacheEntry {
+	storedAt := now
+	if age, err := strconv.ParseInt(
+		response.header.Get("Age"), 10, 64); err == nil && age > 0 {
+		storedAt = now.Add(-time.Duration(age) * time.Second)
+	}
+	return &httpCacheEntry{
+		URL:        response.url,
+		StatusCode: response.statusCode,
+		Status:     response.status,
+		Header:     response.header,
+		Vary:       httpCacheVary(response.header),
+		StoredAt:   storedAt,
+	}
+}
+
+// matches returns whether the entry could be served to the
+// request varying by the names loaded from the index.
+func (e *httpCacheEntry) matches(private bool, vary []string) bool {
+	if private && !httpCachePublic(e.Header) {
+		return false
+	}
+	if len(e.Vary) != len(vary) {
+		return false
+	}
+	for i := range vary {
+		if e.Vary[i] != vary[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// response creates the response served from the cache.
+func (e *httpCacheEntry) response(body []byte, stale bool) *httpRawResponse {
+	return &httpRawResponse{
+		status:     e.Status,
+		statusCode: e.StatusCode,
+		header:     e.Header,
+		body:       body,
+		url:        e.URL,
+		cached:     true,
+		stale:      stale,
+	}
+}
+
+// fetch serves the request from the cache if the cached
+// response is fresh, otherwise the request is performed
+// conditionally, and the cached response is served when
+// the server responds 304 Not Modified, or the server is
+// unreachable. The error of updating the cache does not
+// fail the request, but is reported in the response.
+func (c *httpCache) fetch(
+	ctx context.Context, parsedRequest *httpRawRequest,
+) (*httpRawResponse, error) {
+	// The request might forbid the usage of cache.
+	requestDirectives := httpCacheControl(parsedRequest.header)
+	if _, ok := requestDirectives["no-store"]; ok {
+		return fetchHttpRaw(parsedRequest, parsedRequest.newRequest(ctx))
+	}
+	_, revalidate := requestDirectives["no-cache"]
+	if requestDirectives["max-age"] == "0" {
+		revalidate = true
+	}
+
+	// Attempt to serve the fresh response from cache,
+	// which is looked up by the names varied by the last
+	// response, and the request with credentials is only
+	// served by the public responses.
+	header := httpCacheRequestHeader(parsedRequest)
+	private := httpCachePrivate(header)
+	index := httpCacheKey(parsedRequest, header, nil)
+	vary := c.loadVary(index)
+	key := httpCacheKey(parsedRequest, header, vary)
+	entry, body, err := c.load(key)
+	if err != nil || !entry.matches(private, vary) {
+		entry = nil
+	}
+	if entry != nil && !revalidate && entry.fresh(time.Now()) {
+		return entry.response(body, false), nil
+	}
+
+	// Validate the cached response with the validators.
+	request := parsedRequest.newRequest(ctx)
+	if entry != nil {
+		request.Header = make(http.Header)
+		for k, v := range parsedRequest.header {
+			request.Header[k] = v
+		}
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get(
+			"Last-Modified"); lastModified != "" {
+			request.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	response, err := fetchHttpRaw(parsedRequest, request)
+	if err != nil {
+		// Serve the stale response when the server is
+		// unreachable, unless the task is canceled.
+		if entry != nil && ctx.Err() == nil {
+			return entry.response(body, true), nil
+		}
+		return nil, err
+	}
+
+	// Refresh the cached response if it is not modified.
+	now := time.Now()
+	if entry != nil && response.statusCode == http.StatusNotModified {
+		updated := newHttpCacheEntry(response, now)
+		merged := make(http.Header)
+		for k, v := range entry.Header {
+			merged[k] = v
+		}
+		for k, v := range response.header {
+			if k != "Content-Length" {
+				merged[k] = v
+			}
+		}
+		entry.Header = merged
+		entry.StoredAt = updated.StoredAt
+		result := entry.response(body, false)
+		result.cacheErr = c.storeEntry(key, entry)
+		return result, nil
+	}
+
+	// Store the response if it could be cached, under the
+	// key folding the names varied by the response.
+	if httpCacheStorable(private, response) {
+		entry := newHttpCacheEntry(response, now)
+		response.cacheErr = c.storeVary(index, entry.Vary)
+		if response.cacheErr == nil {
+			response.cacheErr = c.store(httpCacheKey(
+				parsedRequest, header, entry.Vary), entry, response.body)
+		}
+	}
+	return response, nil
+}
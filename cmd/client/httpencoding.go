@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// httpAcceptEncoding is the Accept-Encoding header sent when
+// the response is decompressed transparently.
+const httpAcceptEncoding = "gzip, deflate, br, zstd"
+
+// httpDecodeLimitDefault is the default maximum size of the
+// decompressed response body.
+const httpDecodeLimitDefault = 64 << 20
+
+// httpDecodeLimitValue is the maximum size of decompressed
+// response body, it must be accessed atomically.
+var httpDecodeLimitValue int64 = httpDecodeLimitDefault
+
+// httpDecodeLimit returns the maximum size of decompressed
+// response body, so that a decompression bomb would fail
+// the request instead of exhausting the memory.
+func httpDecodeLimit() int64 {
+	return atomic.LoadInt64(&httpDecodeLimitValue)
+}
+
+// httpResponseHasBody returns whether the response could
+// carry a body to decode. The responses to HEAD, and the
+// 204 and 304 responses never carry a body, even if they
+// report the Content-Encoding of the resource.
+func httpResponseHasBody(method string, statusCode int, body []byte) bool {
+	if len(body) == 0 || method == http.MethodHead {
+		return false
+	}
+	return statusCode != http.StatusNoContent &&
+		statusCode != http.StatusNotModified
+}
+
+// httpEncodingWriter creates the writer that compresses
+// the content written into the underlying writer.
+type httpEncodingWriter func(io.Writer) (io.WriteCloser, error)
+
+// httpEncodingWriters are the supported content encodings
+// for compressing the request body.
+var httpEncodingWriters = map[string]httpEncodingWriter{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	"deflate": func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	},
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriter(w), nil
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+}
+
+// httpZstdReadCloser adapts the zstd decoder whose Close
+// method does not return error.
+type httpZstdReadCloser struct {
+	*zstd.Decoder
+}
+
+// Close implements io.Closer for httpZstdReadCloser.
+func (r httpZstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// newHttpDecodingReader creates the reader decompressing
+// the content of the specified encoding.
+func newHttpDecodingReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Though deflate should be zlib wrapped, some of
+		// the servers send raw deflate stream instead.
+		buffered := bufio.NewReader(r)
+		header, err := buffered.Peek(2)
+		if err == nil && header[0]&0x0f == 8 &&
+			(uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return httpZstdReadCloser{decoder}, nil
+	case "identity":
+		return ioutil.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// httpContentEncodings parses the Content-Encoding header
+// into the encodings in the order they are applied.
+func httpContentEncodings(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" {
+				result = append(result, encoding)
+			}
+		}
+	}
+	return result
+}
+
+// httpDecodeBody decompresses the body of the specified
+// encodings, which are undone in the reverse order. Each
+// decoded body must not exceed the limit.
+func httpDecodeBody(encodings []string, body []byte, limit int64) ([]byte, error) {
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader, err := newHttpDecodingReader(
+			encodings[i], bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+		_ = reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(decoded)) > limit {
+			return nil, fmt.Errorf(
+				"decoded body exceeds %d bytes", limit)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+// httpTransferSize records the size of a body before and
+// after it has been compressed, the fields must be accessed
+// atomically since the body might be streamed.
+type httpTransferSize struct {
+	// encoding of the body, empty if not compressed.
+	encoding string
+
+	// size of the body before compression.
+	size int64
+
+	// compressed is the size of body on the wire.
+	compressed int64
+}
+
+// marshal the transfer size as a table on the lua stack.
+func (s *httpTransferSize) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 3)
+	luaStringPush(L, "encoding")
+	if s.encoding != "" {
+		luaStringPush(L, s.encoding)
+	} else {
+		luaStringPush(L, "identity")
+	}
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "size")
+	luaNumberPush(L, float64(atomic.LoadInt64(&s.size)))
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "compressed")
+	luaNumberPush(L, float64(atomic.LoadInt64(&s.compressed)))
+	luaTableRawSet(L, -3)
+}
+
+// httpCountingReader counts the bytes read from the reader.
+type httpCountingReader struct {
+	// reader is the underlying reader.
+	reader io.Reader
+
+	// count is the number of bytes read.
+	count *int64
+}
+
+// Read implements io.Reader for httpCountingReader.
+func (r *httpCountingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// httpCountingBody counts the size of the request body
+// which is not compressed.
+type httpCountingBody struct {
+	io.ReadCloser
+
+	// size records the size of the body.
+	size *httpTransferSize
+}
+
+// Read implements io.Reader for httpCountingBody.
+func (b *httpCountingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.size.size, int64(n))
+	atomic.AddInt64(&b.size.compressed, int64(n))
+	return n, err
+}
+
+// httpCompressedBody is the request body compressed while
+// it is being read, recording the size of the body.
+type httpCompressedBody struct {
+	// source is the uncompressed body.
+	source io.ReadCloser
+
+	// encoding of the compressed body.
+	encoding string
+
+	// size records the size of the body.
+	size *httpTransferSize
+
+	// reader and writer ends of the encoding pipe.
+	reader *io.PipeReader
+	pipe   *io.PipeWriter
+
+	// startOnce ensures the encoder starts only once.
+	startOnce sync.Once
+}
+
+// newHttpCompressedBody creates the body compressing the
+// source body with the specified encoding.
+func newHttpCompressedBody(
+	source io.ReadCloser, encoding string, size *httpTransferSize,
+) (*httpCompressedBody, error) {
+	if _, ok := httpEncodingWriters[encoding]; !ok {
+		return nil, fmt.Errorf("unsupported compress encoding %q", encoding)
+	}
+	reader, pipe := io.Pipe()
+	return &httpCompressedBody{
+		source:   source,
+		encoding: encoding,
+		size:     size,
+		reader:   reader,
+		pipe:     pipe,
+	}, nil
+}
+
+// encode compresses the source body into the pipe.
+func (b *httpCompressedBody) encode() error {
+	defer func() { _ = b.source.Close() }()
+	writer, err := httpEncodingWriters[b.encoding](b.pipe)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, &httpCountingReader{
+		reader: b.source,
+		count:  &b.size.size,
+	}); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Read implements io.Reader for httpCompressedBody, the
+// encoder starts on the first read of the body.
+func (b *httpCompressedBody) Read(p []byte) (int, error) {
+	b.startOnce.Do(func() {
+		go func() {
+			_ = b.pipe.CloseWithError(b.encode())
+		}()
+	})
+	n, err := b.reader.Read(p)
+	atomic.AddInt64(&b.size.compressed, int64(n))
+	return n, err
+}
+
+// Close implements io.Closer for httpCompressedBody, the
+// encoder is interrupted if it is running.
+func (b *httpCompressedBody) Close() error {
+	return b.reader.Close()
+}
+
+// httpCompressBytes compresses the in-memory body with the
+// specified encoding.
+func httpCompressBytes(encoding string, body []byte) ([]byte, error) {
+	newWriter, ok := httpEncodingWriters[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compress encoding %q", encoding)
+	}
+	var buffer bytes.Buffer
+	writer, err := newWriter(&buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
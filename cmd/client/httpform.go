@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// httpFormFile is a file part in the http form, whose
+// content is either in memory or streamed from disk.
+type httpFormFile struct {
+	// filename reported in the Content-Disposition.
+	filename string
+
+	// contentType of the file part.
+	contentType string
+
+	// path of the file to stream the content from, and
+	// the content is used instead when it is empty.
+	path string
+
+	// content of the file part that is in memory.
+	content []byte
+}
+
+// httpFormField is a field in the http form.
+type httpFormField struct {
+	// name of the field.
+	name string
+
+	// value of the field if it is a text field.
+	value string
+
+	// file of the field if it is a file part.
+	file *httpFormFile
+}
+
+// httpForm is the form parsed from the request table.
+type httpForm struct {
+	// fields are the fields of the form, sorted by name
+	// so that the encoded body is reproducible.
+	fields []httpFormField
+}
+
+// luaReadHttpFormFile attempts to read the file part table
+// at the specified index.
+func luaReadHttpFormFile(L *C.lua_State, idx int) (*httpFormFile, error) {
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if idx < 0 {
+		idx = stackTop + idx + 1
+	}
+	result := &httpFormFile{}
+
+	// Attempt to fetch the path or content of the file.
+	luaStringPush(L, "path")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeString {
+		result.path = luaStringGet(L, -1)
+	}
+	luaStackPop(L, 1)
+	luaStringPush(L, "content")
+	luaTableRawGet(L, idx)
+	hasContent := luaTypeOf(L, -1) == luaTypeString
+	if hasContent {
+		result.content = luaBytesGet(L, -1)
+	}
+	luaStackPop(L, 1)
+	if (result.path == "") == !hasContent {
+		return nil, errors.New(
+			"file part requires either path or content")
+	}
+
+	// Ensure the file exists before uploading, so that
+	// the error could be reported as early as possible.
+	if result.path != "" {
+		if _, err := os.Stat(result.path); err != nil {
+			return nil, err
+		}
+		result.filename = filepath.Base(result.path)
+	}
+
+	// Attempt to fetch the filename and content type.
+	luaStringPush(L, "filename")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeString {
+		result.filename = luaStringGet(L, -1)
+	}
+	luaStackPop(L, 1)
+	result.contentType = "application/octet-stream"
+	luaStringPush(L, "type")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeString {
+		result.contentType = luaStringGet(L, -1)
+	}
+	luaStackPop(L, 1)
+	return result, nil
+}
+
+// luaReadHttpFormValue attempts to read a single value of
+// the form field, which is either a string or file part.
+func luaReadHttpFormValue(
+	L *C.lua_State, name string, idx int,
+) (httpFormField, error) {
+	switch luaTypeOf(L, idx) {
+	case luaTypeString, luaTypeNumber:
+		return httpFormField{
+			name:  name,
+			value: luaStringGet(L, idx),
+		}, nil
+	case luaTypeTable:
+		file, err := luaReadHttpFormFile(L, idx)
+		if err != nil {
+			return httpFormField{}, fmt.Errorf(
+				"invalid form item[%s]: %s", name, err)
+		}
+		return httpFormField{name: name, file: file}, nil
+	default:
+		return httpFormField{}, fmt.Errorf(
+			"invalid form item[%s]", name)
+	}
+}
+
+// luaReadHttpForm attempts to read the form table at the
+// specified index. Each value could be a string, a file
+// part table, or an array of them for repeated fields.
+func luaReadHttpForm(L *C.lua_State, idx int) (*httpForm, error) {
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if idx < 0 {
+		idx = stackTop + idx + 1
+	}
+
+	// Attempt to visit all table entries in the map.
+	result := &httpForm{}
+	luaNilPush(L)
+	for luaTableNext(L, idx) {
+		if luaTypeOf(L, -2) != luaTypeString {
+			return nil, errors.New("invalid form key")
+		}
+		name := luaStringGet(L, -2)
+
+		// A table without the file part fields is
+		// treated as an array of values.
+		isArray := false
+		if luaTypeOf(L, -1) == luaTypeTable {
+			luaTableRawGeti(L, -1, 1)
+			isArray = luaTypeOf(L, -1) != luaTypeNil
+			luaStackPop(L, 1)
+		}
+		if !isArray {
+			field, err := luaReadHttpFormValue(L, name, -1)
+			if err != nil {
+				return nil, err
+			}
+			result.fields = append(result.fields, field)
+			luaStackPop(L, 1)
+			continue
+		}
+		for i := 1; ; i++ {
+			luaTableRawGeti(L, -1, i)
+			if luaTypeOf(L, -1) == luaTypeNil {
+				luaStackPop(L, 1)
+				break
+			}
+			field, err := luaReadHttpFormValue(L, name, -1)
+			if err != nil {
+				return nil, err
+			}
+			result.fields = append(result.fields, field)
+			luaStackPop(L, 1)
+		}
+		luaStackPop(L, 1)
+	}
+
+	// Sort the fields by name since the order of table
+	// visiting is not defined.
+	sort.SliceStable(result.fields, func(i, j int) bool {
+		return result.fields[i].name < result.fields[j].name
+	})
+	return result, nil
+}
+
+// httpFormURLEncoded and httpFormMultipart are the content
+// types that the form could be encoded as.
+const (
+	httpFormURLEncoded = "application/x-www-form-urlencoded"
+	httpFormMultipart  = "multipart/form-data"
+)
+
+// encodeURL encodes the form in the url encoded form, the
+// repeated fields are encoded as repeated keys.
+func (f *httpForm) encodeURL() (string, error) {
+	var builder strings.Builder
+	for i, field := range f.fields {
+		if field.file != nil {
+			return "", fmt.Errorf(
+				"unexpected file part in item[%s]", field.name)
+		}
+		if i > 0 {
+			builder.WriteByte('&')
+		}
+		builder.WriteString(url.QueryEscape(field.name))
+		builder.WriteByte('=')
+		builder.WriteString(url.QueryEscape(field.value))
+	}
+	return builder.String(), nil
+}
+
+// httpFormEscaper escapes the quoted names in the header.
+var httpFormEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// writeMultipart encodes the form into the multipart writer,
+// file parts on disk are streamed into the writer.
+func (f *httpForm) writeMultipart(w *multipart.Writer) error {
+	for _, field := range f.fields {
+		if field.file == nil {
+			if err := w.WriteField(field.name, field.value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Create the file part with its content type.
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(
+			`form-data; name="%s"; filename="%s"`,
+			httpFormEscaper.Replace(field.name),
+			httpFormEscaper.Replace(field.file.filename)))
+		header.Set("Content-Type", field.file.contentType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if field.file.path == "" {
+			if _, err := part.Write(field.file.content); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := func() error {
+			file, err := os.Open(field.file.path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = file.Close() }()
+			_, err = io.Copy(part, file)
+			return err
+		}(); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// httpMultipartBody is the request body which encodes the
+// form as multipart/form-data while it is being read.
+type httpMultipartBody struct {
+	// form to encode into the body.
+	form *httpForm
+
+	// reader and writer ends of the encoding pipe.
+	reader *io.PipeReader
+	writer *multipart.Writer
+	pipe   *io.PipeWriter
+
+	// startOnce ensures the encoder starts only once.
+	startOnce sync.Once
+}
+
+// newHttpMultipartBody creates the body for uploading the
+// form, returning the body and its content type.
+func newHttpMultipartBody(form *httpForm) (*httpMultipartBody, string) {
+	reader, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	return &httpMultipartBody{
+		form:   form,
+		reader: reader,
+		writer: writer,
+		pipe:   pipe,
+	}, writer.FormDataContentType()
+}
+
+// Read implements io.Reader for httpMultipartBody, the
+// encoder starts on the first read of the body.
+func (b *httpMultipartBody) Read(p []byte) (int, error) {
+	b.startOnce.Do(func() {
+		go func() {
+			_ = b.pipe.CloseWithError(b.form.writeMultipart(b.writer))
+		}()
+	})
+	return b.reader.Read(p)
+}
+
+// Close implements io.Closer for httpMultipartBody, the
+// encoder is interrupted if it is running.
+func (b *httpMultipartBody) Close() error {
+	return b.reader.Close()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 /*
@@ -10,24 +12,39 @@ import (
 */
 import "C"
 
-// luaPushHttpHeader pushes HTTP header onto stack top.
-func luaPushHttpHeader(L *C.lua_State, hdr http.Header) {
+// luaPushHttpHeader pushes HTTP header onto stack top. Each
+// key maps to the canonical single string joined by comma
+// when single is specified, or to an array of its values.
+func luaPushHttpHeader(L *C.lua_State, hdr http.Header, single bool) {
 	// Pushes a new table on the stack first.
-	luaTableNew(L, 0, 0)
+	luaTableNew(L, 0, len(hdr))
 	if hdr == nil {
 		return
 	}
 
 	// Pushes all keys in the header to the stack.
-	for k := range hdr {
+	for k, values := range hdr {
 		luaStringPush(L, k)
-		luaStringPush(L, hdr.Get(k))
+		if single {
+			luaStringPush(L, strings.Join(values, ", "))
+		} else {
+			luaTableNew(L, len(values), 0)
+			for i, value := range values {
+				luaStringPush(L, value)
+				luaTableRawSeti(L, -2, i+1)
+			}
+		}
 		luaTableRawSet(L, -3)
 	}
 }
 
+// luaHttpHeaderOptions limits the header table to the keys
+// mapping to strings or arrays of strings.
+var luaHttpHeaderOptions = luaValueOptions{maxDepth: 2}
+
 // luaReadHttpHeader attempts to read the conten specified
-// by stack index into the http request.
+// by stack index into the http request. Each value could be
+// either a string, or an array of strings for repeated keys.
 func luaReadHttpHeader(L *C.lua_State, idx int) (http.Header, error) {
 	// Ensures the table to visit is of valid type.
 	result := make(http.Header)
@@ -42,29 +59,36 @@ func luaReadHttpHeader(L *C.lua_State, idx int) (http.Header, error) {
 			"invalid header %s", luaStringGet(L, idx))
 	}
 
-	// Save the stack index for resuming after returning.
-	stackTop := luaStackTopGet(L)
-	defer luaStackTopSet(L, stackTop)
-
-	// Reverse the direction of stack indexing since
-	// we will be using minus index while reading,
-	// causing wrong table to be accessed.
-	if idx < 0 {
-		idx = stackTop + idx + 1
+	// Convert the table and add all entries into header.
+	value, err := luaValueGet(L, idx, &luaHttpHeaderOptions)
+	if err != nil {
+		return nil, err
 	}
-
-	// Attempt to visit all table entries in the map.
-	luaNilPush(L)
-	for luaTableNext(L, idx) {
-		key := luaStringGet(L, -2)
-		value := luaStringGet(L, -1)
-		if luaTypeOf(L, -2) != luaTypeString &&
-			luaTypeOf(L, -1) != luaTypeString {
+	entries, ok := value.(luaValueMap)
+	if !ok {
+		return nil, errors.New("invalid header key")
+	}
+	for _, entry := range entries {
+		key, ok := entry.key.(string)
+		if !ok {
+			return nil, errors.New("invalid header key")
+		}
+		switch values := entry.value.(type) {
+		case string:
+			result.Add(key, values)
+		case []interface{}:
+			for i, item := range values {
+				value, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf(
+						"invalid header item[%s][%d]", key, i+1)
+				}
+				result.Add(key, value)
+			}
+		default:
 			return nil, fmt.Errorf(
-				"invalid header item[%s] = %s", key, value)
+				"invalid header item[%s]", key)
 		}
-		result.Set(key, value)
-		luaStackPop(L, 1)
 	}
 	return result, nil
 }
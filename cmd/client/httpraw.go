@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 /*
@@ -15,7 +18,11 @@ import (
 import "C"
 
 // rawClient is the tcp client which is shared among raw requests.
-var rawClient http.Client
+var rawClient = http.Client{
+	Transport:     rawTransport,
+	Jar:           rawCookies,
+	CheckRedirect: rawCheckRedirect,
+}
 
 // httpRawResponse is the task result which should be written back
 // to the caller side for reading.
@@ -34,11 +41,44 @@ type httpRawResponse struct {
 
 	// body of the response that is received.
 	body []byte
+
+	// url is the final url of the response.
+	url string
+
+	// redirects are the urls redirected to in order.
+	redirects []string
+
+	// cached indicates the body is served from cache.
+	cached bool
+
+	// stale indicates the cached response is served
+	// without being validated by the server.
+	stale bool
+
+	// uploadSize records the size of the request body,
+	// nil if there's no request body.
+	uploadSize *httpTransferSize
+
+	// downloadSize records the size of the response body,
+	// nil if the response is served from cache.
+	downloadSize *httpTransferSize
+
+	// protocol of the response like HTTP/2.0, empty if
+	// the response is served from cache.
+	protocol string
+
+	// reused indicates the response is received over a
+	// connection that has been used by previous requests.
+	reused bool
+
+	// cacheErr is the error of storing the response into
+	// the http cache, which does not fail the request.
+	cacheErr error
 }
 
 // marshal the http response back to the lua side.
-func (r httpRawResponse) marshal(L *C.lua_State) {
-	luaTableNew(L, 0, 3)
+func (r *httpRawResponse) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 13)
 
 	// Set the result.code field.
 	luaStringPush(L, "code")
@@ -50,123 +90,497 @@ func (r httpRawResponse) marshal(L *C.lua_State) {
 	luaStringPush(L, r.status)
 	luaTableRawSet(L, -3)
 
-	// Set the result.header field.
+	// Set the result.header and result.headers field.
 	luaStringPush(L, "header")
-	luaPushHttpHeader(L, r.header)
+	luaPushHttpHeader(L, r.header, true)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "headers")
+	luaPushHttpHeader(L, r.header, false)
 	luaTableRawSet(L, -3)
 
 	// Set the result.body field.
 	luaStringPush(L, "body")
 	luaBytesPush(L, r.body)
 	luaTableRawSet(L, -3)
+
+	// Set the result.url field.
+	luaStringPush(L, "url")
+	luaStringPush(L, r.url)
+	luaTableRawSet(L, -3)
+
+	// Set the result.redirects field.
+	luaStringPush(L, "redirects")
+	luaTableNew(L, len(r.redirects), 0)
+	for i, redirect := range r.redirects {
+		luaStringPush(L, redirect)
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaTableRawSet(L, -3)
+
+	// Set the result.cached and result.stale field.
+	luaStringPush(L, "cached")
+	luaBooleanPush(L, r.cached)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "stale")
+	luaBooleanPush(L, r.stale)
+	luaTableRawSet(L, -3)
+
+	// Set the result.compression field.
+	luaStringPush(L, "compression")
+	luaTableNew(L, 0, 2)
+	if r.uploadSize != nil {
+		luaStringPush(L, "request")
+		r.uploadSize.marshal(L)
+		luaTableRawSet(L, -3)
+	}
+	if r.downloadSize != nil {
+		luaStringPush(L, "response")
+		r.downloadSize.marshal(L)
+		luaTableRawSet(L, -3)
+	}
+	luaTableRawSet(L, -3)
+
+	// Set the result.protocol and result.reused field.
+	if r.protocol != "" {
+		luaStringPush(L, "protocol")
+		luaStringPush(L, r.protocol)
+		luaTableRawSet(L, -3)
+	}
+	luaStringPush(L, "reused")
+	luaBooleanPush(L, r.reused)
+	luaTableRawSet(L, -3)
+
+	// Set the result.cacheerror field if any.
+	if r.cacheErr != nil {
+		luaStringPush(L, "cacheerror")
+		luaStringPush(L, r.cacheErr.Error())
+		luaTableRawSet(L, -3)
+	}
 }
 
-//export luatc_httpraw
-func luatc_httpraw(L *C.lua_State) C.int {
+// httpRawRequest is the request parsed from the argument
+// table of client.httpraw and its variants.
+type httpRawRequest struct {
+	// method of the request, like GET, POST.
+	method string
+
+	// url of the request to access.
+	url *url.URL
+
+	// header of the request to send.
+	header http.Header
+
+	// body of the request, nil when there's no body.
+	body io.ReadCloser
+
+	// contentLength is the length of the request body.
+	contentLength int64
+
+	// redirectMode is how the redirects are followed.
+	redirectMode httpRedirectMode
+
+	// maxRedirects is the maximum number of redirects.
+	maxRedirects int
+
+	// useCache indicates the request could be served by
+	// the http cache when it is configured.
+	useCache bool
+
+	// decompress indicates the response body should be
+	// decompressed transparently.
+	decompress bool
+
+	// uploadSize records the size of the request body.
+	uploadSize *httpTransferSize
+}
+
+// luaReadHttpRawRequest attempts to read the request table
+// at the specified index, which is the argument passed to
+// client.httpraw and its variants.
+func luaReadHttpRawRequest(L *C.lua_State, idx int) (*httpRawRequest, error) {
 	// Make sure that the fields are valid for returning first.
-	if luaTypeOf(L, 1) != luaTypeTable {
-		luaNilPush(L)
-		luaStringPush(L, "missing table argument")
-		return C.int(2)
+	if luaTypeOf(L, idx) != luaTypeTable {
+		return nil, errors.New("missing table argument")
+	}
+	result := &httpRawRequest{}
+
+	// Save the stack index for resuming after returning.
+	stackTop := luaStackTopGet(L)
+	defer luaStackTopSet(L, stackTop)
+	if idx < 0 {
+		idx = stackTop + idx + 1
 	}
 
-	// Attempt to fetch the request method.
-	parsedMethod := "GET"
+	// Attempt to fetch the request method, which will be
+	// defaulted after the body has been determined.
 	luaStringPush(L, "method")
-	luaTableRawGet(L, 1)
+	luaTableRawGet(L, idx)
 	if luaTypeOf(L, -1) == luaTypeString {
-		parsedMethod = luaStringGet(L, -1)
+		result.method = luaStringGet(L, -1)
 	}
 	luaStackPop(L, 1)
 
 	// Attempt to fetch the url field from the table.
 	luaStringPush(L, "url")
-	luaTableRawGet(L, 1)
+	luaTableRawGet(L, idx)
 	if luaTypeOf(L, -1) != luaTypeString {
-		luaNilPush(L)
-		luaStringPush(L, "missing url argument")
-		return C.int(2)
+		return nil, errors.New("missing url argument")
 	}
 	argumentURL := luaStringGet(L, -1)
 	luaStackPop(L, 1)
 
 	// Attempt to parse the URL given at index.
-	parsedURL, urlErr := url.Parse(argumentURL)
-	if urlErr != nil {
-		luaNilPush(L)
-		luaStringPush(L, urlErr.Error())
-		return C.int(2)
+	parsedURL, err := url.Parse(argumentURL)
+	if err != nil {
+		return nil, err
+	}
+	result.url = parsedURL
+
+	// Attempt to merge the query table into the url, the
+	// query already in the url is kept unchanged.
+	luaStringPush(L, "query")
+	luaTableRawGet(L, idx)
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeTable {
+		parsedQuery, err := luaReadHttpForm(L, -1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %s", err)
+		}
+		encodedQuery, err := parsedQuery.encodeURL()
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %s", err)
+		}
+		if parsedURL.RawQuery != "" && encodedQuery != "" {
+			parsedURL.RawQuery += "&"
+		}
+		parsedURL.RawQuery += encodedQuery
+	} else if typeOf != luaTypeNil {
+		return nil, errors.New("invalid query argument")
 	}
+	luaStackPop(L, 1)
 
 	// Attempt to parse the http header at index.
 	luaStringPush(L, "header")
-	luaTableRawGet(L, 1)
-	parsedHeader, headerErr := luaReadHttpHeader(L, -1)
+	luaTableRawGet(L, idx)
+	parsedHeader, err := luaReadHttpHeader(L, -1)
 	luaStackPop(L, 1)
-	if headerErr != nil {
-		luaNilPush(L)
-		luaStringPush(L, headerErr.Error())
-		return C.int(2)
+	if err != nil {
+		return nil, err
+	}
+	result.header = parsedHeader
+
+	// Attempt to fetch the redirect policy of request.
+	result.redirectMode = httpRedirectFollow
+	luaStringPush(L, "redirect")
+	luaTableRawGet(L, idx)
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeString {
+		result.redirectMode, err = parseHttpRedirectMode(
+			luaStringGet(L, -1))
+		if err != nil {
+			return nil, err
+		}
+	} else if typeOf != luaTypeNil {
+		return nil, errors.New("invalid redirect argument")
+	}
+	luaStackPop(L, 1)
+	result.maxRedirects = httpRedirectDefaultHops
+	luaStringPush(L, "maxredirects")
+	luaTableRawGet(L, idx)
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeNumber {
+		result.maxRedirects = int(luaNumberGet(L, -1))
+		if result.maxRedirects < 0 {
+			return nil, errors.New("invalid maxredirects argument")
+		}
+	} else if typeOf != luaTypeNil {
+		return nil, errors.New("invalid maxredirects argument")
 	}
+	luaStackPop(L, 1)
+
+	// Attempt to fetch whether to use the http cache.
+	result.useCache = true
+	luaStringPush(L, "cache")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeBoolean {
+		result.useCache = luaBooleanGet(L, -1)
+	}
+	luaStackPop(L, 1)
 
 	// Attempt to read the body and place it into
 	// a byte buffer.
 	luaStringPush(L, "body")
-	luaTableRawGet(L, 1)
-	var body io.ReadCloser
-	var contentLength int64
+	luaTableRawGet(L, idx)
+	var buffer *bytes.Buffer
 	if luaTypeOf(L, -1) == luaTypeString {
 		// If there's body, copy the body into the
 		// buffer, otherwise just ignore the content.
-		var buffer bytes.Buffer
+		buffer = new(bytes.Buffer)
 		if _, err := buffer.WriteString(
 			luaStringGet(L, -1)); err != nil {
-			luaNilPush(L)
-			luaStringPush(L, err.Error())
-			return C.int(2)
+			return nil, err
 		}
-		contentLength = int64(buffer.Len())
-		body = ioutil.NopCloser(&buffer)
+		result.contentLength = int64(buffer.Len())
+		result.body = ioutil.NopCloser(buffer)
 	} else if luaTypeOf(L, -1) != luaTypeNil {
 		// Report error if the body type is not known.
-		luaNilPush(L)
-		luaStringPush(L, "unrecognized body type")
-		return C.int(2)
+		return nil, errors.New("unrecognized body type")
 	}
 	luaStackPop(L, 1)
 
-	// Create the request handle and return.
-	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
-		var err error
-
-		// Initialize the request with parsed arguments.
-		var request http.Request
-		request.Method = parsedMethod
-		request.URL = parsedURL
-		request.Header = parsedHeader
-		request.Body = body
-		request.ContentLength = contentLength
+	// Attempt to fetch the content type to encode the form,
+	// which is determined by the form fields if absent.
+	luaStringPush(L, "enctype")
+	luaTableRawGet(L, idx)
+	var enctype string
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeString {
+		enctype = luaStringGet(L, -1)
+		if enctype != httpFormURLEncoded && enctype != httpFormMultipart {
+			return nil, fmt.Errorf("invalid enctype %q", enctype)
+		}
+	} else if typeOf != luaTypeNil {
+		return nil, errors.New("invalid enctype argument")
+	}
+	luaStackPop(L, 1)
 
-		// Perform the task request with the raw client.
-		response, err := rawClient.Do(request.WithContext(ctx))
+	// Attempt to read the form and encode it as the body.
+	luaStringPush(L, "form")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeTable {
+		if result.body != nil {
+			return nil, errors.New("conflicting body and form")
+		}
+		parsedForm, err := luaReadHttpForm(L, -1)
 		if err != nil {
 			return nil, err
 		}
+		if enctype == "" {
+			enctype = httpFormMultipart
+		}
+		if enctype == httpFormURLEncoded {
+			// The url encoded body is placed in buffer,
+			// just like the string body.
+			encodedForm, err := parsedForm.encodeURL()
+			if err != nil {
+				return nil, fmt.Errorf("invalid form: %s", err)
+			}
+			buffer = bytes.NewBufferString(encodedForm)
+			result.header.Set("Content-Type", httpFormURLEncoded)
+			result.contentLength = int64(buffer.Len())
+			result.body = ioutil.NopCloser(buffer)
+		} else {
+			// The multipart body is streamed while uploading,
+			// so its length is unknown.
+			body, contentType := newHttpMultipartBody(parsedForm)
+			result.header.Set("Content-Type", contentType)
+			result.contentLength = -1
+			result.body = body
+		}
+		if result.method == "" {
+			result.method = "POST"
+		}
+	} else if luaTypeOf(L, -1) != luaTypeNil {
+		return nil, errors.New("invalid form argument")
+	}
+	luaStackPop(L, 1)
+	if result.method == "" {
+		result.method = "GET"
+	}
+
+	// Attempt to fetch the encoding to compress the body.
+	luaStringPush(L, "compress")
+	luaTableRawGet(L, idx)
+	var compress string
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeString {
+		compress = luaStringGet(L, -1)
+	} else if typeOf != luaTypeNil {
+		return nil, errors.New("invalid compress argument")
+	}
+	luaStackPop(L, 1)
+
+	// Compress the body and record the size of it, the
+	// in-memory body is compressed in advance so that its
+	// length is known, while the streamed body is counted
+	// as it is being uploaded.
+	if result.body != nil {
+		result.uploadSize = &httpTransferSize{encoding: compress}
+		if buffer != nil {
+			result.uploadSize.size = int64(buffer.Len())
+			if compress != "" {
+				compressed, err := httpCompressBytes(
+					compress, buffer.Bytes())
+				if err != nil {
+					return nil, err
+				}
+				buffer = bytes.NewBuffer(compressed)
+				result.body = ioutil.NopCloser(buffer)
+				result.contentLength = int64(buffer.Len())
+			}
+			result.uploadSize.compressed = int64(buffer.Len())
+		} else if compress != "" {
+			result.body, err = newHttpCompressedBody(
+				result.body, compress, result.uploadSize)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			result.body = &httpCountingBody{
+				ReadCloser: result.body,
+				size:       result.uploadSize,
+			}
+		}
+		if compress != "" {
+			result.header.Set("Content-Encoding", compress)
+		}
+	} else if compress != "" {
+		return nil, errors.New("compress requires body")
+	}
+
+	// Attempt to fetch whether to decompress the response.
+	result.decompress = true
+	luaStringPush(L, "decompress")
+	luaTableRawGet(L, idx)
+	if luaTypeOf(L, -1) == luaTypeBoolean {
+		result.decompress = luaBooleanGet(L, -1)
+	}
+	luaStackPop(L, 1)
+
+	// Only the plain GET requests could be cached.
+	if result.method != "GET" || result.body != nil {
+		result.useCache = false
+	}
+	return result, nil
+}
 
-		// Receive the response body and status from caller.
-		var receiver bytes.Buffer
-		_, err = io.Copy(&receiver, response.Body)
+// acceptEncoding returns the Accept-Encoding header sent
+// when it is not specified by the request.
+func (r *httpRawRequest) acceptEncoding() string {
+	if r.decompress {
+		return httpAcceptEncoding
+	}
+	return "identity"
+}
+
+// newRequest initializes the http request with the parsed
+// arguments, bound to the specified context.
+func (r *httpRawRequest) newRequest(ctx context.Context) *http.Request {
+	var request http.Request
+	request.Method = r.method
+	request.URL = r.url
+	request.Header = r.header
+	request.Body = r.body
+	request.ContentLength = r.contentLength
+	return request.WithContext(withHttpRedirectPolicy(ctx,
+		&httpRedirectPolicy{
+			mode:    r.redirectMode,
+			maxHops: r.maxRedirects,
+		}))
+}
+
+// fetchHttpRaw performs the request with the raw client,
+// and collects the whole response for returning.
+func fetchHttpRaw(
+	parsedRequest *httpRawRequest, request *http.Request,
+) (*httpRawResponse, error) {
+	var err error
+
+	// Negotiate the content encodings unless specified,
+	// which also prevents the transport from decoding the
+	// gzip response transparently.
+	if request.Header.Get("Accept-Encoding") == "" {
+		header := make(http.Header)
+		for k, v := range request.Header {
+			header[k] = v
+		}
+		header.Set("Accept-Encoding", parsedRequest.acceptEncoding())
+		request.Header = header
+	}
+
+	// Trace whether the connection is reused.
+	var reused bool
+	request = withHttpReusedTrace(request, &reused)
+
+	// Perform the task request with the raw client.
+	response, err := rawClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	// Receive the response body and status from caller.
+	var receiver bytes.Buffer
+	_, err = io.Copy(&receiver, response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress the response body if it is encoded, and
+	// the header should describe the decoded body then.
+	body := receiver.Bytes()
+	header := response.Header
+	downloadSize := &httpTransferSize{
+		size:       int64(len(body)),
+		compressed: int64(len(body)),
+	}
+	encodings := httpContentEncodings(header["Content-Encoding"])
+	if parsedRequest.decompress && len(encodings) > 0 &&
+		httpResponseHasBody(request.Method, response.StatusCode, body) {
+		body, err = httpDecodeBody(encodings, body, httpDecodeLimit())
 		if err != nil {
 			return nil, err
 		}
+		header = make(http.Header)
+		for k, v := range response.Header {
+			if k != "Content-Encoding" && k != "Content-Length" {
+				header[k] = v
+			}
+		}
+		downloadSize.encoding = strings.Join(encodings, ", ")
+		downloadSize.size = int64(len(body))
+	}
 
-		// Return the collected result to the caller.
-		return httpRawResponse{
-			status:     response.Status,
-			statusCode: response.StatusCode,
-			header:     response.Header,
-			body:       receiver.Bytes(),
-		}, nil
+	// Collect the urls that have been redirected to.
+	var redirects []string
+	for _, redirect := range httpRedirectChain(response) {
+		redirects = append(redirects, redirect.String())
+	}
+
+	// Return the collected result to the caller.
+	return &httpRawResponse{
+		status:       response.Status,
+		statusCode:   response.StatusCode,
+		header:       header,
+		body:         body,
+		url:          response.Request.URL.String(),
+		redirects:    redirects,
+		uploadSize:   parsedRequest.uploadSize,
+		downloadSize: downloadSize,
+		protocol:     response.Proto,
+		reused:       reused,
+	}, nil
+}
+
+//export luatc_httpraw
+func luatc_httpraw(L *C.lua_State) C.int {
+	// Attempt to parse the request from the argument.
+	parsedRequest, err := luaReadHttpRawRequest(L, 1)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Create the request handle and return.
+	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
+		var result *httpRawResponse
+		var err error
+		if rawCache.enabled() && parsedRequest.useCache {
+			result, err = rawCache.fetch(ctx, parsedRequest)
+		} else {
+			result, err = fetchHttpRaw(
+				parsedRequest, parsedRequest.newRequest(ctx))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
 	})
 	luaNilPush(L)
 	return C.int(2)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// httpRedirectDefaultHops is the maximum number of redirects
+// followed by default, which is the same as net/http.
+const httpRedirectDefaultHops = 10
+
+// httpRedirectMode is how the redirects are followed.
+type httpRedirectMode string
+
+const (
+	// httpRedirectFollow follows all redirects.
+	httpRedirectFollow = httpRedirectMode("follow")
+
+	// httpRedirectNone returns the redirect response
+	// without following it.
+	httpRedirectNone = httpRedirectMode("none")
+
+	// httpRedirectSameHost only follows the redirects to
+	// the same host of the original request, and returns
+	// the redirect response otherwise.
+	httpRedirectSameHost = httpRedirectMode("same-host")
+)
+
+// parseHttpRedirectMode validates the redirect mode.
+func parseHttpRedirectMode(mode string) (httpRedirectMode, error) {
+	switch result := httpRedirectMode(mode); result {
+	case httpRedirectFollow, httpRedirectNone, httpRedirectSameHost:
+		return result, nil
+	default:
+		return "", fmt.Errorf("invalid redirect mode %q", mode)
+	}
+}
+
+// httpRedirectPolicy is the policy of following redirects
+// for a single request, which also records the redirects.
+type httpRedirectPolicy struct {
+	// mode of following the redirects.
+	mode httpRedirectMode
+
+	// maxHops is the maximum number of redirects.
+	maxHops int
+
+	// chain is the urls redirected to in order.
+	chain []*url.URL
+}
+
+// httpRedirectContextKey is the key for retrieving the
+// redirect policy from the request context.
+type httpRedirectContextKey struct{}
+
+// withHttpRedirectPolicy binds the redirect policy to the
+// context of the request.
+func withHttpRedirectPolicy(
+	ctx context.Context, policy *httpRedirectPolicy,
+) context.Context {
+	return context.WithValue(ctx, httpRedirectContextKey{}, policy)
+}
+
+// httpRedirectChain returns the urls redirected to by the
+// response, in the order they have been visited.
+func httpRedirectChain(response *http.Response) []*url.URL {
+	policy, ok := response.Request.Context().Value(
+		httpRedirectContextKey{}).(*httpRedirectPolicy)
+	if !ok {
+		return nil
+	}
+	return policy.chain
+}
+
+// rawCheckRedirect is the redirect checker of rawClient,
+// which applies the policy bound to the request context.
+func rawCheckRedirect(req *http.Request, via []*http.Request) error {
+	policy, ok := req.Context().Value(
+		httpRedirectContextKey{}).(*httpRedirectPolicy)
+	if !ok {
+		policy = &httpRedirectPolicy{
+			mode:    httpRedirectFollow,
+			maxHops: httpRedirectDefaultHops,
+		}
+	}
+	switch policy.mode {
+	case httpRedirectNone:
+		return http.ErrUseLastResponse
+	case httpRedirectSameHost:
+		if req.URL.Host != via[0].URL.Host {
+			return http.ErrUseLastResponse
+		}
+	}
+	if len(via) > policy.maxHops {
+		return fmt.Errorf("stopped after %d redirects", policy.maxHops)
+	}
+	policy.chain = append(policy.chain, req.URL)
+	return nil
+}
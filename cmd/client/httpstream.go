@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// httpStreamChunkSize is the maximum size of each chunk
+// read from the response body.
+const httpStreamChunkSize = 32 * 1024
+
+// httpStreamChunkQueue is the maximum number of chunks
+// buffered before the lua side reads them, the reader
+// will be blocked when the queue is full.
+const httpStreamChunkQueue = 64
+
+// luaHttpStreamConn is a connection for reading the body
+// of a http response as the chunks arrive.
+type luaHttpStreamConn struct {
+	// response whose body is being streamed.
+	response *http.Response
+
+	// cancel function to abort the underlying request.
+	cancel context.CancelFunc
+
+	// reused indicates the response is received over a
+	// connection that has been used by previous requests.
+	reused bool
+
+	// received is the number of body bytes received,
+	// it must be accessed atomically.
+	received int64
+
+	// chunkCh is the channel of received body chunks,
+	// it is closed after the body has been consumed.
+	chunkCh chan httpStreamChunk
+
+	// receiveMtx is the mutex for blocking the receive.
+	receiveMtx sync.Mutex
+
+	// receiveErr is the error while running reader.
+	receiveErr error
+
+	// closeOnce ensures the connection closes once.
+	closeOnce sync.Once
+
+	// closeCh is the channel that is unblocked when
+	// the stream should close.
+	closeCh chan struct{}
+
+	// statistics of the chunks received.
+	statistics *luaConnStats
+}
+
+// httpStreamChunk is a chunk received from the body.
+type httpStreamChunk struct {
+	// data of the chunk.
+	data []byte
+
+	// received is the local time when it is received.
+	received time.Time
+}
+
+// runHttpStreamReader executes the body reader for a
+// http stream connection.
+func (s *luaHttpStreamConn) runHttpStreamReader() error {
+	defer func() { _ = s.response.Body.Close() }()
+	for {
+		// Attempt to read the next chunk of the body.
+		buf := make([]byte, httpStreamChunkSize)
+		n, err := s.response.Body.Read(buf)
+		if n > 0 {
+			atomic.AddInt64(&s.received, int64(n))
+			received := time.Now()
+			s.statistics.received(received, n)
+			select {
+			case s.chunkCh <- httpStreamChunk{data: buf[:n], received: received}:
+			case <-s.closeCh:
+				return nil
+			}
+		}
+
+		// The end of body is not treated as error.
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// luaHttpStreamReadResult is the chunks read using the
+// read interface of http stream connection.
+type luaHttpStreamReadResult struct {
+	// chunks are the received chunks of the body.
+	chunks [][]byte
+
+	// eof indicates the whole body has been read.
+	eof bool
+}
+
+// marshal the http stream read result to lua stack.
+func (r *luaHttpStreamReadResult) marshal(L *C.lua_State) {
+	luaTableNew(L, len(r.chunks), 1)
+	for i := 0; i < len(r.chunks); i++ {
+		luaBytesPush(L, r.chunks[i])
+		luaTableRawSeti(L, -2, i+1)
+	}
+	if r.eof {
+		luaStringPush(L, "eof")
+		luaBooleanPush(L, true)
+		luaTableRawSet(L, -3)
+	}
+}
+
+// read implements the luaConn.read for luaHttpStreamConn.
+func (s *luaHttpStreamConn) read() (luaReadResult, error) {
+	readResult := &luaHttpStreamReadResult{}
+	for len(readResult.chunks) < httpStreamChunkQueue {
+		select {
+		case chunk, ok := <-s.chunkCh:
+			if !ok {
+				s.receiveMtx.Lock()
+				defer s.receiveMtx.Unlock()
+				readResult.eof = s.receiveErr == nil
+				return readResult, s.receiveErr
+			}
+			readResult.chunks = append(readResult.chunks, chunk.data)
+			s.statistics.read(time.Now(), chunk.received)
+		default:
+			return readResult, nil
+		}
+	}
+	return readResult, nil
+}
+
+// write implements the luaConn.write for luaHttpStreamConn.
+func (s *luaHttpStreamConn) write(L *C.lua_State) error {
+	return errNotWritable
+}
+
+// close implements the luaConn.close for luaHttpStreamConn.
+func (s *luaHttpStreamConn) close() {
+	s.closeOnce.Do(func() {
+		s.statistics.close()
+		close(s.closeCh)
+		s.cancel()
+	})
+}
+
+// stats implements the luaConnStatter.stats for
+// luaHttpStreamConn.
+func (s *luaHttpStreamConn) stats() *luaConnStats {
+	return s.statistics
+}
+
+// luaHttpStreamInfo is the state of the http stream.
+type luaHttpStreamInfo struct {
+	// statusCode of the response.
+	statusCode int
+
+	// status string of the response.
+	status string
+
+	// header of the response that is received.
+	header http.Header
+
+	// received is the number of body bytes received.
+	received int64
+
+	// length is the content length of the response,
+	// and -1 when it is unknown.
+	length int64
+
+	// protocol of the response like HTTP/2.0.
+	protocol string
+
+	// reused indicates the response is received over a
+	// connection that has been used by previous requests.
+	reused bool
+}
+
+// marshal the http stream state to the lua stack.
+func (r *luaHttpStreamInfo) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 8)
+
+	// Set the result.code field.
+	luaStringPush(L, "code")
+	luaIntegerPush(L, r.statusCode)
+	luaTableRawSet(L, -3)
+
+	// Set the result.status field.
+	luaStringPush(L, "status")
+	luaStringPush(L, r.status)
+	luaTableRawSet(L, -3)
+
+	// Set the result.header and result.headers field.
+	luaStringPush(L, "header")
+	luaPushHttpHeader(L, r.header, true)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "headers")
+	luaPushHttpHeader(L, r.header, false)
+	luaTableRawSet(L, -3)
+
+	// Set the result.received field.
+	luaStringPush(L, "received")
+	luaNumberPush(L, float64(r.received))
+	luaTableRawSet(L, -3)
+
+	// Set the result.length field, which is left nil
+	// when the length is unknown.
+	if r.length >= 0 {
+		luaStringPush(L, "length")
+		luaNumberPush(L, float64(r.length))
+		luaTableRawSet(L, -3)
+	}
+
+	// Set the result.protocol and result.reused field.
+	luaStringPush(L, "protocol")
+	luaStringPush(L, r.protocol)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "reused")
+	luaBooleanPush(L, r.reused)
+	luaTableRawSet(L, -3)
+}
+
+// inspect implements the luaConnInspector.inspect for
+// luaHttpStreamConn.
+func (s *luaHttpStreamConn) inspect() luaReadResult {
+	return &luaHttpStreamInfo{
+		statusCode: s.response.StatusCode,
+		status:     s.response.Status,
+		header:     s.response.Header,
+		received:   atomic.LoadInt64(&s.received),
+		length:     s.response.ContentLength,
+		protocol:   s.response.Proto,
+		reused:     s.reused,
+	}
+}
+
+//export luatc_httpstream
+func luatc_httpstream(L *C.lua_State) C.int {
+	// Attempt to parse the request from the argument.
+	parsedRequest, err := luaReadHttpRawRequest(L, 1)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Create the request handle and return.
+	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
+		// The stream outlives the task once the header
+		// arrives, so the request is bound to its own
+		// context, which is only canceled by the task
+		// before the response has been received.
+		streamCtx, streamCancel := context.WithCancel(
+			context.Background())
+		establishedCh := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				streamCancel()
+			case <-establishedCh:
+			}
+		}()
+
+		// Perform the task request with the raw client,
+		// tracing whether the connection is reused.
+		var reused bool
+		response, err := rawClient.Do(withHttpReusedTrace(
+			parsedRequest.newRequest(streamCtx), &reused))
+		close(establishedCh)
+		if err != nil {
+			streamCancel()
+			return nil, err
+		}
+
+		// Create the connection instance and return.
+		result := &luaHttpStreamConn{
+			response:   response,
+			cancel:     streamCancel,
+			reused:     reused,
+			chunkCh:    make(chan httpStreamChunk, httpStreamChunkQueue),
+			closeCh:    make(chan struct{}),
+			statistics: newLuaConnStats(),
+		}
+		go func() {
+			err := result.runHttpStreamReader()
+			result.receiveMtx.Lock()
+			result.receiveErr = err
+			result.receiveMtx.Unlock()
+			close(result.chunkCh)
+		}()
+		return newLuaConnHandle(result), nil
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
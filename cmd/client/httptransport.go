@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// httpProtocol is the protocol negotiated by rawTransport.
+type httpProtocol string
+
+const (
+	// httpProtocolAuto negotiates HTTP/2 through TLS ALPN,
+	// and falls back to HTTP/1.1 otherwise.
+	httpProtocolAuto = httpProtocol("auto")
+
+	// httpProtocolHTTP2 requires HTTP/2, which is spoken
+	// with prior knowledge on the plain http urls.
+	httpProtocolHTTP2 = httpProtocol("http2")
+
+	// httpProtocolHTTP11 always speaks HTTP/1.1.
+	httpProtocolHTTP11 = httpProtocol("http1.1")
+)
+
+// parseHttpProtocol validates the protocol mode.
+func parseHttpProtocol(protocol string) (httpProtocol, error) {
+	switch result := httpProtocol(protocol); result {
+	case httpProtocolAuto, httpProtocolHTTP2, httpProtocolHTTP11:
+		return result, nil
+	default:
+		return "", fmt.Errorf("invalid protocol %q", protocol)
+	}
+}
+
+// httpTransportConfig is the tunable options of the
+// transport, defaulted the same as http.DefaultTransport.
+type httpTransportConfig struct {
+	// maxIdlePerHost is the maximum idle connections
+	// kept for each host.
+	maxIdlePerHost int
+
+	// idleTimeout is how long an idle connection is kept
+	// before it is closed, zero means no limit.
+	idleTimeout time.Duration
+
+	// protocol is the protocol mode of the transport.
+	protocol httpProtocol
+}
+
+// httpTransport is the round tripper of rawClient, which
+// is rebuilt when its configuration is updated.
+type httpTransport struct {
+	// mtx is the mutex for accessing the transport.
+	mtx sync.RWMutex
+
+	// config is the current configuration.
+	config httpTransportConfig
+
+	// transport is the round tripper for https urls.
+	transport http.RoundTripper
+
+	// plainTransport is the round tripper for http urls,
+	// which differs only when HTTP/2 is required.
+	plainTransport http.RoundTripper
+}
+
+// httpDialer is the dialer of the transport connections.
+var httpDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// httpDialPlain dials the plain http connection spoken by
+// HTTP/2 with prior knowledge, which is tunneled through
+// the proxy from environment with CONNECT if there's one.
+// The dial is bounded by the timeout of httpDialer, since
+// the http2.Transport does not pass the request context.
+func httpDialPlain(network, addr string) (net.Conn, error) {
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{
+		URL: &url.URL{Scheme: "http", Host: addr},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return httpDialer.Dial(network, addr)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := httpDialer.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := httpConnectProxy(conn, proxyURL, addr); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnectProxy establishes the tunnel to the address
+// through the proxy connection.
+func httpConnectProxy(conn net.Conn, proxyURL *url.URL, addr string) error {
+	if err := conn.SetDeadline(
+		time.Now().Add(httpDialer.Timeout)); err != nil {
+		return err
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		request.SetBasicAuth(user.Username(), password)
+		request.Header["Proxy-Authorization"] = request.Header["Authorization"]
+		delete(request.Header, "Authorization")
+	}
+	if err := request.Write(conn); err != nil {
+		return err
+	}
+
+	// The client speaks first after the tunnel is set up,
+	// so nothing is buffered beyond the response header,
+	// whose body is the tunnel and must not be drained.
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return fmt.Errorf("proxy refused tunnel: %s", response.Status)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// withHttpReusedTrace traces whether the connection of the
+// request has been reused into reused, which could be read
+// after the round trip. The last connection is reported
+// when there're redirects.
+func withHttpReusedTrace(request *http.Request, reused *bool) *http.Request {
+	return request.WithContext(httptrace.WithClientTrace(
+		request.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				*reused = info.Reused
+			},
+		}))
+}
+
+// rawTransport is the transport shared among raw requests.
+var rawTransport = newHttpTransport(httpTransportConfig{
+	maxIdlePerHost: http.DefaultMaxIdleConnsPerHost,
+	idleTimeout:    90 * time.Second,
+	protocol:       httpProtocolAuto,
+})
+
+// newHttpTransport creates the transport of configuration.
+func newHttpTransport(config httpTransportConfig) *httpTransport {
+	result := &httpTransport{}
+	result.build(config)
+	return result
+}
+
+// build replaces the round trippers with the ones of the
+// configuration, which must be called with mtx locked.
+func (t *httpTransport) build(config httpTransportConfig) {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           httpDialer.DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   config.maxIdlePerHost,
+		IdleConnTimeout:       config.idleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	var plainTransport http.RoundTripper = transport
+	switch config.protocol {
+	case httpProtocolHTTP11:
+		// A non-nil empty map disables the HTTP/2 upgrade.
+		transport.TLSClientConfig = &tls.Config{
+			NextProtos: []string{"http/1.1"},
+		}
+		transport.TLSNextProto = make(map[string]func(
+			string, *tls.Conn) http.RoundTripper)
+	case httpProtocolHTTP2:
+		// The plain http urls are accessed by a standalone
+		// HTTP/2 transport, which multiplexes the requests
+		// over a single connection of each host. It is kept
+		// until closed by the server or reconfigured, so
+		// maxIdlePerHost and idleTimeout do not apply.
+		_ = http2.ConfigureTransport(transport)
+		plainTransport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return httpDialPlain(network, addr)
+			},
+		}
+	default:
+		_ = http2.ConfigureTransport(transport)
+	}
+	t.config = config
+	t.transport = transport
+	t.plainTransport = plainTransport
+}
+
+// configure updates the configuration of the transport,
+// and the idle connections of previous one are closed.
+func (t *httpTransport) configure(update func(*httpTransportConfig)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	transport, plainTransport := t.transport, t.plainTransport
+	config := t.config
+	update(&config)
+	t.build(config)
+	httpCloseIdleConnections(transport)
+	httpCloseIdleConnections(plainTransport)
+}
+
+// httpCloseIdleConnections closes the idle connections
+// of the round tripper if it supports.
+func httpCloseIdleConnections(roundTripper http.RoundTripper) {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if closer, ok := roundTripper.(closeIdler); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// RoundTrip implements http.RoundTripper for httpTransport.
+func (t *httpTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.mtx.RLock()
+	protocol := t.config.protocol
+	roundTripper := t.transport
+	if request.URL.Scheme == "http" {
+		roundTripper = t.plainTransport
+	}
+	t.mtx.RUnlock()
+	response, err := roundTripper.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server might not agree on HTTP/2 in ALPN, and
+	// the response must be rejected then.
+	if protocol == httpProtocolHTTP2 && response.ProtoMajor != 2 {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf(
+			"server does not support http2, got %s", response.Proto)
+	}
+	return response, nil
+}
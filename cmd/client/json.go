@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaJsonOptions is the default options of json, where the
+// null is pushed as the null sentinel.
+var luaJsonOptions = luaValueOptions{
+	maxDepth: luaValueDefaultDepth,
+	null:     true,
+}
+
+// luaJsonObjectKey converts the key of table to the key
+// of json object.
+func luaJsonObjectKey(key interface{}) (string, error) {
+	switch key := key.(type) {
+	case float64:
+		if key == math.Trunc(key) && math.Abs(key) < 1e15 {
+			return strconv.FormatInt(int64(key), 10), nil
+		}
+		return strconv.FormatFloat(key, 'g', -1, 64), nil
+	case string:
+		return key, nil
+	default:
+		return "", errors.New("invalid object key")
+	}
+}
+
+// luaJsonValue converts the value returned by luaValueGet
+// into the value which could be encoded by encoding/json.
+func luaJsonValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("unsupported number %v", value)
+		}
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			var err error
+			if result[i], err = luaJsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case luaValueMap:
+		result := make(map[string]interface{}, len(value))
+		for _, pair := range value {
+			key, err := luaJsonObjectKey(pair.key)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := result[key]; ok {
+				return nil, fmt.Errorf("duplicate object key %q", key)
+			}
+			if result[key], err = luaJsonValue(pair.value); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+// luaReadJson converts the lua value at the specified index
+// into the go value to encode.
+func luaReadJson(
+	L *C.lua_State, idx int, options *luaValueOptions,
+) (interface{}, error) {
+	value, err := luaValueGet(L, idx, options)
+	if err != nil {
+		return nil, err
+	}
+	return luaJsonValue(value)
+}
+
+// encodeJson encodes the converted value as json text.
+func encodeJson(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// decodeJson decodes the json text into the go value, and
+// validates its depth so that it could be pushed safely.
+func decodeJson(data []byte, options *luaValueOptions) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after json value")
+	}
+	if err := luaValueDepthCheck(value, options.maxDepth); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// luaJsonDecoded is the decoded json value as task result.
+type luaJsonDecoded struct {
+	// value decoded whose depth has been validated.
+	value interface{}
+
+	// options to push the value.
+	options *luaValueOptions
+}
+
+// marshal the decoded json value to the lua stack.
+func (r *luaJsonDecoded) marshal(L *C.lua_State) {
+	if err := luaValuePush(L, r.value, r.options); err != nil {
+		luaNilPush(L)
+	}
+}
+
+// luaJsonText is the encoded json text as task result.
+type luaJsonText []byte
+
+// marshal the encoded json text to the lua stack.
+func (r luaJsonText) marshal(L *C.lua_State) {
+	luaBytesPush(L, r)
+}
+
+//export luatc_jsonencode
+func luatc_jsonencode(L *C.lua_State) C.int {
+	options, err := luaValueOptionsGet(L, 2, luaJsonOptions)
+	var data []byte
+	if err == nil {
+		var value interface{}
+		if value, err = luaReadJson(L, 1, options); err == nil {
+			data, err = encodeJson(value)
+		}
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	luaBytesPush(L, data)
+	return C.int(1)
+}
+
+//export luatc_jsondecode
+func luatc_jsondecode(L *C.lua_State) C.int {
+	if luaTypeOf(L, 1) != luaTypeString {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "missing string argument")
+		return C.int(2)
+	}
+	options, err := luaValueOptionsGet(L, 2, luaJsonOptions)
+	var value interface{}
+	if err == nil {
+		value, err = decodeJson(luaBytesGet(L, 1), options)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	if err := luaValuePush(L, value, options); err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	return C.int(1)
+}
+
+//export luatc_jsonencodeasync
+func luatc_jsonencodeasync(L *C.lua_State) C.int {
+	// The value must be converted on the lua thread, and
+	// only the encoding is performed in the task.
+	options, err := luaValueOptionsGet(L, 2, luaJsonOptions)
+	var value interface{}
+	if err == nil {
+		value, err = luaReadJson(L, 1, options)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	luaTaskPush(L, func(context.Context) (luaTaskResult, error) {
+		data, err := encodeJson(value)
+		if err != nil {
+			return nil, err
+		}
+		return luaJsonText(data), nil
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_jsondecodeasync
+func luatc_jsondecodeasync(L *C.lua_State) C.int {
+	if luaTypeOf(L, 1) != luaTypeString {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "missing string argument")
+		return C.int(2)
+	}
+	options, err := luaValueOptionsGet(L, 2, luaJsonOptions)
+	if err != nil {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	data := luaBytesGet(L, 1)
+	luaStackTopSet(L, 0)
+	luaTaskPush(L, func(context.Context) (luaTaskResult, error) {
+		value, err := decodeJson(data, options)
+		if err != nil {
+			return nil, err
+		}
+		return &luaJsonDecoded{value: value, options: options}, nil
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
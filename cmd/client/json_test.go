@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestJsonEncode ensures the converted values are encoded
+// reproducibly, with the numeric keys as object keys.
+func TestJsonEncode(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		value  interface{}
+		expect string
+	}{
+		{"null", nil, `null`},
+		{"array", []interface{}{1.0, "a", true, nil}, `[1,"a",true,null]`},
+		{"empty map", luaValueMap(nil), `{}`},
+		{"empty array", []interface{}{}, `[]`},
+		{"object", luaValueMap{
+			{2.0, "two"},
+			{0.5, "half"},
+			{"b", luaValueMap{{"c", []interface{}{1.0}}}},
+			{"a", "<&>"},
+		}, `{"0.5":"half","2":"two","a":"<&>","b":{"c":[1]}}`},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			value, err := luaJsonValue(testCase.value)
+			if err != nil {
+				t.Fatalf("convert: %v", err)
+			}
+			data, err := encodeJson(value)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if string(data) != testCase.expect {
+				t.Fatalf("expect %s, got %s", testCase.expect, data)
+			}
+		})
+	}
+}
+
+// TestJsonEncodeInvalid ensures the values which could not
+// be represented in json are rejected.
+func TestJsonEncodeInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		name  string
+		value interface{}
+		err   string
+	}{
+		{"nan", math.NaN(), "unsupported number"},
+		{"inf", []interface{}{math.Inf(1)}, "unsupported number"},
+		{"bool key", luaValueMap{{true, 1.0}}, "invalid object key"},
+		{"duplicate key", luaValueMap{{1.0, "a"}, {"1", "b"}}, "duplicate object key"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := luaJsonValue(testCase.value)
+			if err == nil || !strings.Contains(err.Error(), testCase.err) {
+				t.Fatalf("expect error %q, got %v", testCase.err, err)
+			}
+		})
+	}
+}
+
+// TestJsonDecode ensures the json text is decoded into the
+// values which luaValuePush accepts, with depth validated.
+func TestJsonDecode(t *testing.T) {
+	options := &luaValueOptions{maxDepth: 2}
+	value, err := decodeJson([]byte(`{"a":[1,null],"b":"x"}`), options)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	expect := map[string]interface{}{
+		"a": []interface{}{1.0, nil},
+		"b": "x",
+	}
+	if !reflect.DeepEqual(value, expect) {
+		t.Fatalf("expect %#v, got %#v", expect, value)
+	}
+	for _, testCase := range []struct {
+		text string
+		err  string
+	}{
+		{`{"a":[[1]]}`, "maximum depth"},
+		{`[1] [2]`, "unexpected data"},
+		{`{"a":`, "EOF"},
+	} {
+		_, err := decodeJson([]byte(testCase.text), options)
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Fatalf("decode %s: expect error %q, got %v",
+				testCase.text, testCase.err, err)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
 )
 
@@ -39,6 +42,83 @@ type luaConn interface {
 	close()
 }
 
+// errNotWritable is returned by connections that could
+// only be read from the lua side.
+var errNotWritable = errors.New("connection not writable")
+
+// luaConnInspector is the optional interface implemented
+// by the connections whose state could be queried using
+// the client.inspect function.
+type luaConnInspector interface {
+	// inspect returns the current state of connection
+	// which occupies exactly one lua stack slot.
+	inspect() luaReadResult
+}
+
+// luaConnLane is the priority of the values written to
+// the connection, the values in the higher lanes are sent
+// before those in the lower lanes.
+type luaConnLane int
+
+const (
+	// luaConnLaneRealtime is for time-critical values such
+	// as the game inputs.
+	luaConnLaneRealtime luaConnLane = iota
+
+	// luaConnLaneNormal is the default lane.
+	luaConnLaneNormal
+
+	// luaConnLaneBulk is for large values such as chat
+	// histories and replays.
+	luaConnLaneBulk
+
+	// luaConnLaneCount is the number of lanes.
+	luaConnLaneCount
+)
+
+// luaConnLaneNames are the names of lanes on the lua side.
+var luaConnLaneNames = [luaConnLaneCount]string{
+	"realtime", "normal", "bulk",
+}
+
+// parseLuaConnLane looks up the lane by its name.
+func parseLuaConnLane(name string) (luaConnLane, error) {
+	for lane, laneName := range luaConnLaneNames {
+		if laneName == name {
+			return luaConnLane(lane), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid lane %q", name)
+}
+
+// luaConnLaneWriter is the optional interface implemented
+// by the connections whose writes could be prioritized
+// using the client.writelane function.
+type luaConnLaneWriter interface {
+	// writeLane is like write, but the values are sent
+	// in the specified lane.
+	writeLane(L *C.lua_State, lane luaConnLane) error
+}
+
+// luaConnSender is the optional interface implemented by
+// the connections which the go side could also write to.
+type luaConnSender interface {
+	// send nonblockingly writes the values in the form
+	// returned by luaValueGet in the specified lane, as if
+	// they were written by the client.writelane function.
+	send(lane luaConnLane, values ...interface{}) error
+}
+
+// luaConnCaller is the optional interface implemented by
+// the connections which requests could be sent through and
+// answered using the client.rpc function.
+type luaConnCaller interface {
+	// call sends the request of the method with the params
+	// in the form returned by luaValueGet, and blocks until
+	// the response arrives or the context is done.
+	call(ctx context.Context, method string, params luaValueMap) (luaTaskResult, error)
+}
+
 // luaConnHandle is the controllable connection bind to
 // the lua side. The lua side could execute read and
 // write for communication, or unref the connection to
@@ -135,3 +215,78 @@ func luatc_write(L *C.lua_State) C.int {
 	}
 	return C.int(1)
 }
+
+//export luatc_writelane
+func luatc_writelane(L *C.lua_State) C.int {
+	// First, attempt to cast the interface into a conn
+	// whose writes could be prioritized.
+	connHandle, ok := luaGcLookup(L, 1).(*luaConnHandle)
+	if !ok {
+		// return "not main.luaConnHandle"
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "not main.luaConnHandle")
+		return C.int(1)
+	}
+	laneWriter, ok := connHandle.conn.(luaConnLaneWriter)
+	if !ok {
+		// return "connection not prioritizable"
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "connection not prioritizable")
+		return C.int(1)
+	}
+
+	// Second, parse the lane and remove it from the stack,
+	// so that the values are placed as in client.write.
+	if luaTypeOf(L, 2) != luaTypeString {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "missing lane argument")
+		return C.int(1)
+	}
+	lane, err := parseLuaConnLane(luaStringGet(L, 2))
+	if err == nil {
+		luaStackRemove(L, 2)
+		err = laneWriter.writeLane(L, lane)
+	}
+
+	// Third, push back the result normally.
+	luaStackTopSet(L, 0)
+	if err != nil {
+		// return err
+		luaStringPush(L, err.Error())
+	} else {
+		// return nil
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_inspect
+func luatc_inspect(L *C.lua_State) C.int {
+	// First, attempt to cast the interface into a conn.
+	connHandle, ok := luaGcLookup(L, 1).(*luaConnHandle)
+	if !ok {
+		// return nil, "not main.luaConnHandle"
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaConnHandle")
+		return C.int(2)
+	}
+
+	// Second, attempt to cast the connection into an
+	// inspector, which is optional for connections.
+	inspector, ok := connHandle.conn.(luaConnInspector)
+	if !ok {
+		// return nil, "connection not inspectable"
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "connection not inspectable")
+		return C.int(2)
+	}
+
+	// Third, push back the result normally.
+	// return state, nil.
+	luaStackTopSet(L, 0)
+	inspector.inspect().marshal(L)
+	luaNilPush(L)
+	return C.int(2)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 )
 
 /*
@@ -37,6 +38,30 @@ type luaTaskHandle struct {
 
 	// completionCh channel used for completion notification.
 	completionCh chan struct{}
+
+	// progressMtx is the mutex for updating the progress.
+	progressMtx sync.Mutex
+
+	// progress reported by the task while it is running,
+	// nil if the task does not report progress.
+	progress luaTaskResult
+}
+
+// luaTaskContextKey is the key for retrieving the task
+// handle from the context passed to the task function.
+type luaTaskContextKey struct{}
+
+// luaTaskReport updates the progress of the task executed
+// with the specified context, which will be returned by the
+// client.poll before the task completes.
+func luaTaskReport(ctx context.Context, progress luaTaskResult) {
+	taskHandle, ok := ctx.Value(luaTaskContextKey{}).(*luaTaskHandle)
+	if !ok {
+		return
+	}
+	taskHandle.progressMtx.Lock()
+	defer taskHandle.progressMtx.Unlock()
+	taskHandle.progress = progress
 }
 
 // luaTask is the function that will be executed after the
@@ -56,6 +81,7 @@ func luaTaskPush(L *C.lua_State, task luaTask) {
 
 	// Bind the task control block to the lua side.
 	luaGcAlloc(L, taskHandle, taskHandle.cancel)
+	ctx = context.WithValue(ctx, luaTaskContextKey{}, taskHandle)
 
 	// Startup the task execution goroutine.
 	go func() {
@@ -113,10 +139,17 @@ func luatc_poll(L *C.lua_State) C.int {
 		return C.int(2)
 
 	default:
-		// return nil, nil
+		// return nil, nil, progress
+		taskHandle.progressMtx.Lock()
+		progress := taskHandle.progress
+		taskHandle.progressMtx.Unlock()
 		luaStackTopSet(L, 0)
 		luaNilPush(L)
 		luaNilPush(L)
-		return C.int(2)
+		if progress == nil {
+			return C.int(2)
+		}
+		progress.marshal(L)
+		return C.int(3)
 	}
 }
@@ -9,12 +9,109 @@ LUALIB_API int luaopen_client(lua_State* L) {
 		{ "poll", luatc_poll },
 		{ "read", luatc_read },
 		{ "write", luatc_write },
+		{ "writelane", luatc_writelane },
+		{ "inspect", luatc_inspect },
+		{ "rpc", luatc_rpc },
+		{ "clocksync", luatc_clocksync },
+		{ "servertime", luatc_servertime },
+		{ "connstats", luatc_connstats },
 		{ "httpraw", luatc_httpraw },
 		{ "wsraw", luatc_wsraw },
+		{ "wschannel", luatc_wschannel },
+		{ "httpstream", luatc_httpstream },
+		{ "download", luatc_download },
+		{ "cookiejar", luatc_cookiejar },
+		{ "getcookies", luatc_getcookies },
+		{ "setcookie", luatc_setcookie },
+		{ "clearcookies", luatc_clearcookies },
+		{ "configure", luatc_configure },
+		{ "sse", luatc_sse },
+		{ NULL, NULL },
+	};
+	luaL_Reg jsonRegs[] = {
+		{ "encode", luatc_jsonencode },
+		{ "decode", luatc_jsondecode },
+		{ "encodeasync", luatc_jsonencodeasync },
+		{ "decodeasync", luatc_jsondecodeasync },
+		{ NULL, NULL },
+	};
+	luaL_Reg msgpackRegs[] = {
+		{ "pack", luatc_msgpackpack },
+		{ "unpack", luatc_msgpackunpack },
+		{ NULL, NULL },
+	};
+	luaL_Reg gameRegs[] = {
+		{ "new", luatc_gamenew },
+		{ "clone", luatc_gameclone },
+		{ "input", luatc_gameinput },
+		{ "tick", luatc_gametick },
+		{ "garbage", luatc_gamegarbage },
+		{ "state", luatc_gamestate },
+		{ NULL, NULL },
+	};
+	luaL_Reg rngRegs[] = {
+		{ "new", luatc_rngnew },
+		{ "clone", luatc_rngclone },
+		{ "next", luatc_rngnext },
+		{ "peek", luatc_rngpeek },
+		{ NULL, NULL },
+	};
+	luaL_Reg netcodeRegs[] = {
+		{ "new", luatc_netcodenew },
+		{ "input", luatc_netcodeinput },
+		{ "garbage", luatc_netcodegarbage },
+		{ "advance", luatc_netcodeadvance },
+		{ "receive", luatc_netcodereceive },
+		{ "state", luatc_netcodestate },
+		{ "info", luatc_netcodeinfo },
+		{ NULL, NULL },
+	};
+	luaL_Reg garbageRegs[] = {
+		{ "new", luatc_garbagenew },
+		{ "attack", luatc_garbageattack },
+		{ "receive", luatc_garbagereceive },
+		{ "resend", luatc_garbageresend },
+		{ "pending", luatc_garbagepending },
+		{ "take", luatc_garbagetake },
+		{ "info", luatc_garbageinfo },
 		{ NULL, NULL },
 	};
     lua_createtable(L, 0, 0);
 	luaL_register(L, NULL, regs);
+
+	// Register the client.json table and its null sentinel.
+	lua_createtable(L, 0, 0);
+	luaL_register(L, NULL, jsonRegs);
+	lua_pushlightuserdata(L, NULL);
+	lua_setfield(L, -2, "null");
+	lua_setfield(L, -2, "json");
+
+	// Register the client.msgpack table sharing the sentinel.
+	lua_createtable(L, 0, 0);
+	luaL_register(L, NULL, msgpackRegs);
+	lua_pushlightuserdata(L, NULL);
+	lua_setfield(L, -2, "null");
+	lua_setfield(L, -2, "msgpack");
+
+	// Register the client.game table of simulation.
+	lua_createtable(L, 0, 0);
+	luaL_register(L, NULL, gameRegs);
+	lua_setfield(L, -2, "game");
+
+	// Register the client.rng table of piece generators.
+	lua_createtable(L, 0, 0);
+	luaL_register(L, NULL, rngRegs);
+	lua_setfield(L, -2, "rng");
+
+	// Register the client.netcode table of lockstep.
+	lua_createtable(L, 0, 0);
+	luaL_register(L, NULL, netcodeRegs);
+	lua_setfield(L, -2, "netcode");
+
+	// Register the client.garbage table of attack exchange.
+	lua_createtable(L, 0, 0);
+	luaL_register(L, NULL, garbageRegs);
+	lua_setfield(L, -2, "garbage");
 	return 1;
 }
 */
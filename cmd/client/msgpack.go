@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaMsgpackOptions is the default options of msgpack,
+// where the integral numbers are packed as integers.
+var luaMsgpackOptions = luaValueOptions{
+	maxDepth: luaValueDefaultDepth,
+	integers: true,
+	null:     true,
+}
+
+// msgpackWriter packs the go values into the buffer.
+type msgpackWriter struct {
+	bytes.Buffer
+}
+
+// msgpackHeader is the type bytes of a variable length type,
+// where zero means the form is absent.
+type msgpackHeader struct {
+	fixed    byte
+	fixedMax int
+	code8    byte
+	code16   byte
+	code32   byte
+}
+
+var (
+	msgpackStrHeader   = msgpackHeader{0xa0, 31, 0xd9, 0xda, 0xdb}
+	msgpackBinHeader   = msgpackHeader{0, 0, 0xc4, 0xc5, 0xc6}
+	msgpackArrayHeader = msgpackHeader{0x90, 15, 0, 0xdc, 0xdd}
+	msgpackMapHeader   = msgpackHeader{0x80, 15, 0, 0xde, 0xdf}
+)
+
+// writeHeader writes the type byte followed by the length
+// in the smallest form.
+func (w *msgpackWriter) writeHeader(header msgpackHeader, length int) {
+	var scratch [8]byte
+	switch {
+	case header.fixed != 0 && length <= header.fixedMax:
+		_ = w.WriteByte(header.fixed | byte(length))
+	case header.code8 != 0 && length <= math.MaxUint8:
+		_ = w.WriteByte(header.code8)
+		_ = w.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		_ = w.WriteByte(header.code16)
+		binary.BigEndian.PutUint16(scratch[:2], uint16(length))
+		_, _ = w.Write(scratch[:2])
+	default:
+		_ = w.WriteByte(header.code32)
+		binary.BigEndian.PutUint32(scratch[:4], uint32(length))
+		_, _ = w.Write(scratch[:4])
+	}
+}
+
+// writeInteger writes the signed integer in smallest form.
+func (w *msgpackWriter) writeInteger(value int64) {
+	if value >= 0 {
+		w.writeUnsigned(uint64(value))
+		return
+	}
+	var scratch [8]byte
+	switch {
+	case value >= -32:
+		_ = w.WriteByte(byte(value))
+	case value >= math.MinInt8:
+		_ = w.WriteByte(0xd0)
+		_ = w.WriteByte(byte(value))
+	case value >= math.MinInt16:
+		_ = w.WriteByte(0xd1)
+		binary.BigEndian.PutUint16(scratch[:2], uint16(value))
+		_, _ = w.Write(scratch[:2])
+	case value >= math.MinInt32:
+		_ = w.WriteByte(0xd2)
+		binary.BigEndian.PutUint32(scratch[:4], uint32(value))
+		_, _ = w.Write(scratch[:4])
+	default:
+		_ = w.WriteByte(0xd3)
+		binary.BigEndian.PutUint64(scratch[:], uint64(value))
+		_, _ = w.Write(scratch[:])
+	}
+}
+
+// writeUnsigned writes the unsigned integer in smallest form.
+func (w *msgpackWriter) writeUnsigned(value uint64) {
+	var scratch [8]byte
+	switch {
+	case value <= 0x7f:
+		_ = w.WriteByte(byte(value))
+	case value <= math.MaxUint8:
+		_ = w.WriteByte(0xcc)
+		_ = w.WriteByte(byte(value))
+	case value <= math.MaxUint16:
+		_ = w.WriteByte(0xcd)
+		binary.BigEndian.PutUint16(scratch[:2], uint16(value))
+		_, _ = w.Write(scratch[:2])
+	case value <= math.MaxUint32:
+		_ = w.WriteByte(0xce)
+		binary.BigEndian.PutUint32(scratch[:4], uint32(value))
+		_, _ = w.Write(scratch[:4])
+	default:
+		_ = w.WriteByte(0xcf)
+		binary.BigEndian.PutUint64(scratch[:], value)
+		_, _ = w.Write(scratch[:])
+	}
+}
+
+// write packs the go value into the buffer.
+func (w *msgpackWriter) write(value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		_ = w.WriteByte(0xc0)
+	case bool:
+		if value {
+			_ = w.WriteByte(0xc3)
+		} else {
+			_ = w.WriteByte(0xc2)
+		}
+	case int64:
+		w.writeInteger(value)
+	case uint64:
+		w.writeUnsigned(value)
+	case float64:
+		var scratch [8]byte
+		_ = w.WriteByte(0xcb)
+		binary.BigEndian.PutUint64(scratch[:], math.Float64bits(value))
+		_, _ = w.Write(scratch[:])
+	case string:
+		// The lua strings are packed as binary unless they
+		// are valid utf-8 text.
+		if utf8.ValidString(value) {
+			w.writeHeader(msgpackStrHeader, len(value))
+		} else {
+			w.writeHeader(msgpackBinHeader, len(value))
+		}
+		_, _ = w.WriteString(value)
+	case []interface{}:
+		w.writeHeader(msgpackArrayHeader, len(value))
+		for _, item := range value {
+			if err := w.write(item); err != nil {
+				return err
+			}
+		}
+	case luaValueMap:
+		w.writeHeader(msgpackMapHeader, len(value))
+		for _, pair := range value {
+			if err := w.write(pair.key); err != nil {
+				return err
+			}
+			if err := w.write(pair.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value %T", value)
+	}
+	return nil
+}
+
+// packMsgpack packs the converted value as msgpack data.
+func packMsgpack(value interface{}) ([]byte, error) {
+	var writer msgpackWriter
+	if err := writer.write(value); err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
+}
+
+// errMsgpackShort is the error when the data is truncated.
+var errMsgpackShort = errors.New("unexpected end of msgpack data")
+
+// msgpackReader unpacks the go values from the data.
+type msgpackReader struct {
+	// data is the remaining data to unpack.
+	data []byte
+
+	// maxDepth is the maximum nesting depth.
+	maxDepth int
+}
+
+// next consumes the specified number of bytes.
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data) < n {
+		return nil, errMsgpackShort
+	}
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result, nil
+}
+
+// length reads the big-endian length of the given size.
+func (r *msgpackReader) length(size int) (int, error) {
+	data, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(data[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(data)), nil
+	default:
+		length := binary.BigEndian.Uint32(data)
+		if uint64(length) > uint64(len(r.data)) {
+			return 0, errMsgpackShort
+		}
+		return int(length), nil
+	}
+}
+
+// readString reads the string of the given length.
+func (r *msgpackReader) readString(length int) (interface{}, error) {
+	data, err := r.next(length)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// readArray reads the array of the given length.
+func (r *msgpackReader) readArray(length, depth int) (interface{}, error) {
+	if depth+1 > r.maxDepth {
+		return nil, errors.New("maximum depth exceeded")
+	}
+	if length > len(r.data) {
+		return nil, errMsgpackShort
+	}
+	result := make([]interface{}, length)
+	for i := range result {
+		var err error
+		if result[i], err = r.read(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// readMap reads the map of the given length.
+func (r *msgpackReader) readMap(length, depth int) (interface{}, error) {
+	if depth+1 > r.maxDepth {
+		return nil, errors.New("maximum depth exceeded")
+	}
+	if length > len(r.data)/2 {
+		return nil, errMsgpackShort
+	}
+	result := make(luaValueMap, length)
+	for i := range result {
+		key, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case bool, int64, uint64, string:
+		case float64:
+			if math.IsNaN(key) {
+				return nil, errors.New("invalid map key NaN")
+			}
+		default:
+			return nil, fmt.Errorf("invalid map key of %T", key)
+		}
+		value, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = luaValuePair{key: key, value: value}
+	}
+	return result, nil
+}
+
+// read unpacks a value with the depth of its enclosing
+// arrays and maps.
+func (r *msgpackReader) read(depth int) (interface{}, error) {
+	head, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := head[0]
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return r.readString(int(code & 0x1f))
+	case code&0xf0 == 0x90:
+		return r.readArray(int(code&0x0f), depth)
+	case code&0xf0 == 0x80:
+		return r.readMap(int(code&0x0f), depth)
+	}
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		// Both str and bin are unpacked as lua strings.
+		size := 1 << ((code - 0xc4) % 3)
+		if code >= 0xd9 {
+			size = 1 << (code - 0xd9)
+		}
+		length, err := r.length(size)
+		if err != nil {
+			return nil, err
+		}
+		return r.readString(length)
+	case 0xca:
+		data, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(
+			binary.BigEndian.Uint32(data))), nil
+	case 0xcb:
+		data, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		data, err := r.next(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var value uint64
+		for _, b := range data {
+			value = value<<8 | uint64(b)
+		}
+		return value, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		data, err := r.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var value uint64
+		for _, b := range data {
+			value = value<<8 | uint64(b)
+		}
+		shift := uint(64 - 8*size)
+		return int64(value<<shift) >> shift, nil
+	case 0xdc, 0xdd:
+		length, err := r.length(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.readArray(length, depth)
+	case 0xde, 0xdf:
+		length, err := r.length(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.readMap(length, depth)
+	default:
+		return nil, fmt.Errorf("unsupported msgpack type 0x%02x", code)
+	}
+}
+
+// unpackMsgpack unpacks the msgpack data into go value.
+func unpackMsgpack(data []byte, options *luaValueOptions) (interface{}, error) {
+	reader := &msgpackReader{data: data, maxDepth: options.maxDepth}
+	value, err := reader.read(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(reader.data) > 0 {
+		return nil, errors.New("unexpected data after msgpack value")
+	}
+	return value, nil
+}
+
+//export luatc_msgpackpack
+func luatc_msgpackpack(L *C.lua_State) C.int {
+	options, err := luaValueOptionsGet(L, 2, luaMsgpackOptions)
+	var data []byte
+	if err == nil {
+		var value interface{}
+		if value, err = luaValueGet(L, 1, options); err == nil {
+			data, err = packMsgpack(value)
+		}
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	luaBytesPush(L, data)
+	return C.int(1)
+}
+
+//export luatc_msgpackunpack
+func luatc_msgpackunpack(L *C.lua_State) C.int {
+	if luaTypeOf(L, 1) != luaTypeString {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "missing string argument")
+		return C.int(2)
+	}
+	options, err := luaValueOptionsGet(L, 2, luaMsgpackOptions)
+	var value interface{}
+	if err == nil {
+		value, err = unpackMsgpack(luaBytesGet(L, 1), options)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	if err := luaValuePush(L, value, options); err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	return C.int(1)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMsgpackRoundTrip ensures the values are packed in the
+// smallest form and unpacked back.
+func TestMsgpackRoundTrip(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		value  interface{}
+		packed []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"bool", []interface{}{true, false}, []byte{0x92, 0xc3, 0xc2}},
+		{"fixint", int64(127), []byte{0x7f}},
+		{"negative fixint", int64(-32), []byte{0xe0}},
+		{"uint8", uint64(200), []byte{0xcc, 0xc8}},
+		{"int8", int64(-33), []byte{0xd0, 0xdf}},
+		{"uint16", uint64(65535), []byte{0xcd, 0xff, 0xff}},
+		{"int32", int64(math.MinInt32), []byte{0xd2, 0x80, 0, 0, 0}},
+		{"uint64", uint64(math.MaxUint64), []byte{
+			0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"float", 0.5, []byte{0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0}},
+		{"str", "ab", []byte{0xa2, 'a', 'b'}},
+		{"bin", "\xff", []byte{0xc4, 0x01, 0xff}},
+		{"map", luaValueMap{
+			{int64(1), "a"},
+			{"k", []interface{}{nil}},
+		}, []byte{0x82, 0x01, 0xa1, 'a', 0xa1, 'k', 0x91, 0xc0}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			data, err := packMsgpack(testCase.value)
+			if err != nil {
+				t.Fatalf("pack: %v", err)
+			}
+			if !bytes.Equal(data, testCase.packed) {
+				t.Fatalf("expect % x, got % x", testCase.packed, data)
+			}
+			value, err := unpackMsgpack(data, &luaMsgpackOptions)
+			if err != nil {
+				t.Fatalf("unpack: %v", err)
+			}
+			if !reflect.DeepEqual(value, testCase.value) {
+				t.Fatalf("expect %#v, got %#v", testCase.value, value)
+			}
+		})
+	}
+}
+
+// TestMsgpackLongHeaders ensures the lengths beyond fixed
+// forms are packed with the wider headers.
+func TestMsgpackLongHeaders(t *testing.T) {
+	text := strings.Repeat("x", 300)
+	array := make([]interface{}, 20)
+	for i := range array {
+		array[i] = int64(i)
+	}
+	for _, testCase := range []struct {
+		value  interface{}
+		header []byte
+	}{
+		{text, []byte{0xda, 0x01, 0x2c}},
+		{array, []byte{0xdc, 0x00, 0x14}},
+	} {
+		data, err := packMsgpack(testCase.value)
+		if err != nil {
+			t.Fatalf("pack: %v", err)
+		}
+		if !bytes.HasPrefix(data, testCase.header) {
+			t.Fatalf("expect header % x, got % x",
+				testCase.header, data[:len(testCase.header)])
+		}
+		value, err := unpackMsgpack(data, &luaMsgpackOptions)
+		if err != nil || !reflect.DeepEqual(value, testCase.value) {
+			t.Fatalf("round trip %T failed: %v", testCase.value, err)
+		}
+	}
+}
+
+// TestMsgpackUnpackInvalid ensures the malformed data is
+// rejected instead of being partially unpacked.
+func TestMsgpackUnpackInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "unexpected end"},
+		{"truncated str", []byte{0xa3, 'a'}, "unexpected end"},
+		{"truncated array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, "unexpected end"},
+		{"trailing", []byte{0xc0, 0xc0}, "unexpected data"},
+		{"nan key", []byte{0x81, 0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1, 0xc0}, "NaN"},
+		{"array key", []byte{0x81, 0x90, 0xc0}, "invalid map key"},
+		{"unsupported", []byte{0xc1}, "unsupported msgpack type"},
+		{"too deep", []byte{0x91, 0x91, 0x91, 0xc0}, "maximum depth"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := unpackMsgpack(testCase.data, &luaValueOptions{maxDepth: 2})
+			if err == nil || !strings.Contains(err.Error(), testCase.err) {
+				t.Fatalf("expect error %q, got %v", testCase.err, err)
+			}
+		})
+	}
+}
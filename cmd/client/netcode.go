@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Techmino/TechminoOnline/game"
+	"github.com/Techmino/TechminoOnline/netcode"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaNetcodeDefaultInputDelay is the default input delay.
+const luaNetcodeDefaultInputDelay = 2
+
+// luaNetcodeDefaultWindow is the default rollback window.
+const luaNetcodeDefaultWindow = 8
+
+// luaNetcodePacketOptions are the options to read packets,
+// which are tables of { player, frame, inputs, garbage }.
+var luaNetcodePacketOptions = luaValueOptions{
+	maxDepth:   3,
+	emptyArray: true,
+}
+
+// luaNetcodeSession is the lockstep session bound to the
+// connection which the local inputs are sent through.
+type luaNetcodeSession struct {
+	// session is the lockstep session.
+	session *netcode.Session
+
+	// conn is the handle of connection, which is kept so
+	// that the connection is alive with the session.
+	conn *luaConnHandle
+
+	// sender is the connection to send the inputs.
+	sender luaConnSender
+
+	// relay indicates the packets are wrapped as relay
+	// messages of the online server.
+	relay bool
+}
+
+// luaNetcodeLookup attempts to dereference the session at
+// the specified index.
+func luaNetcodeLookup(L *C.lua_State, index int) (*luaNetcodeSession, bool) {
+	s, ok := luaGcLookup(L, index).(*luaNetcodeSession)
+	return s, ok
+}
+
+// playerGet reads the player numbered from 1 at the
+// specified index.
+func (s *luaNetcodeSession) playerGet(L *C.lua_State, index int) (int, error) {
+	if luaTypeOf(L, index) != luaTypeNumber {
+		return 0, errors.New("missing player argument")
+	}
+	player := int(luaNumberGet(L, index)) - 1
+	if player < 0 || player >= s.session.Config().Players {
+		return 0, errors.New("invalid player argument")
+	}
+	return player, nil
+}
+
+// flush sends the local inputs not sent yet.
+func (s *luaNetcodeSession) flush() error {
+	packet := s.session.Outgoing()
+	if packet == nil {
+		return nil
+	}
+	inputs := make([]interface{}, len(packet.Inputs))
+	for i, actions := range packet.Inputs {
+		names := make([]interface{}, len(actions))
+		for j, action := range actions {
+			names[j] = action.String()
+		}
+		inputs[i] = names
+	}
+	fields := luaValueMap{{"frame", int64(packet.Frame)}}
+	if len(packet.Garbage) > 0 {
+		garbage := make([]interface{}, len(packet.Garbage))
+		for i, item := range packet.Garbage {
+			garbage[i] = luaValueMap{
+				{"frame", int64(item.Frame)},
+				{"hole", int64(item.Hole + 1)},
+				{"lines", int64(item.Lines)},
+			}
+		}
+		fields = append(fields, luaValuePair{"garbage", garbage})
+	}
+	fields = append(fields,
+		luaValuePair{"inputs", inputs},
+		luaValuePair{"player", int64(packet.Player + 1)})
+	var value interface{} = fields
+	if s.relay {
+		value = luaValueMap{
+			{"data", value},
+			{"type", "relay"},
+		}
+	}
+	return s.sender.send(luaConnLaneRealtime, value)
+}
+
+// luaNetcodeInteger converts the number in the packet.
+func luaNetcodeInteger(value interface{}) (int, bool) {
+	number, ok := value.(float64)
+	return int(number), ok && number == float64(int(number))
+}
+
+// luaReadNetcodePacket reads the packet received at the
+// specified index.
+func luaReadNetcodePacket(L *C.lua_State, index int) (*netcode.Packet, error) {
+	value, err := luaValueGet(L, index, &luaNetcodePacketOptions)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := value.(luaValueMap)
+	if !ok {
+		return nil, errors.New("invalid packet")
+	}
+	result := &netcode.Packet{}
+	var hasPlayer, hasFrame bool
+	for _, pair := range fields {
+		switch pair.key {
+		case "player":
+			if result.Player, hasPlayer = luaNetcodeInteger(pair.value); hasPlayer {
+				result.Player--
+			}
+		case "frame":
+			result.Frame, hasFrame = luaNetcodeInteger(pair.value)
+		case "inputs":
+			inputs, ok := pair.value.([]interface{})
+			if !ok {
+				return nil, errors.New("invalid inputs of packet")
+			}
+			for _, item := range inputs {
+				names, ok := item.([]interface{})
+				if !ok {
+					return nil, errors.New("invalid inputs of packet")
+				}
+				var actions []game.Action
+				for _, name := range names {
+					name, ok := name.(string)
+					if !ok {
+						return nil, errors.New("invalid inputs of packet")
+					}
+					action, err := game.ParseAction(name)
+					if err != nil {
+						return nil, err
+					}
+					actions = append(actions, action)
+				}
+				result.Inputs = append(result.Inputs, actions)
+			}
+		case "garbage":
+			garbage, ok := pair.value.([]interface{})
+			if !ok {
+				return nil, errors.New("invalid garbage of packet")
+			}
+			for _, item := range garbage {
+				item, err := luaReadNetcodeGarbage(item)
+				if err != nil {
+					return nil, err
+				}
+				result.Garbage = append(result.Garbage, item)
+			}
+		}
+	}
+	if !hasPlayer || !hasFrame {
+		return nil, errors.New("missing player or frame of packet")
+	}
+	return result, nil
+}
+
+// luaReadNetcodeGarbage reads the garbage { frame, lines,
+// hole } in the packet, where the hole is numbered from 1.
+func luaReadNetcodeGarbage(value interface{}) (game.Garbage, error) {
+	var result game.Garbage
+	fields, ok := value.(luaValueMap)
+	if !ok {
+		return result, errors.New("invalid garbage of packet")
+	}
+	var hasFrame, hasLines, hasHole bool
+	for _, pair := range fields {
+		switch pair.key {
+		case "frame":
+			result.Frame, hasFrame = luaNetcodeInteger(pair.value)
+		case "lines":
+			result.Lines, hasLines = luaNetcodeInteger(pair.value)
+		case "hole":
+			result.Hole, hasHole = luaNetcodeInteger(pair.value)
+		}
+	}
+	if !hasFrame || !hasLines || !hasHole {
+		return result, errors.New("invalid garbage of packet")
+	}
+	result.Hole--
+	return result, nil
+}
+
+// luaNetcodeInfo is the state of the session.
+type luaNetcodeInfo struct {
+	// session inspected.
+	session *netcode.Session
+}
+
+// marshal the state of the session to the lua stack.
+func (r *luaNetcodeInfo) marshal(L *C.lua_State) {
+	s := r.session
+	luaTableNew(L, 0, 5)
+	luaStringPush(L, "frame")
+	luaIntegerPush(L, s.Frame())
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "confirmed")
+	luaIntegerPush(L, s.Confirmed())
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "stalled")
+	luaBooleanPush(L, s.Stalled())
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "rollbacks")
+	luaIntegerPush(L, s.Rollbacks())
+	luaTableRawSet(L, -3)
+	players := s.Config().Players
+	luaStringPush(L, "received")
+	luaTableNew(L, players, 0)
+	for i := 0; i < players; i++ {
+		luaIntegerPush(L, s.Received(i))
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaTableRawSet(L, -3)
+}
+
+//export luatc_netcodenew
+func luatc_netcodenew(L *C.lua_State) C.int {
+	// First, attempt to cast the interface into a conn
+	// which the go side could send through.
+	connHandle, ok := luaGcLookup(L, 1).(*luaConnHandle)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaConnHandle")
+		return C.int(2)
+	}
+	sender, ok := connHandle.conn.(luaConnSender)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "connection not sendable")
+		return C.int(2)
+	}
+
+	// Second, read the configuration of the session.
+	gameConfig, algorithm, seed, err := luaReadGameConfig(L, 2)
+	config := netcode.Config{
+		Game:       gameConfig,
+		Algorithm:  algorithm,
+		Seed:       seed,
+		Players:    2,
+		InputDelay: luaNetcodeDefaultInputDelay,
+		Window:     luaNetcodeDefaultWindow,
+	}
+	local, relay := 1, true
+	for _, field := range []struct {
+		key   string
+		value *int
+	}{
+		{"players", &config.Players},
+		{"player", &local},
+		{"inputdelay", &config.InputDelay},
+		{"window", &config.Window},
+	} {
+		if err == nil {
+			err = luaGameIntegerField(L, 2, field.key, field.value)
+		}
+	}
+	if err == nil {
+		err = luaGameBooleanField(L, 2, "relay", &relay)
+	}
+	config.Local = local - 1
+	var session *netcode.Session
+	if err == nil {
+		session, err = netcode.New(config)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Third, push back the session normally.
+	luaGcAlloc(L, &luaNetcodeSession{
+		session: session,
+		conn:    connHandle,
+		sender:  sender,
+		relay:   relay,
+	}, func() {})
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_netcodeinput
+func luatc_netcodeinput(L *C.lua_State) C.int {
+	s, ok := luaNetcodeLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "not main.luaNetcodeSession")
+		return C.int(1)
+	}
+
+	// Validate all actions before scheduling any of them.
+	top := luaStackTopGet(L)
+	actions := make([]game.Action, 0, top-1)
+	for i := 2; i <= top; i++ {
+		err := errors.New("invalid action argument")
+		var action game.Action
+		if luaTypeOf(L, i) == luaTypeString {
+			action, err = game.ParseAction(luaStringGet(L, i))
+		}
+		if err != nil {
+			luaStackTopSet(L, 0)
+			luaStringPush(L, err.Error())
+			return C.int(1)
+		}
+		actions = append(actions, action)
+	}
+	for _, action := range actions {
+		s.session.Input(action)
+	}
+	luaStackTopSet(L, 0)
+	luaNilPush(L)
+	return C.int(1)
+}
+
+//export luatc_netcodegarbage
+func luatc_netcodegarbage(L *C.lua_State) C.int {
+	s, ok := luaNetcodeLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "not main.luaNetcodeSession")
+		return C.int(1)
+	}
+	if luaTypeOf(L, 2) != luaTypeNumber || luaTypeOf(L, 3) != luaTypeNumber {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "missing lines or hole argument")
+		return C.int(1)
+	}
+	lines := int(luaNumberGet(L, 2))
+	hole := int(luaNumberGet(L, 3)) - 1
+	luaStackTopSet(L, 0)
+	if err := s.session.Garbage(lines, hole); err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_netcodeadvance
+func luatc_netcodeadvance(L *C.lua_State) C.int {
+	s, ok := luaNetcodeLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaNetcodeSession")
+		return C.int(2)
+	}
+	frames := 1
+	if typeOf := luaTypeOf(L, 2); typeOf == luaTypeNumber {
+		frames = int(luaNumberGet(L, 2))
+	} else if typeOf != luaTypeNil && typeOf != luaTypeNone {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "invalid frames argument")
+		return C.int(2)
+	}
+	luaStackTopSet(L, 0)
+
+	// Advance until stalled, and send the local inputs.
+	advanced := 0
+	for advanced < frames && s.session.Advance() {
+		advanced++
+	}
+	if err := s.flush(); err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// return advanced, nil
+	luaIntegerPush(L, advanced)
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_netcodereceive
+func luatc_netcodereceive(L *C.lua_State) C.int {
+	s, ok := luaNetcodeLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaStringPush(L, "not main.luaNetcodeSession")
+		return C.int(1)
+	}
+	packet, err := luaReadNetcodePacket(L, 2)
+	if err == nil {
+		err = s.session.Receive(packet)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaStringPush(L, err.Error())
+	} else {
+		luaNilPush(L)
+	}
+	return C.int(1)
+}
+
+//export luatc_netcodestate
+func luatc_netcodestate(L *C.lua_State) C.int {
+	s, ok := luaNetcodeLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaNetcodeSession")
+		return C.int(2)
+	}
+	player, err := s.playerGet(L, 2)
+	confirmed := luaTypeOf(L, 3) == luaTypeBoolean && luaBooleanGet(L, 3)
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	g := s.session.PredictedGame(player)
+	if confirmed {
+		g = s.session.ConfirmedGame(player)
+	}
+	(&luaGameState{g: g}).marshal(L)
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_netcodeinfo
+func luatc_netcodeinfo(L *C.lua_State) C.int {
+	s, ok := luaNetcodeLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaNetcodeSession")
+		return C.int(2)
+	}
+	(&luaNetcodeInfo{session: s.session}).marshal(L)
+	luaNilPush(L)
+	return C.int(2)
+}
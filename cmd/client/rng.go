@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Techmino/TechminoOnline/game"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaRngMaxPeek is the maximum number of pieces peeked.
+const luaRngMaxPeek = 1024
+
+// luaRngLookup attempts to dereference the generator at
+// the specified index.
+func luaRngLookup(L *C.lua_State, index int) (game.Generator, bool) {
+	generator, ok := luaGcLookup(L, index).(game.Generator)
+	return generator, ok
+}
+
+// luaRngPush pushes the generator as userdata onto the stack.
+func luaRngPush(L *C.lua_State, generator game.Generator) {
+	luaGcAlloc(L, generator, func() {})
+}
+
+//export luatc_rngnew
+func luatc_rngnew(L *C.lua_State) C.int {
+	seed, err := luaGameSeedGet(L, 1)
+	var algorithm string
+	if err == nil {
+		algorithm, err = luaGameAlgorithmGet(L, 2)
+	}
+	var generator game.Generator
+	if err == nil {
+		generator, err = game.NewGenerator(algorithm, seed)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	luaRngPush(L, generator)
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_rngclone
+func luatc_rngclone(L *C.lua_State) C.int {
+	generator, ok := luaRngLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not game.Generator")
+		return C.int(2)
+	}
+	luaRngPush(L, generator.Clone())
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_rngnext
+func luatc_rngnext(L *C.lua_State) C.int {
+	generator, ok := luaRngLookup(L, 1)
+	luaStackTopSet(L, 0)
+	if !ok {
+		luaNilPush(L)
+		luaStringPush(L, "not game.Generator")
+		return C.int(2)
+	}
+	luaPiecePush(L, generator.Next())
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_rngpeek
+func luatc_rngpeek(L *C.lua_State) C.int {
+	generator, ok := luaRngLookup(L, 1)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not game.Generator")
+		return C.int(2)
+	}
+	n := 1
+	var err error
+	if typeOf := luaTypeOf(L, 2); typeOf == luaTypeNumber {
+		n = int(luaNumberGet(L, 2))
+		if n < 1 || n > luaRngMaxPeek {
+			err = errors.New("invalid count argument")
+		}
+	} else if typeOf != luaTypeNil && typeOf != luaTypeNone {
+		err = errors.New("invalid count argument")
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// return { piece1, piece2, ... }, nil
+	pieces := game.Peek(generator, n)
+	luaTableNew(L, len(pieces), 0)
+	for i, piece := range pieces {
+		luaPiecePush(L, piece)
+		luaTableRawSeti(L, -2, i+1)
+	}
+	luaNilPush(L)
+	return C.int(2)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// sseDefaultRetry is the reconnection delay before the
+// server specifies one with the retry field.
+const sseDefaultRetry = 3 * time.Second
+
+// sseMaxLineSize is the maximum length of a line in the
+// event stream.
+const sseMaxLineSize = 1024 * 1024
+
+// sseMaxQueue is the maximum number of events queued
+// before they are read, which is the same as the default
+// backlog of the websocket channels.
+const sseMaxQueue = luaWebSocketChannelDefaultBacklog
+
+// errSseOverflow is the error of the event stream whose
+// receive queue has exceeded its limit.
+var errSseOverflow = errors.New("event stream receive queue overflow")
+
+// sseEvent is an event dispatched by the event stream.
+type sseEvent struct {
+	// event is the type of the event.
+	event string
+
+	// data of the event.
+	data string
+
+	// id is the last event id when it is dispatched.
+	id string
+
+	// received is the local time when it is dispatched.
+	received time.Time
+}
+
+// sseParser parses the event stream line by line, as is
+// specified by the HTML Living Standard.
+type sseParser struct {
+	// event is the buffer of event type.
+	event string
+
+	// data is the buffer of event data.
+	data bytes.Buffer
+
+	// lastEventID is the last event id received.
+	lastEventID string
+
+	// retry is the reconnection delay, which is zero if
+	// it is not specified by the server.
+	retry time.Duration
+}
+
+// parseLine processes a line of the event stream, and
+// returns the event when the line dispatches one.
+func (p *sseParser) parseLine(line string) (*sseEvent, bool) {
+	// An empty line dispatches the buffered event.
+	if line == "" {
+		defer func() {
+			p.event = ""
+			p.data.Reset()
+		}()
+		if p.data.Len() == 0 {
+			return nil, false
+		}
+		data := strings.TrimSuffix(p.data.String(), "\n")
+		event := p.event
+		if event == "" {
+			event = "message"
+		}
+		return &sseEvent{
+			event: event,
+			data:  data,
+			id:    p.lastEventID,
+		}, true
+	}
+
+	// A line starting with colon is comment.
+	if strings.HasPrefix(line, ":") {
+		return nil, false
+	}
+	field, value := line, ""
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		field = line[:i]
+		value = strings.TrimPrefix(line[i+1:], " ")
+	}
+	switch field {
+	case "event":
+		p.event = value
+	case "data":
+		p.data.WriteString(value)
+		p.data.WriteByte('\n')
+	case "id":
+		if strings.IndexByte(value, 0) < 0 {
+			p.lastEventID = value
+		}
+	case "retry":
+		if millis, err := strconv.ParseUint(value, 10, 32); err == nil {
+			p.retry = time.Duration(millis) * time.Millisecond
+		}
+	}
+	return nil, false
+}
+
+// sseScanLines is the split function of bufio.Scanner for
+// the lines ended by either CRLF, LF or CR.
+func sseScanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// The CR might be followed by LF in the next read.
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+
+	// The incomplete line at the end of stream is dropped,
+	// since it could never be dispatched.
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
+// luaSseConn is a connection receiving the server-sent
+// events, which reconnects when the stream is broken.
+type luaSseConn struct {
+	// request is the template of the requests to send.
+	request *httpRawRequest
+
+	// ctx is the context of the connection.
+	ctx context.Context
+
+	// cancel function to abort the connection.
+	cancel context.CancelFunc
+
+	// stateMtx is the mutex for the connection state.
+	stateMtx sync.Mutex
+
+	// parser of the event stream, whose state persists
+	// across reconnections.
+	parser sseParser
+
+	// connected indicates whether there's an established
+	// event stream currently.
+	connected bool
+
+	// reconnects is the number of reconnections.
+	reconnects int
+
+	// receiveMtx is the mutex for blocking the receive.
+	receiveMtx sync.Mutex
+
+	// receiveQueue for the event stream.
+	receiveQueue []*sseEvent
+
+	// receiveErr is the error while running reader.
+	receiveErr error
+
+	// statistics of the events received.
+	statistics *luaConnStats
+}
+
+// connect sends the request for the event stream, and
+// returns the response if the stream is established.
+func (s *luaSseConn) connect() (*http.Response, error) {
+	request := s.request.newRequest(s.ctx)
+	request.Header = make(http.Header)
+	for k, v := range s.request.header {
+		request.Header[k] = v
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Cache-Control", "no-cache")
+	s.stateMtx.Lock()
+	lastEventID := s.parser.lastEventID
+	s.stateMtx.Unlock()
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := rawClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensures the response is an event stream.
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, errSseRejected{response.Status}
+	}
+	mediaType, _, _ := mime.ParseMediaType(
+		response.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		_ = response.Body.Close()
+		return nil, errSseRejected{fmt.Sprintf(
+			"unexpected content type %q", mediaType)}
+	}
+	return response, nil
+}
+
+// errSseRejected is the error when the server rejects the
+// event stream, which should not be reconnected.
+type errSseRejected struct {
+	reason string
+}
+
+// Error implements error for errSseRejected.
+func (e errSseRejected) Error() string {
+	return e.reason
+}
+
+// receive reads the events from the stream until it ends.
+// The stream is closed with errSseOverflow when the queue
+// overflows, so that the events are never silently lost.
+func (s *luaSseConn) receive(body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, sseMaxLineSize)
+	scanner.Split(sseScanLines)
+	size := 0
+	first := true
+	for scanner.Scan() {
+		// The lines are measured as if they are ended by LF,
+		// and each event is measured as a frame. The leading
+		// byte order mark of the stream is ignored.
+		size += len(scanner.Bytes()) + 1
+		line := scanner.Text()
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		s.stateMtx.Lock()
+		event, ok := s.parser.parseLine(line)
+		s.stateMtx.Unlock()
+		if !ok {
+			continue
+		}
+		event.received = time.Now()
+		s.statistics.received(event.received, size)
+		size = 0
+		s.receiveMtx.Lock()
+		overflow := len(s.receiveQueue) >= sseMaxQueue
+		if !overflow {
+			s.receiveQueue = append(s.receiveQueue, event)
+		}
+		s.receiveMtx.Unlock()
+		if overflow {
+			return errSseOverflow
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// runSseReader executes the event stream reader for the
+// connection, starting with the established response.
+func (s *luaSseConn) runSseReader(response *http.Response) error {
+	for {
+		// Receive the events until the stream is broken.
+		s.stateMtx.Lock()
+		s.connected = true
+		s.stateMtx.Unlock()
+		err := s.receive(response.Body)
+		_ = response.Body.Close()
+		s.stateMtx.Lock()
+		s.connected = false
+		retry := s.parser.retry
+		s.parser.event = ""
+		s.parser.data.Reset()
+		s.stateMtx.Unlock()
+		if err == errSseOverflow {
+			return err
+		}
+		if retry == 0 {
+			retry = sseDefaultRetry
+		}
+
+		// Wait for the delay before reconnecting, and keep
+		// on retrying until the server rejects the stream.
+		for {
+			select {
+			case <-s.ctx.Done():
+				return errors.New("connection closed")
+			case <-time.After(retry):
+			}
+			s.stateMtx.Lock()
+			s.reconnects++
+			s.stateMtx.Unlock()
+			s.statistics.reconnect()
+			var err error
+			response, err = s.connect()
+			if err == nil {
+				break
+			}
+			if rejected, ok := err.(errSseRejected); ok {
+				return rejected
+			}
+		}
+	}
+}
+
+// luaSseReadResult is multiple events read using the read
+// interface of event stream connection.
+type luaSseReadResult struct {
+	// events are the received events.
+	events []*sseEvent
+}
+
+// marshal the event stream read result to lua stack.
+func (r *luaSseReadResult) marshal(L *C.lua_State) {
+	luaTableNew(L, len(r.events), 0)
+	for i, event := range r.events {
+		luaTableNew(L, 0, 3)
+		luaStringPush(L, "event")
+		luaStringPush(L, event.event)
+		luaTableRawSet(L, -3)
+		luaStringPush(L, "data")
+		luaStringPush(L, event.data)
+		luaTableRawSet(L, -3)
+		luaStringPush(L, "id")
+		luaStringPush(L, event.id)
+		luaTableRawSet(L, -3)
+		luaTableRawSeti(L, -2, i+1)
+	}
+}
+
+// read implements the luaConn.read for luaSseConn.
+func (s *luaSseConn) read() (luaReadResult, error) {
+	s.receiveMtx.Lock()
+	defer s.receiveMtx.Unlock()
+	readResult := &luaSseReadResult{}
+	readResult.events, s.receiveQueue = s.receiveQueue, nil
+	now := time.Now()
+	for _, event := range readResult.events {
+		s.statistics.read(now, event.received)
+	}
+	return readResult, s.receiveErr
+}
+
+// write implements the luaConn.write for luaSseConn.
+func (s *luaSseConn) write(L *C.lua_State) error {
+	return errNotWritable
+}
+
+// close implements the luaConn.close for luaSseConn.
+func (s *luaSseConn) close() {
+	s.statistics.close()
+	s.cancel()
+}
+
+// stats implements the luaConnStatter.stats for luaSseConn.
+func (s *luaSseConn) stats() *luaConnStats {
+	return s.statistics
+}
+
+// luaSseInfo is the state of the event stream.
+type luaSseInfo struct {
+	// connected indicates whether the stream is up.
+	connected bool
+
+	// lastEventID is the last event id received.
+	lastEventID string
+
+	// retry is the reconnection delay.
+	retry time.Duration
+
+	// reconnects is the number of reconnections.
+	reconnects int
+}
+
+// marshal the event stream state to the lua stack.
+func (r *luaSseInfo) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 4)
+	luaStringPush(L, "connected")
+	luaBooleanPush(L, r.connected)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "lastid")
+	luaStringPush(L, r.lastEventID)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "retry")
+	luaNumberPush(L, r.retry.Seconds())
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "reconnects")
+	luaIntegerPush(L, r.reconnects)
+	luaTableRawSet(L, -3)
+}
+
+// inspect implements the luaConnInspector.inspect for
+// luaSseConn.
+func (s *luaSseConn) inspect() luaReadResult {
+	s.stateMtx.Lock()
+	defer s.stateMtx.Unlock()
+	retry := s.parser.retry
+	if retry == 0 {
+		retry = sseDefaultRetry
+	}
+	return &luaSseInfo{
+		connected:   s.connected,
+		lastEventID: s.parser.lastEventID,
+		retry:       retry,
+		reconnects:  s.reconnects,
+	}
+}
+
+//export luatc_sse
+func luatc_sse(L *C.lua_State) C.int {
+	// Attempt to parse the request from the argument.
+	parsedRequest, err := luaReadHttpRawRequest(L, 1)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+	if parsedRequest.body != nil {
+		// The body could not be resent on reconnection.
+		luaNilPush(L)
+		luaStringPush(L, "sse does not support body")
+		return C.int(2)
+	}
+
+	// Create the event stream connect task and return.
+	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
+		// The connection outlives the task once the stream
+		// is established, so it is bound to its own context.
+		connCtx, connCancel := context.WithCancel(
+			context.Background())
+		result := &luaSseConn{
+			request:    parsedRequest,
+			ctx:        connCtx,
+			cancel:     connCancel,
+			statistics: newLuaConnStats(),
+		}
+		establishedCh := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				connCancel()
+			case <-establishedCh:
+			}
+		}()
+
+		// Establish the first stream before returning, so
+		// that the malformed request is reported.
+		response, err := result.connect()
+		close(establishedCh)
+		if err != nil {
+			connCancel()
+			return nil, err
+		}
+		go func() {
+			err := result.runSseReader(response)
+			result.receiveMtx.Lock()
+			defer result.receiveMtx.Unlock()
+			result.receiveErr = err
+		}()
+		return newLuaConnHandle(result), nil
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
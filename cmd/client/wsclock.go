@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaClockDefaultSamples is the default number of ping
+// exchanges of client.clocksync.
+const luaClockDefaultSamples = 8
+
+// luaClockMaxSamples is the maximum number of ping
+// exchanges of client.clocksync.
+const luaClockMaxSamples = 64
+
+// luaClockResyncSamples is the number of ping exchanges
+// of each resynchronization in the background.
+const luaClockResyncSamples = 4
+
+// luaClockResyncInterval is the interval between the
+// resynchronizations in the background.
+const luaClockResyncInterval = 10 * time.Second
+
+// luaClockPingTimeout is the timeout of each ping.
+const luaClockPingTimeout = 5 * time.Second
+
+// luaClockDrift is the relative drift between the local and
+// server clocks assumed, by which the error bound of the
+// estimate grows over time.
+const luaClockDrift = 1e-4
+
+// errClockNotSynced is returned by client.servertime before
+// the clock is synchronized.
+var errClockNotSynced = errors.New("clock not synchronized")
+
+// luaConnClock is the optional interface implemented by the
+// connections which the server clock could be synchronized
+// through using client.clocksync and client.servertime.
+type luaConnClock interface {
+	// clocksync exchanges the pings with the server, and
+	// keeps resynchronizing in the background afterwards.
+	clocksync(ctx context.Context, samples int) (luaTaskResult, error)
+
+	// servertime returns the estimated server time and its
+	// error bound.
+	servertime() (time.Time, time.Duration, error)
+}
+
+// luaClockEstimate is the estimated offset of server clock.
+type luaClockEstimate struct {
+	// offset is the server time minus the local time.
+	offset time.Duration
+
+	// bound is the error bound of the offset when estimated.
+	bound time.Duration
+
+	// rtt is the round trip time of the ping estimated from.
+	rtt time.Duration
+
+	// at is the local time when estimated.
+	at time.Time
+}
+
+// boundAt returns the error bound of the estimate at the
+// local time, which grows with the drift of clocks.
+func (e *luaClockEstimate) boundAt(now time.Time) time.Duration {
+	return e.bound + time.Duration(float64(now.Sub(e.at))*luaClockDrift)
+}
+
+// marshal the estimate as the result of client.clocksync.
+func (e *luaClockEstimate) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 3)
+	luaStringPush(L, "offset")
+	luaNumberPush(L, e.offset.Seconds()*1000)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "bound")
+	luaNumberPush(L, e.bound.Seconds()*1000)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "rtt")
+	luaNumberPush(L, e.rtt.Seconds()*1000)
+	luaTableRawSet(L, -3)
+}
+
+// ping exchanges a ping with the server in the realtime
+// lane, and estimates the offset from its pong.
+func (wsconn *luaWebSocketConn) ping(ctx context.Context) (*luaClockEstimate, error) {
+	ctx, cancel := context.WithTimeout(ctx, luaClockPingTimeout)
+	defer cancel()
+	sent := time.Now()
+	result, err := wsconn.callLane(ctx, luaConnLaneRealtime, "ping", nil)
+	if err != nil {
+		return nil, err
+	}
+	received := time.Now()
+	value, _ := luaWebSocketField(result.value, "time")
+	millis, ok := luaWebSocketInteger(value)
+	if !ok {
+		return nil, errors.New("invalid time of pong")
+	}
+
+	// The server time is assumed to be read at the middle
+	// of the round trip, which is wrong by rtt/2 at most,
+	// plus the millisecond resolution of the server time.
+	rtt := received.Sub(sent)
+	middle := sent.Add(rtt / 2)
+	server := time.Unix(0, millis*int64(time.Millisecond))
+	return &luaClockEstimate{
+		offset: server.Sub(middle),
+		bound:  rtt/2 + time.Millisecond,
+		rtt:    rtt,
+		at:     middle,
+	}, nil
+}
+
+// sync exchanges the pings, and updates the estimate with
+// the one of the shortest round trip if it is better.
+func (wsconn *luaWebSocketConn) sync(
+	ctx context.Context, samples int,
+) (*luaClockEstimate, error) {
+	var best *luaClockEstimate
+	for i := 0; i < samples; i++ {
+		estimate, err := wsconn.ping(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || estimate.rtt < best.rtt {
+			best = estimate
+		}
+	}
+	wsconn.clockMtx.Lock()
+	defer wsconn.clockMtx.Unlock()
+	current := wsconn.clock
+	if current == nil || best.bound <= current.boundAt(best.at) {
+		wsconn.clock = best
+	}
+	return best, nil
+}
+
+// runClockSync resynchronizes the clock in the background
+// until the connection closes.
+func (wsconn *luaWebSocketConn) runClockSync() {
+	ticker := time.NewTicker(luaClockResyncInterval)
+	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-wsconn.closeCh
+		cancel()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The failures are ignored since the estimate is
+		// still usable with the growing bound.
+		_, _ = wsconn.sync(ctx, luaClockResyncSamples)
+	}
+}
+
+// clocksync implements the luaConnClock.clocksync for
+// luaWebSocketConn.
+func (wsconn *luaWebSocketConn) clocksync(
+	ctx context.Context, samples int,
+) (luaTaskResult, error) {
+	estimate, err := wsconn.sync(ctx, samples)
+	if err != nil {
+		return nil, err
+	}
+	wsconn.clockMtx.Lock()
+	defer wsconn.clockMtx.Unlock()
+	if !wsconn.clockRunning {
+		wsconn.clockRunning = true
+		go wsconn.runClockSync()
+	}
+	return estimate, nil
+}
+
+// servertime implements the luaConnClock.servertime for
+// luaWebSocketConn.
+func (wsconn *luaWebSocketConn) servertime() (time.Time, time.Duration, error) {
+	wsconn.clockMtx.Lock()
+	defer wsconn.clockMtx.Unlock()
+	if wsconn.clock == nil {
+		return time.Time{}, 0, errClockNotSynced
+	}
+	now := time.Now()
+	return now.Add(wsconn.clock.offset), wsconn.clock.boundAt(now), nil
+}
+
+// luaClockLookup attempts to cast the connection at the
+// specified index into a clock.
+func luaClockLookup(L *C.lua_State, index int) (*luaConnHandle, luaConnClock, error) {
+	connHandle, ok := luaGcLookup(L, index).(*luaConnHandle)
+	if !ok {
+		return nil, nil, errors.New("not main.luaConnHandle")
+	}
+	clock, ok := connHandle.conn.(luaConnClock)
+	if !ok {
+		return nil, nil, errors.New("connection not synchronizable")
+	}
+	return connHandle, clock, nil
+}
+
+//export luatc_clocksync
+func luatc_clocksync(L *C.lua_State) C.int {
+	connHandle, clock, err := luaClockLookup(L, 1)
+	samples := luaClockDefaultSamples
+	if typeOf := luaTypeOf(L, 2); err == nil && typeOf == luaTypeNumber {
+		samples = int(luaNumberGet(L, 2))
+		if samples < 1 || samples > luaClockMaxSamples {
+			err = errors.New("invalid samples argument")
+		}
+	} else if err == nil && typeOf != luaTypeNil && typeOf != luaTypeNone {
+		err = errors.New("invalid samples argument")
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Create the synchronization task and return.
+	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
+		result, err := clock.clocksync(ctx, samples)
+		runtime.KeepAlive(connHandle)
+		return result, err
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
+
+//export luatc_servertime
+func luatc_servertime(L *C.lua_State) C.int {
+	_, clock, err := luaClockLookup(L, 1)
+	var now time.Time
+	var bound time.Duration
+	if err == nil {
+		now, bound, err = clock.servertime()
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		// return nil, nil, err
+		luaNilPush(L)
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(3)
+	}
+
+	// return time, bound, nil
+	luaNumberPush(L, float64(now.UnixNano())/float64(time.Millisecond))
+	luaNumberPush(L, bound.Seconds()*1000)
+	luaNilPush(L)
+	return C.int(3)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaWebSocketCodec converts between the lua values and the
+// websocket frames. The conversion from and to the lua stack
+// is performed on the lua thread, while the encoding and
+// decoding are performed in the websocket goroutines.
+type luaWebSocketCodec interface {
+	// read converts the lua value at the specified index
+	// into the go value to encode.
+	read(L *C.lua_State, idx int) (interface{}, error)
+
+	// convert the value in the form returned by luaValueGet
+	// into the go value to encode.
+	convert(value interface{}) (interface{}, error)
+
+	// encode the go value into the payload of frame.
+	encode(value interface{}) ([]byte, error)
+
+	// decode the payload of frame into the go value.
+	decode(frame []byte) (interface{}, error)
+
+	// push the decoded go value onto the lua stack, and
+	// nothing is pushed on error.
+	push(L *C.lua_State, value interface{}) error
+
+	// text returns whether the frames are sent as text
+	// frames instead of binary frames.
+	text() bool
+}
+
+// luaWebSocketCodecs are the codecs that could be specified
+// in the codec field of client.wsraw.
+var luaWebSocketCodecs = map[string]luaWebSocketCodec{
+	"raw":     luaWebSocketRawCodec{},
+	"json":    luaWebSocketJsonCodec{},
+	"msgpack": luaWebSocketMsgpackCodec{},
+}
+
+// parseLuaWebSocketCodec looks up the codec by its name.
+func parseLuaWebSocketCodec(name string) (luaWebSocketCodec, error) {
+	codec, ok := luaWebSocketCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid codec %q", name)
+	}
+	return codec, nil
+}
+
+// luaWebSocketRawCodec transfers the strings as they are.
+type luaWebSocketRawCodec struct{}
+
+// read implements luaWebSocketCodec.read for raw codec.
+func (luaWebSocketRawCodec) read(L *C.lua_State, idx int) (interface{}, error) {
+	if luaTypeOf(L, idx) != luaTypeString {
+		return nil, errors.New("invalid argument type")
+	}
+	return luaBytesGet(L, idx), nil
+}
+
+// convert implements luaWebSocketCodec.convert for raw codec.
+func (luaWebSocketRawCodec) convert(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	default:
+		return nil, errors.New("invalid argument type")
+	}
+}
+
+// encode implements luaWebSocketCodec.encode for raw codec.
+func (luaWebSocketRawCodec) encode(value interface{}) ([]byte, error) {
+	return value.([]byte), nil
+}
+
+// decode implements luaWebSocketCodec.decode for raw codec.
+func (luaWebSocketRawCodec) decode(frame []byte) (interface{}, error) {
+	return frame, nil
+}
+
+// push implements luaWebSocketCodec.push for raw codec.
+func (luaWebSocketRawCodec) push(L *C.lua_State, value interface{}) error {
+	luaBytesPush(L, value.([]byte))
+	return nil
+}
+
+// text implements luaWebSocketCodec.text for raw codec.
+func (luaWebSocketRawCodec) text() bool {
+	return false
+}
+
+// luaWebSocketJsonCodec transfers the lua values as json
+// text frames, just like client.json.
+type luaWebSocketJsonCodec struct{}
+
+// read implements luaWebSocketCodec.read for json codec.
+func (luaWebSocketJsonCodec) read(L *C.lua_State, idx int) (interface{}, error) {
+	return luaReadJson(L, idx, &luaJsonOptions)
+}
+
+// convert implements luaWebSocketCodec.convert for json codec.
+func (luaWebSocketJsonCodec) convert(value interface{}) (interface{}, error) {
+	return luaJsonValue(value)
+}
+
+// encode implements luaWebSocketCodec.encode for json codec.
+func (luaWebSocketJsonCodec) encode(value interface{}) ([]byte, error) {
+	return encodeJson(value)
+}
+
+// decode implements luaWebSocketCodec.decode for json codec.
+func (luaWebSocketJsonCodec) decode(frame []byte) (interface{}, error) {
+	return decodeJson(frame, &luaJsonOptions)
+}
+
+// push implements luaWebSocketCodec.push for json codec.
+func (luaWebSocketJsonCodec) push(L *C.lua_State, value interface{}) error {
+	return luaValuePush(L, value, &luaJsonOptions)
+}
+
+// text implements luaWebSocketCodec.text for json codec.
+func (luaWebSocketJsonCodec) text() bool {
+	return true
+}
+
+// luaWebSocketMsgpackCodec transfers the lua values as
+// msgpack binary frames, just like client.msgpack.
+type luaWebSocketMsgpackCodec struct{}
+
+// read implements luaWebSocketCodec.read for msgpack codec.
+func (luaWebSocketMsgpackCodec) read(L *C.lua_State, idx int) (interface{}, error) {
+	return luaValueGet(L, idx, &luaMsgpackOptions)
+}
+
+// convert implements luaWebSocketCodec.convert for msgpack codec.
+func (luaWebSocketMsgpackCodec) convert(value interface{}) (interface{}, error) {
+	return value, nil
+}
+
+// encode implements luaWebSocketCodec.encode for msgpack codec.
+func (luaWebSocketMsgpackCodec) encode(value interface{}) ([]byte, error) {
+	return packMsgpack(value)
+}
+
+// decode implements luaWebSocketCodec.decode for msgpack codec.
+func (luaWebSocketMsgpackCodec) decode(frame []byte) (interface{}, error) {
+	return unpackMsgpack(frame, &luaMsgpackOptions)
+}
+
+// push implements luaWebSocketCodec.push for msgpack codec.
+func (luaWebSocketMsgpackCodec) push(L *C.lua_State, value interface{}) error {
+	return luaValuePush(L, value, &luaMsgpackOptions)
+}
+
+// text implements luaWebSocketCodec.text for msgpack codec.
+func (luaWebSocketMsgpackCodec) text() bool {
+	return false
+}
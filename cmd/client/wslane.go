@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaWebSocketFragmentSize is the maximum size of encoded
+// bulk values sent in a single frame, the larger ones are
+// split into fragments so that the frames of higher lanes
+// could be interleaved.
+const luaWebSocketFragmentSize = 16 << 10
+
+// luaWebSocketFragmentType is the type of the fragment
+// frames, which are { type = "fragment", fragment, index,
+// count, data }.
+const luaWebSocketFragmentType = "fragment"
+
+// luaWebSocketMaxAssembledSize is the maximum size of the
+// value reassembled from fragments, like the reference server.
+const luaWebSocketMaxAssembledSize = 1 << 20
+
+// errRawBulkTooLarge is returned when the bulk frame of the
+// raw codec is too large, since it could not be fragmented.
+var errRawBulkTooLarge = errors.New("bulk frame too large for raw codec")
+
+// luaWebSocketAssembly is the fragmented value being
+// received, which is only accessed by the reader.
+type luaWebSocketAssembly struct {
+	// id is the sequence number of the fragmented value.
+	id int64
+
+	// count is the number of fragments of the value.
+	count int64
+
+	// next is the index of the next fragment expected.
+	next int64
+
+	// data is the payload of the fragments received.
+	data []byte
+}
+
+// luaWebSocketInteger converts the integral number decoded
+// by the json or msgpack codec.
+func luaWebSocketInteger(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return value, true
+	case uint64:
+		return int64(value), value <= math.MaxInt64
+	case float64:
+		return int64(value), value == math.Trunc(value) &&
+			math.Abs(value) <= 1<<53
+	default:
+		return 0, false
+	}
+}
+
+// fragment splits the encoded bulk value into the encoded
+// fragment frames, or returns nil if it is small enough. The
+// large bulk frames of the raw codec, which could not carry
+// the fragments, are rejected when enqueued.
+func (wsconn *luaWebSocketConn) fragment(data []byte) ([][]byte, error) {
+	if len(data) <= luaWebSocketFragmentSize ||
+		luaWebSocketChannelOptions(wsconn.codec) == nil {
+		return nil, nil
+	}
+
+	// The text is split at the boundaries of characters,
+	// so that every fragment is still valid utf-8 text.
+	var chunks []string
+	for len(data) > 0 {
+		size := len(data)
+		if size > luaWebSocketFragmentSize {
+			size = luaWebSocketFragmentSize
+			for wsconn.codec.text() && size > 0 && !utf8.RuneStart(data[size]) {
+				size--
+			}
+			if size == 0 {
+				size = luaWebSocketFragmentSize
+			}
+		}
+		chunks = append(chunks, string(data[:size]))
+		data = data[size:]
+	}
+	wsconn.sendMtx.Lock()
+	wsconn.sendFragmentSeq++
+	id := wsconn.sendFragmentSeq
+	wsconn.sendMtx.Unlock()
+	result := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		value, err := wsconn.codec.convert(luaValueMap{
+			{"count", int64(len(chunks))},
+			{"data", chunk},
+			{"fragment", id},
+			{"index", int64(i)},
+			{"type", luaWebSocketFragmentType},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result[i], err = wsconn.codec.encode(value); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// reassemble collects the fragment frame, and returns the
+// frame of the value when its last fragment arrives. The
+// frames which are not fragments are returned as they are.
+func (wsconn *luaWebSocketConn) reassemble(
+	frame luaWebSocketFrame,
+) (luaWebSocketFrame, bool) {
+	if frame.err != nil {
+		return frame, true
+	}
+	if kind, _ := luaWebSocketField(frame.value, "type"); kind != luaWebSocketFragmentType {
+		return frame, true
+	}
+	id, idOk := luaWebSocketField(frame.value, "fragment")
+	index, indexOk := luaWebSocketField(frame.value, "index")
+	count, countOk := luaWebSocketField(frame.value, "count")
+	data, dataOk := luaWebSocketField(frame.value, "data")
+	chunk, isChunk := data.(string)
+	if !idOk || !indexOk || !countOk || !dataOk || !isChunk {
+		return frame, true
+	}
+	fragmentID, idOk := luaWebSocketInteger(id)
+	fragmentIndex, indexOk := luaWebSocketInteger(index)
+	fragmentCount, countOk := luaWebSocketInteger(count)
+	if !idOk || !indexOk || !countOk {
+		return frame, true
+	}
+
+	// The fragments of a value are sent consecutively, the
+	// assembly is restarted by the first fragment, and the
+	// fragments out of sequence are reported as errors.
+	assembly := &wsconn.receiveAssembly
+	if fragmentCount < 1 || fragmentIndex < 0 || fragmentIndex >= fragmentCount {
+		*assembly = luaWebSocketAssembly{}
+		frame.err = errors.New("invalid fragment")
+		return frame, true
+	}
+	if fragmentIndex == 0 {
+		*assembly = luaWebSocketAssembly{
+			id:    fragmentID,
+			count: fragmentCount,
+		}
+	} else if assembly.id != fragmentID || assembly.count != fragmentCount ||
+		assembly.next != fragmentIndex {
+		*assembly = luaWebSocketAssembly{}
+		frame.err = errors.New("fragment out of sequence")
+		return frame, true
+	}
+	if len(assembly.data)+len(chunk) > luaWebSocketMaxAssembledSize {
+		*assembly = luaWebSocketAssembly{}
+		frame.err = errors.New("message too large")
+		return frame, true
+	}
+	assembly.data = append(assembly.data, chunk...)
+	assembly.next++
+	if fragmentIndex+1 < fragmentCount {
+		return frame, false
+	}
+	result := luaWebSocketFrame{data: assembly.data}
+	result.value, result.err = wsconn.codec.decode(assembly.data)
+	*assembly = luaWebSocketAssembly{}
+	return result, true
+}
+
+// laneDepths returns the number of frames queued in each
+// lane, where the fragments are counted in the bulk lane.
+func (wsconn *luaWebSocketConn) laneDepths() [luaConnLaneCount]int {
+	wsconn.sendMtx.Lock()
+	defer wsconn.sendMtx.Unlock()
+	var result [luaConnLaneCount]int
+	for lane, queue := range wsconn.sendQueues {
+		result[lane] = len(queue)
+	}
+	result[luaConnLaneBulk] += len(wsconn.sendFragments)
+	return result
+}
+
+// luaWebSocketInspect is the state of websocket connection.
+type luaWebSocketInspect struct {
+	// lanes is the number of frames queued in each lane.
+	lanes [luaConnLaneCount]int
+}
+
+// marshal the state of connection to the lua stack.
+func (r *luaWebSocketInspect) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 1)
+	luaStringPush(L, "lanes")
+	luaTableNew(L, 0, int(luaConnLaneCount))
+	for lane, queued := range r.lanes {
+		luaStringPush(L, luaConnLaneNames[lane])
+		luaIntegerPush(L, queued)
+		luaTableRawSet(L, -3)
+	}
+	luaTableRawSet(L, -3)
+}
+
+// inspect implements the luaConnInspector.inspect for
+// luaWebSocketConn.
+func (wsconn *luaWebSocketConn) inspect() luaReadResult {
+	return &luaWebSocketInspect{lanes: wsconn.laneDepths()}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaWebSocketChannelDefaultBacklog is the default maximum
+// number of frames received by a channel and not read yet.
+const luaWebSocketChannelDefaultBacklog = 1024
+
+// errChannelClosed is the error of the channel closed.
+var errChannelClosed = errors.New("channel closed")
+
+// luaWebSocketChannel is the logical channel multiplexed
+// over the websocket connection, whose frames are wrapped
+// as { channel = name, data = value }.
+type luaWebSocketChannel struct {
+	// parent is the websocket connection multiplexed.
+	parent *luaWebSocketConn
+
+	// handle is the handle of parent, which is kept so that
+	// the parent is alive with the channel.
+	handle *luaConnHandle
+
+	// options to read the values written to the channel.
+	options *luaValueOptions
+
+	// name of the channel.
+	name string
+
+	// maxBacklog is the maximum number of frames queued,
+	// beyond which the socket is not read until the channel
+	// is read, so that the peer is slowed down.
+	maxBacklog int
+
+	// queue is the frames received, guarded by the
+	// receiveMtx of parent.
+	queue []luaWebSocketFrame
+
+	// received is the number of frames received, guarded
+	// by the receiveMtx of parent.
+	received int
+
+	// dropped is the number of frames received after the
+	// channel is closed, guarded by the receiveMtx of parent.
+	dropped int
+
+	// readyCh is the channel that is unblocked when the
+	// backlog is read or the channel is closed, which the
+	// reader waits for while the backlog is full. It is nil
+	// when the reader is not waiting, guarded by the
+	// receiveMtx of parent.
+	readyCh chan struct{}
+
+	// err is the error which the channel is closed with,
+	// guarded by the receiveMtx of parent.
+	err error
+
+	// statistics of the frames of the channel.
+	statistics *luaConnStats
+}
+
+// luaWebSocketChannelOptions returns the options to read
+// the values for the codec, or nil if the codec could not
+// carry the channel frames.
+func luaWebSocketChannelOptions(codec luaWebSocketCodec) *luaValueOptions {
+	switch codec.(type) {
+	case luaWebSocketJsonCodec:
+		return &luaJsonOptions
+	case luaWebSocketMsgpackCodec:
+		return &luaMsgpackOptions
+	default:
+		return nil
+	}
+}
+
+// demux delivers the frame to the channel it is wrapped
+// for, and returns whether it is consumed. The frames of
+// channels never opened are left to the parent, and those
+// of channels closed are counted and dropped. When the
+// backlog of the channel is full, the frame is not consumed
+// and the channel to wait for before retrying is returned.
+// The receiveMtx must be held.
+func (wsconn *luaWebSocketConn) demux(
+	frame luaWebSocketFrame,
+) (bool, chan struct{}) {
+	if frame.err != nil || len(wsconn.channels) == 0 {
+		return false, nil
+	}
+	name, ok := luaWebSocketField(frame.value, "channel")
+	if !ok {
+		return false, nil
+	}
+	key, ok := name.(string)
+	if !ok {
+		return false, nil
+	}
+	channel, ok := wsconn.channels[key]
+	if !ok {
+		return false, nil
+	}
+	if channel.err != nil {
+		channel.dropped++
+		return true, nil
+	}
+
+	// The reader stops reading the socket while the backlog
+	// is full, so that the peer is blocked by the transport
+	// instead of losing the frames.
+	if len(channel.queue) >= channel.maxBacklog {
+		if channel.readyCh == nil {
+			channel.readyCh = make(chan struct{})
+		}
+		return false, channel.readyCh
+	}
+	frame.value, _ = luaWebSocketField(frame.value, "data")
+	channel.queue = append(channel.queue, frame)
+	channel.received++
+	channel.statistics.received(frame.received, len(frame.data))
+	return true, nil
+}
+
+// wake unblocks the reader waiting for the backlog of the
+// channel. The receiveMtx of parent must be held.
+func (c *luaWebSocketChannel) wake() {
+	if c.readyCh != nil {
+		close(c.readyCh)
+		c.readyCh = nil
+	}
+}
+
+// wrap wraps the value as the frame of the channel.
+func (c *luaWebSocketChannel) wrap(value interface{}) interface{} {
+	return luaValueMap{
+		{"channel", c.name},
+		{"data", value},
+	}
+}
+
+// read implements the luaConn.read for luaWebSocketChannel.
+func (c *luaWebSocketChannel) read() (luaReadResult, error) {
+	c.parent.receiveMtx.Lock()
+	defer c.parent.receiveMtx.Unlock()
+	readResult := &luaWebSocketReadResult{codec: c.parent.codec}
+	readResult.frames, c.queue = c.queue, nil
+	c.wake()
+	luaWebSocketFramesRead(c.statistics, readResult.frames)
+	if c.err != nil {
+		return readResult, c.err
+	}
+	return readResult, c.parent.receiveErr
+}
+
+// closed returns the error if the channel is closed.
+func (c *luaWebSocketChannel) closed() error {
+	c.parent.receiveMtx.Lock()
+	defer c.parent.receiveMtx.Unlock()
+	return c.err
+}
+
+// write implements the luaConn.write for luaWebSocketChannel.
+func (c *luaWebSocketChannel) write(L *C.lua_State) error {
+	return c.writeLane(L, luaConnLaneNormal)
+}
+
+// writeLane implements the luaConnLaneWriter.writeLane for
+// luaWebSocketChannel.
+func (c *luaWebSocketChannel) writeLane(L *C.lua_State, lane luaConnLane) error {
+	if err := c.closed(); err != nil {
+		return err
+	}
+	top := luaStackTopGet(L)
+	var pendingFrames []interface{}
+	for i := 2; i <= top; i++ {
+		value, err := luaValueGet(L, i, c.options)
+		if err != nil {
+			return err
+		}
+		pendingFrames = append(pendingFrames, c.wrap(value))
+	}
+	return c.parent.sendChannel(lane, c.statistics, pendingFrames)
+}
+
+// send implements the luaConnSender.send for luaWebSocketChannel.
+func (c *luaWebSocketChannel) send(lane luaConnLane, values ...interface{}) error {
+	if err := c.closed(); err != nil {
+		return err
+	}
+	pendingFrames := make([]interface{}, len(values))
+	for i, value := range values {
+		pendingFrames[i] = c.wrap(value)
+	}
+	return c.parent.sendChannel(lane, c.statistics, pendingFrames)
+}
+
+// close implements the luaConn.close for luaWebSocketChannel,
+// and the channel is kept registered so that its frames are
+// dropped instead of leaking to the parent, until the name
+// is opened again.
+func (c *luaWebSocketChannel) close() {
+	c.parent.receiveMtx.Lock()
+	defer c.parent.receiveMtx.Unlock()
+	if c.err == nil {
+		c.err = errChannelClosed
+	}
+	c.queue = nil
+	c.wake()
+	c.statistics.close()
+
+	// The parent is released, otherwise the channel kept
+	// registered would keep the parent alive through it.
+	c.handle = nil
+}
+
+// stats implements the luaConnStatter.stats for
+// luaWebSocketChannel.
+func (c *luaWebSocketChannel) stats() *luaConnStats {
+	return c.statistics
+}
+
+// luaWebSocketChannelInspect is the state of the channel.
+type luaWebSocketChannelInspect struct {
+	// name of the channel.
+	name string
+
+	// queued is the number of frames not read.
+	queued int
+
+	// received is the number of frames received.
+	received int
+
+	// dropped is the number of frames dropped after closed.
+	dropped int
+
+	// paused indicates the socket is not read until the
+	// backlog of the channel is read.
+	paused bool
+
+	// err is the error which the channel is closed with.
+	err error
+}
+
+// marshal the state of the channel to the lua stack.
+func (r *luaWebSocketChannelInspect) marshal(L *C.lua_State) {
+	luaTableNew(L, 0, 6)
+	luaStringPush(L, "channel")
+	luaStringPush(L, r.name)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "queued")
+	luaIntegerPush(L, r.queued)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "received")
+	luaIntegerPush(L, r.received)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "dropped")
+	luaIntegerPush(L, r.dropped)
+	luaTableRawSet(L, -3)
+	luaStringPush(L, "paused")
+	luaBooleanPush(L, r.paused)
+	luaTableRawSet(L, -3)
+	if r.err != nil {
+		luaStringPush(L, "error")
+		luaStringPush(L, r.err.Error())
+		luaTableRawSet(L, -3)
+	}
+}
+
+// inspect implements the luaConnInspector.inspect for
+// luaWebSocketChannel.
+func (c *luaWebSocketChannel) inspect() luaReadResult {
+	c.parent.receiveMtx.Lock()
+	defer c.parent.receiveMtx.Unlock()
+	err := c.err
+	if err == nil {
+		err = c.parent.receiveErr
+	}
+	return &luaWebSocketChannelInspect{
+		name:     c.name,
+		queued:   len(c.queue),
+		received: c.received,
+		dropped:  c.dropped,
+		paused:   c.readyCh != nil,
+		err:      err,
+	}
+}
+
+// open registers the channel of the name, and the frames
+// of the channel are delivered to it afterwards.
+func (wsconn *luaWebSocketConn) open(
+	handle *luaConnHandle, name string, maxBacklog int,
+) (*luaWebSocketChannel, error) {
+	options := luaWebSocketChannelOptions(wsconn.codec)
+	if options == nil {
+		return nil, errors.New("channel requires json or msgpack codec")
+	}
+	wsconn.receiveMtx.Lock()
+	defer wsconn.receiveMtx.Unlock()
+	if wsconn.receiveErr != nil {
+		return nil, wsconn.receiveErr
+	}
+	if previous, ok := wsconn.channels[name]; ok && previous.err == nil {
+		return nil, fmt.Errorf("channel %q already opened", name)
+	}
+	channel := &luaWebSocketChannel{
+		parent:     wsconn,
+		handle:     handle,
+		options:    options,
+		name:       name,
+		maxBacklog: maxBacklog,
+		statistics: newLuaConnStats(),
+	}
+	wsconn.channels[name] = channel
+	return channel, nil
+}
+
+//export luatc_wschannel
+func luatc_wschannel(L *C.lua_State) C.int {
+	// First, attempt to cast the interface into a
+	// websocket connection to multiplex.
+	connHandle, ok := luaGcLookup(L, 1).(*luaConnHandle)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaConnHandle")
+		return C.int(2)
+	}
+	wsconn, ok := connHandle.conn.(*luaWebSocketConn)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not websocket connection")
+		return C.int(2)
+	}
+
+	// Second, read the name and backlog of the channel.
+	var err error
+	var name string
+	if luaTypeOf(L, 2) == luaTypeString && luaStringGet(L, 2) != "" {
+		name = luaStringGet(L, 2)
+	} else {
+		err = errors.New("missing name argument")
+	}
+	maxBacklog := luaWebSocketChannelDefaultBacklog
+	if typeOf := luaTypeOf(L, 3); err == nil && typeOf == luaTypeNumber {
+		maxBacklog = int(luaNumberGet(L, 3))
+		if maxBacklog < 1 {
+			err = errors.New("invalid maxbacklog argument")
+		}
+	} else if err == nil && typeOf != luaTypeNil && typeOf != luaTypeNone {
+		err = errors.New("invalid maxbacklog argument")
+	}
+	var channel *luaWebSocketChannel
+	if err == nil {
+		channel, err = wsconn.open(connHandle, name, maxBacklog)
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Third, push back the channel as a connection.
+	newLuaConnHandle(channel).marshal(L)
+	luaNilPush(L)
+	return C.int(2)
+}
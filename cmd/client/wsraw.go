@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,16 +26,32 @@ type luaWebSocketConn struct {
 	// communication.
 	conn *websocket.Conn
 
+	// codec converts between the lua values and frames.
+	codec luaWebSocketCodec
+
 	// sendMtx is the mutex for blocking the sending.
 	sendMtx sync.Mutex
 
-	// sendQueue for the websocket stream.
-	sendQueue [][]byte
+	// sendQueues for the websocket stream by lanes, which
+	// hold the values to encode by the codec.
+	sendQueues [luaConnLaneCount][]luaWebSocketSendItem
+
+	// sendFragments are the encoded fragments of the bulk
+	// value being sent, which are sent before other bulk
+	// values.
+	sendFragments []luaWebSocketSendItem
+
+	// sendFragmentSeq is the sequence number of the last
+	// value fragmented.
+	sendFragmentSeq int64
 
 	// sendWaitCh is the channel for waiting for send
-	// queue payloads.
+	// queue payloads, which is closed when ready.
 	sendWaitCh chan struct{}
 
+	// sendReady indicates the sendWaitCh has been closed.
+	sendReady bool
+
 	// sendErr is the error sending back to the caller.
 	sendErr error
 
@@ -42,46 +59,153 @@ type luaWebSocketConn struct {
 	receiveMtx sync.Mutex
 
 	// receiveQueue for the websocket stream.
-	receiveQueue [][]byte
+	receiveQueue []luaWebSocketFrame
 
 	// receiveErr is the error while running reader.
 	receiveErr error
 
+	// receiveAssembly is the fragmented value being
+	// received, which is only accessed by the reader.
+	receiveAssembly luaWebSocketAssembly
+
+	// rpcSeq is the sequence number of the last request
+	// sent by client.rpc, guarded by the receiveMtx.
+	rpcSeq uint64
+
+	// rpcPending are the channels waiting for responses by
+	// the id of requests, guarded by the receiveMtx.
+	rpcPending map[string]chan luaWebSocketFrame
+
+	// channels are the logical channels multiplexed over
+	// the connection by name, guarded by the receiveMtx.
+	channels map[string]*luaWebSocketChannel
+
+	// clockMtx is the mutex for the clock synchronization.
+	clockMtx sync.Mutex
+
+	// clock is the estimated offset of server clock, nil
+	// before synchronized.
+	clock *luaClockEstimate
+
+	// clockRunning indicates the clock is resynchronizing
+	// in the background.
+	clockRunning bool
+
+	// statistics of the connection, which is carried over
+	// from the previous connection when reconnected.
+	statistics *luaConnStats
+
 	// closeCh is the channel that is unblocked when
 	// the websocket should close.
 	closeCh chan struct{}
 }
 
+// luaWebSocketSendItem is a value queued to send.
+type luaWebSocketSendItem struct {
+	// value to encode by the codec.
+	value interface{}
+
+	// data is the encoded value, which is only present for
+	// the fragments.
+	data []byte
+
+	// queued is the local time when the value is queued.
+	queued time.Time
+
+	// channel is the statistics of the channel which the
+	// value is sent through, nil if it is not.
+	channel *luaConnStats
+}
+
 // runWebSocketWriter executes the websocket writer for
 // a websocket connection.
 func (wsconn *luaWebSocketConn) runWebSocketWriter() error {
 	defer func() { _ = wsconn.conn.Close() }()
 	for {
-		// Wait for the socket closing or new content.
-		select {
-		case <-wsconn.closeCh:
-			return errors.New("connection closed")
-		case <-wsconn.sendWaitCh:
+		// Pop the next item of the highest lane, or wait
+		// for the socket closing or new content.
+		item, lane, sendWaitCh := wsconn.dequeue()
+		if sendWaitCh != nil {
+			select {
+			case <-wsconn.closeCh:
+				return errors.New("connection closed")
+			case <-sendWaitCh:
+			}
+			continue
 		}
 
-		// Swap out the send queue content and write
-		// out to the websocket writer.
-		swappedSendQueue := func() (result [][]byte) {
-			wsconn.sendMtx.Lock()
-			defer wsconn.sendMtx.Unlock()
-			result, wsconn.sendQueue = wsconn.sendQueue, nil
-			wsconn.sendWaitCh = make(chan struct{})
-			return
-		}()
-
-		// Attempt to write out to the writer.
-		for _, item := range swappedSendQueue {
-			err := websocket.Message.Send(wsconn.conn, item)
-			if err != nil {
+		// Encode the item, and the large bulk item is split
+		// into fragments to be sent among other lanes.
+		data := item.data
+		if data == nil {
+			var err error
+			if data, err = wsconn.codec.encode(item.value); err != nil {
 				return err
 			}
+			if lane == luaConnLaneBulk {
+				fragments, err := wsconn.fragment(data)
+				if err != nil {
+					return err
+				}
+				if fragments != nil {
+					wsconn.sendMtx.Lock()
+					wsconn.sendFragments = make([]luaWebSocketSendItem, len(fragments))
+					for i, fragment := range fragments {
+						wsconn.sendFragments[i] = item
+						wsconn.sendFragments[i].value = nil
+						wsconn.sendFragments[i].data = fragment
+					}
+					wsconn.sendMtx.Unlock()
+					continue
+				}
+			}
+		}
+
+		// Attempt to write out to the writer.
+		var err error
+		if wsconn.codec.text() {
+			err = websocket.Message.Send(wsconn.conn, string(data))
+		} else {
+			err = websocket.Message.Send(wsconn.conn, data)
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		wsconn.statistics.sent(now, item.queued, len(data))
+		if item.channel != nil {
+			item.channel.sent(now, item.queued, len(data))
+		}
+	}
+}
+
+// dequeue pops the value of the highest lane, or the next
+// fragment before the bulk values. The channel to wait for is
+// returned if there's nothing to send.
+func (wsconn *luaWebSocketConn) dequeue() (
+	item luaWebSocketSendItem, lane luaConnLane, sendWaitCh chan struct{},
+) {
+	wsconn.sendMtx.Lock()
+	defer wsconn.sendMtx.Unlock()
+	for lane = 0; lane < luaConnLaneCount; lane++ {
+		if lane == luaConnLaneBulk && len(wsconn.sendFragments) > 0 {
+			item = wsconn.sendFragments[0]
+			wsconn.sendFragments[0] = luaWebSocketSendItem{}
+			wsconn.sendFragments = wsconn.sendFragments[1:]
+			return item, lane, nil
 		}
+		if queue := wsconn.sendQueues[lane]; len(queue) > 0 {
+			item = queue[0]
+			queue[0] = luaWebSocketSendItem{}
+			wsconn.sendQueues[lane] = queue[1:]
+			return item, lane, nil
+		}
+	}
+	if wsconn.sendReady {
+		wsconn.sendWaitCh = make(chan struct{})
+		wsconn.sendReady = false
 	}
+	return item, 0, wsconn.sendWaitCh
 }
 
 // runWebSocketReader executes the websocket reader for
@@ -120,67 +244,211 @@ func (wsconn *luaWebSocketConn) runWebSocketReader() error {
 			// For other cases, also return the error to caller.
 			return netErr
 		}
+		received := time.Now()
+		wsconn.statistics.received(received, len(data))
+
+		// Decode the frame and append the item into the
+		// receive queue, the frame failed to decode is kept
+		// along with its error. The fragments are collected
+		// until the value is complete. The responses to client.rpc
+		// and the frames of channels are dispatched to their
+		// receivers instead.
+		frame := luaWebSocketFrame{data: data}
+		frame.value, frame.err = wsconn.codec.decode(data)
+		frame, complete := wsconn.reassemble(frame)
+		if !complete {
+			continue
+		}
+		frame.received = received
+		for {
+			readyCh := func() chan struct{} {
+				wsconn.receiveMtx.Lock()
+				defer wsconn.receiveMtx.Unlock()
+				if wsconn.dispatch(frame) {
+					return nil
+				}
+				consumed, readyCh := wsconn.demux(frame)
+				if !consumed && readyCh == nil {
+					wsconn.receiveQueue = append(wsconn.receiveQueue, frame)
+				}
+				return readyCh
+			}()
+			if readyCh == nil {
+				break
+			}
 
-		// Append the item into the receive queue.
-		func() {
-			wsconn.receiveMtx.Lock()
-			defer wsconn.receiveMtx.Unlock()
-			wsconn.receiveQueue = append(wsconn.receiveQueue, data)
-		}()
+			// The backlog of the channel is full, so the
+			// socket is not read until it is read or closed.
+			select {
+			case <-wsconn.closeCh:
+				return errors.New("connection closed")
+			case <-readyCh:
+			}
+		}
 	}
 }
 
+// luaWebSocketFrame is a frame received from websocket.
+type luaWebSocketFrame struct {
+	// data is the payload of the frame.
+	data []byte
+
+	// value is the payload decoded by the codec.
+	value interface{}
+
+	// err is the error while decoding the frame.
+	err error
+
+	// received is the local time when the frame is
+	// received completely.
+	received time.Time
+}
+
 // luaWebSocketReadResult is multiple frames read using
 // the read interface of websocket connection.
 type luaWebSocketReadResult struct {
+	// codec to push the decoded frames.
+	codec luaWebSocketCodec
+
 	// frames are the received frames from the websocket.
-	frames [][]byte
+	frames []luaWebSocketFrame
 }
 
 // marshal the websocket read result to lua stack.
 func (r *luaWebSocketReadResult) marshal(L *C.lua_State) {
 	luaTableNew(L, len(r.frames), 0)
+	errs := make(map[int]error)
 	for i := 0; i < len(r.frames); i++ {
-		luaBytesPush(L, r.frames[i])
+		err := r.frames[i].err
+		if err == nil {
+			err = r.codec.push(L, r.frames[i].value)
+		}
+		if err != nil {
+			luaBytesPush(L, r.frames[i].data)
+			errs[i+1] = err
+		}
 		luaTableRawSeti(L, -2, i+1)
 	}
+
+	// The frames failed to decode are placed as they are,
+	// and their errors are reported in the errors field.
+	if len(errs) == 0 {
+		return
+	}
+	luaStringPush(L, "errors")
+	luaTableNew(L, 0, len(errs))
+	for i, err := range errs {
+		luaStringPush(L, err.Error())
+		luaTableRawSeti(L, -2, i)
+	}
+	luaTableRawSet(L, -3)
 }
 
 // read implements the luaConn.read for luaWebSocketConn.
 func (wsconn *luaWebSocketConn) read() (luaReadResult, error) {
 	wsconn.receiveMtx.Lock()
 	defer wsconn.receiveMtx.Unlock()
-	readResult := &luaWebSocketReadResult{}
+	readResult := &luaWebSocketReadResult{codec: wsconn.codec}
 	readResult.frames, wsconn.receiveQueue = wsconn.receiveQueue, nil
+	luaWebSocketFramesRead(wsconn.statistics, readResult.frames)
 	return readResult, wsconn.receiveErr
 }
 
+// luaWebSocketFramesRead records the frames read by the lua
+// side into the statistics.
+func luaWebSocketFramesRead(stats *luaConnStats, frames []luaWebSocketFrame) {
+	now := time.Now()
+	for _, frame := range frames {
+		stats.read(now, frame.received)
+	}
+}
+
 // write implements the luaConn.write for luaWebSocketConn.
 func (wsconn *luaWebSocketConn) write(L *C.lua_State) error {
+	return wsconn.writeLane(L, luaConnLaneNormal)
+}
+
+// writeLane implements the luaConnLaneWriter.writeLane for
+// luaWebSocketConn.
+func (wsconn *luaWebSocketConn) writeLane(L *C.lua_State, lane luaConnLane) error {
 	// Attempt to read the pending frames on the lua stack.
 	top := luaStackTopGet(L)
-	var pendingFrames [][]byte
+	var pendingFrames []interface{}
 	for i := 2; i <= top; i++ {
-		if luaTypeOf(L, i) != luaTypeString {
-			return errors.New("invalid argument type")
+		value, err := wsconn.codec.read(L, i)
+		if err != nil {
+			return err
 		}
 
-		pendingFrames = append(pendingFrames, luaBytesGet(L, i))
+		pendingFrames = append(pendingFrames, value)
 	}
+	return wsconn.enqueue(lane, nil, pendingFrames)
+}
+
+// send implements the luaConnSender.send for luaWebSocketConn.
+func (wsconn *luaWebSocketConn) send(lane luaConnLane, values ...interface{}) error {
+	return wsconn.sendChannel(lane, nil, values)
+}
 
-	// Emplace the read content to the writer goroutine.
+// sendChannel is like send, but the values are measured in
+// the statistics of the channel as well.
+func (wsconn *luaWebSocketConn) sendChannel(
+	lane luaConnLane, channel *luaConnStats, values []interface{},
+) error {
+	pendingFrames := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		item, err := wsconn.codec.convert(value)
+		if err != nil {
+			return err
+		}
+		pendingFrames = append(pendingFrames, item)
+	}
+	return wsconn.enqueue(lane, channel, pendingFrames)
+}
+
+// enqueue emplaces the values to encode to the writer
+// goroutine in the lane, and returns the error of writer
+// if any. The large bulk frames of the raw codec are
+// rejected, since they could not be fragmented.
+func (wsconn *luaWebSocketConn) enqueue(
+	lane luaConnLane, channel *luaConnStats, pendingFrames []interface{},
+) error {
+	if _, ok := wsconn.codec.(luaWebSocketRawCodec); ok && lane == luaConnLaneBulk {
+		for _, value := range pendingFrames {
+			if data, _ := value.([]byte); len(data) > luaWebSocketFragmentSize {
+				return errRawBulkTooLarge
+			}
+		}
+	}
 	wsconn.sendMtx.Lock()
 	defer wsconn.sendMtx.Unlock()
-	if len(wsconn.sendQueue) == 0 {
+	if len(pendingFrames) == 0 {
+		return wsconn.sendErr
+	}
+	if !wsconn.sendReady {
 		close(wsconn.sendWaitCh)
-		wsconn.sendWaitCh = nil
+		wsconn.sendReady = true
+	}
+	now := time.Now()
+	for _, value := range pendingFrames {
+		wsconn.sendQueues[lane] = append(wsconn.sendQueues[lane], luaWebSocketSendItem{
+			value:   value,
+			queued:  now,
+			channel: channel,
+		})
 	}
-	wsconn.sendQueue = append(wsconn.sendQueue, pendingFrames...)
 	return wsconn.sendErr
 }
 
+// stats implements the luaConnStatter.stats for
+// luaWebSocketConn.
+func (wsconn *luaWebSocketConn) stats() *luaConnStats {
+	return wsconn.statistics
+}
+
 // close implements the luaConn.close for luaWebSocketConn.
 func (wsconn *luaWebSocketConn) close() {
+	wsconn.statistics.close()
 	close(wsconn.closeCh)
 }
 
@@ -254,6 +522,60 @@ func luatc_wsraw(L *C.lua_State) C.int {
 	}
 	config.Header = parsedHeader
 
+	// Attempt to fetch the codec of frames from the table.
+	var codec luaWebSocketCodec = luaWebSocketRawCodec{}
+	luaStringPush(L, "codec")
+	luaTableRawGet(L, 1)
+	if typeOf := luaTypeOf(L, -1); typeOf == luaTypeString {
+		var codecErr error
+		codec, codecErr = parseLuaWebSocketCodec(luaStringGet(L, -1))
+		if codecErr != nil {
+			luaNilPush(L)
+			luaStringPush(L, codecErr.Error())
+			return C.int(2)
+		}
+	} else if typeOf != luaTypeNil {
+		luaNilPush(L)
+		luaStringPush(L, "invalid codec argument")
+		return C.int(2)
+	}
+	luaStackPop(L, 1)
+
+	// Attempt to fetch the previous connection from the
+	// table, whose statistics are carried over.
+	var stats *luaConnStats
+	luaStringPush(L, "stats")
+	luaTableRawGet(L, 1)
+	if typeOf := luaTypeOf(L, -1); typeOf != luaTypeNil {
+		var statsErr error
+		if stats, statsErr = luaConnStatsLookup(L, -1); statsErr != nil {
+			luaNilPush(L)
+			luaStringPush(L, "invalid stats argument")
+			return C.int(2)
+		}
+	}
+	luaStackPop(L, 1)
+
+	// Attach the cookies in the jar to the handshake, so
+	// that the sessions of httpraw could be carried over.
+	cookieURL := *parsedURL
+	switch cookieURL.Scheme {
+	case "ws":
+		cookieURL.Scheme = "http"
+	case "wss":
+		cookieURL.Scheme = "https"
+	}
+	var cookies []string
+	if cookie := config.Header.Get("Cookie"); cookie != "" {
+		cookies = append(cookies, cookie)
+	}
+	for _, cookie := range rawCookies.Cookies(&cookieURL) {
+		cookies = append(cookies, cookie.String())
+	}
+	if len(cookies) > 0 {
+		config.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
 	// Create the websocket connect task and return.
 	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
 		var err error
@@ -266,11 +588,21 @@ func luatc_wsraw(L *C.lua_State) C.int {
 		}
 
 		// Create the connection instance and return.
+		if stats == nil {
+			stats = newLuaConnStats()
+		} else {
+			stats.resume()
+		}
 		result := &luaWebSocketConn{
 			conn:       conn,
+			codec:      codec,
 			sendWaitCh: make(chan struct{}),
+			rpcPending: make(map[string]chan luaWebSocketFrame),
+			channels:   make(map[string]*luaWebSocketChannel),
+			statistics: stats,
 			closeCh:    make(chan struct{}),
 		}
+		stats.attachLanes(result.laneDepths)
 		go func() {
 			err := result.runWebSocketWriter()
 			result.sendMtx.Lock()
@@ -282,6 +614,10 @@ func luatc_wsraw(L *C.lua_State) C.int {
 			result.receiveMtx.Lock()
 			defer result.receiveMtx.Unlock()
 			result.receiveErr = err
+			for id, ch := range result.rpcPending {
+				close(ch)
+				delete(result.rpcPending, id)
+			}
 		}()
 		return newLuaConnHandle(result), nil
 	})
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+#include "client.h"
+*/
+import "C"
+
+// luaRpcIDPrefix is the prefix of the id of requests sent
+// by client.rpc, so that they will not be confused with the
+// numeric ids hand-rolled by the lua side.
+const luaRpcIDPrefix = "rpc:"
+
+// luaRpcParamsOptions are the options to read the params
+// of requests, which are merged into the request.
+var luaRpcParamsOptions = luaValueOptions{
+	maxDepth: luaValueDefaultDepth,
+	null:     true,
+}
+
+// luaWebSocketField looks up the field of the decoded value
+// by the key, which is a json object or a msgpack map.
+func luaWebSocketField(value interface{}, key string) (interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		result, ok := value[key]
+		return result, ok
+	case luaValueMap:
+		for _, pair := range value {
+			if pair.key == key {
+				return pair.value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// dispatch delivers the frame to the caller of client.rpc
+// if it is the response to a pending request, and returns
+// whether it is consumed. The receiveMtx must be held.
+func (wsconn *luaWebSocketConn) dispatch(frame luaWebSocketFrame) bool {
+	if frame.err != nil || len(wsconn.rpcPending) == 0 {
+		return false
+	}
+	id, ok := luaWebSocketField(frame.value, "id")
+	if !ok {
+		return false
+	}
+	key, ok := id.(string)
+	if !ok {
+		return false
+	}
+	ch, ok := wsconn.rpcPending[key]
+	if !ok {
+		return false
+	}
+	delete(wsconn.rpcPending, key)
+	ch <- frame
+	return true
+}
+
+// luaWebSocketRpcResult is the response of client.rpc.
+type luaWebSocketRpcResult struct {
+	// codec to push the decoded response.
+	codec luaWebSocketCodec
+
+	// value is the decoded response.
+	value interface{}
+}
+
+// marshal the response to the lua stack.
+func (r *luaWebSocketRpcResult) marshal(L *C.lua_State) {
+	if err := r.codec.push(L, r.value); err != nil {
+		luaNilPush(L)
+	}
+}
+
+// call implements the luaConnCaller.call for luaWebSocketConn.
+func (wsconn *luaWebSocketConn) call(
+	ctx context.Context, method string, params luaValueMap,
+) (luaTaskResult, error) {
+	result, err := wsconn.callLane(ctx, luaConnLaneNormal, method, params)
+	if result == nil {
+		return nil, err
+	}
+	return result, err
+}
+
+// callLane is like call, but the request is sent in the
+// specified lane.
+func (wsconn *luaWebSocketConn) callLane(
+	ctx context.Context, lane luaConnLane, method string, params luaValueMap,
+) (*luaWebSocketRpcResult, error) {
+	if _, ok := wsconn.codec.(luaWebSocketRawCodec); ok {
+		return nil, errors.New("connection not callable with raw codec")
+	}
+
+	// Register the request before sending, so that the
+	// response will not be missed by the reader.
+	wsconn.receiveMtx.Lock()
+	if wsconn.receiveErr != nil {
+		err := wsconn.receiveErr
+		wsconn.receiveMtx.Unlock()
+		return nil, err
+	}
+	wsconn.rpcSeq++
+	id := luaRpcIDPrefix + strconv.FormatUint(wsconn.rpcSeq, 10)
+	ch := make(chan luaWebSocketFrame, 1)
+	wsconn.rpcPending[id] = ch
+	wsconn.receiveMtx.Unlock()
+	defer func() {
+		wsconn.receiveMtx.Lock()
+		defer wsconn.receiveMtx.Unlock()
+		delete(wsconn.rpcPending, id)
+	}()
+
+	// Send the request with the type and id overriding
+	// the fields of params.
+	request := make(luaValueMap, 0, len(params)+2)
+	for _, pair := range params {
+		if pair.key != "id" && pair.key != "type" {
+			request = append(request, pair)
+		}
+	}
+	request = append(request,
+		luaValuePair{key: "id", value: id},
+		luaValuePair{key: "type", value: method})
+	sort.Slice(request, func(i, j int) bool {
+		return luaValueKeyLess(request[i].key, request[j].key)
+	})
+	if err := wsconn.send(lane, request); err != nil {
+		return nil, err
+	}
+
+	// Wait for the response, or the connection failure.
+	var frame luaWebSocketFrame
+	var ok bool
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case frame, ok = <-ch:
+	}
+	if !ok {
+		wsconn.receiveMtx.Lock()
+		defer wsconn.receiveMtx.Unlock()
+		return nil, wsconn.receiveErr
+	}
+	result := &luaWebSocketRpcResult{
+		codec: wsconn.codec,
+		value: frame.value,
+	}
+	if kind, _ := luaWebSocketField(frame.value, "type"); kind == "error" {
+		message, ok := luaWebSocketField(frame.value, "error")
+		if text, isText := message.(string); ok && isText {
+			return result, errors.New(text)
+		}
+		return result, errors.New("rpc failed")
+	}
+	return result, nil
+}
+
+//export luatc_rpc
+func luatc_rpc(L *C.lua_State) C.int {
+	// First, attempt to cast the interface into a conn
+	// which requests could be sent through.
+	connHandle, ok := luaGcLookup(L, 1).(*luaConnHandle)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "not main.luaConnHandle")
+		return C.int(2)
+	}
+	caller, ok := connHandle.conn.(luaConnCaller)
+	if !ok {
+		luaStackTopSet(L, 0)
+		luaNilPush(L)
+		luaStringPush(L, "connection not callable")
+		return C.int(2)
+	}
+
+	// Second, read the method, params and timeout.
+	var err error
+	var method string
+	if luaTypeOf(L, 2) == luaTypeString {
+		method = luaStringGet(L, 2)
+	} else {
+		err = errors.New("missing method argument")
+	}
+	var params luaValueMap
+	if typeOf := luaTypeOf(L, 3); err == nil && typeOf == luaTypeTable {
+		var value interface{}
+		value, err = luaValueGet(L, 3, &luaRpcParamsOptions)
+		switch value := value.(type) {
+		case luaValueMap:
+			params = value
+		case []interface{}:
+			if len(value) > 0 {
+				err = errors.New("invalid params argument")
+			}
+		}
+	} else if err == nil && typeOf != luaTypeNil && typeOf != luaTypeNone {
+		err = errors.New("invalid params argument")
+	}
+	var timeout time.Duration
+	if typeOf := luaTypeOf(L, 4); err == nil && typeOf == luaTypeNumber {
+		seconds := luaNumberGet(L, 4)
+		if !(seconds > 0) || seconds > math.MaxInt64/float64(time.Second) {
+			err = errors.New("invalid timeout argument")
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	} else if err == nil && typeOf != luaTypeNil && typeOf != luaTypeNone {
+		err = errors.New("invalid timeout argument")
+	}
+	luaStackTopSet(L, 0)
+	if err != nil {
+		luaNilPush(L)
+		luaStringPush(L, err.Error())
+		return C.int(2)
+	}
+
+	// Create the request task and return, the connection
+	// handle is kept alive by the task until it completes.
+	luaTaskPush(L, func(ctx context.Context) (luaTaskResult, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		result, err := caller.call(ctx, method, params)
+		if err == context.DeadlineExceeded {
+			err = errors.New("rpc timeout")
+		}
+		runtime.KeepAlive(connHandle)
+		return result, err
+	})
+	luaNilPush(L)
+	return C.int(2)
+}
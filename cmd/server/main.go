@@ -0,0 +1,86 @@
+// Command server is the reference Techmino Online server,
+// which runs locally without any external dependencies, so
+// that the online play could be developed offline.
+//
+// The clients connect to the /ws endpoint by websocket, and
+// exchange json text frames of the form {"type": ..., ...}.
+// The "id" field of a request is echoed back in its response,
+// and the failing requests are answered with {"type": "error",
+// "error": ...}. The messages sent by clients are:
+//
+//   - auth {version, name, token}: must be the first message,
+//     answered by welcome {version, session}.
+//   - ping: answered by pong {time} in unix milliseconds.
+//   - lobby: answered by lobby {rooms}.
+//   - create {name, capacity, password}: creates and joins the
+//     room as host, answered by room {room}.
+//   - join {room, password}: joins the waiting room.
+//   - leave: leaves the current room, answered by leave.
+//   - ready {ready}: updates the ready state, answered by ready
+//     after the room is notified.
+//   - start: starts the game when the other players are ready,
+//     which is only sent by the host. All players receive
+//     start {room, seed, time}, where the game begins at the
+//     server time in unix milliseconds.
+//   - over {data}: reports the game is over with the result,
+//     which is broadcast as over {from, data} and answered by
+//     over. When all players are over, result {results} is
+//     broadcast and the room is waiting again.
+//   - relay {to, data}: forwards the data to the player, or all
+//     other players in the room, as relay {from, data}. It is
+//     answered by relay only when it carries an id, since the
+//     relays are sent frequently.
+//
+// The players in the room receive room {room} whenever the
+// state of the room changes.
+//
+// The messages could also be wrapped as {"channel": ...,
+// "data": message} by clients multiplexing the connection into
+// logical channels. The replies of such a message, which carry
+// its id or are errors, are wrapped in the same channel, while
+// the other messages are always sent unwrapped.
+//
+// The messages larger than 16KiB are split into fragment
+// {fragment, index, count, data} messages sent consecutively,
+// where data are the pieces of the message text at boundaries
+// of characters, and they are reassembled before handled. The
+// fragments are used in both directions: the clients may split
+// their messages, and the server always splits its large ones,
+// such as relay and over carrying large data. The scheme is
+// part of the protocol version 1, and changing it bumps the
+// version.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// main starts the reference online server, which serves the
+// online protocol as json text frames at the /ws endpoint.
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080",
+		"address to listen on")
+	token := flag.String("token", "",
+		"shared token required in auth, any token if empty")
+	flag.Parse()
+
+	srv := newServer(*token)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Server{
+		// The clients are not browsers, so the origin
+		// is not checked at all.
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: srv.serve,
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+// protocolVersion is the version of the online protocol,
+// which must be matched by the auth message of clients.
+const protocolVersion = 1
+
+// Message types sent by the clients.
+const (
+	// typeAuth must be the first message of a session.
+	typeAuth = "auth"
+
+	// typePing queries for the server time.
+	typePing = "ping"
+
+	// typeLobby queries for the rooms in the lobby.
+	typeLobby = "lobby"
+
+	// typeCreate creates a room and joins it as host.
+	typeCreate = "create"
+
+	// typeJoin joins a waiting room.
+	typeJoin = "join"
+
+	// typeLeave leaves the current room.
+	typeLeave = "leave"
+
+	// typeReady updates the ready state in the room.
+	typeReady = "ready"
+
+	// typeStart starts the game, only sent by the host.
+	typeStart = "start"
+
+	// typeOver reports the game is over for the player.
+	typeOver = "over"
+
+	// typeRelay relays the data to the other players.
+	typeRelay = "relay"
+
+	// typeFragment is a piece of a large message, which is
+	// reassembled before handled.
+	typeFragment = "fragment"
+)
+
+// Message types sent by the server.
+const (
+	// typeWelcome acknowledges the auth message.
+	typeWelcome = "welcome"
+
+	// typePong answers the ping message.
+	typePong = "pong"
+
+	// typeRoom notifies the state of the current room.
+	typeRoom = "room"
+
+	// typeResult notifies the results of the game when
+	// all players are over.
+	typeResult = "result"
+
+	// typeError answers the message that fails.
+	typeError = "error"
+)
+
+// message is the json text frame exchanged between the
+// server and clients, whose fields are present depending
+// on the type of message.
+type message struct {
+	// Type of the message.
+	Type string `json:"type"`
+
+	// ID is specified by the client in the request, and
+	// echoed back in the response to correlate them.
+	ID json.RawMessage `json:"id,omitempty"`
+
+	// Version of the protocol in auth and welcome.
+	Version int `json:"version,omitempty"`
+
+	// Name of the player in auth, or the room in create.
+	Name string `json:"name,omitempty"`
+
+	// Token to authenticate the player in auth.
+	Token string `json:"token,omitempty"`
+
+	// Session is the id of the player's session.
+	Session string `json:"session,omitempty"`
+
+	// Room is the id of the room in join, or the state of
+	// the current room in room.
+	Room interface{} `json:"room,omitempty"`
+
+	// Password of the room in create and join.
+	Password string `json:"password,omitempty"`
+
+	// Capacity of the room in create.
+	Capacity int `json:"capacity,omitempty"`
+
+	// Ready is the ready state in ready.
+	Ready *bool `json:"ready,omitempty"`
+
+	// Rooms are the rooms listed in lobby.
+	Rooms []*roomInfo `json:"rooms,omitempty"`
+
+	// Seed of the game shared by the players in start.
+	Seed *int64 `json:"seed,omitempty"`
+
+	// Time is the server time in milliseconds in pong, or
+	// when the game begins in start.
+	Time int64 `json:"time,omitempty"`
+
+	// To is the session relayed to, or all other players
+	// in the room if it is empty.
+	To string `json:"to,omitempty"`
+
+	// From is the session relaying the data.
+	From string `json:"from,omitempty"`
+
+	// Data relayed, or reported in over.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Results of players in result.
+	Results []*playerResult `json:"results,omitempty"`
+
+	// Error of the request in error.
+	Error string `json:"error,omitempty"`
+}
+
+// roomInfo is the summary of a room listed in the lobby.
+type roomInfo struct {
+	// ID of the room.
+	ID string `json:"id"`
+
+	// Name of the room.
+	Name string `json:"name"`
+
+	// Host is the session id of the host.
+	Host string `json:"host"`
+
+	// State of the room, waiting or playing.
+	State roomState `json:"state"`
+
+	// Capacity is the maximum number of players.
+	Capacity int `json:"capacity"`
+
+	// Locked indicates the room requires password.
+	Locked bool `json:"locked"`
+
+	// Players are the players in the room.
+	Players []*playerInfo `json:"players"`
+}
+
+// playerInfo is the state of a player in the room.
+type playerInfo struct {
+	// Session id of the player.
+	Session string `json:"session"`
+
+	// Name of the player.
+	Name string `json:"name"`
+
+	// Ready indicates the player is ready.
+	Ready bool `json:"ready"`
+}
+
+// playerResult is the result reported by a player.
+type playerResult struct {
+	// Session id of the player.
+	Session string `json:"session"`
+
+	// Name of the player.
+	Name string `json:"name"`
+
+	// Data reported in over, null if the player has left.
+	Data json.RawMessage `json:"data"`
+}
+
+// channelFrame is a message wrapped in the logical channel
+// of the client, which multiplexes the connection.
+type channelFrame struct {
+	// Channel is the name of the channel.
+	Channel string `json:"channel"`
+
+	// Data is the message wrapped.
+	Data interface{} `json:"data"`
+}
+
+// unwrapChannel returns the name of the channel and the
+// message wrapped if the text is a channel frame, or the
+// text itself with empty name otherwise.
+func unwrapChannel(text []byte) (string, []byte, error) {
+	var frame struct {
+		Channel string          `json:"channel"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(text, &frame); err != nil || frame.Channel == "" {
+		return "", text, nil
+	}
+	if len(frame.Data) == 0 {
+		return frame.Channel, nil, errors.New("missing data of channel")
+	}
+	return frame.Channel, frame.Data, nil
+}
+
+// maxAssembledSize is the maximum size of the message
+// reassembled from fragments.
+const maxAssembledSize = 1 << 20
+
+// fragmentSize is the maximum size of message text sent in
+// a single frame, the larger ones are split into fragments
+// like the clients do.
+const fragmentSize = 16 << 10
+
+// fragment is a piece of a large message split by either
+// side, so that its other messages could be interleaved.
+type fragment struct {
+	// Type of the message, which must be fragment.
+	Type string `json:"type"`
+
+	// Fragment is the sequence number of the message.
+	Fragment int64 `json:"fragment"`
+
+	// Index of the piece from 0.
+	Index int `json:"index"`
+
+	// Count of the pieces of the message.
+	Count int `json:"count"`
+
+	// Data is the piece of the message text.
+	Data string `json:"data"`
+}
+
+// assembler reassembles the fragments of a connection,
+// which are sent consecutively for each message.
+type assembler struct {
+	// id is the sequence number of the message.
+	id int64
+
+	// next is the index of the next piece expected.
+	next int
+
+	// data is the text of the pieces received.
+	data []byte
+}
+
+// collect returns the text of the message received, which
+// is the message itself if it is not a fragment, or nil if
+// the message is not complete yet.
+func (a *assembler) collect(text []byte) ([]byte, error) {
+	var piece fragment
+	err := json.Unmarshal(text, &piece)
+	if piece.Type != typeFragment {
+		return text, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if piece.Index == 0 {
+		*a = assembler{id: piece.Fragment}
+	} else if piece.Fragment != a.id || piece.Index != a.next {
+		*a = assembler{}
+		return nil, errors.New("fragment out of sequence")
+	}
+	if len(a.data)+len(piece.Data) > maxAssembledSize {
+		*a = assembler{}
+		return nil, errors.New("message too large")
+	}
+	a.data = append(a.data, piece.Data...)
+	a.next++
+	if a.next < piece.Count {
+		return nil, nil
+	}
+	result := a.data
+	*a = assembler{}
+	return result, nil
+}
+
+// split splits the message text into the fragments of the
+// sequence number, or returns nil if it is small enough.
+// The text is split at the boundaries of characters, so
+// that every fragment is still valid utf-8 text.
+func split(id int64, text []byte) []*fragment {
+	if len(text) <= fragmentSize {
+		return nil
+	}
+	var result []*fragment
+	for len(text) > 0 {
+		size := len(text)
+		if size > fragmentSize {
+			size = fragmentSize
+			for size > 0 && !utf8.RuneStart(text[size]) {
+				size--
+			}
+			if size == 0 {
+				size = fragmentSize
+			}
+		}
+		result = append(result, &fragment{
+			Type:     typeFragment,
+			Fragment: id,
+			Index:    len(result),
+			Data:     string(text[:size]),
+		})
+		text = text[size:]
+	}
+	for _, piece := range result {
+		piece.Count = len(result)
+	}
+	return result
+}
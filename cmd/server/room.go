@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// defaultCapacity is the capacity of rooms if unspecified.
+const defaultCapacity = 2
+
+// maxCapacity is the maximum capacity of rooms.
+const maxCapacity = 16
+
+// roomState is the lifecycle state of a room.
+type roomState string
+
+const (
+	// roomWaiting is when the players are getting ready,
+	// and the room could be joined.
+	roomWaiting = roomState("waiting")
+
+	// roomPlaying is when the game is running, and the
+	// room returns to waiting after all players are over.
+	roomPlaying = roomState("playing")
+)
+
+// room is a group of players playing together.
+type room struct {
+	// id of the room.
+	id string
+
+	// name of the room.
+	name string
+
+	// password of the room, empty if it is not locked.
+	password string
+
+	// capacity is the maximum number of players.
+	capacity int
+
+	// state of the room.
+	state roomState
+
+	// players are the sessions in the room in the order
+	// they have joined, and the first one is the host.
+	players []*session
+
+	// results are the results of players who have left
+	// during the game.
+	results []*playerResult
+}
+
+// info returns the summary of the room.
+func (r *room) info() *roomInfo {
+	result := &roomInfo{
+		ID:       r.id,
+		Name:     r.name,
+		State:    r.state,
+		Capacity: r.capacity,
+		Locked:   r.password != "",
+		Players:  make([]*playerInfo, 0, len(r.players)),
+	}
+	if len(r.players) > 0 {
+		result.Host = r.players[0].id
+	}
+	for _, player := range r.players {
+		result.Players = append(result.Players, &playerInfo{
+			Session: player.id,
+			Name:    player.name,
+			Ready:   player.ready,
+		})
+	}
+	return result
+}
+
+// broadcast sends the message to all players in the room
+// except the specified session, which could be nil.
+func (r *room) broadcast(msg *message, except *session) {
+	for _, player := range r.players {
+		if player != except {
+			player.send(msg)
+		}
+	}
+}
+
+// notify broadcasts the state of the room to its players.
+func (r *room) notify() {
+	r.broadcast(&message{Type: typeRoom, Room: r.info()}, nil)
+}
+
+// lobby lists the rooms sorted by their names.
+func (srv *server) lobby() []*roomInfo {
+	result := make([]*roomInfo, 0, len(srv.rooms))
+	for _, r := range srv.rooms {
+		result = append(result, r.info())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// create creates a room with the session as host.
+func (srv *server) create(s *session, msg *message) error {
+	if s.room != nil {
+		return errors.New("already in room")
+	}
+	if len(msg.Name) > maxNameLength {
+		return errors.New("invalid room name")
+	}
+	capacity := msg.Capacity
+	if capacity == 0 {
+		capacity = defaultCapacity
+	}
+	if capacity < 1 || capacity > maxCapacity {
+		return errors.New("invalid capacity")
+	}
+	r := &room{
+		id:       newID(),
+		name:     msg.Name,
+		password: msg.Password,
+		capacity: capacity,
+		state:    roomWaiting,
+		players:  []*session{s},
+	}
+	if r.name == "" {
+		r.name = s.name + "'s room"
+		if len(r.name) > maxNameLength {
+			r.name = r.id
+		}
+	}
+	srv.rooms[r.id] = r
+	s.room = r
+	s.ready = false
+	s.send(&message{Type: typeRoom, ID: msg.ID, Room: r.info()})
+	return nil
+}
+
+// join adds the session into the waiting room.
+func (srv *server) join(s *session, msg *message) error {
+	if s.room != nil {
+		return errors.New("already in room")
+	}
+	id, _ := msg.Room.(string)
+	r, ok := srv.rooms[id]
+	switch {
+	case !ok:
+		return errors.New("room not found")
+	case r.state != roomWaiting:
+		return errors.New("room is playing")
+	case len(r.players) >= r.capacity:
+		return errors.New("room is full")
+	case r.password != "" && msg.Password != r.password:
+		return errors.New("invalid password")
+	}
+	r.players = append(r.players, s)
+	s.room = r
+	s.ready = false
+	s.send(&message{Type: typeRoom, ID: msg.ID, Room: r.info()})
+	r.broadcast(&message{Type: typeRoom, Room: r.info()}, s)
+	return nil
+}
+
+// leave removes the session from its room, the host is
+// transferred to the next player, and the room is removed
+// when there's no player.
+func (srv *server) leave(s *session) {
+	r := s.room
+	for i, player := range r.players {
+		if player == s {
+			r.players = append(r.players[:i], r.players[i+1:]...)
+			break
+		}
+	}
+	s.room = nil
+	s.ready = false
+	over := s.over
+	s.over = false
+	s.result = nil
+	if len(r.players) == 0 {
+		delete(srv.rooms, r.id)
+		return
+	}
+
+	// The player leaving during the game is recorded in
+	// the results, which might complete the game.
+	if r.state == roomPlaying {
+		if !over {
+			r.results = append(r.results, &playerResult{
+				Session: s.id,
+				Name:    s.name,
+			})
+		}
+		if srv.finish(r) {
+			return
+		}
+	}
+	r.notify()
+}
+
+// ready updates the ready state of the session.
+func (srv *server) ready(s *session, msg *message) error {
+	r := s.room
+	switch {
+	case r == nil:
+		return errors.New("not in room")
+	case r.state != roomWaiting:
+		return errors.New("room is playing")
+	case msg.Ready == nil:
+		return errors.New("missing ready state")
+	}
+	s.ready = *msg.Ready
+	r.notify()
+	s.send(&message{Type: typeReady, ID: msg.ID})
+	return nil
+}
+
+// startCountdown is the time from the start message to the
+// moment the game begins, which is carried in the message so
+// that the players could begin simultaneously.
+const startCountdown = 3 * time.Second
+
+// start starts the game when all players are ready, which
+// could only be requested by the host.
+func (srv *server) start(s *session, msg *message) error {
+	r := s.room
+	switch {
+	case r == nil:
+		return errors.New("not in room")
+	case r.players[0] != s:
+		return errors.New("not host")
+	case r.state != roomWaiting:
+		return errors.New("room is playing")
+	}
+	for _, player := range r.players {
+		if player != s && !player.ready {
+			return errors.New("players not ready")
+		}
+	}
+
+	// Generate the seed shared by all players, so that
+	// their games are deterministic.
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return err
+	}
+	seed := int64(binary.BigEndian.Uint64(data[:]) >> 11)
+	r.state = roomPlaying
+	r.results = nil
+	for _, player := range r.players {
+		player.ready = false
+		player.over = false
+		player.result = nil
+	}
+	info := r.info()
+	at := time.Now().Add(startCountdown).UnixNano() / int64(time.Millisecond)
+	for _, player := range r.players {
+		start := &message{Type: typeStart, Room: info, Seed: &seed, Time: at}
+		if player == s {
+			start.ID = msg.ID
+		}
+		player.send(start)
+	}
+	return nil
+}
+
+// over records the result of the session, and finishes the
+// game when all players are over.
+func (srv *server) over(s *session, msg *message) error {
+	r := s.room
+	switch {
+	case r == nil:
+		return errors.New("not in room")
+	case r.state != roomPlaying:
+		return errors.New("room is not playing")
+	case s.over:
+		return errors.New("already over")
+	}
+	s.over = true
+	s.result = msg.Data
+	r.broadcast(&message{
+		Type: typeOver,
+		From: s.id,
+		Data: msg.Data,
+	}, nil)
+	s.send(&message{Type: typeOver, ID: msg.ID})
+	srv.finish(r)
+	return nil
+}
+
+// finish completes the game if all players are over, and
+// returns whether the game has been completed.
+func (srv *server) finish(r *room) bool {
+	results := append([]*playerResult(nil), r.results...)
+	for _, player := range r.players {
+		if !player.over {
+			return false
+		}
+		results = append(results, &playerResult{
+			Session: player.id,
+			Name:    player.name,
+			Data:    player.result,
+		})
+	}
+	r.state = roomWaiting
+	r.results = nil
+	r.broadcast(&message{Type: typeResult, Results: results}, nil)
+	r.notify()
+	return true
+}
+
+// relay forwards the data to the other players in the room,
+// or the specified player. It is only acknowledged when it
+// carries an id, since the relays are sent frequently.
+func (srv *server) relay(s *session, msg *message) error {
+	r := s.room
+	if r == nil {
+		return errors.New("not in room")
+	}
+	relay := &message{Type: typeRelay, From: s.id, Data: msg.Data}
+	if msg.To == "" {
+		r.broadcast(relay, s)
+	} else {
+		var to *session
+		for _, player := range r.players {
+			if player.id == msg.To {
+				to = player
+			}
+		}
+		if to == nil {
+			return errors.New("player not found")
+		}
+		to.send(relay)
+	}
+	if len(msg.ID) > 0 {
+		s.send(&message{Type: typeRelay, ID: msg.ID})
+	}
+	return nil
+}
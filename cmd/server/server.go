@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// authTimeout is the time for a client to authenticate
+// after the websocket has been connected.
+const authTimeout = 10 * time.Second
+
+// sendQueueSize is the number of messages queued for a
+// session, the session is dropped when it is exceeded.
+const sendQueueSize = 256
+
+// maxNameLength is the maximum length of player names and
+// room names.
+const maxNameLength = 32
+
+// session is an authenticated connection of a player.
+type session struct {
+	// id of the session.
+	id string
+
+	// name of the player.
+	name string
+
+	// conn is the websocket connection.
+	conn *websocket.Conn
+
+	// sendCh is the queue of messages to send, which is
+	// only accessed with server.mtx locked.
+	sendCh chan interface{}
+
+	// fragmentSeq is the sequence number of the last message
+	// fragmented, which is only accessed by the writer.
+	fragmentSeq int64
+
+	// channel is the channel of the request being handled,
+	// empty if the request is not wrapped in a channel.
+	channel string
+
+	// room is the current room of the session, nil if the
+	// session is in the lobby.
+	room *room
+
+	// ready indicates the player is ready in the room.
+	ready bool
+
+	// over indicates the game is over for the player.
+	over bool
+
+	// result is the data reported in over.
+	result json.RawMessage
+}
+
+// send queues the message for the session, and the session
+// is dropped if it could not keep up with the messages.
+// The replies of the request received in a channel, which
+// are the errors or carry the id, are wrapped in the same
+// channel. It must be called with server.mtx locked.
+func (s *session) send(msg *message) {
+	var value interface{} = msg
+	if s.channel != "" && (msg.ID != nil || msg.Type == typeError) {
+		value = &channelFrame{Channel: s.channel, Data: msg}
+	}
+	select {
+	case s.sendCh <- value:
+	default:
+		log.Printf("session %s dropped: send queue full", s.id)
+		_ = s.conn.Close()
+	}
+}
+
+// runWriter writes out the queued messages until the queue
+// is closed or the connection is broken.
+func (s *session) runWriter() {
+	for msg := range s.sendCh {
+		if err := s.write(msg); err != nil {
+			_ = s.conn.Close()
+			for range s.sendCh {
+			}
+			return
+		}
+	}
+}
+
+// write writes out the message, which is sent as fragments
+// consecutively if its text is large.
+func (s *session) write(msg interface{}) error {
+	text, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	pieces := split(s.fragmentSeq+1, text)
+	if pieces == nil {
+		return websocket.Message.Send(s.conn, string(text))
+	}
+	s.fragmentSeq++
+	for _, piece := range pieces {
+		if err := websocket.JSON.Send(s.conn, piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// server is the state of the online server, where all
+// sessions and rooms are guarded by the mutex.
+type server struct {
+	// token is the shared secret of auth, and any token is
+	// accepted when it is empty.
+	token string
+
+	// mtx is the mutex guarding the states below.
+	mtx sync.Mutex
+
+	// sessions are the authenticated sessions by id.
+	sessions map[string]*session
+
+	// rooms are the rooms by id.
+	rooms map[string]*room
+}
+
+// newServer creates the server with the auth token.
+func newServer(token string) *server {
+	return &server{
+		token:    token,
+		sessions: make(map[string]*session),
+		rooms:    make(map[string]*room),
+	}
+}
+
+// newID generates a random id for sessions and rooms.
+func newID() string {
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data[:])
+}
+
+// authenticate receives and validates the auth message.
+func (srv *server) authenticate(conn *websocket.Conn) (*message, error) {
+	if err := conn.SetReadDeadline(
+		time.Now().Add(authTimeout)); err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := websocket.JSON.Receive(conn, &msg); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.Type != typeAuth:
+		return &msg, errors.New("auth required")
+	case msg.Version != protocolVersion:
+		return &msg, errors.New("unsupported protocol version")
+	case msg.Name == "" || len(msg.Name) > maxNameLength:
+		return &msg, errors.New("invalid name")
+	case srv.token != "" && msg.Token != srv.token:
+		return &msg, errors.New("invalid token")
+	}
+	return &msg, nil
+}
+
+// serve handles the websocket connection of a client.
+func (srv *server) serve(conn *websocket.Conn) {
+	defer func() { _ = conn.Close() }()
+	conn.PayloadType = websocket.TextFrame
+
+	// Authenticate the client before anything else.
+	auth, err := srv.authenticate(conn)
+	if err != nil {
+		reply := &message{Type: typeError, Error: err.Error()}
+		if auth != nil {
+			reply.ID = auth.ID
+		}
+		_ = websocket.JSON.Send(conn, reply)
+		return
+	}
+	s := &session{
+		id:     newID(),
+		name:   auth.Name,
+		conn:   conn,
+		sendCh: make(chan interface{}, sendQueueSize),
+	}
+	go s.runWriter()
+	srv.mtx.Lock()
+	srv.sessions[s.id] = s
+	s.send(&message{
+		Type:    typeWelcome,
+		ID:      auth.ID,
+		Version: protocolVersion,
+		Session: s.id,
+	})
+	srv.mtx.Unlock()
+	log.Printf("session %s (%s) connected from %s",
+		s.id, s.name, conn.Request().RemoteAddr)
+
+	// Handle the messages until the connection is broken.
+	var pieces assembler
+	for {
+		var text []byte
+		if err := websocket.Message.Receive(conn, &text); err != nil {
+			break
+		}
+
+		// The large messages are reassembled from fragments,
+		// and unwrapped if they are sent in a channel. The
+		// malformed message is answered with error, which
+		// does not break the connection.
+		var msg message
+		text, err := pieces.collect(text)
+		if err == nil && text == nil {
+			continue
+		}
+		channel := ""
+		if err == nil {
+			channel, text, err = unwrapChannel(text)
+		}
+		if err == nil {
+			err = json.Unmarshal(text, &msg)
+		}
+		srv.mtx.Lock()
+		s.channel = channel
+		if err != nil {
+			s.send(&message{Type: typeError, Error: err.Error()})
+		} else if err := srv.handle(s, &msg); err != nil {
+			s.send(&message{
+				Type:  typeError,
+				ID:    msg.ID,
+				Error: err.Error(),
+			})
+		}
+		s.channel = ""
+		srv.mtx.Unlock()
+	}
+
+	// Remove the session from its room and the server.
+	srv.mtx.Lock()
+	if s.room != nil {
+		srv.leave(s)
+	}
+	delete(srv.sessions, s.id)
+	close(s.sendCh)
+	srv.mtx.Unlock()
+	log.Printf("session %s (%s) disconnected", s.id, s.name)
+}
+
+// handle dispatches the message of the session, which must
+// be called with mtx locked.
+func (srv *server) handle(s *session, msg *message) error {
+	switch msg.Type {
+	case typePing:
+		s.send(&message{
+			Type: typePong,
+			ID:   msg.ID,
+			Time: time.Now().UnixNano() / int64(time.Millisecond),
+		})
+		return nil
+	case typeLobby:
+		s.send(&message{
+			Type:  typeLobby,
+			ID:    msg.ID,
+			Rooms: srv.lobby(),
+		})
+		return nil
+	case typeCreate:
+		return srv.create(s, msg)
+	case typeJoin:
+		return srv.join(s, msg)
+	case typeLeave:
+		if s.room == nil {
+			return errors.New("not in room")
+		}
+		srv.leave(s)
+		s.send(&message{Type: typeLeave, ID: msg.ID})
+		return nil
+	case typeReady:
+		return srv.ready(s, msg)
+	case typeStart:
+		return srv.start(s, msg)
+	case typeOver:
+		return srv.over(s, msg)
+	case typeRelay:
+		return srv.relay(s, msg)
+	default:
+		return errors.New("unknown message type")
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// testToken is the auth token of the test server.
+const testToken = "secret"
+
+// testServer starts the server at the /ws endpoint as
+// main does, returning its url and the server to close.
+func testServer() (string, *httptest.Server) {
+	srv := newServer(testToken)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: srv.serve,
+	})
+	server := httptest.NewServer(mux)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws", server
+}
+
+// testClient is a websocket connection to the server.
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// dial connects to the server without authenticating.
+func dial(t *testing.T, url string) *testClient {
+	t.Helper()
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return &testClient{t: t, conn: conn}
+}
+
+// login connects to the server and authenticates with the
+// name, returning the client and its session id.
+func login(t *testing.T, url, name string) (*testClient, string) {
+	t.Helper()
+	c := dial(t, url)
+	c.send(`{"type":"auth","id":1,"version":1,"name":"` +
+		name + `","token":"` + testToken + `"}`)
+	welcome := c.expect(typeWelcome, `1`)
+	if welcome.Version != protocolVersion || welcome.Session == "" {
+		t.Fatalf("unexpected welcome %+v", welcome)
+	}
+	return c, welcome.Session
+}
+
+// close closes the connection.
+func (c *testClient) close() {
+	_ = c.conn.Close()
+}
+
+// send sends the text frame to the server.
+func (c *testClient) send(text string) {
+	c.t.Helper()
+	if err := websocket.Message.Send(c.conn, text); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// receive receives the next message from the server.
+func (c *testClient) receive() *message {
+	c.t.Helper()
+	if err := c.conn.SetReadDeadline(
+		time.Now().Add(5 * time.Second)); err != nil {
+		c.t.Fatalf("deadline: %v", err)
+	}
+	var msg message
+	if err := websocket.JSON.Receive(c.conn, &msg); err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	return &msg
+}
+
+// expect receives the next message, which must be of the
+// type and carry the id, or no id if it is empty.
+func (c *testClient) expect(typ, id string) *message {
+	c.t.Helper()
+	msg := c.receive()
+	if msg.Type != typ || string(msg.ID) != id {
+		c.t.Fatalf("expect %s with id %q, got %+v", typ, id, msg)
+	}
+	return msg
+}
+
+// expectError receives the error answering the request
+// with the id, whose error must contain the text.
+func (c *testClient) expectError(id, text string) {
+	c.t.Helper()
+	msg := c.expect(typeError, id)
+	if !strings.Contains(msg.Error, text) {
+		c.t.Fatalf("expect error %q, got %q", text, msg.Error)
+	}
+}
+
+// roomOf decodes the room carried in the message.
+func roomOf(t *testing.T, msg *message) *roomInfo {
+	t.Helper()
+	data, err := json.Marshal(msg.Room)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var result roomInfo
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("unmarshal room: %v", err)
+	}
+	return &result
+}
+
+// TestServerAuth ensures the failed auth is answered with
+// the error carrying the request id, and the ping is
+// answered after auth.
+func TestServerAuth(t *testing.T) {
+	url, server := testServer()
+	defer server.Close()
+	for _, testCase := range []struct {
+		name  string
+		auth  string
+		error string
+	}{
+		{"not auth", `{"type":"ping","id":"a"}`, "auth required"},
+		{"version", `{"type":"auth","id":"a","version":2,` +
+			`"name":"p","token":"secret"}`, "unsupported protocol version"},
+		{"name", `{"type":"auth","id":"a","version":1,` +
+			`"token":"secret"}`, "invalid name"},
+		{"token", `{"type":"auth","id":"a","version":1,` +
+			`"name":"p","token":"wrong"}`, "invalid token"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			c := dial(t, url)
+			defer c.close()
+			c.send(testCase.auth)
+			c.expectError(`"a"`, testCase.error)
+		})
+	}
+
+	c, _ := login(t, url, "player")
+	defer c.close()
+	c.send(`{"type":"ping","id":{"n":2}}`)
+	if pong := c.expect(typePong, `{"n":2}`); pong.Time <= 0 {
+		t.Fatalf("unexpected pong %+v", pong)
+	}
+}
+
+// TestServerGame runs through creating, joining, starting
+// and finishing a game with two players.
+func TestServerGame(t *testing.T) {
+	url, server := testServer()
+	defer server.Close()
+	host, hostID := login(t, url, "host")
+	defer host.close()
+	guest, guestID := login(t, url, "guest")
+	defer guest.close()
+
+	// The host creates the locked room.
+	host.send(`{"type":"create","id":2,"name":"duel","password":"pw"}`)
+	created := roomOf(t, host.expect(typeRoom, `2`))
+	if created.Name != "duel" || created.Host != hostID ||
+		created.Capacity != defaultCapacity || !created.Locked ||
+		created.State != roomWaiting || len(created.Players) != 1 {
+		t.Fatalf("unexpected room %+v", created)
+	}
+	guest.send(`{"type":"lobby","id":3}`)
+	lobby := guest.expect(typeLobby, `3`)
+	if len(lobby.Rooms) != 1 || lobby.Rooms[0].ID != created.ID {
+		t.Fatalf("unexpected lobby %+v", lobby.Rooms)
+	}
+
+	// The guest joins with the password, and the host is
+	// notified without the id of the guest's request.
+	guest.send(`{"type":"join","id":4,"room":"` +
+		created.ID + `","password":"nope"}`)
+	guest.expectError(`4`, "invalid password")
+	guest.send(`{"type":"join","id":5,"room":"` +
+		created.ID + `","password":"pw"}`)
+	joined := roomOf(t, guest.expect(typeRoom, `5`))
+	if len(joined.Players) != 2 || joined.Players[1].Session != guestID {
+		t.Fatalf("unexpected room %+v", joined)
+	}
+	host.expect(typeRoom, ``)
+
+	// The game is only started by the host when the
+	// other players are ready.
+	guest.send(`{"type":"start","id":6}`)
+	guest.expectError(`6`, "not host")
+	host.send(`{"type":"start","id":7}`)
+	host.expectError(`7`, "players not ready")
+	guest.send(`{"type":"ready","id":8,"ready":true}`)
+	host.expect(typeRoom, ``)
+	guest.expect(typeRoom, ``)
+	guest.expect(typeReady, `8`)
+	host.send(`{"type":"start","id":9}`)
+	hostStart := host.expect(typeStart, `9`)
+	guestStart := guest.expect(typeStart, ``)
+	if hostStart.Seed == nil || guestStart.Seed == nil ||
+		*hostStart.Seed != *guestStart.Seed ||
+		hostStart.Time != guestStart.Time ||
+		hostStart.Time < time.Now().UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("unexpected start %+v and %+v", hostStart, guestStart)
+	}
+	guest.send(`{"type":"join","id":10,"room":"` + created.ID + `"}`)
+	guest.expectError(`10`, "already in room")
+
+	// The data is relayed to the other player, and the relay
+	// is only acknowledged when it carries an id.
+	host.send(`{"type":"relay","id":11,"data":{"attack":4}}`)
+	relay := guest.expect(typeRelay, ``)
+	if relay.From != hostID || string(relay.Data) != `{"attack":4}` {
+		t.Fatalf("unexpected relay %+v", relay)
+	}
+	host.expect(typeRelay, `11`)
+	host.send(`{"type":"relay","to":"` + guestID + `","data":2}`)
+	if relay := guest.expect(typeRelay, ``); string(relay.Data) != `2` {
+		t.Fatalf("unexpected relay %+v", relay)
+	}
+	guest.send(`{"type":"relay","id":"r","to":"` + hostID + `","data":3}`)
+	if relay := host.expect(typeRelay, ``); relay.From != guestID ||
+		string(relay.Data) != `3` {
+		t.Fatalf("unexpected relay %+v", relay)
+	}
+	guest.expect(typeRelay, `"r"`)
+
+	// The results are sent when all players are over, and
+	// the room returns to waiting.
+	guest.send(`{"type":"over","id":12,"data":1}`)
+	host.expect(typeOver, ``)
+	guest.expect(typeOver, ``)
+	guest.expect(typeOver, `12`)
+	host.send(`{"type":"over","id":13,"data":2}`)
+	host.expect(typeOver, ``)
+	guest.expect(typeOver, ``)
+	host.expect(typeOver, `13`)
+	result := guest.expect(typeResult, ``)
+	if len(result.Results) != 2 ||
+		result.Results[0].Session != hostID ||
+		string(result.Results[0].Data) != `2` ||
+		result.Results[1].Session != guestID ||
+		string(result.Results[1].Data) != `1` {
+		t.Fatalf("unexpected results %+v", result.Results)
+	}
+	if waiting := roomOf(t, guest.expect(typeRoom, ``)); waiting.State != roomWaiting {
+		t.Fatalf("unexpected room %+v", waiting)
+	}
+}
+
+// TestServerErrors ensures the failed requests are
+// answered with the error carrying their ids.
+func TestServerErrors(t *testing.T) {
+	url, server := testServer()
+	defer server.Close()
+	c, _ := login(t, url, "player")
+	defer c.close()
+	for _, testCase := range []struct {
+		request string
+		id      string
+		error   string
+	}{
+		{`{"type":"dance","id":1}`, `1`, "unknown message type"},
+		{`{"type":"join","id":"join"}`, `"join"`, "room not found"},
+		{`{"type":"join","id":2,"room":"missing"}`, `2`, "room not found"},
+		{`{"type":"leave","id":3}`, `3`, "not in room"},
+		{`{"type":"ready","id":4,"ready":true}`, `4`, "not in room"},
+		{`{"type":"start","id":5}`, `5`, "not in room"},
+		{`{"type":"over","id":6}`, `6`, "not in room"},
+		{`{"type":"relay","id":7}`, `7`, "not in room"},
+		{`{"type":"create","id":8,"capacity":17}`, `8`, "invalid capacity"},
+	} {
+		c.send(testCase.request)
+		c.expectError(testCase.id, testCase.error)
+	}
+
+	// The malformed message could not carry an id, and the
+	// connection is still usable after it.
+	c.send(`{"type":`)
+	c.expect(typeError, ``)
+	c.send(`{"type":"ping","id":9}`)
+	c.expect(typePong, `9`)
+}
+
+// TestServerFragment ensures the fragments are reassembled
+// and the message is answered with its id.
+func TestServerFragment(t *testing.T) {
+	url, server := testServer()
+	defer server.Close()
+	c, _ := login(t, url, "player")
+	defer c.close()
+	text := `{"type":"create","id":"big","name":"fragmented"}`
+	pieces := []string{text[:10], text[10:30], text[30:]}
+	for i, piece := range pieces {
+		data, err := json.Marshal(&fragment{
+			Type:     typeFragment,
+			Fragment: 1,
+			Index:    i,
+			Count:    len(pieces),
+			Data:     piece,
+		})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		c.send(string(data))
+	}
+	if r := roomOf(t, c.expect(typeRoom, `"big"`)); r.Name != "fragmented" {
+		t.Fatalf("unexpected room %+v", r)
+	}
+
+	// The piece out of sequence is rejected.
+	c.send(`{"type":"fragment","fragment":2,"index":1,"count":2,"data":"x"}`)
+	c.expectError(``, "out of sequence")
+}
+
+// TestServerFragmentSent ensures the large messages sent by
+// the server are split into fragments of valid text, which
+// are reassembled into the message.
+func TestServerFragmentSent(t *testing.T) {
+	url, server := testServer()
+	defer server.Close()
+	host, hostID := login(t, url, "host")
+	defer host.close()
+	guest, _ := login(t, url, "guest")
+	defer guest.close()
+	host.send(`{"type":"create","id":2,"name":"duel"}`)
+	created := roomOf(t, host.expect(typeRoom, `2`))
+	guest.send(`{"type":"join","id":3,"room":"` + created.ID + `"}`)
+	guest.expect(typeRoom, `3`)
+	host.expect(typeRoom, ``)
+
+	// The data of multibyte characters is relayed, so that
+	// the pieces must be split at their boundaries.
+	data := `"` + strings.Repeat("方块", fragmentSize) + `"`
+	host.send(`{"type":"relay","id":4,"data":` + data + `}`)
+	var pieces assembler
+	var text []byte
+	for count := 0; text == nil; count++ {
+		if err := guest.conn.SetReadDeadline(
+			time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("deadline: %v", err)
+		}
+		var frame string
+		if err := websocket.Message.Receive(guest.conn, &frame); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		var piece fragment
+		if err := json.Unmarshal([]byte(frame), &piece); err != nil ||
+			piece.Type != typeFragment || piece.Index != count ||
+			len(piece.Data) > fragmentSize || !utf8.ValidString(piece.Data) {
+			t.Fatalf("unexpected fragment %d: %.64s", count, frame)
+		}
+		var err error
+		if text, err = pieces.collect([]byte(frame)); err != nil {
+			t.Fatalf("collect: %v", err)
+		}
+	}
+	var relay message
+	if err := json.Unmarshal(text, &relay); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if relay.Type != typeRelay || relay.From != hostID ||
+		string(relay.Data) != data {
+		t.Fatalf("unexpected relay from %q", relay.From)
+	}
+
+	// The small messages are still sent as they are.
+	host.send(`{"type":"relay","id":5,"data":1}`)
+	if relay := guest.expect(typeRelay, ``); string(relay.Data) != `1` {
+		t.Fatalf("unexpected relay %+v", relay)
+	}
+}
+
+// expectChannel receives the next message, which must be
+// wrapped in the channel, and returns the message wrapped.
+func (c *testClient) expectChannel(channel string) *message {
+	c.t.Helper()
+	if err := c.conn.SetReadDeadline(
+		time.Now().Add(5 * time.Second)); err != nil {
+		c.t.Fatalf("deadline: %v", err)
+	}
+	var frame struct {
+		Channel string   `json:"channel"`
+		Data    *message `json:"data"`
+	}
+	if err := websocket.JSON.Receive(c.conn, &frame); err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	if frame.Channel != channel || frame.Data == nil {
+		c.t.Fatalf("expect channel %q, got %+v", channel, frame)
+	}
+	return frame.Data
+}
+
+// TestServerChannel ensures the messages wrapped in channels
+// are handled, and only their replies are wrapped.
+func TestServerChannel(t *testing.T) {
+	url, server := testServer()
+	defer server.Close()
+	host, _ := login(t, url, "host")
+	defer host.close()
+	guest, _ := login(t, url, "guest")
+	defer guest.close()
+
+	host.send(`{"channel":"lobby","data":{"type":"ping","id":1}}`)
+	if pong := host.expectChannel("lobby"); pong.Type != typePong ||
+		string(pong.ID) != `1` {
+		t.Fatalf("unexpected pong %+v", pong)
+	}
+	host.send(`{"channel":"lobby","data":{"type":"dance","id":2}}`)
+	if reply := host.expectChannel("lobby"); reply.Type != typeError ||
+		string(reply.ID) != `2` {
+		t.Fatalf("unexpected error %+v", reply)
+	}
+	host.send(`{"channel":"lobby"}`)
+	if reply := host.expectChannel("lobby"); reply.Type != typeError ||
+		!strings.Contains(reply.Error, "missing data") {
+		t.Fatalf("unexpected error %+v", reply)
+	}
+
+	// The notifications caused by the request are not
+	// replies, which are sent unwrapped.
+	host.send(`{"channel":"match","data":{"type":"create","id":3}}`)
+	created := roomOf(t, host.expectChannel("match"))
+	guest.send(`{"channel":"match","data":{"type":"join","id":4,"room":"` +
+		created.ID + `"}}`)
+	if joined := guest.expectChannel("match"); joined.Type != typeRoom {
+		t.Fatalf("unexpected join %+v", joined)
+	}
+	host.expect(typeRoom, ``)
+	host.send(`{"type":"ping","id":5}`)
+	host.expect(typePong, `5`)
+}
@@ -0,0 +1,77 @@
+package game
+
+import (
+	"errors"
+)
+
+// Action is the input of player applied to the game.
+type Action uint8
+
+const (
+	// ActionLeft moves the piece left by a column.
+	ActionLeft = Action(iota)
+
+	// ActionRight moves the piece right by a column.
+	ActionRight
+
+	// ActionSoftDrop moves the piece down by a row.
+	ActionSoftDrop
+
+	// ActionHardDrop drops the piece to the bottom and
+	// locks it immediately.
+	ActionHardDrop
+
+	// ActionRotateCW rotates the piece clockwise.
+	ActionRotateCW
+
+	// ActionRotateCCW rotates the piece counterclockwise.
+	ActionRotateCCW
+
+	// ActionRotate180 rotates the piece by a half turn.
+	ActionRotate180
+
+	// ActionHold swaps the piece with the held piece.
+	ActionHold
+)
+
+// actionNames are the names of actions by their values.
+var actionNames = [...]string{
+	"left", "right", "softdrop", "harddrop",
+	"cw", "ccw", "180", "hold",
+}
+
+// String returns the name of the action.
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return ""
+}
+
+// ParseAction parses the action from its name.
+func ParseAction(name string) (Action, error) {
+	for i, actionName := range actionNames {
+		if actionName == name {
+			return Action(i), nil
+		}
+	}
+	return 0, errors.New("invalid action")
+}
+
+// MarshalText encodes the action as its name.
+func (a Action) MarshalText() ([]byte, error) {
+	if int(a) >= len(actionNames) {
+		return nil, errors.New("invalid action")
+	}
+	return []byte(actionNames[a]), nil
+}
+
+// UnmarshalText decodes the action from its name.
+func (a *Action) UnmarshalText(text []byte) error {
+	action, err := ParseAction(string(text))
+	if err != nil {
+		return err
+	}
+	*a = action
+	return nil
+}
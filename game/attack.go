@@ -0,0 +1,105 @@
+package game
+
+// Spin is the kind of spin recognized when a piece locks.
+type Spin uint8
+
+const (
+	// SpinNone is when the piece is not spun into place.
+	SpinNone = Spin(iota)
+
+	// SpinMini is the mini spin, which sends less attack.
+	SpinMini
+
+	// SpinFull is the full spin.
+	SpinFull
+)
+
+// spinNames are the names of spins by their values.
+var spinNames = [...]string{"", "mini", "full"}
+
+// String returns the name of the spin, or empty string if
+// the piece is not spun.
+func (s Spin) String() string {
+	if int(s) < len(spinNames) {
+		return spinNames[s]
+	}
+	return ""
+}
+
+// Lock is the result of locking a piece.
+type Lock struct {
+	// Piece is the piece locked.
+	Piece Piece
+
+	// Spin is the spin recognized.
+	Spin Spin
+
+	// Lines is the number of lines cleared.
+	Lines int
+
+	// Combo is the number of consecutive clears before this
+	// clear, or -1 if no line is cleared.
+	Combo int
+
+	// B2B indicates the back-to-back bonus is applied.
+	B2B bool
+
+	// AllClear indicates the board is emptied.
+	AllClear bool
+
+	// Attack is the number of garbage lines sent.
+	Attack int
+}
+
+// clearAttack is the attack of clears by the lines.
+var clearAttack = [...]int{0, 0, 1, 2, 4}
+
+// spinAttack is the attack of full spins by the lines.
+var spinAttack = [...]int{0, 2, 4, 6, 8}
+
+// miniAttack is the attack of mini spins by the lines.
+var miniAttack = [...]int{0, 0, 1, 2, 4}
+
+// comboAttack is the extra attack by the combo, and the
+// combo beyond the table sends the last value.
+var comboAttack = [...]int{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 4, 5}
+
+// b2bAttack is the extra attack by back-to-back.
+const b2bAttack = 1
+
+// allClearAttack is the extra attack of clearing the board.
+const allClearAttack = 10
+
+// difficult returns whether the clear continues the back
+// to back chain, which is either 4 lines or a spin.
+func (l *Lock) difficult() bool {
+	return l.Lines >= 4 || (l.Lines > 0 && l.Spin != SpinNone)
+}
+
+// attack calculates the attack of the clear.
+func (l *Lock) attack() int {
+	if l.Lines <= 0 {
+		return 0
+	}
+	var result int
+	switch l.Spin {
+	case SpinFull:
+		result = spinAttack[l.Lines]
+	case SpinMini:
+		result = miniAttack[l.Lines]
+	default:
+		result = clearAttack[l.Lines]
+	}
+	if l.Combo < len(comboAttack) {
+		result += comboAttack[l.Combo]
+	} else {
+		result += comboAttack[len(comboAttack)-1]
+	}
+	if l.B2B {
+		result += b2bAttack
+	}
+	if l.AllClear {
+		result += allClearAttack
+	}
+	return result
+}
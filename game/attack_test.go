@@ -0,0 +1,55 @@
+package game
+
+import (
+	"testing"
+)
+
+// TestAttack compares the attack of clears with the tables.
+func TestAttack(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		lock   Lock
+		attack int
+	}{
+		{"no clear", Lock{Combo: -1}, 0},
+		{"single", Lock{Lines: 1}, 0},
+		{"double", Lock{Lines: 2}, 1},
+		{"triple", Lock{Lines: 3}, 2},
+		{"tetris", Lock{Lines: 4}, 4},
+		{"spin single", Lock{Spin: SpinFull, Lines: 1}, 2},
+		{"spin double", Lock{Spin: SpinFull, Lines: 2}, 4},
+		{"spin triple", Lock{Spin: SpinFull, Lines: 3}, 6},
+		{"mini single", Lock{Spin: SpinMini, Lines: 1}, 0},
+		{"mini double", Lock{Spin: SpinMini, Lines: 2}, 1},
+		{"combo", Lock{Lines: 1, Combo: 4}, 2},
+		{"long combo", Lock{Lines: 2, Combo: 20}, 6},
+		{"back to back", Lock{Lines: 4, Combo: 1, B2B: true}, 5},
+		{"all clear", Lock{Lines: 2, AllClear: true}, 11},
+		{"everything", Lock{
+			Spin: SpinFull, Lines: 3, Combo: 8, B2B: true, AllClear: true,
+		}, 6 + 4 + 1 + 10},
+	} {
+		if attack := testCase.lock.attack(); attack != testCase.attack {
+			t.Errorf("%s: expect attack %d, got %d",
+				testCase.name, testCase.attack, attack)
+		}
+	}
+}
+
+// TestDifficult ensures only tetrises and spin clears
+// continue the back-to-back chain.
+func TestDifficult(t *testing.T) {
+	for _, testCase := range []struct {
+		lock      Lock
+		difficult bool
+	}{
+		{Lock{Lines: 3}, false},
+		{Lock{Lines: 4}, true},
+		{Lock{Spin: SpinMini, Lines: 1}, true},
+		{Lock{Spin: SpinFull}, false},
+	} {
+		if difficult := testCase.lock.difficult(); difficult != testCase.difficult {
+			t.Errorf("%+v: expect difficult %v", testCase.lock, testCase.difficult)
+		}
+	}
+}
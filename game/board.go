@@ -0,0 +1,108 @@
+package game
+
+// BoardWidth is the number of columns of the board.
+const BoardWidth = 10
+
+// BoardHeight is the number of rows of the board, including
+// the rows above the visible area.
+const BoardHeight = 40
+
+// VisibleHeight is the number of rows visible to players,
+// above which the pieces spawn.
+const VisibleHeight = 20
+
+// Cell is the content of a cell on the board, which is
+// either empty, the piece locked there, or garbage.
+type Cell uint8
+
+const (
+	// CellEmpty is the empty cell.
+	CellEmpty = Cell(PieceNone)
+
+	// CellGarbage is the cell of garbage lines.
+	CellGarbage = Cell(len(pieceNames))
+)
+
+// Board is the cells of the playfield indexed by row and
+// column, where the row 0 is the bottom row.
+type Board [BoardHeight][BoardWidth]Cell
+
+// Get returns the cell at the specified position, and the
+// positions outside the board are considered as garbage.
+func (b *Board) Get(x, y int) Cell {
+	if x < 0 || x >= BoardWidth || y < 0 || y >= BoardHeight {
+		return CellGarbage
+	}
+	return b[y][x]
+}
+
+// fits returns whether the cells are inside the board and
+// not occupied.
+func (b *Board) fits(cells [4]Point) bool {
+	for _, cell := range cells {
+		if b.Get(cell.X, cell.Y) != CellEmpty {
+			return false
+		}
+	}
+	return true
+}
+
+// place fills the cells, which must fit in the board.
+func (b *Board) place(cells [4]Point, value Cell) {
+	for _, cell := range cells {
+		b[cell.Y][cell.X] = value
+	}
+}
+
+// full returns whether the row is filled.
+func (b *Board) full(y int) bool {
+	for _, cell := range b[y] {
+		if cell == CellEmpty {
+			return false
+		}
+	}
+	return true
+}
+
+// clear removes the filled rows and returns their number.
+func (b *Board) clear() int {
+	lines := 0
+	for y := 0; y < BoardHeight; y++ {
+		if b.full(y) {
+			lines++
+			continue
+		}
+		if lines > 0 {
+			b[y-lines] = b[y]
+		}
+	}
+	for y := BoardHeight - lines; y < BoardHeight; y++ {
+		b[y] = [BoardWidth]Cell{}
+	}
+	return lines
+}
+
+// Empty returns whether there's no cell on the board.
+func (b *Board) Empty() bool {
+	return *b == Board{}
+}
+
+// raise pushes up the board by garbage lines with the hole
+// at the specified column, and returns false if any cell is
+// pushed out of the board.
+func (b *Board) raise(lines, hole int) bool {
+	ok := true
+	for y := BoardHeight - lines; y < BoardHeight; y++ {
+		if b[y] != [BoardWidth]Cell{} {
+			ok = false
+		}
+	}
+	copy(b[lines:], b[:BoardHeight-lines])
+	for y := 0; y < lines; y++ {
+		for x := range b[y] {
+			b[y][x] = CellGarbage
+		}
+		b[y][hole] = CellEmpty
+	}
+	return ok
+}
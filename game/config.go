@@ -0,0 +1,62 @@
+package game
+
+import (
+	"errors"
+)
+
+// Config is the rules of the game, where the durations
+// are measured in frames.
+type Config struct {
+	// Gravity is the frames for the piece to fall a row,
+	// and the piece drops to the bottom at once if zero.
+	Gravity int `json:"gravity"`
+
+	// LockDelay is the frames for the piece to lock after
+	// it has landed.
+	LockDelay int `json:"lockdelay"`
+
+	// MaxLockResets is the number of times the lock delay
+	// could be reset by moving or rotating the landed piece,
+	// which is renewed when the piece falls lower.
+	MaxLockResets int `json:"maxresets"`
+
+	// Preview is the number of next pieces visible.
+	Preview int `json:"preview"`
+
+	// Hold indicates whether the piece could be held.
+	Hold bool `json:"hold"`
+
+	// AllSpin indicates whether the spins of pieces other
+	// than T are recognized when they are immobile.
+	AllSpin bool `json:"allspin"`
+}
+
+// DefaultConfig returns the default rules of Techmino.
+func DefaultConfig() Config {
+	return Config{
+		Gravity:       60,
+		LockDelay:     60,
+		MaxLockResets: 15,
+		Preview:       6,
+		Hold:          true,
+		AllSpin:       true,
+	}
+}
+
+// maxPreview is the maximum number of next pieces visible.
+const maxPreview = 16
+
+// Validate returns error if the config is out of range.
+func (c *Config) Validate() error {
+	switch {
+	case c.Gravity < 0:
+		return errors.New("invalid gravity")
+	case c.LockDelay < 0:
+		return errors.New("invalid lock delay")
+	case c.MaxLockResets < 0:
+		return errors.New("invalid max lock resets")
+	case c.Preview < 0 || c.Preview > maxPreview:
+		return errors.New("invalid preview")
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+// Package game implements the core rules of Techmino
+// deterministically, including the board, super rotation
+// system, 7-bag generator, gravity and lock delay in frames,
+// line clears, spins, combo, back-to-back and attack, so
+// that the games could be simulated and verified anywhere.
+package game
+
+import (
+	"errors"
+)
+
+// Stats are the statistics of the game.
+type Stats struct {
+	// Pieces is the number of pieces locked.
+	Pieces int
+
+	// Lines is the number of lines cleared.
+	Lines int
+
+	// Attack is the number of garbage lines sent.
+	Attack int
+}
+
+// Game is the deterministic simulation of a player's game,
+// which advances only by the actions and frames applied,
+// so that it could be replayed and verified.
+type Game struct {
+	// config is the rules of the game.
+	config Config
+
+	// board is the playfield.
+	board Board
+
+	// generator generates the pieces to spawn.
+	generator Generator
+
+	// queue is the next pieces to spawn.
+	queue []Piece
+
+	// hold is the piece held, or PieceNone if empty.
+	hold Piece
+
+	// held indicates the hold has been used since the
+	// current piece spawns.
+	held bool
+
+	// falling is the piece controlled by the player, which
+	// is absent only when the game is over.
+	falling Falling
+
+	// frame is the number of frames elapsed.
+	frame int
+
+	// fallTimer is the frames elapsed since the piece has
+	// fallen the last row.
+	fallTimer int
+
+	// lockTimer is the frames elapsed since the piece has
+	// landed, or zero if it is in the air.
+	lockTimer int
+
+	// lockResets is the number of times the lock delay has
+	// been reset since the piece reached the lowest row.
+	lockResets int
+
+	// lowest is the lowest row the piece has reached.
+	lowest int
+
+	// rotated indicates the last movement of the piece is
+	// a rotation, which is required to be a spin.
+	rotated bool
+
+	// kick is the index of kick used by the last rotation.
+	kick int
+
+	// combo is the number of consecutive clears minus one,
+	// or -1 if the last piece clears no line.
+	combo int
+
+	// b2b indicates the last clear is difficult.
+	b2b bool
+
+	// over indicates the game is over.
+	over bool
+
+	// stats are the statistics of the game.
+	stats Stats
+}
+
+// New creates the game with the 7-bag generator from seed.
+func New(config Config, seed uint64) (*Game, error) {
+	return NewWithGenerator(config, NewBag(seed))
+}
+
+// NewWithGenerator creates the game with the generator.
+func NewWithGenerator(config Config, generator Generator) (*Game, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	g := &Game{
+		config:    config,
+		generator: generator,
+		combo:     -1,
+	}
+	for len(g.queue) < config.Preview {
+		g.queue = append(g.queue, generator.Next())
+	}
+	g.spawn(g.next())
+	return g, nil
+}
+
+// Clone returns an independent copy of the game, which
+// evolves identically with the same actions and frames.
+func (g *Game) Clone() *Game {
+	result := *g
+	result.generator = g.generator.Clone()
+	result.queue = append([]Piece(nil), g.queue...)
+	return &result
+}
+
+// Config returns the rules of the game.
+func (g *Game) Config() Config {
+	return g.config
+}
+
+// Board returns the playfield without the falling piece.
+func (g *Game) Board() *Board {
+	board := g.board
+	return &board
+}
+
+// Falling returns the piece controlled by the player, and
+// false if the game is over.
+func (g *Game) Falling() (Falling, bool) {
+	return g.falling, !g.over
+}
+
+// Ghost returns where the falling piece would be dropped.
+func (g *Game) Ghost() Falling {
+	result := g.falling
+	for g.board.fits(Falling{
+		Piece: result.Piece, Rotation: result.Rotation,
+		X: result.X, Y: result.Y - 1,
+	}.Cells()) {
+		result.Y--
+	}
+	return result
+}
+
+// Next returns the next pieces visible.
+func (g *Game) Next() []Piece {
+	return append([]Piece(nil), g.queue...)
+}
+
+// Hold returns the piece held, or PieceNone if empty.
+func (g *Game) Hold() Piece {
+	return g.hold
+}
+
+// Frame returns the number of frames elapsed.
+func (g *Game) Frame() int {
+	return g.frame
+}
+
+// Combo returns the current combo, or -1 if none.
+func (g *Game) Combo() int {
+	return g.combo
+}
+
+// B2B returns whether the back-to-back chain is active.
+func (g *Game) B2B() bool {
+	return g.b2b
+}
+
+// Over returns whether the game is over.
+func (g *Game) Over() bool {
+	return g.over
+}
+
+// Stats returns the statistics of the game.
+func (g *Game) Stats() Stats {
+	return g.stats
+}
+
+// next takes the next piece from the queue.
+func (g *Game) next() Piece {
+	if len(g.queue) == 0 {
+		return g.generator.Next()
+	}
+	result := g.queue[0]
+	copy(g.queue, g.queue[1:])
+	g.queue[len(g.queue)-1] = g.generator.Next()
+	return result
+}
+
+// spawn places the piece right above the visible area,
+// and the game is over if it is blocked.
+func (g *Game) spawn(piece Piece) {
+	shape := &pieceShapes[piece]
+	bottom := shape.size
+	for _, cell := range shape.cells[RotationSpawn] {
+		if cell.Y < bottom {
+			bottom = cell.Y
+		}
+	}
+	g.falling = Falling{
+		Piece:    piece,
+		Rotation: RotationSpawn,
+		X:        (BoardWidth - shape.size) / 2,
+		Y:        VisibleHeight - bottom,
+	}
+	g.fallTimer = 0
+	g.lockTimer = 0
+	g.lockResets = 0
+	g.lowest = g.falling.Y
+	g.rotated = false
+	g.kick = 0
+	if !g.board.fits(g.falling.Cells()) {
+		g.over = true
+		return
+	}
+	if g.config.Gravity == 0 {
+		g.fall(BoardHeight)
+	}
+}
+
+// fits returns whether the falling piece fits with the
+// specified offset and rotation.
+func (g *Game) fits(dx, dy int, rotation Rotation) bool {
+	return g.board.fits(Falling{
+		Piece:    g.falling.Piece,
+		Rotation: rotation,
+		X:        g.falling.X + dx,
+		Y:        g.falling.Y + dy,
+	}.Cells())
+}
+
+// landed returns whether the falling piece is on ground.
+func (g *Game) landed() bool {
+	return !g.fits(0, -1, g.falling.Rotation)
+}
+
+// fall moves the piece down by at most the rows, and
+// returns the number of rows fallen.
+func (g *Game) fall(rows int) int {
+	fallen := 0
+	for fallen < rows && !g.landed() {
+		g.falling.Y--
+		fallen++
+	}
+	if fallen > 0 {
+		g.rotated = false
+		if g.falling.Y < g.lowest {
+			g.lowest = g.falling.Y
+			g.lockResets = 0
+		}
+	}
+	return fallen
+}
+
+// shifted resets the lock delay after the piece has been
+// moved or rotated by the player, if it has landed.
+func (g *Game) shifted() {
+	if g.lockTimer > 0 && g.lockResets < g.config.MaxLockResets {
+		g.lockTimer = 0
+		g.lockResets++
+	}
+	if g.config.Gravity == 0 {
+		g.fall(BoardHeight)
+	}
+}
+
+// move moves the piece horizontally by the columns.
+func (g *Game) move(dx int) bool {
+	if !g.fits(dx, 0, g.falling.Rotation) {
+		return false
+	}
+	g.falling.X += dx
+	g.rotated = false
+	g.shifted()
+	return true
+}
+
+// rotate rotates the piece by the quarter turns clockwise,
+// attempting the kicks in order.
+func (g *Game) rotate(turns int) bool {
+	from := g.falling.Rotation
+	to := from.Rotate(turns)
+	for i, kick := range kicks(g.falling.Piece, from, to) {
+		if !g.fits(kick.X, kick.Y, to) {
+			continue
+		}
+		g.falling.X += kick.X
+		g.falling.Y += kick.Y
+		g.falling.Rotation = to
+		g.shifted()
+		g.rotated = true
+		g.kick = i
+		return true
+	}
+	return false
+}
+
+// Apply applies the action of player, and returns whether
+// the action takes effect, along with the result of lock
+// if the piece is locked by the action.
+func (g *Game) Apply(action Action) (bool, *Lock) {
+	if g.over {
+		return false, nil
+	}
+	switch action {
+	case ActionLeft:
+		return g.move(-1), nil
+	case ActionRight:
+		return g.move(1), nil
+	case ActionSoftDrop:
+		if g.fall(1) == 0 {
+			return false, nil
+		}
+		g.fallTimer = 0
+		return true, nil
+	case ActionHardDrop:
+		rotated := g.rotated
+		g.fall(BoardHeight)
+		g.rotated = rotated
+		return true, g.lock()
+	case ActionRotateCW:
+		return g.rotate(1), nil
+	case ActionRotateCCW:
+		return g.rotate(3), nil
+	case ActionRotate180:
+		return g.rotate(2), nil
+	case ActionHold:
+		if !g.config.Hold || g.held {
+			return false, nil
+		}
+		piece := g.hold
+		g.hold = g.falling.Piece
+		if piece == PieceNone {
+			piece = g.next()
+		}
+		g.spawn(piece)
+		g.held = true
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// Tick advances the game by a frame, where the piece falls
+// by gravity and locks after the lock delay, and returns the
+// result of lock if the piece is locked.
+func (g *Game) Tick() *Lock {
+	if g.over {
+		return nil
+	}
+	g.frame++
+	if g.config.Gravity == 0 {
+		g.fall(BoardHeight)
+	} else if g.fallTimer++; g.fallTimer >= g.config.Gravity {
+		g.fallTimer = 0
+		g.fall(1)
+	}
+	if !g.landed() {
+		g.lockTimer = 0
+		return nil
+	}
+	g.lockTimer++
+	if g.lockTimer < g.config.LockDelay {
+		return nil
+	}
+	return g.lock()
+}
+
+// blocked returns whether the cell relative to the piece
+// is occupied or outside the board.
+func (g *Game) blocked(p Point) bool {
+	return g.board.Get(g.falling.X+p.X, g.falling.Y+p.Y) != CellEmpty
+}
+
+// tCorners are the corners around the center of T piece,
+// where the first two are in front of its spawn state.
+var tCorners = [4]Point{{0, 2}, {2, 2}, {0, 0}, {2, 0}}
+
+// spin recognizes the spin of the falling piece, where the
+// T piece uses the three corner rule, and the other pieces
+// are recognized if they are immobile.
+func (g *Game) spin() Spin {
+	if !g.rotated {
+		return SpinNone
+	}
+	if g.falling.Piece == PieceT {
+		corners, front := 0, 0
+		for i, corner := range tCorners {
+			for r := RotationSpawn; r < g.falling.Rotation; r++ {
+				corner = rotatePoint(corner, 3)
+			}
+			if g.blocked(corner) {
+				corners++
+				if i < 2 {
+					front++
+				}
+			}
+		}
+		switch {
+		case corners < 3:
+			return SpinNone
+		case front == 2 || g.kick == 4:
+			return SpinFull
+		default:
+			return SpinMini
+		}
+	}
+	if g.config.AllSpin && !g.fits(-1, 0, g.falling.Rotation) &&
+		!g.fits(1, 0, g.falling.Rotation) &&
+		!g.fits(0, 1, g.falling.Rotation) {
+		return SpinFull
+	}
+	return SpinNone
+}
+
+// lock locks the falling piece onto the board, clears the
+// lines, and spawns the next piece.
+func (g *Game) lock() *Lock {
+	result := &Lock{Piece: g.falling.Piece, Spin: g.spin()}
+	g.board.place(g.falling.Cells(), Cell(g.falling.Piece))
+	result.Lines = g.board.clear()
+	if result.Lines > 0 {
+		g.combo++
+		result.Combo = g.combo
+		result.AllClear = g.board.Empty()
+		difficult := result.difficult()
+		result.B2B = difficult && g.b2b
+		g.b2b = difficult
+	} else {
+		g.combo = -1
+		result.Combo = -1
+	}
+	result.Attack = result.attack()
+	g.stats.Pieces++
+	g.stats.Lines += result.Lines
+	g.stats.Attack += result.Attack
+	g.held = false
+	g.spawn(g.next())
+	return result
+}
+
+// maxGarbage is the maximum number of garbage lines that
+// could be received at once.
+const maxGarbage = BoardHeight
+
+// errInvalidGarbage is returned when the garbage lines or
+// the column of hole is out of range.
+var errInvalidGarbage = errors.New("invalid garbage")
+
+// Garbage raises the board by the garbage lines with the
+// hole at the column, and the falling piece is pushed up if
+// it overlaps. The game is over if the board overflows.
+func (g *Game) Garbage(lines, hole int) error {
+	if lines < 1 || lines > maxGarbage || hole < 0 || hole >= BoardWidth {
+		return errInvalidGarbage
+	}
+	if g.over {
+		return nil
+	}
+	if !g.board.raise(lines, hole) {
+		g.over = true
+		return nil
+	}
+	for !g.board.fits(g.falling.Cells()) {
+		g.falling.Y++
+		if g.falling.Y >= BoardHeight {
+			g.over = true
+			return nil
+		}
+	}
+	return nil
+}
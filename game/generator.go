@@ -0,0 +1,165 @@
+package game
+
+import (
+	"fmt"
+)
+
+// Generator generates the sequence of pieces to spawn.
+type Generator interface {
+	// Next returns the next piece of the sequence.
+	Next() Piece
+
+	// Clone returns an independent copy of the generator,
+	// which generates the same sequence afterwards.
+	Clone() Generator
+}
+
+// Bag is the 7-bag generator, which deals the shuffled
+// permutations of all seven pieces in turn.
+type Bag struct {
+	// rng is the random source of shuffling.
+	rng Rng
+
+	// bag is the rest of the current permutation.
+	bag []Piece
+}
+
+// NewBag creates the 7-bag generator from the seed.
+func NewBag(seed uint64) *Bag {
+	return &Bag{rng: Rng{state: seed}}
+}
+
+// Next returns the next piece, and the bag is refilled
+// and shuffled when it is exhausted.
+func (g *Bag) Next() Piece {
+	if len(g.bag) == 0 {
+		g.bag = append(g.bag[:0], Pieces[:]...)
+		for i := len(g.bag) - 1; i > 0; i-- {
+			j := g.rng.Intn(i + 1)
+			g.bag[i], g.bag[j] = g.bag[j], g.bag[i]
+		}
+	}
+	result := g.bag[0]
+	g.bag = g.bag[1:]
+	return result
+}
+
+// Clone returns the copy of the generator.
+func (g *Bag) Clone() Generator {
+	return &Bag{
+		rng: g.rng,
+		bag: append([]Piece(nil), g.bag...),
+	}
+}
+
+// hisRolls is the number of times the his generator rolls
+// for a piece absent from the history.
+const hisRolls = 6
+
+// His is the history generator, which rerolls the piece
+// if it is in the history of the last four pieces.
+type His struct {
+	// rng is the random source of rolling.
+	rng Rng
+
+	// history is the last four pieces, initialized with S
+	// and Z so that the game rarely starts with them.
+	history [4]Piece
+}
+
+// NewHis creates the history generator from the seed.
+func NewHis(seed uint64) *His {
+	return &His{
+		rng:     Rng{state: seed},
+		history: [4]Piece{PieceZ, PieceS, PieceZ, PieceS},
+	}
+}
+
+// contains returns whether the piece is in the history.
+func (g *His) contains(piece Piece) bool {
+	for _, item := range g.history {
+		if item == piece {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next piece, which is the last piece
+// rolled if all rolls hit the history.
+func (g *His) Next() Piece {
+	var result Piece
+	for i := 0; i < hisRolls; i++ {
+		result = Pieces[g.rng.Intn(len(Pieces))]
+		if !g.contains(result) {
+			break
+		}
+	}
+	copy(g.history[:], g.history[1:])
+	g.history[len(g.history)-1] = result
+	return result
+}
+
+// Clone returns the copy of the generator.
+func (g *His) Clone() Generator {
+	result := *g
+	return &result
+}
+
+// Random is the generator of uniformly random pieces.
+type Random struct {
+	// rng is the random source.
+	rng Rng
+}
+
+// NewRandom creates the random generator from the seed.
+func NewRandom(seed uint64) *Random {
+	return &Random{rng: Rng{state: seed}}
+}
+
+// Next returns the next piece.
+func (g *Random) Next() Piece {
+	return Pieces[g.rng.Intn(len(Pieces))]
+}
+
+// Clone returns the copy of the generator.
+func (g *Random) Clone() Generator {
+	result := *g
+	return &result
+}
+
+// generators are the constructors of generators by their
+// algorithm names.
+var generators = map[string]func(uint64) Generator{
+	"bag":    func(seed uint64) Generator { return NewBag(seed) },
+	"his":    func(seed uint64) Generator { return NewHis(seed) },
+	"random": func(seed uint64) Generator { return NewRandom(seed) },
+}
+
+// DefaultAlgorithm is the algorithm of generator if it is
+// unspecified.
+const DefaultAlgorithm = "bag"
+
+// NewGenerator creates the generator of the algorithm, which
+// is one of bag, his and random, from the seed.
+func NewGenerator(algorithm string, seed uint64) (Generator, error) {
+	if algorithm == "" {
+		algorithm = DefaultAlgorithm
+	}
+	constructor, ok := generators[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+	return constructor(seed), nil
+}
+
+// Peek returns the next pieces of the generator without
+// advancing it.
+func Peek(g Generator, n int) []Piece {
+	clone := g.Clone()
+	result := make([]Piece, n)
+	for i := range result {
+		result[i] = clone.Next()
+	}
+	return result
+}
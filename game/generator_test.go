@@ -0,0 +1,115 @@
+package game
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestRng compares the sequence with the reference values
+// of splitmix64 seeded with zero.
+func TestRng(t *testing.T) {
+	rng := NewRng(0)
+	for i, expect := range []uint64{
+		0xe220a8397b1dcdaf, 0x6e789e6aa1b965f4, 0x06c45d188009454f,
+	} {
+		if value := rng.Uint64(); value != expect {
+			t.Fatalf("expect value %d %#x, got %#x", i, expect, value)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if n := rng.Intn(7); n < 0 || n >= 7 {
+			t.Fatalf("unexpected Intn %d", n)
+		}
+		if f := rng.Float64(); f < 0 || f >= 1 {
+			t.Fatalf("unexpected Float64 %v", f)
+		}
+	}
+}
+
+// parsePieces parses the sequence of piece names.
+func parsePieces(t *testing.T, names string) []Piece {
+	result := make([]Piece, len(names))
+	for i := range names {
+		piece, err := ParsePiece(names[i : i+1])
+		if err != nil {
+			t.Fatalf("parse %q: %v", names[i:i+1], err)
+		}
+		result[i] = piece
+	}
+	return result
+}
+
+// TestGenerators compares the sequences of generators with
+// the recorded ones, which must never change for the same
+// seeds, otherwise the records could not be replayed.
+func TestGenerators(t *testing.T) {
+	for _, testCase := range []struct {
+		algorithm string
+		seed      uint64
+		pieces    string
+	}{
+		{"", 0, "ILSOTZJLZIOTJS"},
+		{"bag", 6, "TJIZSOLOSLTIZJ"},
+		{"his", 0, "JTOILZJSTIZLJS"},
+		{"his", 4, "ITOJZLIOSZJIOL"},
+		{"random", 4, "ITISITOJZLLLIJ"},
+	} {
+		generator, err := NewGenerator(testCase.algorithm, testCase.seed)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.algorithm, err)
+		}
+		expect := parsePieces(t, testCase.pieces)
+		if peek := Peek(generator, len(expect)); !reflect.DeepEqual(peek, expect) {
+			t.Fatalf("%s %d: expect peek %v, got %v",
+				testCase.algorithm, testCase.seed, expect, peek)
+		}
+		for i, piece := range expect {
+			if next := generator.Next(); next != piece {
+				t.Fatalf("%s %d: expect piece %d %v, got %v",
+					testCase.algorithm, testCase.seed, i, piece, next)
+			}
+		}
+	}
+	if _, err := NewGenerator("tgm", 0); err == nil {
+		t.Fatal("expect unknown algorithm error")
+	}
+}
+
+// TestBag ensures every seven pieces are a permutation.
+func TestBag(t *testing.T) {
+	bag := NewBag(42)
+	for i := 0; i < 100; i++ {
+		var seen [len(pieceNames)]bool
+		for range Pieces {
+			piece := bag.Next()
+			if seen[piece] {
+				t.Fatalf("piece %v repeated in bag %d", piece, i)
+			}
+			seen[piece] = true
+		}
+	}
+}
+
+// TestHis ensures the pieces rarely repeat the last four
+// pieces, which happens only when all rolls hit them.
+func TestHis(t *testing.T) {
+	his := NewHis(42)
+	history := []Piece{PieceZ, PieceS, PieceZ, PieceS}
+	repeated := 0
+	for i := 0; i < 1000; i++ {
+		piece := his.Next()
+		for _, item := range history[len(history)-4:] {
+			if item == piece {
+				repeated++
+				break
+			}
+		}
+		history = append(history, piece)
+	}
+
+	// All rolls hit the history with probability (4/7)^6
+	// at most, which is about 3.5%.
+	if repeated > 60 {
+		t.Fatalf("too many repeated pieces %d", repeated)
+	}
+}
@@ -0,0 +1,71 @@
+package game
+
+// kickTable are the offsets attempted in order when the
+// piece rotates, indexed by the source and target states.
+type kickTable [4][4][]Point
+
+// kickJLSTZ is the kick table of J, L, S, T and Z pieces in
+// the super rotation system, with the 180 kicks added.
+var kickJLSTZ = kickTable{
+	RotationSpawn: {
+		RotationRight:   {{0, 0}, {-1, 0}, {-1, 1}, {0, -2}, {-1, -2}},
+		RotationReverse: {{0, 0}, {0, 1}, {1, 1}, {-1, 1}, {1, 0}, {-1, 0}},
+		RotationLeft:    {{0, 0}, {1, 0}, {1, 1}, {0, -2}, {1, -2}},
+	},
+	RotationRight: {
+		RotationSpawn:   {{0, 0}, {1, 0}, {1, -1}, {0, 2}, {1, 2}},
+		RotationReverse: {{0, 0}, {1, 0}, {1, -1}, {0, 2}, {1, 2}},
+		RotationLeft:    {{0, 0}, {1, 0}, {1, 2}, {1, 1}, {0, 2}, {0, 1}},
+	},
+	RotationReverse: {
+		RotationSpawn: {{0, 0}, {0, -1}, {-1, -1}, {1, -1}, {-1, 0}, {1, 0}},
+		RotationRight: {{0, 0}, {-1, 0}, {-1, 1}, {0, -2}, {-1, -2}},
+		RotationLeft:  {{0, 0}, {1, 0}, {1, 1}, {0, -2}, {1, -2}},
+	},
+	RotationLeft: {
+		RotationSpawn:   {{0, 0}, {-1, 0}, {-1, -1}, {0, 2}, {-1, 2}},
+		RotationRight:   {{0, 0}, {-1, 0}, {-1, 2}, {-1, 1}, {0, 2}, {0, 1}},
+		RotationReverse: {{0, 0}, {-1, 0}, {-1, -1}, {0, 2}, {-1, 2}},
+	},
+}
+
+// kickI is the kick table of I piece in the super rotation
+// system, with the 180 kicks added.
+var kickI = kickTable{
+	RotationSpawn: {
+		RotationRight:   {{0, 0}, {-2, 0}, {1, 0}, {-2, -1}, {1, 2}},
+		RotationReverse: {{0, 0}, {0, 1}},
+		RotationLeft:    {{0, 0}, {-1, 0}, {2, 0}, {-1, 2}, {2, -1}},
+	},
+	RotationRight: {
+		RotationSpawn:   {{0, 0}, {2, 0}, {-1, 0}, {2, 1}, {-1, -2}},
+		RotationReverse: {{0, 0}, {-1, 0}, {2, 0}, {-1, 2}, {2, -1}},
+		RotationLeft:    {{0, 0}, {1, 0}},
+	},
+	RotationReverse: {
+		RotationSpawn: {{0, 0}, {0, -1}},
+		RotationRight: {{0, 0}, {1, 0}, {-2, 0}, {1, -2}, {-2, 1}},
+		RotationLeft:  {{0, 0}, {2, 0}, {-1, 0}, {2, 1}, {-1, -2}},
+	},
+	RotationLeft: {
+		RotationSpawn:   {{0, 0}, {1, 0}, {-2, 0}, {1, -2}, {-2, 1}},
+		RotationRight:   {{0, 0}, {-1, 0}},
+		RotationReverse: {{0, 0}, {-2, 0}, {1, 0}, {-2, -1}, {1, 2}},
+	},
+}
+
+// kickO is the kick offset of O piece, which never kicks.
+var kickO = []Point{{0, 0}}
+
+// kicks returns the offsets attempted when the piece
+// rotates from one state to another.
+func kicks(piece Piece, from, to Rotation) []Point {
+	switch piece {
+	case PieceI:
+		return kickI[from][to]
+	case PieceO:
+		return kickO
+	default:
+		return kickJLSTZ[from][to]
+	}
+}
@@ -0,0 +1,180 @@
+package game
+
+import (
+	"errors"
+	"strings"
+)
+
+// Piece is the kind of tetromino, numbered in the order
+// of Techmino, and the zero value means no piece.
+type Piece uint8
+
+const (
+	// PieceNone is the absence of piece, like empty hold.
+	PieceNone = Piece(iota)
+
+	// PieceZ is the Z tetromino.
+	PieceZ
+
+	// PieceS is the S tetromino.
+	PieceS
+
+	// PieceJ is the J tetromino.
+	PieceJ
+
+	// PieceL is the L tetromino.
+	PieceL
+
+	// PieceT is the T tetromino.
+	PieceT
+
+	// PieceO is the O tetromino.
+	PieceO
+
+	// PieceI is the I tetromino.
+	PieceI
+)
+
+// Pieces are the tetrominoes in the order of Techmino.
+var Pieces = [...]Piece{
+	PieceZ, PieceS, PieceJ, PieceL, PieceT, PieceO, PieceI,
+}
+
+// pieceNames are the names of pieces by their values.
+var pieceNames = [...]string{"", "Z", "S", "J", "L", "T", "O", "I"}
+
+// String returns the name of the piece, or empty string
+// if it is not a piece.
+func (p Piece) String() string {
+	if int(p) < len(pieceNames) {
+		return pieceNames[p]
+	}
+	return ""
+}
+
+// ParsePiece parses the piece from its name.
+func ParsePiece(name string) (Piece, error) {
+	for _, piece := range Pieces {
+		if strings.EqualFold(pieceNames[piece], name) {
+			return piece, nil
+		}
+	}
+	return PieceNone, errors.New("invalid piece")
+}
+
+// Rotation is the rotation state of a piece, numbered
+// clockwise from the spawn state.
+type Rotation uint8
+
+const (
+	// RotationSpawn is the state the pieces spawn with.
+	RotationSpawn = Rotation(iota)
+
+	// RotationRight is rotated clockwise from spawn.
+	RotationRight
+
+	// RotationReverse is rotated twice from spawn.
+	RotationReverse
+
+	// RotationLeft is rotated counterclockwise from spawn.
+	RotationLeft
+)
+
+// rotationNames are the names of rotations by their values.
+var rotationNames = [...]string{"0", "R", "2", "L"}
+
+// String returns the name of the rotation state.
+func (r Rotation) String() string {
+	return rotationNames[r&3]
+}
+
+// Rotate returns the rotation state after rotating the
+// specified quarter turns clockwise.
+func (r Rotation) Rotate(turns int) Rotation {
+	return Rotation((int(r) + turns) & 3)
+}
+
+// Point is a cell position, where x increases rightward
+// and y increases upward from the bottom row.
+type Point struct {
+	// X is the column of the cell.
+	X int
+
+	// Y is the row of the cell.
+	Y int
+}
+
+// pieceShape is the shape of a piece inside its bounding
+// box, which rotates around the center of the box like
+// the super rotation system.
+type pieceShape struct {
+	// size of the bounding box.
+	size int
+
+	// cells of the piece in each rotation state, relative
+	// to the bottom left of the bounding box.
+	cells [4][4]Point
+}
+
+// pieceShapes are the shapes of pieces by their values,
+// initialized from the spawn states below.
+var pieceShapes [len(pieceNames)]pieceShape
+
+// init computes the shapes of the rotation states by
+// rotating the spawn states clockwise.
+func init() {
+	spawns := map[Piece]struct {
+		size  int
+		cells [4]Point
+	}{
+		PieceZ: {3, [4]Point{{0, 2}, {1, 2}, {1, 1}, {2, 1}}},
+		PieceS: {3, [4]Point{{1, 2}, {2, 2}, {0, 1}, {1, 1}}},
+		PieceJ: {3, [4]Point{{0, 2}, {0, 1}, {1, 1}, {2, 1}}},
+		PieceL: {3, [4]Point{{2, 2}, {0, 1}, {1, 1}, {2, 1}}},
+		PieceT: {3, [4]Point{{1, 2}, {0, 1}, {1, 1}, {2, 1}}},
+		PieceO: {2, [4]Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}}},
+		PieceI: {4, [4]Point{{0, 2}, {1, 2}, {2, 2}, {3, 2}}},
+	}
+	for piece, spawn := range spawns {
+		shape := &pieceShapes[piece]
+		shape.size = spawn.size
+		shape.cells[RotationSpawn] = spawn.cells
+		for r := RotationRight; r <= RotationLeft; r++ {
+			for i, cell := range shape.cells[r-1] {
+				shape.cells[r][i] = rotatePoint(cell, spawn.size)
+			}
+		}
+	}
+}
+
+// rotatePoint rotates the point inside the bounding box of
+// the specified size clockwise by a quarter turn.
+func rotatePoint(p Point, size int) Point {
+	return Point{X: p.Y, Y: size - 1 - p.X}
+}
+
+// Falling is the piece controlled by the player, located
+// by the bottom left of its bounding box.
+type Falling struct {
+	// Piece is the kind of the falling piece.
+	Piece Piece
+
+	// Rotation is the current rotation state.
+	Rotation Rotation
+
+	// X is the column of the bounding box.
+	X int
+
+	// Y is the row of the bounding box.
+	Y int
+}
+
+// Cells returns the cells occupied by the falling piece.
+func (f Falling) Cells() [4]Point {
+	result := pieceShapes[f.Piece].cells[f.Rotation&3]
+	for i := range result {
+		result[i].X += f.X
+		result[i].Y += f.Y
+	}
+	return result
+}
@@ -0,0 +1,105 @@
+package game
+
+import (
+	"fmt"
+)
+
+// Input is an action applied at the specified frame.
+type Input struct {
+	// Frame is the frame when the action is applied, which
+	// is the number of frames elapsed before the action.
+	Frame int `json:"frame"`
+
+	// Action is the action applied.
+	Action Action `json:"action"`
+}
+
+// Garbage is the garbage lines received at the frame.
+type Garbage struct {
+	// Frame is the frame when the garbage is received.
+	Frame int `json:"frame"`
+
+	// Lines is the number of garbage lines.
+	Lines int `json:"lines"`
+
+	// Hole is the column of the hole.
+	Hole int `json:"hole"`
+}
+
+// Record is the record of a game, which could be replayed
+// to reproduce and verify the game.
+type Record struct {
+	// Config is the rules of the game.
+	Config Config `json:"config"`
+
+	// Algorithm is the algorithm of the generator, which
+	// is the DefaultAlgorithm if empty.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Seed is the seed of the generator.
+	Seed uint64 `json:"seed"`
+
+	// Inputs are the actions applied in order of frames.
+	Inputs []Input `json:"inputs"`
+
+	// Garbage are the garbage received in order of frames,
+	// which are received before the inputs of the frame.
+	Garbage []Garbage `json:"garbage,omitempty"`
+
+	// Frames is the number of frames the game lasts.
+	Frames int `json:"frames"`
+}
+
+// Replay replays the record, and returns the game at the
+// end of the record, with the results of all locks.
+func Replay(record *Record) (*Game, []*Lock, error) {
+	generator, err := NewGenerator(record.Algorithm, record.Seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := NewWithGenerator(record.Config, generator)
+	if err != nil {
+		return nil, nil, err
+	}
+	var locks []*Lock
+	advance := func(frame int) error {
+		if frame < g.frame || frame > record.Frames {
+			return fmt.Errorf("frame %d out of order", frame)
+		}
+		for g.frame < frame && !g.over {
+			if lock := g.Tick(); lock != nil {
+				locks = append(locks, lock)
+			}
+		}
+		return nil
+	}
+	inputs, garbage := record.Inputs, record.Garbage
+	for len(inputs) > 0 || len(garbage) > 0 {
+		if len(garbage) > 0 &&
+			(len(inputs) == 0 || garbage[0].Frame <= inputs[0].Frame) {
+			if err := advance(garbage[0].Frame); err != nil {
+				return nil, nil, err
+			}
+			if err := g.Garbage(garbage[0].Lines, garbage[0].Hole); err != nil {
+				return nil, nil, err
+			}
+			garbage = garbage[1:]
+			continue
+		}
+		if err := advance(inputs[0].Frame); err != nil {
+			return nil, nil, err
+		}
+		if g.over {
+			return nil, nil, fmt.Errorf(
+				"input at frame %d after game over", inputs[0].Frame)
+		}
+		if _, lock := g.Apply(inputs[0].Action); lock != nil {
+			locks = append(locks, lock)
+		}
+		inputs = inputs[1:]
+	}
+	if err := advance(record.Frames); err != nil {
+		return nil, nil, err
+	}
+	return g, locks, nil
+}
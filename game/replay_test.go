@@ -0,0 +1,367 @@
+package game
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// boardRows renders the board from the highest row that is
+// not empty down to the bottom row, where the empty cells
+// are dots and the garbage cells are X.
+func boardRows(b *Board) []string {
+	top := -1
+	for y := 0; y < BoardHeight; y++ {
+		if b[y] != [BoardWidth]Cell{} {
+			top = y
+		}
+	}
+	var result []string
+	for y := top; y >= 0; y-- {
+		var row strings.Builder
+		for _, cell := range b[y] {
+			switch {
+			case cell == CellEmpty:
+				row.WriteByte('.')
+			case cell == CellGarbage:
+				row.WriteByte('X')
+			default:
+				row.WriteString(Piece(cell).String())
+			}
+		}
+		result = append(result, row.String())
+	}
+	return result
+}
+
+// inputs returns the actions applied at the same frame.
+func inputs(frame int, actions ...Action) []Input {
+	result := make([]Input, len(actions))
+	for i, action := range actions {
+		result[i] = Input{Frame: frame, Action: action}
+	}
+	return result
+}
+
+// instantConfig is the default config with instant gravity,
+// so that the pieces are controlled on the ground.
+func instantConfig() Config {
+	config := DefaultConfig()
+	config.Gravity = 0
+	return config
+}
+
+// TestReplay replays the recorded games, and compares the
+// final boards, locks and stats with the expected ones.
+func TestReplay(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		record *Record
+		board  []string
+		locks  []Lock
+		stats  Stats
+		hold   Piece
+	}{{
+		// The I piece is dropped into the well of the
+		// garbage, which is a tetris and an all clear.
+		name: "all clear",
+		record: &Record{
+			Config:  DefaultConfig(),
+			Seed:    0,
+			Garbage: []Garbage{{Frame: 0, Lines: 4, Hole: 0}},
+			Inputs: inputs(0, ActionRotateCW,
+				ActionLeft, ActionLeft, ActionLeft, ActionLeft, ActionLeft,
+				ActionHardDrop),
+		},
+		locks: []Lock{{
+			Piece: PieceI, Lines: 4, Combo: 0, AllClear: true,
+			Attack: 4 + allClearAttack,
+		}},
+		stats: Stats{Pieces: 1, Lines: 4, Attack: 14},
+	}, {
+		// The T piece kicks into the hole at the wall by
+		// the second offset, which is a mini spin. Then the
+		// I piece is rotated by the fifth offset of the I
+		// kicks over the raised garbage, and is dropped into
+		// the well for back-to-back tetris in combo.
+		name: "mini spin and back to back",
+		record: &Record{
+			Config: instantConfig(),
+			Seed:   6,
+			Garbage: []Garbage{
+				{Frame: 0, Lines: 1, Hole: 0},
+				{Frame: 1, Lines: 4, Hole: 9},
+			},
+			Inputs: append(inputs(0,
+				ActionLeft, ActionLeft, ActionLeft, ActionRotateCW,
+				ActionHardDrop,
+			), inputs(1,
+				ActionHold, ActionRotateCW,
+				ActionRight, ActionRight, ActionRight, ActionHardDrop,
+			)...),
+			Frames: 1,
+		},
+		board: []string{
+			"T.........",
+			"TT........",
+		},
+		locks: []Lock{
+			{Piece: PieceT, Spin: SpinMini, Lines: 1, Combo: 0},
+			{Piece: PieceI, Lines: 4, Combo: 1, B2B: true, Attack: 5},
+		},
+		stats: Stats{Pieces: 2, Lines: 5, Attack: 5},
+		hold:  PieceJ,
+	}, {
+		// The J piece is flipped by the second 180 kick to
+		// make the overhang, and the T piece is spun under
+		// it into the hole with both front corners blocked,
+		// which is a full spin single.
+		name: "full spin",
+		record: &Record{
+			Config:  instantConfig(),
+			Seed:    6,
+			Garbage: []Garbage{{Frame: 0, Lines: 1, Hole: 1}},
+			Inputs: inputs(0,
+				ActionHold, ActionLeft, ActionRotate180, ActionHardDrop,
+				ActionHold, ActionRotateCW,
+				ActionLeft, ActionLeft, ActionLeft, ActionRotateCW,
+				ActionHardDrop),
+		},
+		board: []string{
+			"..JJJ.....",
+			"TTT.J.....",
+		},
+		locks: []Lock{
+			{Piece: PieceJ, Combo: -1},
+			{Piece: PieceT, Spin: SpinFull, Lines: 1, Combo: 0, Attack: 2},
+		},
+		stats: Stats{Pieces: 2, Lines: 1, Attack: 2},
+		hold:  PieceI,
+	}, {
+		// The J piece of the his generator falls a row per
+		// 60 frames for 20 rows, and locks after 60 frames
+		// on the ground including the frame it lands.
+		name: "gravity and lock delay",
+		record: &Record{
+			Config:    DefaultConfig(),
+			Algorithm: "his",
+			Seed:      0,
+			Frames:    20*60 + 59,
+		},
+		board: []string{
+			"...J......",
+			"...JJJ....",
+		},
+		locks: []Lock{{Piece: PieceJ, Combo: -1}},
+		stats: Stats{Pieces: 1},
+	}, {
+		// The T piece is held for the second I piece, and
+		// the falling I piece is soft dropped before moved.
+		name: "hold and soft drop",
+		record: &Record{
+			Config:    DefaultConfig(),
+			Algorithm: "random",
+			Seed:      4,
+			Inputs: append(inputs(0,
+				ActionLeft, ActionLeft, ActionLeft, ActionHardDrop,
+				ActionHold, ActionSoftDrop, ActionSoftDrop,
+			), inputs(30, ActionRight, ActionHardDrop)...),
+			Frames: 30,
+		},
+		board: []string{"IIIIIIII.."},
+		locks: []Lock{
+			{Piece: PieceI, Combo: -1},
+			{Piece: PieceI, Combo: -1},
+		},
+		stats: Stats{Pieces: 2},
+		hold:  PieceT,
+	}} {
+		t.Run(testCase.name, func(t *testing.T) {
+			g, locks, err := Replay(testCase.record)
+			if err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+			if board := boardRows(g.Board()); !reflect.DeepEqual(board, testCase.board) {
+				t.Fatalf("expect board %q, got %q", testCase.board, board)
+			}
+			if len(locks) != len(testCase.locks) {
+				t.Fatalf("expect %d locks, got %d", len(testCase.locks), len(locks))
+			}
+			for i, lock := range locks {
+				if *lock != testCase.locks[i] {
+					t.Fatalf("expect lock %d %+v, got %+v", i, testCase.locks[i], *lock)
+				}
+			}
+			if stats := g.Stats(); stats != testCase.stats {
+				t.Fatalf("expect stats %+v, got %+v", testCase.stats, stats)
+			}
+			if hold := g.Hold(); hold != testCase.hold {
+				t.Fatalf("expect hold %v, got %v", testCase.hold, hold)
+			}
+			if g.Frame() != testCase.record.Frames || g.Over() {
+				t.Fatalf("unexpected frame %d, over %v", g.Frame(), g.Over())
+			}
+		})
+	}
+}
+
+// TestReplayLockDelay ensures the piece is not locked a
+// frame before the lock delay elapses.
+func TestReplayLockDelay(t *testing.T) {
+	g, locks, err := Replay(&Record{
+		Config:    DefaultConfig(),
+		Algorithm: "his",
+		Frames:    20*60 + 58,
+	})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	falling, ok := g.Falling()
+	if len(locks) != 0 || !ok || falling.Piece != PieceJ || falling.Y != -1 {
+		t.Fatalf("unexpected locks %d, falling %+v", len(locks), falling)
+	}
+}
+
+// TestReplayErrors ensures the invalid records are rejected.
+func TestReplayErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		record *Record
+		error  string
+	}{
+		{"algorithm", &Record{
+			Config: DefaultConfig(), Algorithm: "tgm",
+		}, "unknown algorithm"},
+		{"config", &Record{
+			Config: Config{Preview: maxPreview + 1},
+		}, "invalid preview"},
+		{"order", &Record{
+			Config: DefaultConfig(),
+			Inputs: []Input{{Frame: 2}, {Frame: 1}},
+			Frames: 2,
+		}, "out of order"},
+		{"frames", &Record{
+			Config: DefaultConfig(),
+			Inputs: []Input{{Frame: 2}},
+			Frames: 1,
+		}, "out of order"},
+		{"garbage", &Record{
+			Config:  DefaultConfig(),
+			Garbage: []Garbage{{Lines: 1, Hole: BoardWidth}},
+		}, "invalid garbage"},
+		{"over", &Record{
+			Config:  DefaultConfig(),
+			Garbage: []Garbage{{Lines: maxGarbage, Hole: 0}},
+			Inputs:  []Input{{Frame: 0, Action: ActionHardDrop}},
+		}, "after game over"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, _, err := Replay(testCase.record)
+			if err == nil || !strings.Contains(err.Error(), testCase.error) {
+				t.Fatalf("expect error %q, got %v", testCase.error, err)
+			}
+		})
+	}
+}
+
+// randomRecord plays the game with the actions and garbage
+// picked by the rng until it is over or the frames elapse,
+// and returns the game with its record.
+func randomRecord(seed uint64) (*Game, *Record) {
+	rng := NewRng(seed)
+	record := &Record{
+		Config:    DefaultConfig(),
+		Algorithm: "his",
+		Seed:      seed,
+	}
+	generator, _ := NewGenerator(record.Algorithm, seed)
+	g, _ := NewWithGenerator(record.Config, generator)
+	for !g.Over() && g.Frame() < 3000 {
+		// The garbage is received before the inputs of the
+		// frame, as it is replayed.
+		if rng.Intn(100) == 0 {
+			garbage := Garbage{
+				Frame: g.Frame(),
+				Lines: 1 + rng.Intn(3),
+				Hole:  rng.Intn(BoardWidth),
+			}
+			_ = g.Garbage(garbage.Lines, garbage.Hole)
+			record.Garbage = append(record.Garbage, garbage)
+		}
+		for n := rng.Intn(3); n > 0 && !g.Over(); n-- {
+			action := Action(rng.Intn(len(actionNames)))
+			g.Apply(action)
+			record.Inputs = append(record.Inputs, Input{
+				Frame: g.Frame(), Action: action})
+		}
+		g.Tick()
+	}
+	record.Frames = g.Frame()
+	return g, record
+}
+
+// TestReplayDeterministic ensures the same seed and actions
+// reproduce the identical game, including the record
+// transferred as json.
+func TestReplayDeterministic(t *testing.T) {
+	for seed := uint64(0); seed < 8; seed++ {
+		played, record := randomRecord(seed)
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var decoded Record
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		first, firstLocks, err := Replay(record)
+		if err != nil {
+			t.Fatalf("seed %d: replay: %v", seed, err)
+		}
+		second, secondLocks, err := Replay(&decoded)
+		if err != nil {
+			t.Fatalf("seed %d: replay decoded: %v", seed, err)
+		}
+		if !reflect.DeepEqual(first, played) || !reflect.DeepEqual(first, second) {
+			t.Fatalf("seed %d: games differ", seed)
+		}
+		if !reflect.DeepEqual(firstLocks, secondLocks) {
+			t.Fatalf("seed %d: locks differ", seed)
+		}
+		if len(firstLocks) != played.Stats().Pieces || len(firstLocks) == 0 {
+			t.Fatalf("seed %d: unexpected %d locks", seed, len(firstLocks))
+		}
+	}
+}
+
+// TestCloneDeterministic ensures the clone evolves
+// identically to the game it is cloned from.
+func TestCloneDeterministic(t *testing.T) {
+	g, err := New(DefaultConfig(), 42)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	rng := NewRng(42)
+	for i := 0; i < 500; i++ {
+		g.Apply(Action(rng.Intn(len(actionNames))))
+		g.Tick()
+	}
+	clone := g.Clone()
+	for i := 0; i < 500; i++ {
+		action := Action(rng.Intn(len(actionNames)))
+		if _, lock := g.Apply(action); lock != nil {
+			_, cloneLock := clone.Apply(action)
+			if !reflect.DeepEqual(lock, cloneLock) {
+				t.Fatalf("locks differ at %d", i)
+			}
+		} else {
+			clone.Apply(action)
+		}
+		g.Tick()
+		clone.Tick()
+	}
+	if !reflect.DeepEqual(g, clone) {
+		t.Fatal("clone differs from the game")
+	}
+}
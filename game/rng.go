@@ -0,0 +1,47 @@
+package game
+
+// Rng is the pseudo random number generator of the game,
+// which uses the splitmix64 algorithm on integers only,
+// so that the sequence is identical on every platform.
+type Rng struct {
+	// state is the internal state of the generator.
+	state uint64
+}
+
+// NewRng creates the generator from the seed.
+func NewRng(seed uint64) *Rng {
+	return &Rng{state: seed}
+}
+
+// Uint64 returns the next random 64-bit integer.
+func (r *Rng) Uint64() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Intn returns a uniform random integer within [0, n),
+// where n must be positive.
+func (r *Rng) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+
+	// Reject the values in the incomplete range at the end,
+	// so that the result is not biased.
+	bound := uint64(n)
+	limit := -bound % bound
+	for {
+		value := r.Uint64()
+		if value >= limit {
+			return int(value % bound)
+		}
+	}
+}
+
+// Float64 returns a uniform random number within [0, 1).
+func (r *Rng) Float64() float64 {
+	return float64(r.Uint64()>>11) / (1 << 53)
+}
@@ -2,4 +2,8 @@ module github.com/Techmino/TechminoOnline
 
 go 1.12
 
-require golang.org/x/net v0.0.0-20200513185701-a91f0712d120
+require (
+	github.com/andybalholm/brotli v1.0.0
+	github.com/klauspost/compress v1.9.8
+	golang.org/x/net v0.0.0-20200513185701-a91f0712d120
+)
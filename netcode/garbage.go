@@ -0,0 +1,230 @@
+package netcode
+
+import (
+	"errors"
+
+	"github.com/Techmino/TechminoOnline/game"
+)
+
+// Message types of the attack exchange.
+const (
+	// MessageAttack carries the garbage lines sent.
+	MessageAttack = "attack"
+
+	// MessageAck acknowledges the attacks received.
+	MessageAck = "ack"
+)
+
+// Message is the typed message of the attack exchange.
+type Message struct {
+	// Type of the message, attack or ack.
+	Type string `json:"type"`
+
+	// Seq is the sequence number of the attack, which is
+	// numbered from 1 by the sender.
+	Seq int `json:"seq,omitempty"`
+
+	// Ack is the sequence number of the last attack from the
+	// peer that has been received in order.
+	Ack int `json:"ack"`
+
+	// Lines is the number of garbage lines of the attack.
+	Lines int `json:"lines,omitempty"`
+
+	// Hole is the column of the hole of garbage lines.
+	Hole int `json:"hole,omitempty"`
+}
+
+// Garbage is the garbage lines pending to be received.
+type Garbage struct {
+	// Seq is the sequence number of the attack.
+	Seq int
+
+	// Lines is the number of garbage lines.
+	Lines int
+
+	// Hole is the column of the hole.
+	Hole int
+}
+
+// maxAttack is the maximum lines of a single attack.
+const maxAttack = game.BoardHeight
+
+// maxReorder is the maximum number of attacks buffered when
+// they arrive out of order.
+const maxReorder = 256
+
+// Exchange is the attack exchange between a pair of peers,
+// where the attacks are numbered and retransmitted until they
+// are acknowledged, and the attacks received are accepted in
+// order exactly once regardless of duplication or reordering.
+type Exchange struct {
+	// rng generates the holes of outgoing garbage lines.
+	rng game.Rng
+
+	// seq is the sequence number of the last attack sent.
+	seq int
+
+	// unacked are the attacks not acknowledged by peer.
+	unacked []*Message
+
+	// ack is the sequence number of the last attack from
+	// the peer accepted in order.
+	ack int
+
+	// early are the attacks arrived before their preceding
+	// ones, by their sequence numbers.
+	early map[int]*Message
+
+	// pending is the queue of incoming garbage lines.
+	pending []Garbage
+
+	// sent is the total garbage lines sent.
+	sent int
+
+	// received is the total garbage lines received.
+	received int
+
+	// cancelled is the total garbage lines cancelled.
+	cancelled int
+}
+
+// NewExchange creates the attack exchange, where the seed is
+// used to generate the holes of outgoing garbage lines.
+func NewExchange(seed uint64) *Exchange {
+	return &Exchange{
+		rng:   *game.NewRng(seed),
+		early: make(map[int]*Message),
+	}
+}
+
+// Attack sends the attack of the lines, which cancels the
+// pending garbage from the oldest first, and returns the
+// message of the rest of lines, or nil if all are cancelled.
+func (e *Exchange) Attack(lines int) (*Message, error) {
+	if lines < 0 || lines > maxAttack {
+		return nil, errors.New("invalid attack lines")
+	}
+	for lines > 0 && len(e.pending) > 0 {
+		cancel := lines
+		if cancel > e.pending[0].Lines {
+			cancel = e.pending[0].Lines
+		}
+		lines -= cancel
+		e.cancelled += cancel
+		if e.pending[0].Lines -= cancel; e.pending[0].Lines == 0 {
+			e.pending = e.pending[1:]
+		}
+	}
+	if lines == 0 {
+		return nil, nil
+	}
+	e.seq++
+	e.sent += lines
+	message := &Message{
+		Type:  MessageAttack,
+		Seq:   e.seq,
+		Ack:   e.ack,
+		Lines: lines,
+		Hole:  e.rng.Intn(game.BoardWidth),
+	}
+	e.unacked = append(e.unacked, message)
+	return message, nil
+}
+
+// Receive accepts the message from the peer, and returns the
+// ack message to reply if there are attacks accepted in order.
+func (e *Exchange) Receive(message *Message) (*Message, error) {
+	switch message.Type {
+	case MessageAttack:
+		if message.Seq < 1 || message.Lines < 1 || message.Lines > maxAttack ||
+			message.Hole < 0 || message.Hole >= game.BoardWidth {
+			return nil, errors.New("invalid attack message")
+		}
+	case MessageAck:
+	default:
+		return nil, errors.New("invalid message type")
+	}
+	if message.Ack < 0 || message.Ack > e.seq {
+		return nil, errors.New("invalid ack of message")
+	}
+
+	// Drop the attacks acknowledged by the peer.
+	for len(e.unacked) > 0 && e.unacked[0].Seq <= message.Ack {
+		e.unacked = e.unacked[1:]
+	}
+	if message.Type != MessageAttack {
+		return nil, nil
+	}
+
+	// Acknowledge the duplicated attacks again, since the ack
+	// replied previously might have been lost.
+	if message.Seq <= e.ack {
+		return &Message{Type: MessageAck, Ack: e.ack}, nil
+	}
+
+	// Accept the attacks in order, buffering the early ones.
+	if message.Seq > e.ack+1 {
+		if len(e.early) >= maxReorder {
+			return nil, errors.New("too many attacks out of order")
+		}
+		e.early[message.Seq] = message
+		return nil, nil
+	}
+	for message != nil {
+		e.ack = message.Seq
+		e.received += message.Lines
+		e.pending = append(e.pending, Garbage{
+			Seq:   message.Seq,
+			Lines: message.Lines,
+			Hole:  message.Hole,
+		})
+		message = e.early[e.ack+1]
+		delete(e.early, e.ack+1)
+	}
+	return &Message{Type: MessageAck, Ack: e.ack}, nil
+}
+
+// Unacked returns the attacks not acknowledged yet, which
+// should be sent again after the connection recovers.
+func (e *Exchange) Unacked() []*Message {
+	result := make([]*Message, len(e.unacked))
+	for i, message := range e.unacked {
+		resend := *message
+		resend.Ack = e.ack
+		result[i] = &resend
+	}
+	return result
+}
+
+// Pending returns the queue of incoming garbage lines.
+func (e *Exchange) Pending() []Garbage {
+	return append([]Garbage(nil), e.pending...)
+}
+
+// Take removes at most the lines from the pending garbage,
+// where the last one might be split, and returns them. The
+// garbage taken should be scheduled by Session.Garbage in a
+// lockstep session, so that every peer receives it at the
+// same frame.
+func (e *Exchange) Take(lines int) []Garbage {
+	var result []Garbage
+	for lines > 0 && len(e.pending) > 0 {
+		item := e.pending[0]
+		if item.Lines > lines {
+			item.Lines = lines
+			e.pending[0].Lines -= lines
+		} else {
+			e.pending = e.pending[1:]
+		}
+		lines -= item.Lines
+		result = append(result, item)
+	}
+	return result
+}
+
+// Stats returns the total garbage lines sent, received and
+// cancelled by the exchange.
+func (e *Exchange) Stats() (sent, received, cancelled int) {
+	return e.sent, e.received, e.cancelled
+}
@@ -0,0 +1,329 @@
+package netcode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// attack is the attack message from the peer.
+func attack(seq, ack, lines, hole int) Message {
+	return Message{Type: MessageAttack, Seq: seq, Ack: ack, Lines: lines, Hole: hole}
+}
+
+// ack is the ack message from the peer.
+func ack(seq int) Message {
+	return Message{Type: MessageAck, Ack: seq}
+}
+
+// step is a message received, with the ack replied or -1
+// if there's no reply, or the error expected.
+type step struct {
+	message Message
+	reply   int
+	error   string
+}
+
+// seqs returns the sequence numbers of the messages.
+func seqs(messages []*Message) []int {
+	result := []int{}
+	for _, message := range messages {
+		result = append(result, message.Seq)
+	}
+	return result
+}
+
+// TestExchangeReceive receives the messages in order, and
+// compares the replies, the pending garbage and the attacks
+// not acknowledged with the expected ones.
+func TestExchangeReceive(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		sent    int
+		steps   []step
+		pending []Garbage
+		unacked []int
+	}{{
+		name: "in order",
+		steps: []step{
+			{message: attack(1, 0, 2, 3), reply: 1},
+			{message: attack(2, 0, 1, 4), reply: 2},
+		},
+		pending: []Garbage{{1, 2, 3}, {2, 1, 4}},
+	}, {
+		name: "reordered",
+		steps: []step{
+			{message: attack(3, 0, 3, 0), reply: -1},
+			{message: attack(2, 0, 2, 0), reply: -1},
+			{message: attack(1, 0, 1, 0), reply: 3},
+			{message: attack(4, 0, 4, 0), reply: 4},
+		},
+		pending: []Garbage{{1, 1, 0}, {2, 2, 0}, {3, 3, 0}, {4, 4, 0}},
+	}, {
+		name: "duplicated",
+		steps: []step{
+			{message: attack(1, 0, 1, 0), reply: 1},
+			{message: attack(1, 0, 1, 0), reply: 1},
+			{message: attack(3, 0, 3, 0), reply: -1},
+			{message: attack(3, 0, 3, 0), reply: -1},
+			{message: attack(2, 0, 2, 0), reply: 3},
+			{message: attack(2, 0, 2, 0), reply: 3},
+			{message: attack(3, 0, 3, 0), reply: 3},
+		},
+		pending: []Garbage{{1, 1, 0}, {2, 2, 0}, {3, 3, 0}},
+	}, {
+		name: "acks",
+		sent: 3,
+		steps: []step{
+			{message: ack(1), reply: -1},
+			{message: attack(1, 2, 1, 0), reply: 1},
+		},
+		pending: []Garbage{{1, 1, 0}},
+		unacked: []int{3},
+	}, {
+		name: "stale acks",
+		sent: 3,
+		steps: []step{
+			{message: ack(2), reply: -1},
+			{message: ack(1), reply: -1},
+			{message: attack(1, 0, 1, 0), reply: 1},
+		},
+		pending: []Garbage{{1, 1, 0}},
+		unacked: []int{3},
+	}, {
+		name: "ack beyond seq",
+		sent: 2,
+		steps: []step{
+			{message: ack(3), error: "invalid ack"},
+			{message: attack(1, 3, 1, 0), error: "invalid ack"},
+			{message: ack(-1), error: "invalid ack"},
+		},
+		unacked: []int{1, 2},
+	}, {
+		name: "invalid attacks",
+		steps: []step{
+			{message: attack(0, 0, 1, 0), error: "invalid attack"},
+			{message: attack(1, 0, 0, 0), error: "invalid attack"},
+			{message: attack(1, 0, maxAttack+1, 0), error: "invalid attack"},
+			{message: attack(1, 0, 1, -1), error: "invalid attack"},
+			{message: attack(1, 0, 1, 10), error: "invalid attack"},
+			{message: Message{Type: "garbage"}, error: "invalid message type"},
+		},
+	}} {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := NewExchange(0)
+			for i := 0; i < testCase.sent; i++ {
+				if _, err := e.Attack(1); err != nil {
+					t.Fatalf("attack: %v", err)
+				}
+			}
+			for i, step := range testCase.steps {
+				message := step.message
+				reply, err := e.Receive(&message)
+				if step.error != "" {
+					if err == nil || !strings.Contains(err.Error(), step.error) {
+						t.Fatalf("step %d: expect error %q, got %v", i, step.error, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: receive: %v", i, err)
+				}
+				switch {
+				case step.reply < 0 && reply != nil:
+					t.Fatalf("step %d: unexpected reply %+v", i, reply)
+				case step.reply >= 0 && (reply == nil ||
+					*reply != Message{Type: MessageAck, Ack: step.reply}):
+					t.Fatalf("step %d: expect ack %d, got %+v", i, step.reply, reply)
+				}
+			}
+			if pending := e.Pending(); !reflect.DeepEqual(pending, testCase.pending) {
+				t.Fatalf("expect pending %+v, got %+v", testCase.pending, pending)
+			}
+			expect := testCase.unacked
+			if expect == nil {
+				expect = []int{}
+			}
+			if unacked := seqs(e.Unacked()); !reflect.DeepEqual(unacked, expect) {
+				t.Fatalf("expect unacked %v, got %v", expect, unacked)
+			}
+		})
+	}
+}
+
+// TestExchangeReorderLimit ensures at most maxReorder attacks
+// are buffered, and the buffered ones are still accepted.
+func TestExchangeReorderLimit(t *testing.T) {
+	e := NewExchange(0)
+	for seq := 2; seq < maxReorder+2; seq++ {
+		message := attack(seq, 0, 1, 0)
+		if reply, err := e.Receive(&message); err != nil || reply != nil {
+			t.Fatalf("seq %d: unexpected reply %+v, %v", seq, reply, err)
+		}
+	}
+	beyond := attack(maxReorder+2, 0, 1, 0)
+	if _, err := e.Receive(&beyond); err == nil ||
+		!strings.Contains(err.Error(), "out of order") {
+		t.Fatalf("expect reorder error, got %v", err)
+	}
+	first := attack(1, 0, 1, 0)
+	reply, err := e.Receive(&first)
+	if err != nil || reply == nil || reply.Ack != maxReorder+1 {
+		t.Fatalf("expect ack %d, got %+v, %v", maxReorder+1, reply, err)
+	}
+	if pending := e.Pending(); len(pending) != maxReorder+1 {
+		t.Fatalf("expect %d pending, got %d", maxReorder+1, len(pending))
+	}
+
+	// The attack rejected could be received again.
+	if reply, err := e.Receive(&beyond); err != nil || reply.Ack != maxReorder+2 {
+		t.Fatalf("expect ack %d, got %+v, %v", maxReorder+2, reply, err)
+	}
+}
+
+// TestExchangeCancel ensures the attacks cancel the pending
+// garbage from the oldest first.
+func TestExchangeCancel(t *testing.T) {
+	e := NewExchange(0)
+	for _, message := range []Message{
+		attack(1, 0, 3, 1), attack(2, 0, 2, 2), attack(3, 0, 4, 3),
+	} {
+		message := message
+		if _, err := e.Receive(&message); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+	}
+	for _, testCase := range []struct {
+		lines   int
+		sent    int
+		pending []Garbage
+	}{
+		{0, 0, []Garbage{{1, 3, 1}, {2, 2, 2}, {3, 4, 3}}},
+		{2, 0, []Garbage{{1, 1, 1}, {2, 2, 2}, {3, 4, 3}}},
+		{2, 0, []Garbage{{2, 1, 2}, {3, 4, 3}}},
+		{7, 2, []Garbage{}},
+		{1, 1, []Garbage{}},
+	} {
+		message, err := e.Attack(testCase.lines)
+		if err != nil {
+			t.Fatalf("attack: %v", err)
+		}
+		sent := 0
+		if message != nil {
+			sent = message.Lines
+		}
+		if sent != testCase.sent {
+			t.Fatalf("attack %d: expect sent %d, got %d",
+				testCase.lines, testCase.sent, sent)
+		}
+		pending := e.Pending()
+		if pending == nil {
+			pending = []Garbage{}
+		}
+		if !reflect.DeepEqual(pending, testCase.pending) {
+			t.Fatalf("attack %d: expect pending %+v, got %+v",
+				testCase.lines, testCase.pending, pending)
+		}
+	}
+	if sent, received, cancelled := e.Stats(); sent != 3 ||
+		received != 9 || cancelled != 9 {
+		t.Fatalf("unexpected stats %d, %d, %d", sent, received, cancelled)
+	}
+	if _, err := e.Attack(maxAttack + 1); err == nil {
+		t.Fatal("expect invalid attack error")
+	}
+}
+
+// pendingLines returns the total lines pending.
+func pendingLines(e *Exchange) int {
+	result := 0
+	for _, item := range e.Pending() {
+		result += item.Lines
+	}
+	return result
+}
+
+// TestExchangeCrossing exchanges the attacks sent by both
+// peers at the same time, where the messages are lost and
+// resent, and both peers must end consistently.
+func TestExchangeCrossing(t *testing.T) {
+	peers := [2]*Exchange{NewExchange(1), NewExchange(2)}
+
+	// deliver delivers the messages to the peer, and
+	// returns its replies, where nil messages are skipped.
+	deliver := func(to int, messages ...*Message) []*Message {
+		var replies []*Message
+		for _, message := range messages {
+			if message == nil {
+				continue
+			}
+			reply, err := peers[to].Receive(message)
+			if err != nil {
+				t.Fatalf("peer %d: receive: %v", to, err)
+			}
+			if reply != nil {
+				replies = append(replies, reply)
+			}
+		}
+		return replies
+	}
+	send := func(from, lines int) *Message {
+		message, err := peers[from].Attack(lines)
+		if err != nil {
+			t.Fatalf("peer %d: attack: %v", from, err)
+		}
+		return message
+	}
+
+	// Both peers attack before receiving the other's, so
+	// that neither attack is cancelled.
+	a1, b1 := send(0, 4), send(1, 3)
+	deliver(0, deliver(1, a1)...)
+	deliver(1, deliver(0, b1)...)
+	if pendingLines(peers[0]) != 3 || pendingLines(peers[1]) != 4 {
+		t.Fatalf("unexpected pending %d and %d",
+			pendingLines(peers[0]), pendingLines(peers[1]))
+	}
+
+	// The second peer cancels the pending garbage and sends
+	// the rest, whose reply is lost, while the first peer
+	// cancels a part of its pending garbage.
+	b2 := send(1, 6)
+	a2 := send(0, 1)
+	if a2 != nil || b2 == nil || b2.Lines != 2 {
+		t.Fatalf("unexpected attacks %+v and %+v", a2, b2)
+	}
+	deliver(0, b2)
+	if len(peers[1].Unacked()) != 1 {
+		t.Fatal("expect the attack not acknowledged")
+	}
+
+	// The attack is resent after the connection recovers,
+	// which is acknowledged again without duplication.
+	deliver(1, deliver(0, peers[1].Unacked()...)...)
+	for i, e := range peers {
+		if len(e.Unacked()) != 0 {
+			t.Fatalf("peer %d: unexpected unacked %v", i, seqs(e.Unacked()))
+		}
+	}
+	if pendingLines(peers[0]) != 2+2 || pendingLines(peers[1]) != 0 {
+		t.Fatalf("unexpected pending %d and %d",
+			pendingLines(peers[0]), pendingLines(peers[1]))
+	}
+
+	// The lines sent by a peer are all received by the
+	// other, and the pending lines are those received and
+	// not cancelled.
+	for i, e := range peers {
+		other := peers[1-i]
+		sent, _, _ := e.Stats()
+		_, received, cancelled := other.Stats()
+		if sent != received {
+			t.Fatalf("peer %d: sent %d, received %d", i, sent, received)
+		}
+		if pendingLines(other) != received-cancelled {
+			t.Fatalf("peer %d: pending %d, received %d, cancelled %d",
+				1-i, pendingLines(other), received, cancelled)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Package netcode implements the input based lockstep of
+// versus matches with rollback, where only the inputs are
+// exchanged, and every peer simulates the games of all
+// players deterministically from the same seed.
+package netcode
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Techmino/TechminoOnline/game"
+)
+
+// Config is the configuration of a session, which must be
+// identical among the peers except the Local player.
+type Config struct {
+	// Game is the rules of the games.
+	Game game.Config
+
+	// Algorithm is the algorithm of the piece generators.
+	Algorithm string
+
+	// Seed is the seed of the piece generators shared by
+	// all players.
+	Seed uint64
+
+	// Players is the number of players in the match.
+	Players int
+
+	// Local is the index of the local player.
+	Local int
+
+	// InputDelay is the frames the local inputs are delayed,
+	// so that they could arrive at peers before simulated.
+	InputDelay int
+
+	// Window is the maximum frames predicted beyond the
+	// confirmed frame, the session stalls when it is reached.
+	Window int
+}
+
+// maxPlayers is the maximum number of players in a session.
+const maxPlayers = 16
+
+// maxFrames is the maximum frames of input delay and window.
+const maxFrames = 600
+
+// Validate returns error if the config is out of range.
+func (c *Config) Validate() error {
+	switch {
+	case c.Players < 1 || c.Players > maxPlayers:
+		return errors.New("invalid players")
+	case c.Local < 0 || c.Local >= c.Players:
+		return errors.New("invalid local player")
+	case c.InputDelay < 0 || c.InputDelay > maxFrames:
+		return errors.New("invalid input delay")
+	case c.Window < 1 || c.Window > maxFrames:
+		return errors.New("invalid rollback window")
+	}
+	return c.Game.Validate()
+}
+
+// Packet carries the inputs of consecutive frames of a
+// player, which are sent to the other peers in order.
+type Packet struct {
+	// Player is the index of the player.
+	Player int `json:"player"`
+
+	// Frame is the frame of the first inputs.
+	Frame int `json:"frame"`
+
+	// Inputs are the actions of each frame from Frame.
+	Inputs [][]game.Action `json:"inputs"`
+
+	// Garbage are the garbage lines received by the player
+	// within the frames of inputs in order, which are applied
+	// before the actions of their frames.
+	Garbage []game.Garbage `json:"garbage,omitempty"`
+}
+
+// Session is the lockstep of a match on a peer, which keeps
+// the games at the confirmed frame where inputs of all players
+// have arrived, and the games at the current frame predicted
+// by assuming the inputs not arrived yet are empty.
+type Session struct {
+	// config of the session.
+	config Config
+
+	// confirmed are the games at the confirmed frame.
+	confirmed []*game.Game
+
+	// confirmedFrame is the confirmed frame, where the inputs
+	// of all players before it have arrived.
+	confirmedFrame int
+
+	// predicted are the games at the current frame.
+	predicted []*game.Game
+
+	// frame is the current frame.
+	frame int
+
+	// inputs are the actions of each player by frames,
+	// where the frames before confirmed frame are dropped.
+	inputs []map[int][]game.Action
+
+	// garbage are the garbage lines received by each player
+	// by frames, which are dropped like the inputs.
+	garbage []map[int][]game.Garbage
+
+	// received are the frames whose inputs have not been
+	// received for each player, and the inputs before it
+	// are all known.
+	received []int
+
+	// pending are the local actions to schedule.
+	pending []game.Action
+
+	// pendingGarbage are the local garbage to schedule.
+	pendingGarbage []game.Garbage
+
+	// outgoing is the local inputs not sent yet.
+	outgoing *Packet
+
+	// rollbacks is the number of times the predicted games
+	// are resimulated.
+	rollbacks int
+}
+
+// New creates the session at the frame 0.
+func New(config Config) (*Session, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Session{
+		config:    config,
+		confirmed: make([]*game.Game, config.Players),
+		predicted: make([]*game.Game, config.Players),
+		inputs:    make([]map[int][]game.Action, config.Players),
+		garbage:   make([]map[int][]game.Garbage, config.Players),
+		received:  make([]int, config.Players),
+	}
+	for i := range s.confirmed {
+		generator, err := game.NewGenerator(config.Algorithm, config.Seed)
+		if err != nil {
+			return nil, err
+		}
+		if s.confirmed[i], err = game.NewWithGenerator(
+			config.Game, generator); err != nil {
+			return nil, err
+		}
+		s.predicted[i] = s.confirmed[i].Clone()
+		s.inputs[i] = make(map[int][]game.Action)
+		s.garbage[i] = make(map[int][]game.Garbage)
+
+		// The frames within the input delay have no input,
+		// since no input could be scheduled for them.
+		s.received[i] = config.InputDelay
+	}
+	return s, nil
+}
+
+// Config returns the configuration of the session.
+func (s *Session) Config() Config {
+	return s.config
+}
+
+// Frame returns the current frame, which is predicted.
+func (s *Session) Frame() int {
+	return s.frame
+}
+
+// Confirmed returns the confirmed frame, where the inputs
+// of all players before it have arrived.
+func (s *Session) Confirmed() int {
+	return s.confirmedFrame
+}
+
+// Received returns the frame whose input of the player has
+// not been received.
+func (s *Session) Received(player int) int {
+	return s.received[player]
+}
+
+// Rollbacks returns the number of times the predicted games
+// have been resimulated.
+func (s *Session) Rollbacks() int {
+	return s.rollbacks
+}
+
+// Stalled returns whether the session could not advance
+// until more inputs arrive.
+func (s *Session) Stalled() bool {
+	return s.frame-s.Confirmed() >= s.config.Window
+}
+
+// ConfirmedGame returns a copy of the game of the player at
+// the confirmed frame.
+func (s *Session) ConfirmedGame(player int) *game.Game {
+	return s.confirmed[player].Clone()
+}
+
+// PredictedGame returns a copy of the game of the player at
+// the current frame.
+func (s *Session) PredictedGame(player int) *game.Game {
+	return s.predicted[player].Clone()
+}
+
+// Input schedules the local action, which is applied at the
+// current frame plus the input delay.
+func (s *Session) Input(action game.Action) {
+	s.pending = append(s.pending, action)
+}
+
+// errInvalidGarbage is returned when the garbage lines or
+// the column of hole is out of range.
+var errInvalidGarbage = errors.New("invalid garbage")
+
+// validGarbage returns whether the garbage could be applied
+// to the game, so that it never fails in simulation.
+func validGarbage(lines, hole int) bool {
+	return lines >= 1 && lines <= game.BoardHeight &&
+		hole >= 0 && hole < game.BoardWidth
+}
+
+// Garbage schedules the garbage lines received by the local
+// player, which are applied at the current frame plus the
+// input delay, and sent to the peers with the inputs, so that
+// the games of all players stay identical among the peers.
+func (s *Session) Garbage(lines, hole int) error {
+	if !validGarbage(lines, hole) {
+		return errInvalidGarbage
+	}
+	s.pendingGarbage = append(s.pendingGarbage,
+		game.Garbage{Lines: lines, Hole: hole})
+	return nil
+}
+
+// step advances the game of the player from the frame with
+// the known inputs, or no input if it is not known, where
+// the garbage is received before the actions like replay.
+func (s *Session) step(player int, g *game.Game, frame int) {
+	for _, item := range s.garbage[player][frame] {
+		_ = g.Garbage(item.Lines, item.Hole)
+	}
+	for _, action := range s.inputs[player][frame] {
+		g.Apply(action)
+	}
+	g.Tick()
+}
+
+// Advance advances the session by a frame, and returns false
+// if it has stalled. The scheduled local actions are sent as
+// the inputs of the frame plus the input delay.
+func (s *Session) Advance() bool {
+	if s.Stalled() {
+		return false
+	}
+
+	// Commit the scheduled actions and garbage as the local
+	// inputs.
+	local := s.config.Local
+	frame := s.frame + s.config.InputDelay
+	if len(s.pending) > 0 {
+		s.inputs[local][frame] = s.pending
+	}
+	if s.outgoing == nil {
+		s.outgoing = &Packet{Player: local, Frame: frame}
+	}
+	s.outgoing.Inputs = append(s.outgoing.Inputs, s.pending)
+	s.pending = nil
+	if len(s.pendingGarbage) > 0 {
+		for i := range s.pendingGarbage {
+			s.pendingGarbage[i].Frame = frame
+		}
+		s.garbage[local][frame] = s.pendingGarbage
+		s.outgoing.Garbage = append(s.outgoing.Garbage, s.pendingGarbage...)
+	}
+	s.pendingGarbage = nil
+	s.received[local] = frame + 1
+
+	// Predict the games of the frame and confirm them.
+	for player, g := range s.predicted {
+		s.step(player, g, s.frame)
+	}
+	s.frame++
+	s.confirm()
+	return true
+}
+
+// Outgoing returns the local inputs not sent yet, or nil if
+// there's nothing to send.
+func (s *Session) Outgoing() *Packet {
+	result := s.outgoing
+	s.outgoing = nil
+	return result
+}
+
+// Receive accepts the inputs of a remote player, and the
+// predicted games are resimulated from the confirmed frame
+// if the inputs differ from the prediction.
+func (s *Session) Receive(packet *Packet) error {
+	player := packet.Player
+	if player < 0 || player >= s.config.Players || player == s.config.Local {
+		return errors.New("invalid player of packet")
+	}
+	if packet.Frame > s.received[player] {
+		return fmt.Errorf("missing inputs of player %d from frame %d",
+			player, s.received[player])
+	}
+
+	// The peer could not be more than the window ahead of
+	// the local inputs it has received, which are sent up to
+	// the input delay ahead, and its own inputs are delayed
+	// likewise, so the inputs beyond are never valid.
+	limit := s.frame + 2*s.config.InputDelay + s.config.Window
+	if packet.Frame+len(packet.Inputs) > limit {
+		return fmt.Errorf("inputs of player %d beyond frame %d",
+			player, limit)
+	}
+	last := packet.Frame
+	for _, item := range packet.Garbage {
+		if item.Frame < last || item.Frame >= packet.Frame+len(packet.Inputs) {
+			return errors.New("garbage out of frames of packet")
+		}
+		if !validGarbage(item.Lines, item.Hole) {
+			return errInvalidGarbage
+		}
+		last = item.Frame
+	}
+
+	// Accept the garbage and inputs of the frames not
+	// received yet, the rest have been received before.
+	mispredicted := false
+	for _, item := range packet.Garbage {
+		if item.Frame < s.received[player] {
+			continue
+		}
+		s.garbage[player][item.Frame] = append(
+			s.garbage[player][item.Frame], item)
+		if item.Frame < s.frame {
+			mispredicted = true
+		}
+	}
+	for i, actions := range packet.Inputs {
+		frame := packet.Frame + i
+		if frame < s.received[player] {
+			continue
+		}
+		if len(actions) > 0 {
+			s.inputs[player][frame] = actions
+			if frame < s.frame {
+				mispredicted = true
+			}
+		}
+		s.received[player] = frame + 1
+	}
+	s.confirm()
+	if mispredicted {
+		s.resimulate(player)
+	}
+	return nil
+}
+
+// confirm advances the confirmed games to the frame where the
+// inputs of all players are known, without exceeding the
+// current frame.
+func (s *Session) confirm() {
+	target := s.frame
+	for _, received := range s.received {
+		if received < target {
+			target = received
+		}
+	}
+	for ; s.confirmedFrame < target; s.confirmedFrame++ {
+		for player, g := range s.confirmed {
+			s.step(player, g, s.confirmedFrame)
+			delete(s.inputs[player], s.confirmedFrame)
+			delete(s.garbage[player], s.confirmedFrame)
+		}
+	}
+}
+
+// resimulate rolls the predicted game of the player back to
+// the confirmed frame, and simulates again to the current
+// frame, since the games of players are independent.
+func (s *Session) resimulate(player int) {
+	predicted := s.confirmed[player].Clone()
+	for frame := s.confirmedFrame; frame < s.frame; frame++ {
+		s.step(player, predicted, frame)
+	}
+	s.predicted[player] = predicted
+	s.rollbacks++
+}
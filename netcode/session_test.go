@@ -0,0 +1,332 @@
+package netcode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Techmino/TechminoOnline/game"
+)
+
+// testConfig is the config of the session of the player.
+func testConfig(local, inputDelay, window int) Config {
+	return Config{
+		Game:       game.DefaultConfig(),
+		Seed:       7,
+		Players:    2,
+		Local:      local,
+		InputDelay: inputDelay,
+		Window:     window,
+	}
+}
+
+// newSession creates the session or fails the test.
+func newSession(t *testing.T, config Config) *Session {
+	t.Helper()
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	return s
+}
+
+// receive delivers the packet to the session.
+func receive(t *testing.T, s *Session, packet *Packet) {
+	t.Helper()
+	if err := s.Receive(packet); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+}
+
+// peer is a session along with the record of its local
+// game, which is replayed to verify the session.
+type peer struct {
+	*Session
+
+	// record of the local game.
+	record game.Record
+}
+
+// newPeer creates the peer of the local player.
+func newPeer(t *testing.T, config Config) *peer {
+	return &peer{
+		Session: newSession(t, config),
+		record: game.Record{
+			Config:    config.Game,
+			Algorithm: config.Algorithm,
+			Seed:      config.Seed,
+		},
+	}
+}
+
+// advance schedules the action, which is not applied if
+// it is negative, and the garbage if it has lines, then
+// advances the session by a frame.
+func (p *peer) advance(t *testing.T, action int, garbage game.Garbage) {
+	t.Helper()
+	frame := p.Frame() + p.Config().InputDelay
+	if garbage.Lines > 0 {
+		if err := p.Garbage(garbage.Lines, garbage.Hole); err != nil {
+			t.Fatalf("garbage: %v", err)
+		}
+		garbage.Frame = frame
+		p.record.Garbage = append(p.record.Garbage, garbage)
+	}
+	if action >= 0 {
+		p.Input(game.Action(action))
+		p.record.Inputs = append(p.record.Inputs, game.Input{
+			Frame: frame, Action: game.Action(action)})
+	}
+	if !p.Advance() {
+		t.Fatalf("stalled at frame %d", p.Frame())
+	}
+}
+
+// replay replays the record of the local game to the frame.
+func (p *peer) replay(t *testing.T, frame int) *game.Game {
+	t.Helper()
+	record := p.record
+	record.Inputs = nil
+	for _, input := range p.record.Inputs {
+		if input.Frame < frame {
+			record.Inputs = append(record.Inputs, input)
+		}
+	}
+	record.Garbage = nil
+	for _, garbage := range p.record.Garbage {
+		if garbage.Frame < frame {
+			record.Garbage = append(record.Garbage, garbage)
+		}
+	}
+	record.Frames = frame
+	g, _, err := game.Replay(&record)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	// The game is cloned like those returned by the session,
+	// so that they are compared deeply.
+	return g.Clone()
+}
+
+// TestSessionLatePackets delivers the packets of a player
+// late, so that its inputs arrive after the frames have been
+// predicted, which must be resimulated into the same games
+// as the peer and the replay.
+func TestSessionLatePackets(t *testing.T) {
+	const latency = 5
+	peers := []*peer{
+		newPeer(t, testConfig(0, 2, 16)),
+		newPeer(t, testConfig(1, 2, 16)),
+	}
+	rng := game.NewRng(1)
+	var delayed []*Packet
+	for frame := 0; frame < 90; frame++ {
+		for i, p := range peers {
+			// Move and rotate at random, dropping the piece
+			// every 15 frames, and the second player
+			// receives garbage sometimes.
+			action := -1
+			switch {
+			case frame%15 == 14:
+				action = int(game.ActionHardDrop)
+			case rng.Intn(3) == 0:
+				action = rng.Intn(int(game.ActionRotate180) + 1)
+			}
+			var garbage game.Garbage
+			if i == 1 && frame%40 == 20 {
+				garbage = game.Garbage{Lines: 2, Hole: rng.Intn(game.BoardWidth)}
+			}
+			p.advance(t, action, garbage)
+		}
+
+		// The packets of the first player arrive at once,
+		// and those of the second player are delayed.
+		if packet := peers[0].Outgoing(); packet != nil {
+			receive(t, peers[1].Session, packet)
+		}
+		delayed = append(delayed, peers[1].Outgoing())
+		if len(delayed) > latency {
+			receive(t, peers[0].Session, delayed[0])
+			delayed = delayed[1:]
+		}
+		if confirmed := peers[0].Confirmed(); confirmed > peers[0].Frame() {
+			t.Fatalf("confirmed %d beyond frame %d", confirmed, peers[0].Frame())
+		}
+	}
+	if peers[0].Confirmed() >= peers[0].Frame() {
+		t.Fatal("expect the delayed frames not confirmed")
+	}
+	rollbacks := peers[0].Rollbacks()
+	if rollbacks == 0 {
+		t.Fatal("expect rollbacks of the late inputs")
+	}
+	for _, packet := range delayed {
+		receive(t, peers[0].Session, packet)
+	}
+
+	// All inputs have arrived, the predicted games converge
+	// to the confirmed ones, which are identical to the
+	// peer and the replay.
+	frame := peers[0].Frame()
+	if peers[0].Confirmed() != frame || peers[1].Confirmed() != frame {
+		t.Fatalf("expect confirmed %d, got %d and %d",
+			frame, peers[0].Confirmed(), peers[1].Confirmed())
+	}
+	for player, p := range peers {
+		expect := p.replay(t, frame)
+		if expect.Stats().Pieces == 0 {
+			t.Fatalf("player %d locked no piece", player)
+		}
+		for _, s := range peers {
+			if !reflect.DeepEqual(s.PredictedGame(player), expect) ||
+				!reflect.DeepEqual(s.ConfirmedGame(player), expect) {
+				t.Fatalf("game of player %d on player %d differs from replay",
+					player, s.Config().Local)
+			}
+		}
+	}
+	if board := peers[0].PredictedGame(1).Board(); board[0] == [game.BoardWidth]game.Cell{} {
+		t.Fatal("expect garbage on the board of the second player")
+	}
+}
+
+// TestSessionDuplicatePackets ensures the frames already
+// received are ignored without rolling back.
+func TestSessionDuplicatePackets(t *testing.T) {
+	local := newSession(t, testConfig(0, 0, 8))
+	remote := newSession(t, testConfig(1, 0, 8))
+	for i := 0; i < 4; i++ {
+		local.Advance()
+		remote.Input(game.ActionLeft)
+		remote.Advance()
+	}
+	packet := remote.Outgoing()
+	receive(t, local, packet)
+	rollbacks := local.Rollbacks()
+	receive(t, local, packet)
+	receive(t, local, &Packet{Player: 1, Frame: 2, Inputs: [][]game.Action{
+		{game.ActionRight}, {game.ActionRight},
+	}})
+	if local.Rollbacks() != rollbacks || local.Received(1) != 4 {
+		t.Fatalf("unexpected rollbacks %d, received %d",
+			local.Rollbacks(), local.Received(1))
+	}
+	if !reflect.DeepEqual(local.PredictedGame(1), remote.PredictedGame(1)) {
+		t.Fatal("game of remote player differs")
+	}
+}
+
+// TestSessionStalled ensures the session stalls exactly when
+// the current frame is window frames ahead of the confirmed
+// frame, where the input delay is confirmed in advance.
+func TestSessionStalled(t *testing.T) {
+	for _, testCase := range []struct {
+		inputDelay int
+		window     int
+	}{
+		{0, 4},
+		{2, 4},
+		{3, 1},
+	} {
+		s := newSession(t, testConfig(0, testCase.inputDelay, testCase.window))
+		limit := testCase.inputDelay + testCase.window
+		for s.Frame() < limit {
+			if s.Stalled() || !s.Advance() {
+				t.Fatalf("%+v: stalled at frame %d", testCase, s.Frame())
+			}
+		}
+		if !s.Stalled() || s.Advance() {
+			t.Fatalf("%+v: expect stalled at frame %d", testCase, s.Frame())
+		}
+		if s.Frame() != limit || s.Confirmed() != testCase.inputDelay {
+			t.Fatalf("%+v: unexpected frame %d, confirmed %d",
+				testCase, s.Frame(), s.Confirmed())
+		}
+
+		// The inputs of a frame confirm the frame, and the
+		// session advances by a frame.
+		receive(t, s, &Packet{
+			Player: 1,
+			Frame:  testCase.inputDelay,
+			Inputs: [][]game.Action{nil},
+		})
+		if s.Stalled() || !s.Advance() || !s.Stalled() {
+			t.Fatalf("%+v: expect advancing a frame", testCase)
+		}
+	}
+}
+
+// TestSessionReceiveErrors ensures the invalid packets are
+// rejected without changing the session.
+func TestSessionReceiveErrors(t *testing.T) {
+	s := newSession(t, testConfig(0, 0, 8))
+	inputs := [][]game.Action{nil, nil}
+	for _, testCase := range []struct {
+		name   string
+		packet *Packet
+		error  string
+	}{
+		{"local", &Packet{Player: 0, Inputs: inputs}, "invalid player"},
+		{"player", &Packet{Player: 2, Inputs: inputs}, "invalid player"},
+		{"missing", &Packet{Player: 1, Frame: 1, Inputs: inputs}, "missing inputs"},
+		{"ahead", &Packet{Player: 1, Inputs: make([][]game.Action, 9)}, "beyond frame 8"},
+		{"garbage frame", &Packet{Player: 1, Inputs: inputs, Garbage: []game.Garbage{
+			{Frame: 2, Lines: 1},
+		}}, "out of frames"},
+		{"garbage order", &Packet{Player: 1, Inputs: inputs, Garbage: []game.Garbage{
+			{Frame: 1, Lines: 1}, {Frame: 0, Lines: 1},
+		}}, "out of frames"},
+		{"garbage lines", &Packet{Player: 1, Inputs: inputs, Garbage: []game.Garbage{
+			{Frame: 0, Lines: 0},
+		}}, "invalid garbage"},
+		{"garbage hole", &Packet{Player: 1, Inputs: inputs, Garbage: []game.Garbage{
+			{Frame: 0, Lines: 1, Hole: game.BoardWidth},
+		}}, "invalid garbage"},
+	} {
+		err := s.Receive(testCase.packet)
+		if err == nil || !strings.Contains(err.Error(), testCase.error) {
+			t.Fatalf("%s: expect error %q, got %v", testCase.name, testCase.error, err)
+		}
+		if s.Received(1) != 0 {
+			t.Fatalf("%s: packet accepted", testCase.name)
+		}
+	}
+	if err := s.Garbage(game.BoardHeight+1, 0); err == nil {
+		t.Fatal("expect invalid garbage error")
+	}
+}
+
+// TestSessionReceiveAhead ensures the inputs are accepted up
+// to the furthest frame the peer could have reached, which
+// moves along with the local frame.
+func TestSessionReceiveAhead(t *testing.T) {
+	const inputDelay, window = 2, 4
+	s := newSession(t, testConfig(0, inputDelay, window))
+	limit := 2*inputDelay + window
+	beyond := &Packet{Player: 1, Frame: inputDelay,
+		Inputs: make([][]game.Action, limit-inputDelay+1)}
+	if err := s.Receive(beyond); err == nil ||
+		!strings.Contains(err.Error(), "beyond frame") {
+		t.Fatalf("expect beyond error, got %v", err)
+	}
+	receive(t, s, &Packet{Player: 1, Frame: inputDelay,
+		Inputs: make([][]game.Action, limit-inputDelay)})
+	if s.Received(1) != limit {
+		t.Fatalf("expect received %d, got %d", limit, s.Received(1))
+	}
+
+	// The limit moves a frame ahead as the session advances.
+	if !s.Advance() {
+		t.Fatal("stalled at frame 0")
+	}
+	receive(t, s, &Packet{Player: 1, Frame: limit,
+		Inputs: [][]game.Action{{game.ActionLeft}}})
+	if s.Received(1) != limit+1 {
+		t.Fatalf("expect received %d, got %d", limit+1, s.Received(1))
+	}
+	if err := s.Receive(&Packet{Player: 1, Frame: limit + 1,
+		Inputs: [][]game.Action{nil}}); err == nil {
+		t.Fatal("expect beyond error")
+	}
+}